@@ -0,0 +1,268 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"mcli-v2/pkg/api"
+	"os"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+// diskCmd represents the disk command
+var diskCmd = &cobra.Command{
+	Use:   "disk",
+	Short: "manage the disks of a machine",
+}
+
+var diskAttachCmd = &cobra.Command{
+	Use:   "attach <machine name> <disk file>",
+	Args:  cobra.ExactArgs(2),
+	Short: "attach a disk to a machine",
+	Long: `Attach a disk to a machine, hot-adding it if the machine is running.
+If --size is given and the disk file does not exist, it is created.`,
+	Run: doDiskAttach,
+}
+
+var diskDetachCmd = &cobra.Command{
+	Use:   "detach <machine name> <disk id>",
+	Args:  cobra.ExactArgs(2),
+	Short: "detach a disk from a machine",
+	Long:  `Detach a disk from a machine, hot-removing it if the machine is running.`,
+	Run:   doDiskDetach,
+}
+
+var diskResizeCmd = &cobra.Command{
+	Use:   "resize <machine name> <disk id> <size>",
+	Args:  cobra.ExactArgs(3),
+	Short: "resize a disk of a machine",
+	Long: `Resize a disk of a machine to <size>, e.g. 100GiB.  Running machines are
+resized online, stopped machines with qemu-img.  Shrinking requires --force.`,
+	Run: doDiskResize,
+}
+
+var diskThrottleCmd = &cobra.Command{
+	Use:   "throttle <machine name> <disk id>",
+	Args:  cobra.ExactArgs(2),
+	Short: "set the IO limits of a disk",
+	Long: `Set the IOPS and bandwidth limits of a disk, applying them immediately if
+the machine is running.  Unset or zero limits are unlimited, so running
+throttle without any limit flags removes all limits.`,
+	Run: doDiskThrottle,
+}
+
+var diskSecretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "manage the keys of encrypted disks",
+}
+
+var diskSecretExportCmd = &cobra.Command{
+	Use:   "export <machine name> <disk id>",
+	Args:  cobra.ExactArgs(2),
+	Short: "export the key of an encrypted disk",
+	Long: `Export the key of an encrypted disk for disaster recovery.  The key is
+printed to stdout unless --output is given, in which case it is written to
+that file with 0600 permissions.`,
+	Run: doDiskSecretExport,
+}
+
+var diskSecretRotateCmd = &cobra.Command{
+	Use:   "rotate <machine name> <disk id>",
+	Args:  cobra.ExactArgs(2),
+	Short: "replace the key of an encrypted disk",
+	Long: `Replace the key of an encrypted disk with a newly generated key.  The
+machine must be stopped.  Previously exported keys no longer unlock the disk.`,
+	Run: doDiskSecretRotate,
+}
+
+func doDiskAttach(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	disk := api.QemuDisk{
+		File:   args[1],
+		ID:     cmd.Flag("id").Value.String(),
+		Format: cmd.Flag("format").Value.String(),
+		Attach: cmd.Flag("attach").Value.String(),
+		Type:   cmd.Flag("type").Value.String(),
+		Cache:  cmd.Flag("cache").Value.String(),
+		AIO:    cmd.Flag("aio").Value.String(),
+	}
+	if encrypt, _ := cmd.Flags().GetBool("encrypt"); encrypt {
+		disk.Encrypt = api.DiskEncryptLUKS
+	}
+	disk.ReadOnly, _ = cmd.Flags().GetBool("read-only")
+	temporary, _ := cmd.Flags().GetBool("temporary")
+
+	if size := cmd.Flag("size").Value.String(); size != "" {
+		diskSize, err := humanize.ParseBytes(size)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid disk size '%s': %s", size, err))
+		}
+		disk.Size = api.DiskSize(diskSize)
+	}
+	if disk.Size == 0 {
+		// existing disk files must be fully qualified for machined
+		cwd, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+		newPath, err := verifyPath(cwd, disk.File)
+		if err != nil {
+			panic(err)
+		}
+		disk.File = newPath
+	}
+
+	request := api.MachineDiskRequest{Disk: disk, Temporary: temporary}
+	endpoint := fmt.Sprintf("machines/%s/disks", machineName)
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Post(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed POST to '%s' endpoint: %s", endpoint, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func doDiskDetach(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	diskID := args[1]
+	temporary, _ := cmd.Flags().GetBool("temporary")
+
+	endpoint := fmt.Sprintf("machines/%s/disks/%s", machineName, diskID)
+	resp, err := rootclient.R().EnableTrace().SetQueryParam("temporary", fmt.Sprintf("%v", temporary)).Delete(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed DELETE to '%s' endpoint: %s", endpoint, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func doDiskResize(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	diskID := args[1]
+	force, _ := cmd.Flags().GetBool("force")
+
+	request := api.MachineDiskResizeRequest{Size: args[2], Force: force}
+	endpoint := fmt.Sprintf("machines/%s/disks/%s/resize", machineName, diskID)
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Post(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed POST to '%s' endpoint: %s", endpoint, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func doDiskThrottle(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	diskID := args[1]
+	temporary, _ := cmd.Flags().GetBool("temporary")
+
+	throttle := api.DiskThrottle{}
+	throttle.IOPSTotal, _ = cmd.Flags().GetInt64("iops-total")
+	throttle.IOPSRead, _ = cmd.Flags().GetInt64("iops-read")
+	throttle.IOPSWrite, _ = cmd.Flags().GetInt64("iops-write")
+	for flag, value := range map[string]*api.DiskSize{
+		"bps-total": &throttle.BPSTotal,
+		"bps-read":  &throttle.BPSRead,
+		"bps-write": &throttle.BPSWrite,
+	} {
+		if bps := cmd.Flag(flag).Value.String(); bps != "" {
+			bytes, err := humanize.ParseBytes(bps)
+			if err != nil {
+				panic(fmt.Sprintf("Invalid %s value '%s': %s", flag, bps, err))
+			}
+			*value = api.DiskSize(bytes)
+		}
+	}
+
+	request := api.MachineDiskThrottleRequest{Throttle: throttle, Temporary: temporary}
+	endpoint := fmt.Sprintf("machines/%s/disks/%s/throttle", machineName, diskID)
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Put(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed PUT to '%s' endpoint: %s", endpoint, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func doDiskSecretExport(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	diskID := args[1]
+
+	endpoint := fmt.Sprintf("machines/%s/disks/%s/secret", machineName, diskID)
+	resp, err := rootclient.R().EnableTrace().Get(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET to '%s' endpoint: %s", endpoint, err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to export secret of disk '%s': %s %s", diskID, resp, resp.Status()))
+	}
+	secret := api.DiskSecret{}
+	if err := json.Unmarshal(resp.Body(), &secret); err != nil {
+		panic(fmt.Sprintf("Failed to unmarshal response from '%s': %s", endpoint, err))
+	}
+
+	output := cmd.Flag("output").Value.String()
+	if output == "" {
+		fmt.Println(secret.Secret)
+		return
+	}
+	if err := os.WriteFile(output, []byte(secret.Secret+"\n"), 0600); err != nil {
+		panic(fmt.Sprintf("Failed to write secret to %s: %s", output, err))
+	}
+	fmt.Printf("Wrote %s key of disk %s (%s) to %s\n", secret.Encrypt, secret.DiskID, secret.Format, output)
+}
+
+func doDiskSecretRotate(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	diskID := args[1]
+
+	endpoint := fmt.Sprintf("machines/%s/disks/%s/secret/rotate", machineName, diskID)
+	resp, err := rootclient.R().EnableTrace().Post(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed POST to '%s' endpoint: %s", endpoint, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func init() {
+	rootCmd.AddCommand(diskCmd)
+	diskCmd.AddCommand(diskAttachCmd)
+	diskCmd.AddCommand(diskDetachCmd)
+	diskCmd.AddCommand(diskResizeCmd)
+	diskCmd.AddCommand(diskThrottleCmd)
+	diskCmd.AddCommand(diskSecretCmd)
+	diskSecretCmd.AddCommand(diskSecretExportCmd)
+	diskSecretCmd.AddCommand(diskSecretRotateCmd)
+	diskAttachCmd.PersistentFlags().StringP("id", "i", "", "disk id (default is the file name without extension)")
+	diskAttachCmd.PersistentFlags().StringP("size", "s", "", "size of the disk to create, e.g. 10GiB")
+	diskAttachCmd.PersistentFlags().StringP("format", "f", "qcow2", "disk format, qcow2 or raw")
+	diskAttachCmd.PersistentFlags().StringP("attach", "a", "virtio", "disk bus: virtio, scsi or nvme")
+	diskAttachCmd.PersistentFlags().StringP("type", "t", "ssd", "disk type: ssd or hdd")
+	diskAttachCmd.PersistentFlags().String("cache", "", "cache mode: none, writeback, writethrough, directsync or unsafe (default unsafe)")
+	diskAttachCmd.PersistentFlags().String("aio", "", "aio mode: threads, native or io_uring (default threads)")
+	diskAttachCmd.PersistentFlags().Bool("encrypt", false, "create the disk as a LUKS encrypted qcow2")
+	diskAttachCmd.PersistentFlags().BoolP("read-only", "r", false, "attach the disk read-only")
+	diskAttachCmd.PersistentFlags().Bool("temporary", false, "do not persist the change to the machine config")
+	diskDetachCmd.PersistentFlags().Bool("temporary", false, "do not persist the change to the machine config")
+	diskResizeCmd.PersistentFlags().BoolP("force", "F", false, "allow shrinking the disk")
+	diskThrottleCmd.PersistentFlags().Int64("iops-total", 0, "total read and write operations per second")
+	diskThrottleCmd.PersistentFlags().Int64("iops-read", 0, "read operations per second")
+	diskThrottleCmd.PersistentFlags().Int64("iops-write", 0, "write operations per second")
+	diskThrottleCmd.PersistentFlags().String("bps-total", "", "total read and write bytes per second, e.g. 100MB")
+	diskThrottleCmd.PersistentFlags().String("bps-read", "", "read bytes per second")
+	diskThrottleCmd.PersistentFlags().String("bps-write", "", "write bytes per second")
+	diskThrottleCmd.PersistentFlags().Bool("temporary", false, "do not persist the change to the machine config")
+	diskSecretExportCmd.PersistentFlags().StringP("output", "o", "", "write the key to this file")
+}
@@ -101,8 +101,12 @@ func doEdit(cmd *cobra.Command, args []string) {
 			panic(fmt.Sprintf("Error calling editor: %s", err))
 		}
 	}
-	// persist config if not ephemeral
 
+	if err := checkMachineFilePaths(&newMachine); err != nil {
+		panic(err)
+	}
+
+	// persist config if not ephemeral
 	err = putMachine(newMachine)
 	if err != nil {
 		panic(err.Error())
@@ -0,0 +1,110 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"mcli-v2/pkg/api"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+	table "github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+// imageCmd represents the image command
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "search and fetch images from catalog remotes",
+}
+
+var imageSearchCmd = &cobra.Command{
+	Use:   "search [<remote>:]<query>",
+	Short: "search image catalog remotes for matching images",
+	Long:  `Search all configured image catalog remotes, or only <remote>, for images whose name or alias contains <query>`,
+	Run:   doImageSearch,
+}
+
+var imagePullCmd = &cobra.Command{
+	Use:   "pull <remote>:<alias>",
+	Args:  cobra.ExactArgs(1),
+	Short: "resolve an image reference and fetch it into the local image cache",
+	Run:   doImagePull,
+}
+
+func doImageSearch(cmd *cobra.Command, args []string) {
+	query := ""
+	if len(args) > 0 {
+		query = args[0]
+	}
+	arch := cmd.Flag("arch").Value.String()
+
+	results := []api.ImageSearchResult{}
+	searchURL := api.GetAPIURL("images")
+	resp, err := rootclient.R().EnableTrace().SetQueryParams(map[string]string{
+		"query": query,
+		"arch":  arch,
+	}).Get(searchURL)
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET on 'images' endpoint: %s", err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Image search failed: %s %s", resp, resp.Status()))
+	}
+	if err := json.Unmarshal(resp.Body(), &results); err != nil {
+		panic(fmt.Sprintf("Failed to unmarshal GET on /images: %s", err))
+	}
+	tbl := table.New("Image", "Aliases", "Arch", "Format", "Size", "Description")
+	tbl.AddRow("-----", "-------", "----", "------", "----", "-----------")
+	for _, result := range results {
+		size := ""
+		if result.Size > 0 {
+			size = humanize.IBytes(uint64(result.Size))
+		}
+		tbl.AddRow(result.Remote+api.ImageRefSeparator+result.Name, strings.Join(result.Aliases, ","),
+			result.Arch, result.Format, size, result.Description)
+	}
+	tbl.Print()
+}
+
+func doImagePull(cmd *cobra.Command, args []string) {
+	request := api.ImageResolveRequest{
+		Ref:  args[0],
+		Arch: cmd.Flag("arch").Value.String(),
+	}
+	localImage := api.LocalImage{}
+	resolveURL := api.GetAPIURL("images/resolve")
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Post(resolveURL)
+	if err != nil {
+		panic(fmt.Sprintf("Failed POST to 'images/resolve' endpoint: %s", err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to resolve image '%s': %s %s", request.Ref, resp, resp.Status()))
+	}
+	if err := json.Unmarshal(resp.Body(), &localImage); err != nil {
+		panic(fmt.Sprintf("Failed to unmarshal response from images/resolve: %s", err))
+	}
+	fmt.Printf("%s -> %s\n", localImage.Ref, localImage.Path)
+}
+
+func init() {
+	rootCmd.AddCommand(imageCmd)
+	imageCmd.AddCommand(imageSearchCmd)
+	imageCmd.AddCommand(imagePullCmd)
+	imageSearchCmd.PersistentFlags().StringP("arch", "a", "", "only show images for this architecture")
+	imagePullCmd.PersistentFlags().StringP("arch", "a", "", "architecture of the image (default is the host architecture)")
+}
@@ -218,6 +218,37 @@ func checkMachineFilePaths(newMachine *api.Machine) error {
 		newMachine.Config.Cdrom = newPath
 	}
 
+	bootFiles := []*string{
+		&newMachine.Config.Kernel,
+		&newMachine.Config.Initrd,
+		&newMachine.Config.DTB,
+		&newMachine.Config.Firmware.Code,
+		&newMachine.Config.Firmware.Vars,
+	}
+	for _, bootFile := range bootFiles {
+		if *bootFile == "" {
+			continue
+		}
+		newPath, err := verifyPath(cwd, *bootFile)
+		if err != nil {
+			panic(err)
+		}
+		log.Infof("Fully qualified boot file path %s", newPath)
+		*bootFile = newPath
+	}
+
+	for idx := range newMachine.Config.Shares {
+		share := newMachine.Config.Shares[idx]
+		newPath, err := verifyPath(cwd, share.Path)
+		if err != nil {
+			panic(err)
+		}
+		if newPath != share.Path {
+			log.Infof("Fully qualified share path %s", newPath)
+			newMachine.Config.Shares[idx].Path = newPath
+		}
+	}
+
 	return nil
 }
 
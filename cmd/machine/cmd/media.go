@@ -0,0 +1,138 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"mcli-v2/pkg/api"
+	"os"
+
+	table "github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+// mediaCmd represents the media command
+var mediaCmd = &cobra.Command{
+	Use:   "media",
+	Short: "change the cdrom media of a running machine",
+	Long: `Change the cdrom media of a running machine.  Cdrom drives are selected
+by disk id with --drive, the drive of the machine's 'cdrom' setting has the id
+'cdrom'.  Media changes last until the machine stops.`,
+}
+
+var mediaListCmd = &cobra.Command{
+	Use:   "list <machine name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "list the cdrom drives of a machine and their media",
+	Run:   doMediaList,
+}
+
+var mediaEjectCmd = &cobra.Command{
+	Use:   "eject <machine name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "eject the media of a cdrom drive",
+	Run:   doMediaEject,
+}
+
+var mediaInsertCmd = &cobra.Command{
+	Use:   "insert <machine name> <iso>",
+	Args:  cobra.ExactArgs(2),
+	Short: "insert media into a cdrom drive, replacing the current media",
+	Run:   doMediaInsert,
+}
+
+func doMediaList(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+
+	endpoint := fmt.Sprintf("machines/%s/media", machineName)
+	resp, err := rootclient.R().EnableTrace().Get(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET to '%s' endpoint: %s", endpoint, err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to list media of machine '%s': %s %s", machineName, resp, resp.Status()))
+	}
+	media := []api.MediaInfo{}
+	if err := json.Unmarshal(resp.Body(), &media); err != nil {
+		panic(fmt.Sprintf("Failed to unmarshal response from '%s': %s", endpoint, err))
+	}
+
+	tbl := table.New("Drive", "File", "Tray", "Locked")
+	tbl.AddRow("-----", "----", "----", "------")
+	for _, info := range media {
+		tray := "closed"
+		if info.TrayOpen {
+			tray = "open"
+		}
+		tbl.AddRow(info.DiskID, info.File, tray, info.Locked)
+	}
+	tbl.Print()
+}
+
+func doMediaEject(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	diskID := cmd.Flag("drive").Value.String()
+	force, _ := cmd.Flags().GetBool("force")
+
+	request := api.MachineMediaRequest{Force: force}
+	endpoint := fmt.Sprintf("machines/%s/media/%s/eject", machineName, diskID)
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Post(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed POST to '%s' endpoint: %s", endpoint, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func doMediaInsert(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	diskID := cmd.Flag("drive").Value.String()
+	force, _ := cmd.Flags().GetBool("force")
+
+	// media files must be fully qualified for machined
+	cwd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+	mediaPath, err := verifyPath(cwd, args[1])
+	if err != nil {
+		panic(err)
+	}
+
+	request := api.MachineMediaRequest{
+		File:   mediaPath,
+		Format: cmd.Flag("format").Value.String(),
+		Force:  force,
+	}
+	endpoint := fmt.Sprintf("machines/%s/media/%s/insert", machineName, diskID)
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Post(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed POST to '%s' endpoint: %s", endpoint, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func init() {
+	rootCmd.AddCommand(mediaCmd)
+	mediaCmd.AddCommand(mediaListCmd)
+	mediaCmd.AddCommand(mediaEjectCmd)
+	mediaCmd.AddCommand(mediaInsertCmd)
+	mediaEjectCmd.PersistentFlags().StringP("drive", "d", api.CdromDiskID, "disk id of the cdrom drive")
+	mediaEjectCmd.PersistentFlags().BoolP("force", "F", false, "eject media which the guest has locked")
+	mediaInsertCmd.PersistentFlags().StringP("drive", "d", api.CdromDiskID, "disk id of the cdrom drive")
+	mediaInsertCmd.PersistentFlags().StringP("format", "f", "raw", "media format")
+	mediaInsertCmd.PersistentFlags().BoolP("force", "F", false, "open the tray even if the guest has locked it")
+}
@@ -0,0 +1,98 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"mcli-v2/pkg/api"
+
+	table "github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+// remoteCmd represents the remote command
+var remoteCmd = &cobra.Command{
+	Use:   "remote",
+	Short: "manage image catalog remotes",
+	Long:  `Add, list and remove the image catalog remotes used to resolve image references like images:ubuntu/22.04`,
+}
+
+var remoteAddCmd = &cobra.Command{
+	Use:   "add <remote name> <catalog url>",
+	Args:  cobra.ExactArgs(2),
+	Short: "add a new image catalog remote",
+	Long:  `Add a new image catalog remote.  The URL may be http(s):// or file:// and point to a catalog index or a directory containing index.yaml`,
+	Run:   doRemoteAdd,
+}
+
+var remoteListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the configured image catalog remotes",
+	Run:   doRemoteList,
+}
+
+var remoteRmCmd = &cobra.Command{
+	Use:   "rm <remote name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "remove an image catalog remote",
+	Run:   doRemoteRm,
+}
+
+func doRemoteAdd(cmd *cobra.Command, args []string) {
+	newRemote := api.ImageRemote{Name: args[0], URL: args[1]}
+	postURL := api.GetAPIURL("remotes")
+	resp, err := rootclient.R().EnableTrace().SetBody(newRemote).Post(postURL)
+	if err != nil {
+		panic(fmt.Sprintf("Failed POST to 'remotes' endpoint: %s", err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func doRemoteList(cmd *cobra.Command, args []string) {
+	remotes := []api.ImageRemote{}
+	listURL := api.GetAPIURL("remotes")
+	resp, err := rootclient.R().EnableTrace().Get(listURL)
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET on 'remotes' endpoint: %s", err))
+	}
+	if err := json.Unmarshal(resp.Body(), &remotes); err != nil {
+		panic(fmt.Sprintf("Failed to unmarshal GET on /remotes: %s", err))
+	}
+	tbl := table.New("Name", "URL")
+	tbl.AddRow("----", "---")
+	for _, remote := range remotes {
+		tbl.AddRow(remote.Name, remote.URL)
+	}
+	tbl.Print()
+}
+
+func doRemoteRm(cmd *cobra.Command, args []string) {
+	remoteName := args[0]
+	deleteURL := api.GetAPIURL(fmt.Sprintf("remotes/%s", remoteName))
+	resp, err := rootclient.R().EnableTrace().Delete(deleteURL)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to delete remote '%s': %s", remoteName, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func init() {
+	rootCmd.AddCommand(remoteCmd)
+	remoteCmd.AddCommand(remoteAddCmd)
+	remoteCmd.AddCommand(remoteListCmd)
+	remoteCmd.AddCommand(remoteRmCmd)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"mcli-v2/pkg/api"
+
+	humanize "github.com/dustin/go-humanize"
+	table "github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+// resourcesCmd represents the resources command
+var resourcesCmd = &cobra.Command{
+	Use:   "resources <machine name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "show the cgroup resource usage of a running machine",
+	Long: `Show the resource usage of the cgroup holding the QEMU, swtpm and
+virtiofsd processes of a running machine.  Limits are set in the machine
+'resources:' settings.`,
+	Run: doResources,
+}
+
+func doResources(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+
+	endpoint := fmt.Sprintf("machines/%s/resources", machineName)
+	resp, err := rootclient.R().EnableTrace().Get(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET to '%s' endpoint: %s", endpoint, err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to get resources of machine '%s': %s %s", machineName, resp, resp.Status()))
+	}
+	usage := api.CgroupUsage{}
+	if err := json.Unmarshal(resp.Body(), &usage); err != nil {
+		panic(fmt.Sprintf("Failed to unmarshal response from '%s': %s", endpoint, err))
+	}
+
+	tbl := table.New("Resource", "Usage", "Limit")
+	tbl.AddRow("--------", "-----", "-----")
+	tbl.AddRow("cpu", fmt.Sprintf("%.2fs (user %.2fs system %.2fs)", float64(usage.CPUUsageUsec)/1e6,
+		float64(usage.CPUUserUsec)/1e6, float64(usage.CPUSystemUsec)/1e6), fmt.Sprintf("throttled %.2fs", float64(usage.CPUThrottledUsec)/1e6))
+	tbl.AddRow("memory", humanize.IBytes(usage.MemoryCurrent), fmt.Sprintf("%s (%d oom kills)", usage.MemoryMax, usage.OOMKills))
+	tbl.AddRow("io", fmt.Sprintf("read %s write %s", humanize.IBytes(usage.IOReadBytes), humanize.IBytes(usage.IOWriteBytes)), "")
+	tbl.AddRow("pids", fmt.Sprintf("%d", usage.PidsCurrent), usage.PidsMax)
+	tbl.Print()
+	fmt.Printf("cgroup: %s\n", usage.Path)
+}
+
+func init() {
+	rootCmd.AddCommand(resourcesCmd)
+}
@@ -64,8 +64,16 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.client.yaml)")
+	rootCmd.PersistentFlags().Bool("system", false, "connect to the system-wide machined in /run")
+	cobra.OnInitialize(initClient)
+}
 
-	// configure the http client to point to the unix socket
+// initClient configures the http client to point to the unix socket, after
+// the flags are parsed so --system selects the socket
+func initClient() {
+	if system, _ := rootCmd.PersistentFlags().GetBool("system"); system {
+		api.SetSystemMode(true)
+	}
 	apiSocket := api.APISocketPath()
 	if len(apiSocket) == 0 {
 		panic("Failed to get API socket path")
@@ -0,0 +1,184 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"mcli-v2/pkg/api"
+	"sort"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/lxc/lxd/shared/termios"
+	table "github.com/rodaine/table"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// topCmd represents the top command
+var topCmd = &cobra.Command{
+	Use:   "top",
+	Short: "show the cpu, memory, disk and network usage of running machines",
+	Long: `Show the resource usage of the running machines, refreshed every
+interval.  CPU% is the cpu time used per interval, 100% per busy host cpu.
+Network rates are only shown for guests running the QEMU guest agent.`,
+	Run: doTop,
+}
+
+// topSample is a machine stats sample with its summed disk and nic counters
+type topSample struct {
+	stats                api.MachineStats
+	diskRead, diskWrite  uint64
+	netRx, netTx         uint64
+	hasDisks, hasNetwork bool
+}
+
+func getMachineStats(machineName string) (api.MachineStats, error) {
+	stats := api.MachineStats{}
+	endpoint := fmt.Sprintf("machines/%s/stats", machineName)
+	resp, err := rootclient.R().EnableTrace().Get(api.GetAPIURL(endpoint))
+	if err != nil {
+		return stats, fmt.Errorf("Failed GET to '%s' endpoint: %s", endpoint, err)
+	}
+	if resp.IsError() {
+		return stats, fmt.Errorf("Failed to get stats of machine '%s': %s %s", machineName, resp, resp.Status())
+	}
+	if err := json.Unmarshal(resp.Body(), &stats); err != nil {
+		return stats, fmt.Errorf("Failed to unmarshal response from '%s': %s", endpoint, err)
+	}
+	return stats, nil
+}
+
+func newTopSample(stats api.MachineStats) topSample {
+	sample := topSample{stats: stats}
+	for _, disk := range stats.Disks {
+		sample.diskRead += disk.ReadBytes
+		sample.diskWrite += disk.WriteBytes
+		sample.hasDisks = true
+	}
+	for _, nic := range stats.Nics {
+		sample.netRx += nic.RxBytes
+		sample.netTx += nic.TxBytes
+		sample.hasNetwork = true
+	}
+	return sample
+}
+
+// topRate formats the per second rate of a counter between two samples
+func topRate(prev, cur uint64, seconds float64) string {
+	if cur < prev || seconds <= 0 {
+		return "-"
+	}
+	return humanize.IBytes(uint64(float64(cur-prev)/seconds)) + "/s"
+}
+
+// sampleMachines returns a stats sample of each running machine
+func sampleMachines() map[string]topSample {
+	machines, err := getMachines()
+	if err != nil {
+		panic(err)
+	}
+	samples := make(map[string]topSample)
+	for idx := range machines {
+		if machines[idx].Status != api.MachineStatusRunning {
+			continue
+		}
+		stats, err := getMachineStats(machines[idx].Name)
+		if err != nil {
+			continue
+		}
+		samples[machines[idx].Name] = newTopSample(stats)
+	}
+	return samples
+}
+
+func doTop(cmd *cobra.Command, args []string) {
+	interval, err := cmd.Flags().GetDuration("interval")
+	if err != nil {
+		panic(err)
+	}
+	iterations, err := cmd.Flags().GetInt("iterations")
+	if err != nil {
+		panic(err)
+	}
+	clearScreen := termios.IsTerminal(unix.Stdout)
+
+	// rates need two samples
+	previous := sampleMachines()
+	for iteration := 1; iterations == 0 || iteration <= iterations; iteration++ {
+		time.Sleep(interval)
+		current := sampleMachines()
+
+		names := []string{}
+		cpuPercent := make(map[string]float64)
+		for name, sample := range current {
+			names = append(names, name)
+			cpuPercent[name] = -1
+			prev, ok := previous[name]
+			seconds := sample.stats.Timestamp.Sub(prev.stats.Timestamp).Seconds()
+			if ok && seconds > 0 && sample.stats.CPUTimeUsec >= prev.stats.CPUTimeUsec {
+				cpuPercent[name] = float64(sample.stats.CPUTimeUsec-prev.stats.CPUTimeUsec) / (seconds * 1e6) * 100
+			}
+		}
+		// busiest machines first
+		sort.Slice(names, func(i, j int) bool {
+			if cpuPercent[names[i]] != cpuPercent[names[j]] {
+				return cpuPercent[names[i]] > cpuPercent[names[j]]
+			}
+			return names[i] < names[j]
+		})
+
+		if clearScreen {
+			fmt.Print("\033[H\033[2J")
+		}
+		fmt.Printf("machine top - %s, %d running machines, every %s\n\n", time.Now().Format("15:04:05"), len(names), interval)
+		tbl := table.New("Name", "Type", "CPUs", "CPU%", "RSS", "Memory", "Balloon", "Disk Read", "Disk Write", "Net Rx", "Net Tx")
+		for _, name := range names {
+			sample := current[name]
+			stats := sample.stats
+			cpu, diskRead, diskWrite, netRx, netTx := "-", "-", "-", "-", "-"
+			if cpuPercent[name] >= 0 {
+				cpu = fmt.Sprintf("%.1f", cpuPercent[name])
+			}
+			if prev, ok := previous[name]; ok {
+				seconds := stats.Timestamp.Sub(prev.stats.Timestamp).Seconds()
+				if sample.hasDisks {
+					diskRead = topRate(prev.diskRead, sample.diskRead, seconds)
+					diskWrite = topRate(prev.diskWrite, sample.diskWrite, seconds)
+				}
+				if sample.hasNetwork && prev.hasNetwork {
+					netRx = topRate(prev.netRx, sample.netRx, seconds)
+					netTx = topRate(prev.netTx, sample.netTx, seconds)
+				}
+			}
+			balloon := "-"
+			if stats.BalloonActual > 0 {
+				balloon = humanize.IBytes(stats.BalloonActual)
+			}
+			tbl.AddRow(name, stats.Type, stats.CPUs, cpu, humanize.IBytes(stats.RSSBytes), humanize.IBytes(stats.MemoryBytes),
+				balloon, diskRead, diskWrite, netRx, netTx)
+		}
+		tbl.Print()
+		previous = current
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(topCmd)
+	topCmd.PersistentFlags().DurationP("interval", "d", 2*time.Second, "refresh interval")
+	topCmd.PersistentFlags().IntP("iterations", "n", 0, "exit after this many refreshes, 0 runs until interrupted")
+}
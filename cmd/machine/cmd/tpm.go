@@ -0,0 +1,172 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"mcli-v2/pkg/api"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// tpmCmd represents the tpm command
+var tpmCmd = &cobra.Command{
+	Use:   "tpm",
+	Short: "manage the TPM of a machine",
+	Long: `Manage the software TPM of a machine.  Reset, backup and restore require
+the machine to be stopped.`,
+}
+
+var tpmInfoCmd = &cobra.Command{
+	Use:   "info <machine name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "show the TPM and swtpm versions and TPM state",
+	Run:   doTPMInfo,
+}
+
+var tpmResetCmd = &cobra.Command{
+	Use:   "reset <machine name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "reset the TPM to a factory new state",
+	Long: `Remove the TPM state of a machine.  A new TPM with new keys and
+certificates is created on the next start of the machine.`,
+	Run: doTPMReset,
+}
+
+var tpmBackupCmd = &cobra.Command{
+	Use:   "backup <machine name> <backup file>",
+	Args:  cobra.ExactArgs(2),
+	Short: "save the TPM state to a tar.gz file",
+	Run:   doTPMBackup,
+}
+
+var tpmRestoreCmd = &cobra.Command{
+	Use:   "restore <machine name> <backup file>",
+	Args:  cobra.ExactArgs(2),
+	Short: "replace the TPM state with a backup",
+	Run:   doTPMRestore,
+}
+
+var tpmEKCertCmd = &cobra.Command{
+	Use:   "ekcert <machine name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "print the TPM endorsement key certificates as PEM",
+	Run:   doTPMEKCert,
+}
+
+func doTPMInfo(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+
+	endpoint := fmt.Sprintf("machines/%s/tpm", machineName)
+	resp, err := rootclient.R().EnableTrace().Get(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET to '%s' endpoint: %s", endpoint, err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to get TPM of machine '%s': %s %s", machineName, resp, resp.Status()))
+	}
+	info := api.TPMInfo{}
+	if err := json.Unmarshal(resp.Body(), &info); err != nil {
+		panic(fmt.Sprintf("Failed to unmarshal response from '%s': %s", endpoint, err))
+	}
+	out, err := yaml.Marshal(info)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to marshal TPM info: %s", err))
+	}
+	fmt.Printf("%s", string(out))
+}
+
+func doTPMReset(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+
+	endpoint := fmt.Sprintf("machines/%s/tpm/reset", machineName)
+	resp, err := rootclient.R().EnableTrace().Post(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed POST to '%s' endpoint: %s", endpoint, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func doTPMBackup(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	output := args[1]
+
+	endpoint := fmt.Sprintf("machines/%s/tpm/backup", machineName)
+	resp, err := rootclient.R().EnableTrace().Get(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET to '%s' endpoint: %s", endpoint, err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to backup TPM of machine '%s': %s %s", machineName, resp, resp.Status()))
+	}
+	if err := os.WriteFile(output, resp.Body(), 0600); err != nil {
+		panic(fmt.Sprintf("Failed to write TPM backup to %s: %s", output, err))
+	}
+	fmt.Printf("Wrote TPM state of machine %s to %s\n", machineName, output)
+}
+
+func doTPMRestore(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+
+	backup, err := os.ReadFile(args[1])
+	if err != nil {
+		panic(fmt.Sprintf("Failed to read TPM backup: %s", err))
+	}
+	endpoint := fmt.Sprintf("machines/%s/tpm/restore", machineName)
+	resp, err := rootclient.R().EnableTrace().SetBody(backup).Post(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed POST to '%s' endpoint: %s", endpoint, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func doTPMEKCert(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	platform, _ := cmd.Flags().GetBool("platform")
+
+	endpoint := fmt.Sprintf("machines/%s/tpm/ekcert", machineName)
+	resp, err := rootclient.R().EnableTrace().SetQueryParam("platform", fmt.Sprintf("%v", platform)).Get(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET to '%s' endpoint: %s", endpoint, err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to get TPM certificates of machine '%s': %s %s", machineName, resp, resp.Status()))
+	}
+
+	output := cmd.Flag("output").Value.String()
+	if output == "" {
+		fmt.Printf("%s", resp.Body())
+		return
+	}
+	if err := os.WriteFile(output, resp.Body(), 0644); err != nil {
+		panic(fmt.Sprintf("Failed to write certificates to %s: %s", output, err))
+	}
+	fmt.Printf("Wrote TPM certificates of machine %s to %s\n", machineName, output)
+}
+
+func init() {
+	rootCmd.AddCommand(tpmCmd)
+	tpmCmd.AddCommand(tpmInfoCmd)
+	tpmCmd.AddCommand(tpmResetCmd)
+	tpmCmd.AddCommand(tpmBackupCmd)
+	tpmCmd.AddCommand(tpmRestoreCmd)
+	tpmCmd.AddCommand(tpmEKCertCmd)
+	tpmEKCertCmd.PersistentFlags().StringP("output", "o", "", "write the certificates to this file")
+	tpmEKCertCmd.PersistentFlags().Bool("platform", false, "return the platform certificates instead")
+}
@@ -0,0 +1,151 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"mcli-v2/pkg/api"
+	"os"
+
+	table "github.com/rodaine/table"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// truststoreCmd represents the truststore command
+var truststoreCmd = &cobra.Command{
+	Use:   "truststore",
+	Short: "manage the CAs which sign machine TPM certificates",
+	Long: `Manage trust stores, CAs shared by the TPMs of a project.  Machines with
+'truststore: <name>' get their TPM EK and platform certificates signed by the
+trust store CA when the TPM is created, so an attestation server only needs to
+trust the exported CA certificate.`,
+}
+
+var truststoreCreateCmd = &cobra.Command{
+	Use:   "create <trust store name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "create a trust store with a new or an existing CA",
+	Long: `Create a trust store.  A new CA is generated unless an existing CA is
+imported with --key and --cert, the key must be an unencrypted PEM file.`,
+	Run: doTrustStoreCreate,
+}
+
+var truststoreListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the trust stores",
+	Run:   doTrustStoreList,
+}
+
+var truststoreExportCmd = &cobra.Command{
+	Use:   "export <trust store name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "print the CA certificate of a trust store as PEM",
+	Run:   doTrustStoreExport,
+}
+
+func doTrustStoreCreate(cmd *cobra.Command, args []string) {
+	request := api.TrustStoreRequest{
+		Name:       args[0],
+		CommonName: cmd.Flag("cn").Value.String(),
+	}
+	if keyFile := cmd.Flag("key").Value.String(); keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to read CA key: %s", err))
+		}
+		request.Key = content
+	}
+	if certFile := cmd.Flag("cert").Value.String(); certFile != "" {
+		content, err := os.ReadFile(certFile)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to read CA certificate: %s", err))
+		}
+		request.Certificate = content
+	}
+
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Post(api.GetAPIURL("truststores"))
+	if err != nil {
+		panic(fmt.Sprintf("Failed POST to 'truststores' endpoint: %s", err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to create trust store '%s': %s %s", request.Name, resp, resp.Status()))
+	}
+	store := api.TrustStore{}
+	if err := json.Unmarshal(resp.Body(), &store); err != nil {
+		panic(fmt.Sprintf("Failed to unmarshal response from 'truststores': %s", err))
+	}
+	out, err := yaml.Marshal(store)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to marshal trust store: %s", err))
+	}
+	fmt.Printf("%s", string(out))
+}
+
+func doTrustStoreList(cmd *cobra.Command, args []string) {
+	resp, err := rootclient.R().EnableTrace().Get(api.GetAPIURL("truststores"))
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET on 'truststores' endpoint: %s", err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to list trust stores: %s %s", resp, resp.Status()))
+	}
+	stores := []api.TrustStore{}
+	if err := json.Unmarshal(resp.Body(), &stores); err != nil {
+		panic(fmt.Sprintf("Failed to unmarshal GET on /truststores: %s", err))
+	}
+	tbl := table.New("Name", "Subject", "Expires", "Fingerprint")
+	tbl.AddRow("----", "-------", "-------", "-----------")
+	for _, store := range stores {
+		tbl.AddRow(store.Name, store.Subject, store.NotAfter.Format("2006-01-02"), store.Fingerprint)
+	}
+	tbl.Print()
+}
+
+func doTrustStoreExport(cmd *cobra.Command, args []string) {
+	storeName := args[0]
+
+	endpoint := fmt.Sprintf("truststores/%s/cert", storeName)
+	resp, err := rootclient.R().EnableTrace().Get(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET to '%s' endpoint: %s", endpoint, err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to export trust store '%s': %s %s", storeName, resp, resp.Status()))
+	}
+
+	output := cmd.Flag("output").Value.String()
+	if output == "" {
+		fmt.Printf("%s", resp.Body())
+		return
+	}
+	if err := os.WriteFile(output, resp.Body(), 0644); err != nil {
+		panic(fmt.Sprintf("Failed to write CA certificate to %s: %s", output, err))
+	}
+	fmt.Printf("Wrote CA certificate of trust store %s to %s\n", storeName, output)
+}
+
+func init() {
+	rootCmd.AddCommand(truststoreCmd)
+	truststoreCmd.AddCommand(truststoreCreateCmd)
+	truststoreCmd.AddCommand(truststoreListCmd)
+	truststoreCmd.AddCommand(truststoreExportCmd)
+	truststoreCreateCmd.PersistentFlags().String("cn", "", "common name of a new CA, default 'machine <name> TPM CA'")
+	truststoreCreateCmd.PersistentFlags().String("key", "", "import the CA private key from this PEM file")
+	truststoreCreateCmd.PersistentFlags().String("cert", "", "import the CA certificate from this PEM file")
+	truststoreExportCmd.PersistentFlags().StringP("output", "o", "", "write the CA certificate to this file")
+}
@@ -0,0 +1,238 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"mcli-v2/pkg/api"
+	"os"
+	"strconv"
+
+	table "github.com/rodaine/table"
+	"github.com/spf13/cobra"
+)
+
+// uefiCmd represents the uefi command
+var uefiCmd = &cobra.Command{
+	Use:   "uefi",
+	Short: "manage the UEFI variables of a machine",
+	Long: `Manage the UEFI variables of a machine.  The variables are stored in the
+machine's copy of the firmware vars file, which can only be changed while
+the machine is stopped.`,
+}
+
+var uefiListCmd = &cobra.Command{
+	Use:   "list <machine name>",
+	Args:  cobra.ExactArgs(1),
+	Short: "list the UEFI variables of a machine",
+	Run:   doUEFIList,
+}
+
+var uefiGetCmd = &cobra.Command{
+	Use:   "get <machine name> <variable>",
+	Args:  cobra.ExactArgs(2),
+	Short: "read a UEFI variable",
+	Long: `Read a UEFI variable.  The value is written to --output or printed as
+JSON.  --guid defaults to the well known GUID of the variable name.`,
+	Run: doUEFIGet,
+}
+
+var uefiSetCmd = &cobra.Command{
+	Use:   "set <machine name> <variable> <data file>",
+	Args:  cobra.ExactArgs(3),
+	Short: "write a UEFI variable",
+	Long: `Write the contents of <data file> to a UEFI variable, creating it if it
+does not exist.  Time based authenticated variables such as PK, KEK, db and dbx
+should be written with 'uefi enroll'.`,
+	Run: doUEFISet,
+}
+
+var uefiDeleteCmd = &cobra.Command{
+	Use:   "delete <machine name> <variable>",
+	Args:  cobra.ExactArgs(2),
+	Short: "delete a UEFI variable",
+	Run:   doUEFIDelete,
+}
+
+var uefiEnrollCmd = &cobra.Command{
+	Use:   "enroll <machine name> <PK|KEK|db|dbx> <certificate file>...",
+	Args:  cobra.MinimumNArgs(3),
+	Short: "enroll Secure Boot keys",
+	Long: `Enroll PEM or DER encoded X.509 certificates into a Secure Boot key
+database.  The certificates replace the current contents unless --append is
+given.  PK takes exactly one certificate, enrolling it enables Secure Boot.`,
+	Run: doUEFIEnroll,
+}
+
+var uefiExportCmd = &cobra.Command{
+	Use:   "export <machine name> <vars file>",
+	Args:  cobra.ExactArgs(2),
+	Short: "export the UEFI vars file of a machine",
+	Long: `Export the machine's UEFI vars file, e.g. to use as the firmware vars
+template of other machines.`,
+	Run: doUEFIExport,
+}
+
+func uefiVarEndpoint(machineName, varName string) string {
+	return fmt.Sprintf("machines/%s/uefi/vars/%s", machineName, varName)
+}
+
+func doUEFIList(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+
+	endpoint := fmt.Sprintf("machines/%s/uefi/vars", machineName)
+	resp, err := rootclient.R().EnableTrace().Get(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET to '%s' endpoint: %s", endpoint, err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to list UEFI variables of machine '%s': %s %s", machineName, resp, resp.Status()))
+	}
+	vars := []api.UEFIVariable{}
+	if err := json.Unmarshal(resp.Body(), &vars); err != nil {
+		panic(fmt.Sprintf("Failed to unmarshal response from '%s': %s", endpoint, err))
+	}
+
+	tbl := table.New("Name", "GUID", "Attributes", "Size")
+	tbl.AddRow("----", "----", "----------", "----")
+	for _, v := range vars {
+		tbl.AddRow(v.Name, v.GUID, fmt.Sprintf("0x%02x", v.Attributes), v.Size)
+	}
+	tbl.Print()
+}
+
+func doUEFIGet(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	varName := args[1]
+
+	endpoint := uefiVarEndpoint(machineName, varName)
+	resp, err := rootclient.R().EnableTrace().SetQueryParam("guid", cmd.Flag("guid").Value.String()).Get(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET to '%s' endpoint: %s", endpoint, err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to read UEFI variable '%s': %s %s", varName, resp, resp.Status()))
+	}
+	variable := api.UEFIVariable{}
+	if err := json.Unmarshal(resp.Body(), &variable); err != nil {
+		panic(fmt.Sprintf("Failed to unmarshal response from '%s': %s", endpoint, err))
+	}
+
+	output := cmd.Flag("output").Value.String()
+	if output == "" {
+		fmt.Printf("%s\n", resp)
+		return
+	}
+	if err := os.WriteFile(output, variable.Data, 0644); err != nil {
+		panic(fmt.Sprintf("Failed to write variable to %s: %s", output, err))
+	}
+	fmt.Printf("Wrote %d bytes of %s-%s to %s\n", len(variable.Data), variable.Name, variable.GUID, output)
+}
+
+func doUEFISet(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	varName := args[1]
+
+	data, err := os.ReadFile(args[2])
+	if err != nil {
+		panic(fmt.Sprintf("Failed to read variable data: %s", err))
+	}
+	attributes, err := strconv.ParseUint(cmd.Flag("attributes").Value.String(), 0, 32)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid attributes '%s': %s", cmd.Flag("attributes").Value.String(), err))
+	}
+
+	request := api.UEFIVarRequest{Attributes: uint32(attributes), Data: data}
+	endpoint := uefiVarEndpoint(machineName, varName)
+	resp, err := rootclient.R().EnableTrace().SetQueryParam("guid", cmd.Flag("guid").Value.String()).SetBody(request).Put(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed PUT to '%s' endpoint: %s", endpoint, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func doUEFIDelete(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	varName := args[1]
+
+	endpoint := uefiVarEndpoint(machineName, varName)
+	resp, err := rootclient.R().EnableTrace().SetQueryParam("guid", cmd.Flag("guid").Value.String()).Delete(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed DELETE to '%s' endpoint: %s", endpoint, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func doUEFIEnroll(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	appendCerts, _ := cmd.Flags().GetBool("append")
+
+	request := api.UEFIEnrollRequest{
+		Variable: args[1],
+		Owner:    cmd.Flag("owner").Value.String(),
+		Append:   appendCerts,
+	}
+	for _, certFile := range args[2:] {
+		content, err := os.ReadFile(certFile)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to read certificate: %s", err))
+		}
+		request.Certificates = append(request.Certificates, content)
+	}
+
+	endpoint := fmt.Sprintf("machines/%s/uefi/enroll", machineName)
+	resp, err := rootclient.R().EnableTrace().SetBody(request).Post(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed POST to '%s' endpoint: %s", endpoint, err))
+	}
+	fmt.Printf("%s %s\n", resp, resp.Status())
+}
+
+func doUEFIExport(cmd *cobra.Command, args []string) {
+	machineName := args[0]
+	output := args[1]
+
+	endpoint := fmt.Sprintf("machines/%s/uefi/nvram", machineName)
+	resp, err := rootclient.R().EnableTrace().Get(api.GetAPIURL(endpoint))
+	if err != nil {
+		panic(fmt.Sprintf("Failed GET to '%s' endpoint: %s", endpoint, err))
+	}
+	if resp.IsError() {
+		panic(fmt.Sprintf("Failed to export UEFI vars of machine '%s': %s %s", machineName, resp, resp.Status()))
+	}
+	if err := os.WriteFile(output, resp.Body(), 0644); err != nil {
+		panic(fmt.Sprintf("Failed to write UEFI vars to %s: %s", output, err))
+	}
+	fmt.Printf("Wrote UEFI vars of machine %s to %s\n", machineName, output)
+}
+
+func init() {
+	rootCmd.AddCommand(uefiCmd)
+	uefiCmd.AddCommand(uefiListCmd)
+	uefiCmd.AddCommand(uefiGetCmd)
+	uefiCmd.AddCommand(uefiSetCmd)
+	uefiCmd.AddCommand(uefiDeleteCmd)
+	uefiCmd.AddCommand(uefiEnrollCmd)
+	uefiCmd.AddCommand(uefiExportCmd)
+	uefiGetCmd.PersistentFlags().StringP("guid", "g", "", "vendor GUID or alias: global, security-db, secure-boot, custom-mode")
+	uefiGetCmd.PersistentFlags().StringP("output", "o", "", "write the raw variable data to this file")
+	uefiSetCmd.PersistentFlags().StringP("guid", "g", "", "vendor GUID or alias: global, security-db, secure-boot, custom-mode")
+	uefiSetCmd.PersistentFlags().StringP("attributes", "a", "0x7", "variable attributes, default non-volatile, boot and runtime access")
+	uefiDeleteCmd.PersistentFlags().StringP("guid", "g", "", "vendor GUID or alias: global, security-db, secure-boot, custom-mode")
+	uefiEnrollCmd.PersistentFlags().String("owner", "", "signature owner GUID of the certificates")
+	uefiEnrollCmd.PersistentFlags().Bool("append", false, "append to the key database instead of replacing it")
+}
@@ -23,12 +23,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
 )
 
 var cfgFile string
@@ -43,7 +47,10 @@ machine machines.`,
 }
 
 func doServerRun(cmd *cobra.Command, args []string) {
-	conf := api.DefaultMachineDaemonConfig()
+	conf, err := loadConfig(cmd.Flags())
+	if err != nil {
+		panic(err)
+	}
 	ctrl := api.NewController(conf)
 
 	cwd, err := os.Getwd()
@@ -54,19 +61,34 @@ func doServerRun(cmd *cobra.Command, args []string) {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go func() {
+		for range hupCh {
+			log.Infof("machined received SIGHUP, reloading config")
+			newConf, err := loadConfig(cmd.Flags())
+			if err == nil {
+				err = ctrl.ReloadConfig(newConf)
+			}
+			if err != nil {
+				log.Errorf("Failed to reload machined config, keeping the current config: %s", err)
+			}
+		}
+	}()
+
 	go func() {
 		if err := ctrl.Run(ctx); err != nil && err != http.ErrServerClosed {
-			panic(err)
+			log.Fatalf("machined failed: %s", err)
 		}
 	}()
 	<-ctx.Done()
 	log.Infof("machined shutting down gracefully, press Ctrl+C again to force")
-	log.Infof("machined notifying all machines to shutdown... (FIXME)")
-	log.Infof("machined waiting up to %s seconds\n", "30")
+	shutdownTimeout := ctrl.GetConfig().ShutdownTimeout
+	log.Infof("machined waiting up to %d seconds\n", shutdownTimeout)
 	if err := ctrl.MachineController.StopMachines(); err != nil {
 		log.Errorf("Failure during machine shutdown: %s\n", err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(shutdownTimeout))
 	defer cancel()
 	ctrl.Shutdown(ctx)
 	log.Infof("machined exiting")
@@ -138,34 +160,85 @@ func init() {
 	// init our rng
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	cobra.OnInitialize(initConfig)
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.server.yaml)")
+	addConfigFlags(rootCmd.PersistentFlags())
 }
 
-// initConfig reads in config file and ENV variables if set.
-func initConfig() {
-	if cfgFile != "" {
-		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
-	} else {
-		// Find home directory.
-		home, err := os.UserHomeDir()
-		cobra.CheckErr(err)
-
-		// Search config in home directory with name ".server" (without extension).
-		viper.AddConfigPath(home)
-		viper.SetConfigType("yaml")
-		viper.SetConfigName(".server")
+// addConfigFlags adds the flags of the machined config settings
+func addConfigFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&cfgFile, "config", "", "config file (default is <config-dir>/"+api.MachineDaemonConfigName+")")
+	flags.Bool("system", false, "use the system-wide dirs in /etc, /var/lib and /run instead of the XDG user dirs")
+	flags.String("config-dir", "", "directory of the machine configs (default $XDG_CONFIG_HOME/machine)")
+	flags.String("data-dir", "", "directory of the machine data (default $XDG_DATA_HOME/machine)")
+	flags.String("state-dir", "", "directory of the machine state (default $XDG_STATE_HOME/machine)")
+	flags.String("socket-path", "", "path of the API unix socket (default $XDG_RUNTIME_DIR/machined/"+api.MachineUnixSocketName+")")
+	flags.String("qemu-binary", "", "QEMU binary of host architecture guests (default searched)")
+	flags.String("spice-address", api.DefaultSpiceAddress, "address spice displays listen on")
+	flags.String("spice-ports", api.DefaultSpicePorts, "port range of spice displays")
+	flags.Int("stop-timeout", api.DefaultStopTimeout, "seconds a machine gets to power off before it is killed")
+	flags.Int("shutdown-timeout", api.DefaultShutdownTimeout, "seconds machined waits for its server to stop on exit")
+	flags.String("log-level", api.DefaultLogLevel, "log level, one of panic, fatal, error, warn, info, debug or trace")
+	flags.String("metrics-address", "", "serve prometheus metrics on this TCP address, e.g. 127.0.0.1:9101")
+}
+
+// loadConfig returns the machined config, the defaults overridden by the
+// config file, MACHINED_* environment variables and flags, in that order.
+// It is called again to reload the config on SIGHUP.
+func loadConfig(flags *pflag.FlagSet) (*api.MachineDaemonConfig, error) {
+	// the mode selects the default dirs, so it is a flag or MACHINED_SYSTEM
+	// but not a config file setting
+	if system, _ := flags.GetBool("system"); system {
+		api.SetSystemMode(true)
 	}
+	conf := api.DefaultMachineDaemonConfig()
+	v := viper.New()
 
-	viper.AutomaticEnv() // read in environment variables that match
+	// the default config as viper defaults, so every setting can be set by
+	// environment variables
+	content, err := yaml.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	defaults := make(map[string]interface{})
+	if err := yaml.Unmarshal(content, &defaults); err != nil {
+		return nil, err
+	}
+	for key, value := range defaults {
+		v.SetDefault(key, value)
+	}
+
+	v.SetEnvPrefix("MACHINED")
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
 
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	if err := v.BindPFlags(flags); err != nil {
+		return nil, err
 	}
 
-	// TODO:
-	// parse the config
-	// for each on-disk machine, read in the yaml and post the struct
+	if cfgFile != "" {
+		v.SetConfigFile(cfgFile)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("Failed to read config file %s: %s", cfgFile, err)
+		}
+	} else {
+		// the config file is found in the config-dir of the flags or the
+		// environment, not in the default config-dir
+		configFile := filepath.Join(v.GetString("config-dir"), api.MachineDaemonConfigName)
+		if api.PathExists(configFile) {
+			v.SetConfigFile(configFile)
+			if err := v.ReadInConfig(); err != nil {
+				return nil, fmt.Errorf("Failed to read config file %s: %s", configFile, err)
+			}
+		}
+	}
+	if v.ConfigFileUsed() != "" {
+		log.Infof("Using config file: %s", v.ConfigFileUsed())
+	}
+
+	if err := v.Unmarshal(conf); err != nil {
+		return nil, fmt.Errorf("Failed to parse machined config: %s", err)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
 }
@@ -0,0 +1,163 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mcli-v2/pkg/api"
+
+	"github.com/spf13/pflag"
+)
+
+func TestLoadConfig(t *testing.T) {
+	testCases := []struct {
+		name string
+		// machined.yaml in the default config dir
+		file string
+		// machined.yaml in the config-dir of the environment
+		envDirFile  string
+		env         map[string]string
+		args        []string
+		stopTimeout int
+		spicePorts  string
+		err         bool
+	}{
+		{
+			name:        "defaults",
+			stopTimeout: api.DefaultStopTimeout,
+			spicePorts:  api.DefaultSpicePorts,
+		},
+		{
+			name:        "file overrides defaults",
+			file:        "stop-timeout: 20\n",
+			stopTimeout: 20,
+			spicePorts:  api.DefaultSpicePorts,
+		},
+		{
+			name:        "environment overrides file",
+			file:        "stop-timeout: 20\n",
+			env:         map[string]string{"MACHINED_STOP_TIMEOUT": "30"},
+			stopTimeout: 30,
+			spicePorts:  api.DefaultSpicePorts,
+		},
+		{
+			name:        "flags override environment",
+			file:        "stop-timeout: 20\n",
+			env:         map[string]string{"MACHINED_STOP_TIMEOUT": "30"},
+			args:        []string{"--stop-timeout=40"},
+			stopTimeout: 40,
+			spicePorts:  api.DefaultSpicePorts,
+		},
+		{
+			name:        "file in the config-dir of the environment",
+			file:        "spice-ports: 6000-6099\n",
+			envDirFile:  "spice-ports: 7000-7099\n",
+			stopTimeout: api.DefaultStopTimeout,
+			spicePorts:  "7000-7099",
+		},
+		{
+			name: "invalid setting",
+			file: "log-level: loud\n",
+			err:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+			t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+			t.Setenv("XDG_STATE_HOME", filepath.Join(dir, "state"))
+			t.Setenv("XDG_RUNTIME_DIR", filepath.Join(dir, "run"))
+			t.Setenv(api.MachineSystemModeEnv, "")
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+			writeConfig := func(configDir, content string) {
+				if err := os.MkdirAll(configDir, 0755); err != nil {
+					t.Fatalf("failed to create %s: %s", configDir, err)
+				}
+				if err := os.WriteFile(filepath.Join(configDir, api.MachineDaemonConfigName), []byte(content), 0644); err != nil {
+					t.Fatalf("failed to write config: %s", err)
+				}
+			}
+			if tc.file != "" {
+				writeConfig(filepath.Join(dir, "config", "machine"), tc.file)
+			}
+			if tc.envDirFile != "" {
+				envDir := filepath.Join(dir, "env-config")
+				writeConfig(envDir, tc.envDirFile)
+				t.Setenv("MACHINED_CONFIG_DIR", envDir)
+			}
+
+			cfgFile = ""
+			flags := pflag.NewFlagSet("machined", pflag.ContinueOnError)
+			addConfigFlags(flags)
+			if err := flags.Parse(tc.args); err != nil {
+				t.Fatalf("failed to parse flags %v: %s", tc.args, err)
+			}
+
+			conf, err := loadConfig(flags)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, loaded %+v", conf)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if conf.StopTimeout != tc.stopTimeout || conf.SpicePorts != tc.spicePorts {
+				t.Errorf("loaded stop-timeout %d spice-ports %s, expected %d %s",
+					conf.StopTimeout, conf.SpicePorts, tc.stopTimeout, tc.spicePorts)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(dir, "run"))
+	t.Setenv(api.MachineSystemModeEnv, "")
+
+	configFile := filepath.Join(dir, "custom.yaml")
+	if err := os.WriteFile(configFile, []byte("config-dir: "+filepath.Join(dir, "machines")+"\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %s", err)
+	}
+	flags := pflag.NewFlagSet("machined", pflag.ContinueOnError)
+	addConfigFlags(flags)
+	if err := flags.Parse([]string{"--config", configFile}); err != nil {
+		t.Fatalf("failed to parse flags: %s", err)
+	}
+	defer func() { cfgFile = "" }()
+
+	conf, err := loadConfig(flags)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := filepath.Join(dir, "machines"); conf.ConfigDirectory != want {
+		t.Errorf("config-dir %s, expected %s", conf.ConfigDirectory, want)
+	}
+
+	cfgFile = filepath.Join(dir, "missing.yaml")
+	if _, err := loadConfig(flags); err == nil {
+		t.Errorf("expected an error for a missing config file")
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/raharper/qcli"
+	log "github.com/sirupsen/logrus"
+)
+
+// Guest architectures, named like the qemu-system-<arch> binaries
+const (
+	ArchX86_64  = "x86_64"
+	ArchAarch64 = "aarch64"
+	ArchRiscv64 = "riscv64"
+)
+
+// Accelerators, auto uses kvm if the guest architecture matches the host and
+// /dev/kvm is usable, otherwise it falls back to tcg emulation.
+const (
+	AccelKVM  = qcli.MachineAccelerationKVM
+	AccelTCG  = "tcg"
+	AccelAuto = "auto"
+)
+
+const KVMDevice = "/dev/kvm"
+
+// QemuArch describes how to build a VM of a guest architecture
+type QemuArch struct {
+	MachineType    string
+	MachineOptions string
+	// CPU model with kvm and with tcg
+	KVMCPUModel   string
+	TCGCPUModel   string
+	CPUModelFlags []string
+	// SMM is only available on x86 machine types
+	SMM       bool
+	VGA       string
+	TPMDriver qcli.DeviceDriver
+	// qemu parameters for devices qcli cannot express
+	ExtraParams []string
+	// UEFI firmware code and vars shipped by distros, used when no
+	// firmware descriptor for the architecture is installed
+	UEFIFirmware       []qcli.UEFIFirmwareDevice
+	SecureUEFIFirmware []qcli.UEFIFirmwareDevice
+}
+
+// virt machines have no default display or input devices
+var virtDisplayParams = []string{
+	"-device", "virtio-gpu-pci",
+	"-device", "qemu-xhci,id=xhci",
+	"-device", "usb-kbd,bus=xhci.0",
+	"-device", "usb-tablet,bus=xhci.0",
+}
+
+var QemuArches = map[string]QemuArch{
+	ArchX86_64: {
+		MachineType:   qcli.MachineTypePC35,
+		KVMCPUModel:   "qemu64",
+		TCGCPUModel:   "qemu64",
+		CPUModelFlags: []string{"+x2apic"},
+		SMM:           true,
+		VGA:           "qxl",
+		TPMDriver:     qcli.TPMTISDevice,
+	},
+	ArchAarch64: {
+		MachineType:    "virt",
+		MachineOptions: "gic-version=max",
+		KVMCPUModel:    "host",
+		TCGCPUModel:    "max",
+		VGA:            "none",
+		TPMDriver:      "tpm-tis-device",
+		ExtraParams:    virtDisplayParams,
+		UEFIFirmware: []qcli.UEFIFirmwareDevice{
+			{Code: "/usr/share/AAVMF/AAVMF_CODE.fd", Vars: "/usr/share/AAVMF/AAVMF_VARS.fd"},
+			{Code: "/usr/share/edk2/aarch64/QEMU_EFI-pflash.raw", Vars: "/usr/share/edk2/aarch64/vars-template-pflash.raw"},
+		},
+		SecureUEFIFirmware: []qcli.UEFIFirmwareDevice{
+			{Code: "/usr/share/AAVMF/AAVMF_CODE.ms.fd", Vars: "/usr/share/AAVMF/AAVMF_VARS.ms.fd"},
+		},
+	},
+	ArchRiscv64: {
+		MachineType: "virt",
+		KVMCPUModel: "host",
+		TCGCPUModel: "rv64",
+		VGA:         "none",
+		TPMDriver:   "tpm-tis-device",
+		ExtraParams: virtDisplayParams,
+		UEFIFirmware: []qcli.UEFIFirmwareDevice{
+			{Code: "/usr/share/qemu-efi-riscv64/RISCV_VIRT_CODE.fd", Vars: "/usr/share/qemu-efi-riscv64/RISCV_VIRT_VARS.fd"},
+			{Code: "/usr/share/edk2/riscv/RISCV_VIRT_CODE.fd", Vars: "/usr/share/edk2/riscv/RISCV_VIRT_VARS.fd"},
+		},
+	},
+}
+
+var archAliases = map[string]string{
+	"amd64": ArchX86_64,
+	"arm64": ArchAarch64,
+}
+
+// GuestArch returns the guest architecture of the VM, the host architecture
+// if arch is not set.
+func (v *VMDef) GuestArch() (string, error) {
+	arch := v.Arch
+	if arch == "" {
+		arch = HostImageArch()
+	}
+	if alias, ok := archAliases[arch]; ok {
+		arch = alias
+	}
+	if _, ok := QemuArches[arch]; !ok {
+		arches := []string{}
+		for name := range QemuArches {
+			arches = append(arches, name)
+		}
+		sort.Strings(arches)
+		return "", fmt.Errorf("invalid arch: found %s expected one of [%s]", arch, strings.Join(arches, " "))
+	}
+	return arch, nil
+}
+
+// KVMAvailable reports if the host can run kvm guests
+func KVMAvailable() bool {
+	fh, err := os.OpenFile(KVMDevice, os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	fh.Close()
+	return true
+}
+
+// Accelerator returns the accelerator for the VM running arch guests
+func (v *VMDef) Accelerator(arch string) (string, error) {
+	native := arch == HostImageArch()
+	switch v.Accel {
+	case "", AccelAuto:
+		if native && KVMAvailable() {
+			return AccelKVM, nil
+		}
+		if native {
+			log.Warnf("VM:%s %s is not available, falling back to %s emulation", v.Name, KVMDevice, AccelTCG)
+		}
+		return AccelTCG, nil
+	case AccelKVM:
+		if !native {
+			return "", fmt.Errorf("accel %s cannot run %s guests on a %s host", AccelKVM, arch, HostImageArch())
+		}
+		if !KVMAvailable() {
+			return "", fmt.Errorf("accel %s requested but %s is not available", AccelKVM, KVMDevice)
+		}
+		return AccelKVM, nil
+	case AccelTCG:
+		return AccelTCG, nil
+	}
+	return "", fmt.Errorf("invalid accel: found %s expected [%s %s %s]", v.Accel, AccelKVM, AccelTCG, AccelAuto)
+}
+
+// GetQemuPath returns the QEMU binary for arch guests, the qemu-binary of the
+// daemon config for host architecture guests if set
+func GetQemuPath(arch string) (string, error) {
+	emulators := []string{"qemu-system-" + arch}
+	// qemu-kvm and kvm are the host architecture QEMU
+	if arch == HostImageArch() {
+		if qemuBinary := currentDaemonConfig().QemuBinary; qemuBinary != "" {
+			return qemuBinary, nil
+		}
+		emulators = []string{"qemu-kvm", "qemu-system-" + arch, "kvm"}
+	}
+	paths := []string{"/usr/libexec", "/usr/bin"}
+
+	for _, emulator := range emulators {
+		for _, prefix := range paths {
+			qemuPath := path.Join(prefix, emulator)
+			if _, err := os.Stat(qemuPath); err == nil {
+				return qemuPath, nil
+			}
+		}
+	}
+	for _, emulator := range emulators {
+		if qemuPath := Which(emulator); qemuPath != "" {
+			return qemuPath, nil
+		}
+	}
+	return "", fmt.Errorf("Failed to find QEMU binary [%s] in paths [%s] or PATH", emulators, paths)
+}
+
+// systemUEFIFirmware returns the installed UEFI firmware for arch guests,
+// preferring QEMU firmware descriptors over the well known distro paths.
+func systemUEFIFirmware(arch, machineType string, secureBoot bool) (*qcli.UEFIFirmwareDevice, error) {
+	if arch == ArchX86_64 {
+		return qcli.NewSystemUEFIFirmwareDevice(secureBoot)
+	}
+	if desc, err := FindFirmwareDescriptor(arch, machineType, secureBoot); err == nil {
+		log.Infof("Firmware: UEFI descriptor %s: %s", desc.Path, desc.Description)
+		return &qcli.UEFIFirmwareDevice{
+			Code: desc.Mapping.Executable.Filename,
+			Vars: desc.Mapping.NVRAMTemplate.Filename,
+		}, nil
+	}
+	candidates := QemuArches[arch].UEFIFirmware
+	if secureBoot {
+		candidates = QemuArches[arch].SecureUEFIFirmware
+	}
+	for _, dev := range candidates {
+		if PathExists(dev.Code) && PathExists(dev.Vars) {
+			found := dev
+			return &found, nil
+		}
+	}
+	if secureBoot {
+		return nil, fmt.Errorf("secureboot requested, but no secureboot UEFI firmware for %s found", arch)
+	}
+	return nil, fmt.Errorf("no UEFI firmware for %s found, install the %s edk2 firmware or set firmware code and vars", arch, arch)
+}
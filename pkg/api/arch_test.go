@@ -0,0 +1,101 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+
+import (
+	"testing"
+)
+
+func TestGuestArch(t *testing.T) {
+	testCases := []struct {
+		arch string
+		want string
+		err  bool
+	}{
+		{arch: "", want: HostImageArch()},
+		{arch: ArchX86_64, want: ArchX86_64},
+		{arch: "amd64", want: ArchX86_64},
+		{arch: ArchAarch64, want: ArchAarch64},
+		{arch: "arm64", want: ArchAarch64},
+		{arch: ArchRiscv64, want: ArchRiscv64},
+		{arch: "s390x", err: true},
+	}
+
+	for _, tc := range testCases {
+		v := VMDef{Arch: tc.arch}
+		got, err := v.GuestArch()
+		if tc.err {
+			if err == nil {
+				t.Errorf("arch %q: expected an error, found %s", tc.arch, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("arch %q: unexpected error: %s", tc.arch, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("arch %q: guest arch %s, expected %s", tc.arch, got, tc.want)
+		}
+	}
+}
+
+func TestAccelerator(t *testing.T) {
+	// an architecture the host cannot run with kvm
+	foreign := ArchRiscv64
+	if HostImageArch() == ArchRiscv64 {
+		foreign = ArchX86_64
+	}
+	// auto falls back to tcg on hosts without kvm
+	native := AccelTCG
+	if KVMAvailable() {
+		native = AccelKVM
+	}
+
+	testCases := []struct {
+		name  string
+		accel string
+		arch  string
+		want  string
+		err   bool
+	}{
+		{name: "auto native", accel: AccelAuto, arch: HostImageArch(), want: native},
+		{name: "auto foreign", accel: AccelAuto, arch: foreign, want: AccelTCG},
+		{name: "default foreign", arch: foreign, want: AccelTCG},
+		{name: "tcg native", accel: AccelTCG, arch: HostImageArch(), want: AccelTCG},
+		{name: "tcg foreign", accel: AccelTCG, arch: foreign, want: AccelTCG},
+		{name: "kvm foreign", accel: AccelKVM, arch: foreign, err: true},
+		{name: "invalid", accel: "hvf", arch: foreign, err: true},
+	}
+	for _, tc := range testCases {
+		v := VMDef{Name: "vm1", Accel: tc.accel}
+		got, err := v.Accelerator(tc.arch)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, found %s", tc.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: accel %s, expected %s", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/raharper/qcli"
+)
+
+// Machine.Type selects the Backend which runs the machine.  kvm runs
+// machines as QEMU processes, fake simulates them in-process without
+// executing anything so the controller and REST API can be exercised.
+const (
+	BackendKVM     = "kvm"
+	BackendFake    = "fake"
+	DefaultBackend = BackendKVM
+)
+
+// Backend runs the machines of a machine type.  Create returns the Instance
+// of a machine, the other methods operate on instances the backend created.
+type Backend interface {
+	// Create returns a new instance of a machine, it is started with Start
+	Create(ctx context.Context, name string, config VMDef, opts InstanceOptions) (Instance, error)
+	Start(instance Instance) error
+	Stop(instance Instance, force bool) error
+	Status(instance Instance) VMState
+
+	// Console returns the path of the serial console socket of the
+	// running instance
+	Console(instance Instance) (string, error)
+
+	// QMP executes a QMP command on the running instance
+	QMP(instance Instance, command string, args map[string]interface{}) (json.RawMessage, error)
+}
+
+// InstanceOptions holds the machine callbacks and resolved settings an
+// instance is created with
+type InstanceOptions struct {
+	// called once a boot-once cdrom boot is complete
+	BootOnceFn func()
+
+	// called to restart the machine when swtpm fails with policy restart
+	TPMRestartFn func()
+
+	// resolved trust store dir of VMDef.TrustStore
+	TPMTrustStore string
+
+	// cgroup limits of the instance processes
+	Resources MachineResources
+}
+
+// Instance is a machine created by a Backend.  Features not every backend
+// has are optional interfaces an instance may implement, e.g. MediaInstance.
+type Instance interface {
+	Name() string
+	Delete() error
+	Fail(reason string)
+}
+
+// DiskInstance is an instance whose disks can be changed while it runs
+type DiskInstance interface {
+	AttachDisk(disk *QemuDisk) error
+	DetachDisk(disk *QemuDisk) error
+	ResizeDisk(disk *QemuDisk, size DiskSize, force bool) error
+	SetDiskThrottle(disk *QemuDisk, throttle DiskThrottle) error
+}
+
+// MediaInstance is an instance with removable media drives
+type MediaInstance interface {
+	ListMedia() ([]MediaInfo, error)
+	EjectMedia(diskID string, force bool) error
+	InsertMedia(diskID, file, format string, force bool) error
+}
+
+// SpiceInstance is an instance with a SPICE graphical console
+type SpiceInstance interface {
+	SpiceDevice() (qcli.SpiceDevice, error)
+}
+
+// TPMInstance is an instance which may have a software TPM
+type TPMInstance interface {
+	// TPMStatus returns the swtpm status, nil if the instance has no TPM
+	TPMStatus() *SwTPMStatus
+}
+
+// StatsInstance is an instance which reports its resource usage
+type StatsInstance interface {
+	// CgroupUsage returns the resource usage of the instance cgroup
+	CgroupUsage() (CgroupUsage, error)
+
+	// Stats samples the resource usage of the running instance
+	Stats() (MachineStats, error)
+}
+
+var (
+	backendsLock sync.Mutex
+	backends     = map[string]Backend{
+		BackendKVM:  &KVMBackend{},
+		BackendFake: &FakeBackend{},
+	}
+)
+
+// RegisterBackend adds or replaces the Backend of a machine type
+func RegisterBackend(machineType string, backend Backend) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backends[machineType] = backend
+}
+
+// GetBackend returns the Backend of a machine type, an empty type is kvm
+func GetBackend(machineType string) (Backend, error) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if machineType == "" {
+		machineType = DefaultBackend
+	}
+	backend, ok := backends[machineType]
+	if !ok {
+		types := []string{}
+		for name := range backends {
+			types = append(types, name)
+		}
+		sort.Strings(types)
+		return nil, fmt.Errorf("Unknown machine type '%s', expected one of [%s]", machineType, strings.Join(types, " "))
+	}
+	return backend, nil
+}
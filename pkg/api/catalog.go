@@ -0,0 +1,506 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// An image catalog is a YAML (or JSON) index published by a remote which maps
+// product names and aliases to per-architecture artifacts.
+//
+// products:
+//   - name: ubuntu/22.04
+//     aliases: [ubuntu/jammy, ubuntu/lts]
+//     description: Ubuntu 22.04 LTS cloud image
+//     artifacts:
+//       - arch: x86_64
+//         format: qcow2
+//         url: jammy-server-cloudimg-amd64.img
+//         sha256: 5f9a6c...
+//
+// Artifact URLs may be relative to the index URL.
+
+const (
+	ImageRemotesFile  = "remotes.yaml"
+	ImageCatalogIndex = "index.yaml"
+	ImageRefSeparator = ":"
+)
+
+type ImageRemote struct {
+	Name string `yaml:"name" json:"name"`
+	URL  string `yaml:"url" json:"url"`
+}
+
+type ImageCatalog struct {
+	Products []ImageProduct `yaml:"products" json:"products"`
+}
+
+type ImageProduct struct {
+	Name        string          `yaml:"name" json:"name"`
+	Aliases     []string        `yaml:"aliases,omitempty" json:"aliases,omitempty"`
+	Description string          `yaml:"description,omitempty" json:"description,omitempty"`
+	Artifacts   []ImageArtifact `yaml:"artifacts" json:"artifacts"`
+}
+
+type ImageArtifact struct {
+	Arch   string `yaml:"arch" json:"arch"`
+	Format string `yaml:"format" json:"format"`
+	URL    string `yaml:"url" json:"url"`
+	SHA256 string `yaml:"sha256" json:"sha256"`
+	Size   int64  `yaml:"size,omitempty" json:"size,omitempty"`
+}
+
+// ImageSearchResult is a single product/artifact match from a remote catalog.
+type ImageSearchResult struct {
+	Remote      string   `json:"remote"`
+	Name        string   `json:"name"`
+	Aliases     []string `json:"aliases"`
+	Description string   `json:"description"`
+	Arch        string   `json:"arch"`
+	Format      string   `json:"format"`
+	URL         string   `json:"url"`
+	SHA256      string   `json:"sha256"`
+	Size        int64    `json:"size"`
+}
+
+// LocalImage is a catalog artifact which has been downloaded and verified.
+type LocalImage struct {
+	Ref    string `json:"ref"`
+	Remote string `json:"remote"`
+	Name   string `json:"name"`
+	Arch   string `json:"arch"`
+	Format string `json:"format"`
+	SHA256 string `json:"sha256"`
+	Path   string `json:"path"`
+	Cached bool   `json:"cached"`
+}
+
+type ImageController struct {
+	Remotes []ImageRemote
+	lock    sync.Mutex
+}
+
+func (p *ImageProduct) Matches(name string) bool {
+	if p.Name == name {
+		return true
+	}
+	for _, alias := range p.Aliases {
+		if alias == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HostImageArch returns the QEMU architecture name for the host, which is
+// used as the default artifact architecture.
+func HostImageArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	case "386":
+		return "i386"
+	}
+	return runtime.GOARCH
+}
+
+// ParseImageRef splits an image reference, 'remote:alias', into its remote
+// and alias components.
+func ParseImageRef(ref string) (string, string, error) {
+	toks := strings.SplitN(ref, ImageRefSeparator, 2)
+	if len(toks) != 2 || toks[0] == "" || toks[1] == "" {
+		return "", "", fmt.Errorf("Invalid image reference '%s', expected <remote>:<alias>", ref)
+	}
+	return toks[0], toks[1], nil
+}
+
+// image artifact formats machines can use
+var imageFormats = []string{"qcow2", "raw"}
+
+var sha256Re = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// catalogTimeout bounds fetching a catalog index and waiting for the response
+// headers of an artifact download, the artifact body may take longer
+var catalogTimeout = time.Second * 30
+
+func isFileURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Scheme == "file"
+}
+
+// catalogClient returns the client of catalog fetches, only remotes the user
+// added with a file:// URL may read local files.  A timeout of 0 only limits
+// the wait for the response headers.
+func catalogClient(allowFile bool, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = catalogTimeout
+	if allowFile {
+		transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+func fetchURL(rawURL string, allowFile bool, timeout time.Duration) (io.ReadCloser, error) {
+	resp, err := catalogClient(allowFile, timeout).Get(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch %q: %s", rawURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Failed to fetch %q: %s", rawURL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// catalogIndexURL returns the URL of the catalog index for a remote.  A remote
+// URL may point at the index file itself or at the directory containing it.
+func catalogIndexURL(remoteURL string) string {
+	ext := filepath.Ext(remoteURL)
+	if ext == ".yaml" || ext == ".yml" || ext == ".json" {
+		return remoteURL
+	}
+	return strings.TrimSuffix(remoteURL, "/") + "/" + ImageCatalogIndex
+}
+
+func resolveArtifactURL(indexURL, artifactURL string) (string, error) {
+	base, err := url.Parse(indexURL)
+	if err != nil {
+		return "", fmt.Errorf("Invalid catalog URL %q: %s", indexURL, err)
+	}
+	ref, err := url.Parse(artifactURL)
+	if err != nil {
+		return "", fmt.Errorf("Invalid artifact URL %q: %s", artifactURL, err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+func (r *ImageRemote) FetchCatalog() (ImageCatalog, error) {
+	catalog := ImageCatalog{}
+	indexURL := catalogIndexURL(r.URL)
+	allowFile := isFileURL(r.URL)
+	body, err := fetchURL(indexURL, allowFile, catalogTimeout)
+	if err != nil {
+		return catalog, err
+	}
+	defer body.Close()
+
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return catalog, fmt.Errorf("Failed to read catalog from remote '%s': %s", r.Name, err)
+	}
+	// JSON is valid YAML, so a single unmarshal handles both index formats
+	if err := yaml.Unmarshal(content, &catalog); err != nil {
+		return catalog, fmt.Errorf("Failed to parse catalog from remote '%s': %s", r.Name, err)
+	}
+
+	for pIdx := range catalog.Products {
+		product := &catalog.Products[pIdx]
+		for aIdx := range product.Artifacts {
+			artifact := &product.Artifacts[aIdx]
+			artifactURL, err := resolveArtifactURL(indexURL, artifact.URL)
+			if err != nil {
+				return catalog, err
+			}
+			if isFileURL(artifactURL) && !allowFile {
+				return catalog, fmt.Errorf("Artifact URL %q of remote '%s' is a local file, only file:// remotes may use them", artifactURL, r.Name)
+			}
+			artifact.URL = artifactURL
+			if artifact.Format == "" {
+				artifact.Format = "qcow2"
+			}
+		}
+	}
+	return catalog, nil
+}
+
+func (ic *ImageController) RemotesFile(cfg *MachineDaemonConfig) string {
+	return filepath.Join(cfg.ConfigDirectory, ImageRemotesFile)
+}
+
+func (ic *ImageController) ImageCacheDir(cfg *MachineDaemonConfig) string {
+	return filepath.Join(cfg.DataDirectory, "images")
+}
+
+func (ic *ImageController) LoadRemotes(cfg *MachineDaemonConfig) error {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	remotesFile := ic.RemotesFile(cfg)
+	if !PathExists(remotesFile) {
+		return nil
+	}
+	content, err := ioutil.ReadFile(remotesFile)
+	if err != nil {
+		return fmt.Errorf("Error reading image remotes file %q: %s", remotesFile, err)
+	}
+	remotes := []ImageRemote{}
+	if err := yaml.Unmarshal(content, &remotes); err != nil {
+		return fmt.Errorf("Error unmarshaling image remotes file %q: %s", remotesFile, err)
+	}
+	ic.Remotes = remotes
+	return nil
+}
+
+func (ic *ImageController) saveRemotes(cfg *MachineDaemonConfig) error {
+	remotesFile := ic.RemotesFile(cfg)
+	if err := EnsureDir(filepath.Dir(remotesFile)); err != nil {
+		return err
+	}
+	content, err := yaml.Marshal(ic.Remotes)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal image remotes: %s", err)
+	}
+	if err := ioutil.WriteFile(remotesFile, content, 0644); err != nil {
+		return fmt.Errorf("Failed to write image remotes to %q: %s", remotesFile, err)
+	}
+	return nil
+}
+
+func (ic *ImageController) GetRemotes() []ImageRemote {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	return append([]ImageRemote{}, ic.Remotes...)
+}
+
+func (ic *ImageController) getRemote(remoteName string) (ImageRemote, error) {
+	for _, remote := range ic.Remotes {
+		if remote.Name == remoteName {
+			return remote, nil
+		}
+	}
+	return ImageRemote{}, fmt.Errorf("Failed to find image remote '%s'", remoteName)
+}
+
+func (ic *ImageController) AddRemote(newRemote ImageRemote, cfg *MachineDaemonConfig) error {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	if newRemote.Name == "" || strings.Contains(newRemote.Name, ImageRefSeparator) {
+		return fmt.Errorf("Invalid image remote name '%s'", newRemote.Name)
+	}
+	if _, err := url.Parse(newRemote.URL); err != nil || newRemote.URL == "" {
+		return fmt.Errorf("Invalid image remote URL '%s'", newRemote.URL)
+	}
+	if _, err := ic.getRemote(newRemote.Name); err == nil {
+		return fmt.Errorf("Image remote '%s' is already defined", newRemote.Name)
+	}
+	ic.Remotes = append(ic.Remotes, newRemote)
+	log.Infof("Added image remote '%s' -> %s", newRemote.Name, newRemote.URL)
+	return ic.saveRemotes(cfg)
+}
+
+func (ic *ImageController) DeleteRemote(remoteName string, cfg *MachineDaemonConfig) error {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	if _, err := ic.getRemote(remoteName); err != nil {
+		return err
+	}
+	remotes := []ImageRemote{}
+	for _, remote := range ic.Remotes {
+		if remote.Name != remoteName {
+			remotes = append(remotes, remote)
+		}
+	}
+	ic.Remotes = remotes
+	log.Infof("Deleted image remote '%s'", remoteName)
+	return ic.saveRemotes(cfg)
+}
+
+// SearchImages returns all artifacts whose product name or aliases contain
+// query.  An empty query matches everything, an empty arch matches all
+// architectures.
+func (ic *ImageController) SearchImages(query, arch string) ([]ImageSearchResult, error) {
+	results := []ImageSearchResult{}
+	remoteName := ""
+	if strings.Contains(query, ImageRefSeparator) {
+		remoteName, query, _ = strings.Cut(query, ImageRefSeparator)
+	}
+
+	for _, remote := range ic.GetRemotes() {
+		if remoteName != "" && remote.Name != remoteName {
+			continue
+		}
+		catalog, err := remote.FetchCatalog()
+		if err != nil {
+			return results, err
+		}
+		for _, product := range catalog.Products {
+			matched := strings.Contains(product.Name, query)
+			for _, alias := range product.Aliases {
+				if strings.Contains(alias, query) {
+					matched = true
+				}
+			}
+			if !matched {
+				continue
+			}
+			for _, artifact := range product.Artifacts {
+				if arch != "" && artifact.Arch != arch {
+					continue
+				}
+				results = append(results, ImageSearchResult{
+					Remote:      remote.Name,
+					Name:        product.Name,
+					Aliases:     product.Aliases,
+					Description: product.Description,
+					Arch:        artifact.Arch,
+					Format:      artifact.Format,
+					URL:         artifact.URL,
+					SHA256:      artifact.SHA256,
+					Size:        artifact.Size,
+				})
+			}
+		}
+	}
+	return results, nil
+}
+
+// ResolveImage looks up ref in the remote catalog and returns the local cached
+// copy of the artifact, downloading and verifying it if it is not yet cached.
+func (ic *ImageController) ResolveImage(ref, arch string, cfg *MachineDaemonConfig) (LocalImage, error) {
+	localImage := LocalImage{Ref: ref}
+	if arch == "" {
+		arch = HostImageArch()
+	}
+
+	remoteName, alias, err := ParseImageRef(ref)
+	if err != nil {
+		return localImage, err
+	}
+	ic.lock.Lock()
+	remote, err := ic.getRemote(remoteName)
+	ic.lock.Unlock()
+	if err != nil {
+		return localImage, err
+	}
+
+	catalog, err := remote.FetchCatalog()
+	if err != nil {
+		return localImage, err
+	}
+
+	var artifact *ImageArtifact
+	for pIdx := range catalog.Products {
+		product := catalog.Products[pIdx]
+		if !product.Matches(alias) {
+			continue
+		}
+		for aIdx := range product.Artifacts {
+			if product.Artifacts[aIdx].Arch == arch {
+				artifact = &product.Artifacts[aIdx]
+				localImage.Name = product.Name
+				break
+			}
+		}
+		break
+	}
+	if artifact == nil {
+		return localImage, fmt.Errorf("No image matching '%s' for arch %s on remote '%s'", alias, arch, remoteName)
+	}
+	if artifact.SHA256 == "" {
+		return localImage, fmt.Errorf("Image '%s' on remote '%s' has no sha256 digest", alias, remoteName)
+	}
+	// the digest and format name the cached file, so a remote must not be
+	// able to point them outside of the cache
+	digest := strings.ToLower(artifact.SHA256)
+	if !sha256Re.MatchString(digest) {
+		return localImage, fmt.Errorf("Image '%s' on remote '%s' has an invalid sha256 digest '%s'", alias, remoteName, artifact.SHA256)
+	}
+	validFormat := false
+	for _, format := range imageFormats {
+		if artifact.Format == format {
+			validFormat = true
+		}
+	}
+	if !validFormat {
+		return localImage, fmt.Errorf("Image '%s' on remote '%s' has unsupported format '%s', expected one of %v", alias, remoteName, artifact.Format, imageFormats)
+	}
+
+	localImage.Remote = remoteName
+	localImage.Arch = artifact.Arch
+	localImage.Format = artifact.Format
+	localImage.SHA256 = digest
+	cacheDir := ic.ImageCacheDir(cfg)
+	localImage.Path = filepath.Join(cacheDir, localImage.SHA256+"."+artifact.Format)
+	if filepath.Dir(localImage.Path) != filepath.Clean(cacheDir) {
+		return localImage, fmt.Errorf("Image '%s' cache path %s is outside of the image cache %s", ref, localImage.Path, cacheDir)
+	}
+
+	if PathExists(localImage.Path) {
+		log.Infof("Image '%s' found in cache: %s", ref, localImage.Path)
+		localImage.Cached = true
+		return localImage, nil
+	}
+
+	if err := downloadArtifact(artifact.URL, localImage.Path, localImage.SHA256, isFileURL(remote.URL)); err != nil {
+		return localImage, fmt.Errorf("Failed to download image '%s': %s", ref, err)
+	}
+	return localImage, nil
+}
+
+// downloadArtifact fetches srcURL into a temporary file next to dest and
+// only renames it into place once the sha256 digest matches.
+func downloadArtifact(srcURL, dest, digest string, allowFile bool) error {
+	if err := EnsureDir(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	body, err := fetchURL(srcURL, allowFile, 0)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(dest), ".download-*")
+	if err != nil {
+		return fmt.Errorf("Failed to create temp file for download: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	log.Infof("Downloading image %s -> %s", srcURL, dest)
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmpFile, hasher), body); err != nil {
+		return fmt.Errorf("Failed while downloading %q: %s", srcURL, err)
+	}
+	found := hex.EncodeToString(hasher.Sum(nil))
+	if found != digest {
+		return fmt.Errorf("sha256 mismatch for %q: expected %s found %s", srcURL, digest, found)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), dest)
+}
@@ -0,0 +1,358 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testImage = []byte("qcow2 image content")
+
+func testImageDigest() string {
+	sum := sha256.Sum256(testImage)
+	return hex.EncodeToString(sum[:])
+}
+
+// testCatalogIndex returns a catalog index with an artifact url relative to
+// the index and one absolute url
+func testCatalogIndex(absoluteURL string) string {
+	return fmt.Sprintf(`products:
+  - name: ubuntu/22.04
+    aliases: [ubuntu/jammy, ubuntu/lts]
+    description: Ubuntu 22.04 LTS
+    artifacts:
+      - arch: x86_64
+        url: images/jammy-amd64.img
+        sha256: %s
+      - arch: aarch64
+        format: raw
+        url: %s
+        sha256: %s
+  - name: broken/digest
+    artifacts:
+      - arch: x86_64
+        url: images/jammy-amd64.img
+        sha256: ../../etc/passwd
+  - name: broken/format
+    artifacts:
+      - arch: x86_64
+        format: vmdk
+        url: images/jammy-amd64.img
+        sha256: %s
+  - name: broken/mismatch
+    artifacts:
+      - arch: x86_64
+        url: images/jammy-amd64.img
+        sha256: %s
+`, testImageDigest(), absoluteURL, testImageDigest(), testImageDigest(), strings.Repeat("0", 64))
+}
+
+// newTestCatalogServer serves the test catalog at /catalog/index.yaml and
+// counts the image downloads
+func newTestCatalogServer(t *testing.T, downloads *int) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/catalog/index.yaml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testCatalogIndex("http://"+r.Host+"/other/jammy-arm64.img"))
+	})
+	mux.HandleFunc("/catalog/images/jammy-amd64.img", func(w http.ResponseWriter, r *http.Request) {
+		*downloads++
+		w.Write(testImage)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// writeTestCatalogDir writes the test catalog to a dir for file:// remotes
+func writeTestCatalogDir(t *testing.T, absoluteURL string) string {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "images"), 0755); err != nil {
+		t.Fatalf("failed to create catalog dir: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.yaml"), []byte(testCatalogIndex(absoluteURL)), 0644); err != nil {
+		t.Fatalf("failed to write catalog index: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "images", "jammy-amd64.img"), testImage, 0644); err != nil {
+		t.Fatalf("failed to write catalog image: %s", err)
+	}
+	return dir
+}
+
+func newTestImageController(t *testing.T, remotes ...ImageRemote) (*ImageController, *MachineDaemonConfig) {
+	cfg := &MachineDaemonConfig{ConfigDirectory: t.TempDir(), DataDirectory: t.TempDir()}
+	ic := &ImageController{}
+	for _, remote := range remotes {
+		if err := ic.AddRemote(remote, cfg); err != nil {
+			t.Fatalf("AddRemote failed: %s", err)
+		}
+	}
+	return ic, cfg
+}
+
+func TestParseImageRef(t *testing.T) {
+	testCases := []struct {
+		ref    string
+		remote string
+		alias  string
+		err    bool
+	}{
+		{ref: "images:ubuntu/22.04", remote: "images", alias: "ubuntu/22.04"},
+		{ref: "local:a:b", remote: "local", alias: "a:b"},
+		{ref: "ubuntu", err: true},
+		{ref: ":ubuntu", err: true},
+		{ref: "images:", err: true},
+	}
+
+	for _, tc := range testCases {
+		remote, alias, err := ParseImageRef(tc.ref)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expected an error parsing %q", tc.ref)
+			}
+			continue
+		}
+		if err != nil || remote != tc.remote || alias != tc.alias {
+			t.Errorf("parsed %q as %q %q %v, expected %q %q", tc.ref, remote, alias, err, tc.remote, tc.alias)
+		}
+	}
+}
+
+func TestCatalogIndexURL(t *testing.T) {
+	testCases := map[string]string{
+		"https://example.com/catalog":            "https://example.com/catalog/index.yaml",
+		"https://example.com/catalog/":           "https://example.com/catalog/index.yaml",
+		"https://example.com/catalog/index.json": "https://example.com/catalog/index.json",
+		"file:///srv/catalog/custom.yml":         "file:///srv/catalog/custom.yml",
+	}
+	for remoteURL, want := range testCases {
+		if got := catalogIndexURL(remoteURL); got != want {
+			t.Errorf("index URL of %s is %s, expected %s", remoteURL, got, want)
+		}
+	}
+}
+
+func TestFetchCatalog(t *testing.T) {
+	downloads := 0
+	server := newTestCatalogServer(t, &downloads)
+	remote := ImageRemote{Name: "images", URL: server.URL + "/catalog"}
+
+	catalog, err := remote.FetchCatalog()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(catalog.Products) != 4 {
+		t.Fatalf("fetched %d products, expected 4", len(catalog.Products))
+	}
+	product := catalog.Products[0]
+	if !product.Matches("ubuntu/22.04") || !product.Matches("ubuntu/lts") || product.Matches("ubuntu") {
+		t.Errorf("product %s matches the wrong names", product.Name)
+	}
+	want := []ImageArtifact{
+		{Arch: "x86_64", Format: "qcow2", URL: server.URL + "/catalog/images/jammy-amd64.img", SHA256: testImageDigest()},
+		{Arch: "aarch64", Format: "raw", URL: server.URL + "/other/jammy-arm64.img", SHA256: testImageDigest()},
+	}
+	if len(product.Artifacts) != len(want) {
+		t.Fatalf("product has %d artifacts, expected %d", len(product.Artifacts), len(want))
+	}
+	for idx := range want {
+		if product.Artifacts[idx] != want[idx] {
+			t.Errorf("artifact %d is %+v, expected %+v", idx, product.Artifacts[idx], want[idx])
+		}
+	}
+
+	missing := ImageRemote{Name: "missing", URL: server.URL + "/missing"}
+	if _, err := missing.FetchCatalog(); err == nil {
+		t.Errorf("expected an error fetching a missing catalog")
+	}
+}
+
+func TestFetchCatalogFile(t *testing.T) {
+	dir := writeTestCatalogDir(t, "file:///srv/other/jammy-arm64.img")
+	remote := ImageRemote{Name: "local", URL: "file://" + dir}
+
+	catalog, err := remote.FetchCatalog()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	artifacts := catalog.Products[0].Artifacts
+	if want := "file://" + dir + "/images/jammy-amd64.img"; artifacts[0].URL != want {
+		t.Errorf("relative artifact URL resolved to %s, expected %s", artifacts[0].URL, want)
+	}
+	if want := "file:///srv/other/jammy-arm64.img"; artifacts[1].URL != want {
+		t.Errorf("absolute artifact URL resolved to %s, expected %s", artifacts[1].URL, want)
+	}
+}
+
+func TestFetchCatalogRejectsFileArtifacts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testCatalogIndex("file:///etc/shadow"))
+	}))
+	defer server.Close()
+
+	remote := ImageRemote{Name: "images", URL: server.URL + "/index.yaml"}
+	if _, err := remote.FetchCatalog(); err == nil {
+		t.Errorf("expected an error for a file:// artifact of an http remote")
+	}
+	// file:// redirects are not followed either
+	redirect := httptest.NewServer(http.RedirectHandler("file:///etc/passwd", http.StatusFound))
+	defer redirect.Close()
+	remote = ImageRemote{Name: "redirect", URL: redirect.URL}
+	if _, err := remote.FetchCatalog(); err == nil {
+		t.Errorf("expected an error for a file:// redirect of an http remote")
+	}
+}
+
+func TestFetchCatalogTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(time.Second * 10):
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	timeout := catalogTimeout
+	catalogTimeout = time.Millisecond * 100
+	defer func() { catalogTimeout = timeout }()
+
+	remote := ImageRemote{Name: "slow", URL: server.URL}
+	start := time.Now()
+	if _, err := remote.FetchCatalog(); err == nil {
+		t.Errorf("expected an error fetching from a stalled remote")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Errorf("fetch took %s, expected it to time out", elapsed)
+	}
+}
+
+func TestSearchImages(t *testing.T) {
+	downloads := 0
+	server := newTestCatalogServer(t, &downloads)
+	ic, _ := newTestImageController(t,
+		ImageRemote{Name: "images", URL: server.URL + "/catalog"},
+		ImageRemote{Name: "local", URL: "file://" + writeTestCatalogDir(t, "file:///srv/jammy-arm64.img")})
+
+	testCases := []struct {
+		query string
+		arch  string
+		want  int
+	}{
+		{query: "", want: 10},
+		{query: "jammy", want: 4},
+		{query: "jammy", arch: "aarch64", want: 2},
+		{query: "images:lts", want: 2},
+		{query: "local:broken", want: 3},
+		{query: "fedora", want: 0},
+	}
+	for _, tc := range testCases {
+		results, err := ic.SearchImages(tc.query, tc.arch)
+		if err != nil {
+			t.Fatalf("search %q failed: %s", tc.query, err)
+		}
+		if len(results) != tc.want {
+			t.Errorf("search %q arch %q found %d artifacts, expected %d", tc.query, tc.arch, len(results), tc.want)
+		}
+	}
+}
+
+func TestResolveImage(t *testing.T) {
+	downloads := 0
+	server := newTestCatalogServer(t, &downloads)
+	ic, cfg := newTestImageController(t, ImageRemote{Name: "images", URL: server.URL + "/catalog"})
+
+	image, err := ic.ResolveImage("images:ubuntu/jammy", "x86_64", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	wantPath := filepath.Join(cfg.DataDirectory, "images", testImageDigest()+".qcow2")
+	if image.Path != wantPath || image.Name != "ubuntu/22.04" || image.Remote != "images" || image.Cached {
+		t.Errorf("resolved %+v, expected a download to %s", image, wantPath)
+	}
+	content, err := os.ReadFile(image.Path)
+	if err != nil || string(content) != string(testImage) {
+		t.Errorf("cached image content %q, err %v", content, err)
+	}
+
+	image, err = ic.ResolveImage("images:ubuntu/22.04", "x86_64", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !image.Cached || image.Path != wantPath {
+		t.Errorf("second resolve %+v, expected the cached image", image)
+	}
+	if downloads != 1 {
+		t.Errorf("image downloaded %d times, expected once", downloads)
+	}
+}
+
+func TestResolveImageFile(t *testing.T) {
+	dir := writeTestCatalogDir(t, "file:///srv/jammy-arm64.img")
+	ic, cfg := newTestImageController(t, ImageRemote{Name: "local", URL: "file://" + dir})
+
+	image, err := ic.ResolveImage("local:ubuntu/lts", "x86_64", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	content, err := os.ReadFile(image.Path)
+	if err != nil || string(content) != string(testImage) {
+		t.Errorf("cached image content %q, err %v", content, err)
+	}
+}
+
+func TestResolveImageErrors(t *testing.T) {
+	downloads := 0
+	server := newTestCatalogServer(t, &downloads)
+	ic, cfg := newTestImageController(t, ImageRemote{Name: "images", URL: server.URL + "/catalog"})
+
+	testCases := []struct {
+		name string
+		ref  string
+		arch string
+	}{
+		{name: "invalid ref", ref: "ubuntu", arch: "x86_64"},
+		{name: "unknown remote", ref: "other:ubuntu/lts", arch: "x86_64"},
+		{name: "unknown image", ref: "images:fedora", arch: "x86_64"},
+		{name: "unknown arch", ref: "images:ubuntu/lts", arch: "riscv64"},
+		{name: "invalid digest", ref: "images:broken/digest", arch: "x86_64"},
+		{name: "unsupported format", ref: "images:broken/format", arch: "x86_64"},
+		{name: "digest mismatch", ref: "images:broken/mismatch", arch: "x86_64"},
+	}
+	for _, tc := range testCases {
+		if _, err := ic.ResolveImage(tc.ref, tc.arch, cfg); err == nil {
+			t.Errorf("%s: expected an error resolving %s", tc.name, tc.ref)
+		}
+	}
+
+	// a failed download leaves nothing in the cache
+	entries, err := os.ReadDir(filepath.Join(cfg.DataDirectory, "images"))
+	if err != nil {
+		t.Fatalf("failed to read image cache: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("image cache has %d entries after failed resolves", len(entries))
+	}
+}
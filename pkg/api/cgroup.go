@@ -0,0 +1,357 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	CgroupRoot = "/sys/fs/cgroup"
+
+	// machined moves itself into this leaf of its cgroup so machine cgroups
+	// can be created next to it, cgroup v2 only allows processes in leaves
+	cgroupDaemonLeaf = "machined"
+	cgroupMachines   = "machines"
+
+	// cpu.max period, CPUQuota is a percentage of it
+	cgroupCPUPeriod = 100000
+)
+
+var cgroupControllers = []string{"cpu", "memory", "io", "pids"}
+
+// MachineResources limits the QEMU, swtpm and virtiofsd processes of a
+// machine through its cgroup.  CPUWeight and IOWeight are 1-10000 (default
+// 100), CPUQuota is a percentage of one host cpu, e.g. 250% for two and a half
+// cpus, MemoryMax a size like 8GiB and PidsMax the number of tasks.
+type MachineResources struct {
+	CPUWeight uint64 `yaml:"cpu-weight,omitempty"`
+	CPUQuota  string `yaml:"cpu-quota,omitempty"`
+	MemoryMax string `yaml:"memory-max,omitempty"`
+	IOWeight  uint64 `yaml:"io-weight,omitempty"`
+	PidsMax   uint64 `yaml:"pids-max,omitempty"`
+}
+
+// IsSet reports if any resource limit is set
+func (r *MachineResources) IsSet() bool {
+	return *r != MachineResources{}
+}
+
+// cgroupFiles returns the cgroup interface files and values of the limits
+func (r *MachineResources) cgroupFiles() (map[string]string, error) {
+	files := make(map[string]string)
+	errors := []string{}
+
+	if r.CPUWeight > 0 {
+		if r.CPUWeight > 10000 {
+			errors = append(errors, fmt.Sprintf("invalid cpu-weight %d, expected 1-10000", r.CPUWeight))
+		}
+		files["cpu.weight"] = fmt.Sprintf("%d", r.CPUWeight)
+	}
+	if r.CPUQuota != "" {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(r.CPUQuota, "%"), 64)
+		if err != nil || percent <= 0 {
+			errors = append(errors, fmt.Sprintf("invalid cpu-quota '%s', expected a percentage like 150%%", r.CPUQuota))
+		} else {
+			files["cpu.max"] = fmt.Sprintf("%d %d", uint64(percent*cgroupCPUPeriod/100), cgroupCPUPeriod)
+		}
+	}
+	if r.MemoryMax != "" {
+		size, err := humanize.ParseBytes(r.MemoryMax)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("invalid memory-max '%s': %s", r.MemoryMax, err))
+		} else {
+			files["memory.max"] = fmt.Sprintf("%d", size)
+		}
+	}
+	if r.IOWeight > 0 {
+		if r.IOWeight > 10000 {
+			errors = append(errors, fmt.Sprintf("invalid io-weight %d, expected 1-10000", r.IOWeight))
+		}
+		files["io.weight"] = fmt.Sprintf("default %d", r.IOWeight)
+	}
+	if r.PidsMax > 0 {
+		files["pids.max"] = fmt.Sprintf("%d", r.PidsMax)
+	}
+
+	if len(errors) != 0 {
+		return files, fmt.Errorf("bad resources: %s", strings.Join(errors, "\n"))
+	}
+	return files, nil
+}
+
+// Validate checks the resource limits
+func (r *MachineResources) Validate() error {
+	_, err := r.cgroupFiles()
+	return err
+}
+
+// CgroupUsage is the resource usage of a machine cgroup
+type CgroupUsage struct {
+	Path             string `json:"path"`
+	CPUUsageUsec     uint64 `json:"cpu-usage-usec"`
+	CPUUserUsec      uint64 `json:"cpu-user-usec"`
+	CPUSystemUsec    uint64 `json:"cpu-system-usec"`
+	CPUThrottledUsec uint64 `json:"cpu-throttled-usec"`
+	MemoryCurrent    uint64 `json:"memory-current"`
+	MemoryMax        string `json:"memory-max"`
+	OOMKills         uint64 `json:"oom-kills"`
+	IOReadBytes      uint64 `json:"io-read-bytes"`
+	IOWriteBytes     uint64 `json:"io-write-bytes"`
+	PidsCurrent      uint64 `json:"pids-current"`
+	PidsMax          string `json:"pids-max"`
+}
+
+var (
+	machinesCgroupLock sync.Mutex
+	machinesCgroupDir  string
+)
+
+// selfCgroup returns the cgroup v2 path of machined
+func selfCgroup() (string, error) {
+	content, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", fmt.Errorf("machined is not in a cgroup v2 hierarchy")
+}
+
+func readCgroupFile(dir, name string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	return strings.TrimSpace(string(content)), err
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("Failed to write '%s' to %s: %s", value, filepath.Join(dir, name), err)
+	}
+	return nil
+}
+
+// enableControllers enables the available cgroupControllers for the children
+// of dir
+func enableControllers(dir string) error {
+	available, err := readCgroupFile(dir, "cgroup.controllers")
+	if err != nil {
+		return err
+	}
+	enable := []string{}
+	for _, controller := range cgroupControllers {
+		for _, name := range strings.Fields(available) {
+			if name == controller {
+				enable = append(enable, "+"+controller)
+			}
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	return writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(enable, " "))
+}
+
+// machinesCgroup returns the cgroup holding the machine cgroups, the
+// machines child of the cgroup systemd delegated to machined.  The first
+// call moves machined into a leaf cgroup next to it.
+func machinesCgroup() (string, error) {
+	machinesCgroupLock.Lock()
+	defer machinesCgroupLock.Unlock()
+
+	if machinesCgroupDir != "" {
+		return machinesCgroupDir, nil
+	}
+	if !PathExists(filepath.Join(CgroupRoot, "cgroup.controllers")) {
+		return "", fmt.Errorf("cgroup v2 is not mounted at %s", CgroupRoot)
+	}
+	self, err := selfCgroup()
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Join(CgroupRoot, self)
+	if filepath.Base(self) == cgroupDaemonLeaf {
+		base = filepath.Dir(base)
+	} else if self != "/" {
+		// the root cgroup is exempt from the leaf rule
+		leaf := filepath.Join(base, cgroupDaemonLeaf)
+		if err := EnsureDir(leaf); err != nil {
+			return "", fmt.Errorf("Failed to create cgroup %s, is the cgroup of machined delegated? %s", leaf, err)
+		}
+		procs, err := readCgroupFile(base, "cgroup.procs")
+		if err != nil {
+			return "", err
+		}
+		for _, pid := range strings.Fields(procs) {
+			if err := writeCgroupFile(leaf, "cgroup.procs", pid); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := enableControllers(base); err != nil {
+		return "", err
+	}
+	machines := filepath.Join(base, cgroupMachines)
+	if err := EnsureDir(machines); err != nil {
+		return "", fmt.Errorf("Failed to create cgroup %s: %s", machines, err)
+	}
+	if err := enableControllers(machines); err != nil {
+		return "", err
+	}
+	log.Infof("machine cgroups in %s", machines)
+	machinesCgroupDir = machines
+	return machinesCgroupDir, nil
+}
+
+// MachineCgroup is the cgroup of a running machine
+type MachineCgroup struct {
+	Path string
+}
+
+// NewMachineCgroup creates the cgroup of a machine and applies its limits
+func NewMachineCgroup(machineName string, resources MachineResources) (*MachineCgroup, error) {
+	files, err := resources.cgroupFiles()
+	if err != nil {
+		return nil, err
+	}
+	machines, err := machinesCgroup()
+	if err != nil {
+		return nil, err
+	}
+	cg := &MachineCgroup{Path: filepath.Join(machines, machineName)}
+	if err := EnsureDir(cg.Path); err != nil {
+		return nil, fmt.Errorf("Failed to create cgroup %s: %s", cg.Path, err)
+	}
+	for name, value := range files {
+		if !PathExists(filepath.Join(cg.Path, name)) {
+			controller := strings.Split(name, ".")[0]
+			return nil, fmt.Errorf("cgroup controller %s is not available in %s", controller, machines)
+		}
+		if err := writeCgroupFile(cg.Path, name, value); err != nil {
+			return nil, err
+		}
+	}
+	return cg, nil
+}
+
+// StartCommand starts cmd inside the cgroup, the process is cloned into it
+// so its limits apply from its first instruction.  A nil cgroup starts cmd
+// in the cgroup of machined.
+func (cg *MachineCgroup) StartCommand(cmd *exec.Cmd) error {
+	if cg == nil {
+		return cmd.Start()
+	}
+	dir, err := os.Open(cg.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to open cgroup %s: %s", cg.Path, err)
+	}
+	defer dir.Close()
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return cmd.Start()
+}
+
+// Remove removes the cgroup once its processes have exited
+func (cg *MachineCgroup) Remove() error {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		if err = os.Remove(cg.Path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("Failed to remove cgroup %s: %s", cg.Path, err)
+}
+
+// readKeyedFile returns the values of a flat keyed cgroup file like cpu.stat
+func readKeyedFile(dir, name string) map[string]uint64 {
+	values := make(map[string]uint64)
+	content, err := readCgroupFile(dir, name)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = value
+		}
+	}
+	return values
+}
+
+// Usage returns the resource usage of the cgroup, missing files of
+// unavailable controllers are reported as zero.
+func (cg *MachineCgroup) Usage() (CgroupUsage, error) {
+	if !PathExists(cg.Path) {
+		return CgroupUsage{}, fmt.Errorf("cgroup %s does not exist", cg.Path)
+	}
+	usage := CgroupUsage{Path: cg.Path}
+
+	cpuStat := readKeyedFile(cg.Path, "cpu.stat")
+	usage.CPUUsageUsec = cpuStat["usage_usec"]
+	usage.CPUUserUsec = cpuStat["user_usec"]
+	usage.CPUSystemUsec = cpuStat["system_usec"]
+	usage.CPUThrottledUsec = cpuStat["throttled_usec"]
+
+	if value, err := readCgroupFile(cg.Path, "memory.current"); err == nil {
+		usage.MemoryCurrent, _ = strconv.ParseUint(value, 10, 64)
+	}
+	usage.MemoryMax, _ = readCgroupFile(cg.Path, "memory.max")
+	usage.OOMKills = readKeyedFile(cg.Path, "memory.events")["oom_kill"]
+
+	// io.stat has a line of key=value pairs per device
+	if content, err := readCgroupFile(cg.Path, "io.stat"); err == nil {
+		for _, field := range strings.Fields(content) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			count, _ := strconv.ParseUint(value, 10, 64)
+			switch key {
+			case "rbytes":
+				usage.IOReadBytes += count
+			case "wbytes":
+				usage.IOWriteBytes += count
+			}
+		}
+	}
+
+	if value, err := readCgroupFile(cg.Path, "pids.current"); err == nil {
+		usage.PidsCurrent, _ = strconv.ParseUint(value, 10, 64)
+	}
+	usage.PidsMax, _ = readCgroupFile(cg.Path, "pids.max")
+	return usage, nil
+}
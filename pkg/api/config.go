@@ -18,16 +18,57 @@ package api
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
 )
 
+// MachineDaemonConfig is the machined configuration, merged from defaults,
+// the config file, MACHINED_* environment variables and flags.  The dirs,
+// socket-path and metrics-address are used at startup, the other settings
+// are applied on reload.
 type MachineDaemonConfig struct {
-	ConfigDirectory string
-	DataDirectory   string
-	StateDirectory  string
+	ConfigDirectory string `yaml:"config-dir" json:"config-dir" mapstructure:"config-dir"`
+	DataDirectory   string `yaml:"data-dir" json:"data-dir" mapstructure:"data-dir"`
+	StateDirectory  string `yaml:"state-dir" json:"state-dir" mapstructure:"state-dir"`
+	SocketPath      string `yaml:"socket-path" json:"socket-path" mapstructure:"socket-path"`
+
+	// QEMU binary of host architecture guests, searched for if empty
+	QemuBinary string `yaml:"qemu-binary" json:"qemu-binary" mapstructure:"qemu-binary"`
+
+	// spice displays listen on SpiceAddress on the first free port of
+	// SpicePorts, a range like 5900-5999
+	SpiceAddress string `yaml:"spice-address" json:"spice-address" mapstructure:"spice-address"`
+	SpicePorts   string `yaml:"spice-ports" json:"spice-ports" mapstructure:"spice-ports"`
+
+	// seconds a machine gets to power off before it is killed, and machined
+	// waits for its server to stop on exit
+	StopTimeout     int `yaml:"stop-timeout" json:"stop-timeout" mapstructure:"stop-timeout"`
+	ShutdownTimeout int `yaml:"shutdown-timeout" json:"shutdown-timeout" mapstructure:"shutdown-timeout"`
+
+	LogLevel string `yaml:"log-level" json:"log-level" mapstructure:"log-level"`
+
+	// TCP address of the prometheus metrics listener, e.g. 127.0.0.1:9101,
+	// metrics are disabled if empty
+	MetricsAddress string `yaml:"metrics-address" json:"metrics-address" mapstructure:"metrics-address"`
 }
 
+const (
+	MachineDaemonConfigName = "machined.yaml"
+	DefaultSpiceAddress     = "127.0.0.1"
+	DefaultSpicePorts       = "5900-5999"
+	DefaultStopTimeout      = 10
+	DefaultShutdownTimeout  = 30
+	DefaultLogLevel         = "info"
+)
+
 var (
 	mdcCtx         = "mdc-context"
 	mdcCtxConfDir  = mdcCtx + "-confdir"
@@ -35,8 +76,31 @@ var (
 	mdcCtxStateDir = mdcCtx + "-statedir"
 )
 
+// system-wide dirs of machined running as a service account, see SystemMode
+const (
+	SystemConfigDir      = "/etc"
+	SystemDataDir        = "/var/lib"
+	SystemRuntimeDir     = "/run"
+	MachineSystemModeEnv = "MACHINED_SYSTEM"
+)
+
+var systemMode bool
+
+// the settings of the running daemon used by VMs, see SetDaemonConfig
+var (
+	daemonConfigLock sync.RWMutex
+	daemonConfig     *MachineDaemonConfig
+)
+
 func DefaultMachineDaemonConfig() *MachineDaemonConfig {
 	cfg := MachineDaemonConfig{}
+	if SystemMode() {
+		cfg.ConfigDirectory = filepath.Join(SystemConfigDir, "machine")
+		cfg.DataDirectory = filepath.Join(SystemDataDir, "machine")
+		cfg.StateDirectory = filepath.Join(SystemDataDir, "machine", "state")
+		cfg.setDefaults()
+		return &cfg
+	}
 	udd, err := UserDataDir()
 	if err != nil {
 		panic(fmt.Sprintf("Error getting user data dir: %s", err))
@@ -52,9 +116,112 @@ func DefaultMachineDaemonConfig() *MachineDaemonConfig {
 	cfg.ConfigDirectory = filepath.Join(ucd, "machine")
 	cfg.DataDirectory = filepath.Join(udd, "machine")
 	cfg.StateDirectory = filepath.Join(usd, "machine")
+	cfg.setDefaults()
 	return &cfg
 }
 
+// setDefaults sets the defaults of the settings other than the dirs
+func (c *MachineDaemonConfig) setDefaults() {
+	c.SocketPath = APISocketPath()
+	c.SpiceAddress = DefaultSpiceAddress
+	c.SpicePorts = DefaultSpicePorts
+	c.StopTimeout = DefaultStopTimeout
+	c.ShutdownTimeout = DefaultShutdownTimeout
+	c.LogLevel = DefaultLogLevel
+}
+
+// parsePortRange parses a port range like 5900-5999 or a single port
+func parsePortRange(ports string) (int, int, error) {
+	firstStr, lastStr, found := strings.Cut(ports, "-")
+	if !found {
+		lastStr = firstStr
+	}
+	first, err := strconv.Atoi(strings.TrimSpace(firstStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range '%s': %s", ports, err)
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(lastStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range '%s': %s", ports, err)
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid port range '%s', expected first-last within 1-65535", ports)
+	}
+	return first, last, nil
+}
+
+// Validate checks the settings of the config
+func (c *MachineDaemonConfig) Validate() error {
+	errors := []string{}
+	for name, dir := range map[string]string{"config-dir": c.ConfigDirectory, "data-dir": c.DataDirectory, "state-dir": c.StateDirectory} {
+		if dir == "" || !filepath.IsAbs(dir) {
+			errors = append(errors, fmt.Sprintf("%s must be an absolute path, got '%s'", name, dir))
+		}
+	}
+	if c.SocketPath == "" || len(c.SocketPath) >= LinuxUnixSocketMaxLen {
+		errors = append(errors, fmt.Sprintf("socket-path '%s' must be set and shorter than %d", c.SocketPath, LinuxUnixSocketMaxLen))
+	}
+	if c.QemuBinary != "" && !PathExists(c.QemuBinary) {
+		errors = append(errors, fmt.Sprintf("qemu-binary %s does not exist", c.QemuBinary))
+	}
+	if net.ParseIP(c.SpiceAddress) == nil {
+		errors = append(errors, fmt.Sprintf("invalid spice-address '%s'", c.SpiceAddress))
+	}
+	if _, _, err := parsePortRange(c.SpicePorts); err != nil {
+		errors = append(errors, fmt.Sprintf("spice-ports: %s", err))
+	}
+	if c.StopTimeout < 1 {
+		errors = append(errors, fmt.Sprintf("stop-timeout must be at least 1 second, got %d", c.StopTimeout))
+	}
+	if c.ShutdownTimeout < 1 {
+		errors = append(errors, fmt.Sprintf("shutdown-timeout must be at least 1 second, got %d", c.ShutdownTimeout))
+	}
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		errors = append(errors, fmt.Sprintf("log-level: %s", err))
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			errors = append(errors, fmt.Sprintf("metrics-address: %s", err))
+		}
+	}
+	if len(errors) != 0 {
+		sort.Strings(errors)
+		return fmt.Errorf("bad machined config: %s", strings.Join(errors, "\n"))
+	}
+	return nil
+}
+
+// SetDaemonConfig makes cfg the settings of the running daemon and applies
+// its log level
+func SetDaemonConfig(cfg *MachineDaemonConfig) {
+	daemonConfigLock.Lock()
+	defer daemonConfigLock.Unlock()
+
+	current := *cfg
+	daemonConfig = &current
+	if level, err := log.ParseLevel(cfg.LogLevel); err == nil {
+		log.SetLevel(level)
+	}
+}
+
+// currentDaemonConfig returns the settings of the running daemon, or the
+// defaults when no daemon config was set
+func currentDaemonConfig() MachineDaemonConfig {
+	daemonConfigLock.RLock()
+	defer daemonConfigLock.RUnlock()
+
+	if daemonConfig == nil {
+		return MachineDaemonConfig{
+			SpiceAddress:    DefaultSpiceAddress,
+			SpicePorts:      DefaultSpicePorts,
+			StopTimeout:     DefaultStopTimeout,
+			ShutdownTimeout: DefaultShutdownTimeout,
+			LogLevel:        DefaultLogLevel,
+		}
+	}
+	return *daemonConfig
+}
+
 func (c *MachineDaemonConfig) GetConfigContext() context.Context {
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, mdcCtxConfDir, c.ConfigDirectory)
@@ -63,32 +230,83 @@ func (c *MachineDaemonConfig) GetConfigContext() context.Context {
 	return ctx
 }
 
-// FIXME: read from ENV variables before using fallback values
-//  XDG_DATA_HOME
-func UserDataDir() (string, error) {
+// xdgDir returns the XDG base directory of env, or its default relative to
+// the home directory.  Relative paths in env are invalid and ignored.
+func xdgDir(env string, defaultDir ...string) (string, error) {
+	if dir := os.Getenv(env); dir != "" && filepath.IsAbs(dir) {
+		return dir, nil
+	}
 	p, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(p, ".local", "share"), nil
+	return filepath.Join(append([]string{p}, defaultDir...)...), nil
 }
 
-// FIXME: read from ENV variables before using fallback values
-//  XDG_CONFIG_HOME
+// UserDataDir returns $XDG_DATA_HOME, default ~/.local/share
+func UserDataDir() (string, error) {
+	return xdgDir("XDG_DATA_HOME", ".local", "share")
+}
+
+// UserConfigDir returns $XDG_CONFIG_HOME, default ~/.config
 func UserConfigDir() (string, error) {
-	p, err := os.UserHomeDir()
-	if err != nil {
-		return "", err
-	}
-	return filepath.Join(p, ".config"), nil
+	return xdgDir("XDG_CONFIG_HOME", ".config")
 }
 
-// FIXME: read from ENV variables before using fallback values
-//  XDG_STATE_HOME
+// UserStateDir returns $XDG_STATE_HOME, default ~/.local/state
 func UserStateDir() (string, error) {
-	p, err := os.UserHomeDir()
+	return xdgDir("XDG_STATE_HOME", ".local", "state")
+}
+
+// UserRuntimeDir returns $XDG_RUNTIME_DIR.  If it is not set the fallback is
+// a directory in the temp dir only accessible by the user.
+func UserRuntimeDir() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	uid := os.Getuid()
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("machine-runtime-%d", uid))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("Failed to create runtime dir %s: %s", dir, err)
+	}
+	// another user may have created it first
+	info, err := os.Lstat(dir)
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(p, ".local", "state"), nil
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != uid || info.Mode().Perm() != 0700 {
+		return "", fmt.Errorf("XDG_RUNTIME_DIR is not set and %s is not a directory private to uid %d", dir, uid)
+	}
+	log.Debugf("XDG_RUNTIME_DIR is not set, using %s", dir)
+	return dir, nil
+}
+
+// SystemMode reports if machined and the machine client use the system-wide
+// dirs, set with SetSystemMode or MACHINED_SYSTEM=true
+func SystemMode() bool {
+	if systemMode {
+		return true
+	}
+	system, _ := strconv.ParseBool(os.Getenv(MachineSystemModeEnv))
+	return system
+}
+
+// SetSystemMode selects the system-wide dirs instead of the XDG user dirs
+func SetSystemMode(system bool) {
+	systemMode = system
+}
+
+// MachineRuntimeDir returns the dir of the API socket and the VM socket dirs,
+// $XDG_RUNTIME_DIR/machined, or /run/machined in system mode
+func MachineRuntimeDir() (string, error) {
+	base := SystemRuntimeDir
+	if !SystemMode() {
+		dir, err := UserRuntimeDir()
+		if err != nil {
+			return "", err
+		}
+		base = dir
+	}
+	return filepath.Join(base, "machined"), nil
 }
@@ -0,0 +1,240 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	testCases := []struct {
+		ports string
+		first int
+		last  int
+		err   bool
+	}{
+		{ports: "5900-5999", first: 5900, last: 5999},
+		{ports: "5900", first: 5900, last: 5900},
+		{ports: " 5900 - 5901 ", first: 5900, last: 5901},
+		{ports: "5999-5900", err: true},
+		{ports: "0-10", err: true},
+		{ports: "65000-65536", err: true},
+		{ports: "spice", err: true},
+		{ports: "", err: true},
+	}
+
+	for _, tc := range testCases {
+		first, last, err := parsePortRange(tc.ports)
+		if tc.err {
+			if err == nil {
+				t.Errorf("ports %q: expected an error, parsed %d-%d", tc.ports, first, last)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ports %q: unexpected error: %s", tc.ports, err)
+			continue
+		}
+		if first != tc.first || last != tc.last {
+			t.Errorf("ports %q: parsed %d-%d, expected %d-%d", tc.ports, first, last, tc.first, tc.last)
+		}
+	}
+}
+
+func TestDaemonConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	valid := MachineDaemonConfig{
+		ConfigDirectory: filepath.Join(dir, "config"),
+		DataDirectory:   filepath.Join(dir, "data"),
+		StateDirectory:  filepath.Join(dir, "state"),
+		SocketPath:      filepath.Join(dir, "api.socket"),
+		SpiceAddress:    DefaultSpiceAddress,
+		SpicePorts:      DefaultSpicePorts,
+		StopTimeout:     DefaultStopTimeout,
+		ShutdownTimeout: DefaultShutdownTimeout,
+		LogLevel:        DefaultLogLevel,
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(c *MachineDaemonConfig)
+		err    bool
+	}{
+		{name: "valid", modify: func(c *MachineDaemonConfig) {}},
+		{name: "metrics address", modify: func(c *MachineDaemonConfig) { c.MetricsAddress = "127.0.0.1:9101" }},
+		{name: "relative dir", modify: func(c *MachineDaemonConfig) { c.DataDirectory = "data" }, err: true},
+		{name: "empty socket path", modify: func(c *MachineDaemonConfig) { c.SocketPath = "" }, err: true},
+		{name: "missing qemu binary", modify: func(c *MachineDaemonConfig) { c.QemuBinary = filepath.Join(dir, "qemu") }, err: true},
+		{name: "invalid spice address", modify: func(c *MachineDaemonConfig) { c.SpiceAddress = "localhost" }, err: true},
+		{name: "invalid spice ports", modify: func(c *MachineDaemonConfig) { c.SpicePorts = "5999-5900" }, err: true},
+		{name: "zero stop timeout", modify: func(c *MachineDaemonConfig) { c.StopTimeout = 0 }, err: true},
+		{name: "invalid log level", modify: func(c *MachineDaemonConfig) { c.LogLevel = "loud" }, err: true},
+		{name: "invalid metrics address", modify: func(c *MachineDaemonConfig) { c.MetricsAddress = "9101" }, err: true},
+	}
+
+	for _, tc := range testCases {
+		conf := valid
+		tc.modify(&conf)
+		err := conf.Validate()
+		if tc.err && err == nil {
+			t.Errorf("%s: expected an error for %+v", tc.name, conf)
+		}
+		if !tc.err && err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+		}
+	}
+}
+
+func TestXDGDirs(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	testCases := []struct {
+		name string
+		env  string
+		dir  func() (string, error)
+		want string
+	}{
+		{name: "data", env: "XDG_DATA_HOME", dir: UserDataDir, want: filepath.Join(home, ".local", "share")},
+		{name: "config", env: "XDG_CONFIG_HOME", dir: UserConfigDir, want: filepath.Join(home, ".config")},
+		{name: "state", env: "XDG_STATE_HOME", dir: UserStateDir, want: filepath.Join(home, ".local", "state")},
+	}
+
+	for _, tc := range testCases {
+		for _, value := range []string{"", "relative/dir", "/xdg/" + tc.name} {
+			t.Setenv(tc.env, value)
+			want := tc.want
+			// only absolute paths in the environment are used
+			if filepath.IsAbs(value) {
+				want = value
+			}
+			got, err := tc.dir()
+			if err != nil {
+				t.Errorf("%s %s=%q: unexpected error: %s", tc.name, tc.env, value, err)
+				continue
+			}
+			if got != want {
+				t.Errorf("%s %s=%q: dir %s, expected %s", tc.name, tc.env, value, got, want)
+			}
+		}
+	}
+}
+
+func TestUserRuntimeDir(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if dir, err := UserRuntimeDir(); err != nil || dir != "/run/user/1000" {
+		t.Errorf("runtime dir %s %v, expected /run/user/1000", dir, err)
+	}
+
+	// without XDG_RUNTIME_DIR a private dir in the temp dir is created
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	want := filepath.Join(tmpDir, fmt.Sprintf("machine-runtime-%d", os.Getuid()))
+	dir, err := UserRuntimeDir()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if dir != want {
+		t.Errorf("runtime dir %s, expected %s", dir, want)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %s", dir, err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("runtime dir has mode %o, expected 700", info.Mode().Perm())
+	}
+
+	// a fallback dir others can access is rejected
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatalf("failed to chmod %s: %s", dir, err)
+	}
+	if _, err := UserRuntimeDir(); err == nil {
+		t.Errorf("expected an error for a runtime dir with mode 755")
+	}
+}
+
+func TestSystemModeDirs(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	t.Setenv("XDG_STATE_HOME", filepath.Join(dir, "state"))
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(dir, "run"))
+	t.Setenv(MachineSocketPathEnv, "")
+
+	testCases := []struct {
+		name       string
+		system     bool
+		env        string
+		configDir  string
+		dataDir    string
+		stateDir   string
+		runtimeDir string
+	}{
+		{
+			name:       "user",
+			configDir:  filepath.Join(dir, "config", "machine"),
+			dataDir:    filepath.Join(dir, "data", "machine"),
+			stateDir:   filepath.Join(dir, "state", "machine"),
+			runtimeDir: filepath.Join(dir, "run", "machined"),
+		},
+		{
+			name:       "system",
+			system:     true,
+			configDir:  "/etc/machine",
+			dataDir:    "/var/lib/machine",
+			stateDir:   "/var/lib/machine/state",
+			runtimeDir: "/run/machined",
+		},
+		{
+			name:       "system environment",
+			env:        "true",
+			configDir:  "/etc/machine",
+			dataDir:    "/var/lib/machine",
+			stateDir:   "/var/lib/machine/state",
+			runtimeDir: "/run/machined",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			SetSystemMode(tc.system)
+			defer SetSystemMode(false)
+			t.Setenv(MachineSystemModeEnv, tc.env)
+
+			conf := DefaultMachineDaemonConfig()
+			if conf.ConfigDirectory != tc.configDir || conf.DataDirectory != tc.dataDir || conf.StateDirectory != tc.stateDir {
+				t.Errorf("dirs %s %s %s, expected %s %s %s", conf.ConfigDirectory, conf.DataDirectory, conf.StateDirectory,
+					tc.configDir, tc.dataDir, tc.stateDir)
+			}
+			runtimeDir, err := MachineRuntimeDir()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if runtimeDir != tc.runtimeDir {
+				t.Errorf("runtime dir %s, expected %s", runtimeDir, tc.runtimeDir)
+			}
+			if want := filepath.Join(tc.runtimeDir, MachineUnixSocketName); conf.SocketPath != want {
+				t.Errorf("socket path %s, expected %s", conf.SocketPath, want)
+			}
+		})
+	}
+}
@@ -37,12 +37,16 @@ import (
 )
 
 type Controller struct {
-	Config            *MachineDaemonConfig
-	Router            *gin.Engine
-	MachineController MachineController
-	Server            *http.Server
-	wgShutDown        *sync.WaitGroup
-	portNumber        int
+	Config               *MachineDaemonConfig
+	Router               *gin.Engine
+	MachineController    MachineController
+	ImageController      ImageController
+	TrustStoreController TrustStoreController
+	Server               *http.Server
+	MetricsServer        *http.Server
+	wgShutDown           *sync.WaitGroup
+	portNumber           int
+	configLock           sync.RWMutex
 }
 
 func NewController(config *MachineDaemonConfig) *Controller {
@@ -50,16 +54,84 @@ func NewController(config *MachineDaemonConfig) *Controller {
 
 	controller.Config = config
 	controller.wgShutDown = new(sync.WaitGroup)
+	SetDaemonConfig(config)
 
 	return &controller
 }
 
+// GetConfig returns the daemon config
+func (c *Controller) GetConfig() MachineDaemonConfig {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	return *c.Config
+}
+
+// ReloadConfig applies the reloadable settings of newConfig, the dirs,
+// socket-path and metrics-address only change on restart.
+func (c *Controller) ReloadConfig(newConfig *MachineDaemonConfig) error {
+	if err := newConfig.Validate(); err != nil {
+		return err
+	}
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+
+	restartOnly := map[string][2]string{
+		"config-dir":      {c.Config.ConfigDirectory, newConfig.ConfigDirectory},
+		"data-dir":        {c.Config.DataDirectory, newConfig.DataDirectory},
+		"state-dir":       {c.Config.StateDirectory, newConfig.StateDirectory},
+		"socket-path":     {c.Config.SocketPath, newConfig.SocketPath},
+		"metrics-address": {c.Config.MetricsAddress, newConfig.MetricsAddress},
+	}
+	for name, values := range restartOnly {
+		if values[0] != values[1] {
+			log.Warnf("machined config %s changed from '%s' to '%s', restart machined to apply it", name, values[0], values[1])
+		}
+	}
+	c.Config.QemuBinary = newConfig.QemuBinary
+	c.Config.SpiceAddress = newConfig.SpiceAddress
+	c.Config.SpicePorts = newConfig.SpicePorts
+	c.Config.StopTimeout = newConfig.StopTimeout
+	c.Config.ShutdownTimeout = newConfig.ShutdownTimeout
+	c.Config.LogLevel = newConfig.LogLevel
+	SetDaemonConfig(c.Config)
+	log.Infof("machined config reloaded")
+	return nil
+}
+
 func (c *Controller) Run(ctx context.Context) error {
+	unixSocket := c.Config.SocketPath
+	if len(unixSocket) == 0 {
+		panic("Failed to get an API Socket path")
+	}
+
+	// mkdir -p on dirname(unixSocet)
+	err := os.MkdirAll(filepath.Dir(unixSocket), 0755)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create directory path to: %s", unixSocket))
+	}
+
+	// only one machined may serve the socket, check before touching any
+	// machine state
+	runtimeDir, err := MachineRuntimeDir()
+	if err != nil {
+		return err
+	}
+	pidFile, err := LockPidFile(filepath.Join(runtimeDir, MachinedPidFileName))
+	if err != nil {
+		return err
+	}
+	defer pidFile.Release()
+
+	if err := RemoveStaleSocket(unixSocket); err != nil {
+		return err
+	}
+	defer os.Remove(unixSocket)
+
 	// load existing machines
 	machineDir := filepath.Join(c.Config.ConfigDirectory, "machines")
 	if PathExists(machineDir) {
 		log.Infof("Loading saved machine configs...")
-		err := filepath.Walk(machineDir, func(path string, info os.FileInfo, err error) error {
+		err = filepath.Walk(machineDir, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
@@ -72,7 +144,7 @@ func (c *Controller) Run(ctx context.Context) error {
 					}
 					newMachine.ctx = c.Config.GetConfigContext()
 					log.Infof("  loaded machine %s", newMachine.Name)
-					c.MachineController.Machines = append(c.MachineController.Machines, newMachine)
+					c.MachineController.Machines = append(c.MachineController.Machines, &newMachine)
 				}
 			}
 			return nil
@@ -82,27 +154,21 @@ func (c *Controller) Run(ctx context.Context) error {
 		}
 	}
 
-	unixSocket := APISocketPath()
-	if len(unixSocket) == 0 {
-		panic("Failed to get an API Socket path")
-	}
-
-	// mkdir -p on dirname(unixSocet)
-	err := os.MkdirAll(filepath.Dir(unixSocket), 0755)
-	if err != nil {
-		panic(fmt.Sprintf("Failed to create directory path to: %s", unixSocket))
-	}
-
-	// FIXME to check if another machined is running/pidfile?, flock?
-	if PathExists(unixSocket) {
-		os.Remove(unixSocket)
+	if err := c.ImageController.LoadRemotes(c.Config); err != nil {
+		return err
 	}
-	defer os.Remove(unixSocket)
 
 	log.Infof("machined service running on: %s\n", unixSocket)
 	engine := gin.Default()
+	engine.Use(apiMetricsMiddleware)
 	c.Router = engine
 
+	if c.Config.MetricsAddress != "" {
+		if err := c.StartMetricsServer(c.Config.MetricsAddress); err != nil {
+			return err
+		}
+	}
+
 	//  configure routes
 	_ = NewRouteHandler(c)
 
@@ -129,6 +195,11 @@ func (c *Controller) InitMachineController(ctx context.Context) error {
 
 func (c *Controller) Shutdown(ctx context.Context) error {
 	c.wgShutDown.Wait()
+	if c.MetricsServer != nil {
+		if err := c.MetricsServer.Shutdown(ctx); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+	}
 	if err := c.Server.Shutdown(ctx); err != nil && err != http.ErrServerClosed {
 		return err
 	}
@@ -253,7 +324,7 @@ func CopyFileBits(src, dest string) error {
 
 	out, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return fmt.Errorf("Failed to open destination file %q", dest, err)
+		return fmt.Errorf("Failed to open destination file %q: %s", dest, err)
 	}
 	defer out.Close()
 
@@ -317,10 +388,18 @@ func GetCommandErrorRC(err error) int {
 	return GetCommandErrorRCDefault(err, 127)
 }
 
+// GetTempSocketDir creates a new socket dir in the machined runtime dir
 func GetTempSocketDir() (string, error) {
-	d, err := ioutil.TempDir("/tmp", "msockets-*")
+	runtimeDir, err := MachineRuntimeDir()
 	if err != nil {
-		return "", nil
+		return "", err
+	}
+	if err := EnsureDir(runtimeDir); err != nil {
+		return "", err
+	}
+	d, err := ioutil.TempDir(runtimeDir, "msockets-*")
+	if err != nil {
+		return "", err
 	}
 	if err := checkSocketDir(d); err != nil {
 		os.RemoveAll(d)
@@ -0,0 +1,381 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/raharper/qcli"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CPUModelHost passes the host CPU through, it requires kvm
+	CPUModelHost = "host"
+
+	guestMemoryID    = "mem"
+	hostHugePagesDir = "/sys/kernel/mm/hugepages"
+)
+
+// CPUTopology splits the VM cpus into sockets, cores and threads, unset
+// values default to 1.
+type CPUTopology struct {
+	Sockets uint32 `yaml:"sockets,omitempty"`
+	Cores   uint32 `yaml:"cores,omitempty"`
+	Threads uint32 `yaml:"threads,omitempty"`
+}
+
+// NUMANode is a guest NUMA node with its vCPUs, a cpu list like 0-3 or
+// 0,2,4-5, and Memory in MiB
+type NUMANode struct {
+	CPUs   string `yaml:"cpus"`
+	Memory uint32 `yaml:"memory"`
+}
+
+// +flag, -flag or flag=value
+var cpuFlagRe = regexp.MustCompile(`^([+-][A-Za-z0-9_.-]+|[A-Za-z0-9_.-]+=[A-Za-z0-9_.-]+)$`)
+
+// qemuCPUModels returns the cpu models supported by the QEMU binary
+func qemuCPUModels(qemuPath string) ([]string, error) {
+	out, err := exec.Command(qemuPath, "-cpu", "help").Output()
+	if err != nil {
+		return []string{}, fmt.Errorf("Failed to list cpu models of %s: %s", qemuPath, err)
+	}
+	models := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasSuffix(line, ":") {
+			// x86 lists the CPUID flags after the models
+			if strings.HasPrefix(line, "Recognized CPUID flags") {
+				break
+			}
+			continue
+		}
+		if fields[0] == "x86" && len(fields) > 1 {
+			models = append(models, fields[1])
+		} else {
+			models = append(models, fields[0])
+		}
+	}
+	return models, nil
+}
+
+func cpuModelInList(model string, models []string) bool {
+	for _, name := range models {
+		if name == model {
+			return true
+		}
+	}
+	return false
+}
+
+// hostCPUFlags returns the cpu flags of the host from /proc/cpuinfo
+func hostCPUFlags() (map[string]bool, error) {
+	fh, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	flags := make(map[string]bool)
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(key) != "flags" {
+			continue
+		}
+		for _, flag := range strings.Fields(value) {
+			flags[flag] = true
+		}
+		break
+	}
+	return flags, scanner.Err()
+}
+
+// ConfigureCPU sets the cpu model, flags and topology of the VM
+func ConfigureCPU(c *qcli.Config, v VMDef, arch, accel string) error {
+	// arch default model and flags unless a model is set
+	flags := []string{}
+	if v.CPUModel == "" {
+		flags = append(flags, c.CPUModelFlags...)
+	} else {
+		if v.CPUModel == CPUModelHost && accel != AccelKVM {
+			return fmt.Errorf("cpu-model %s requires accel %s, use cpu-model max with %s", CPUModelHost, AccelKVM, accel)
+		}
+		if v.CPUModel != CPUModelHost {
+			models, err := qemuCPUModels(c.Path)
+			if err != nil {
+				log.Warnf("VM:%s cannot validate cpu-model %s: %s", v.Name, v.CPUModel, err)
+			} else if !cpuModelInList(v.CPUModel, models) {
+				return fmt.Errorf("invalid cpu-model: %s does not support %s, see '%s -cpu help'", c.Path, v.CPUModel, c.Path)
+			}
+		}
+		c.CPUModel = v.CPUModel
+	}
+
+	var hostFlags map[string]bool
+	if accel == AccelKVM && arch == ArchX86_64 {
+		found, err := hostCPUFlags()
+		if err != nil {
+			log.Warnf("VM:%s cannot validate cpu-flags: %s", v.Name, err)
+		} else {
+			hostFlags = found
+		}
+	}
+	for _, flag := range v.CPUFlags {
+		if !cpuFlagRe.MatchString(flag) {
+			return fmt.Errorf("invalid cpu-flag '%s', expected +flag, -flag or flag=value", flag)
+		}
+		// /proc/cpuinfo spells sse4.2 and lahf-lm as sse4_2 and lahf_lm
+		hostName := strings.NewReplacer(".", "_", "-", "_").Replace(strings.TrimPrefix(flag, "+"))
+		if strings.HasPrefix(flag, "+") && hostFlags != nil && !hostFlags[hostName] {
+			return fmt.Errorf("cpu-flag %s is not supported by the host cpu", flag)
+		}
+		flags = append(flags, flag)
+	}
+	c.CPUModelFlags = flags
+
+	topo := v.Topology
+	if topo.Sockets > 0 || topo.Cores > 0 || topo.Threads > 0 {
+		for _, value := range []*uint32{&topo.Sockets, &topo.Cores, &topo.Threads} {
+			if *value == 0 {
+				*value = 1
+			}
+		}
+		total := topo.Sockets * topo.Cores * topo.Threads
+		if v.Cpus == 0 {
+			c.SMP.CPUs = total
+		} else if v.Cpus != total {
+			return fmt.Errorf("invalid topology: sockets %d * cores %d * threads %d = %d cpus, expected cpus %d", topo.Sockets, topo.Cores, topo.Threads, total, v.Cpus)
+		}
+		c.SMP.Sockets = topo.Sockets
+		c.SMP.Cores = topo.Cores
+		c.SMP.Threads = topo.Threads
+	}
+	if accel == AccelKVM && int(c.SMP.CPUs) > runtime.NumCPU() {
+		log.Warnf("VM:%s has %d cpus, more than the %d host cpus", v.Name, c.SMP.CPUs, runtime.NumCPU())
+	}
+	log.Infof("VM:%s cpu %s %s smp %d sockets %d cores %d threads %d", v.Name, c.CPUModel, strings.Join(c.CPUModelFlags, ","),
+		c.SMP.CPUs, c.SMP.Sockets, c.SMP.Cores, c.SMP.Threads)
+	return nil
+}
+
+// parseCPUList returns the ranges of a cpu list like 0-3,8
+func parseCPUList(cpus string) ([][2]uint32, error) {
+	ranges := [][2]uint32{}
+	for _, item := range strings.Split(cpus, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		if !isRange {
+			last = first
+		}
+		start, err := strconv.ParseUint(first, 10, 32)
+		if err != nil {
+			return ranges, fmt.Errorf("invalid cpu list '%s': %s", cpus, err)
+		}
+		end, err := strconv.ParseUint(last, 10, 32)
+		if err != nil {
+			return ranges, fmt.Errorf("invalid cpu list '%s': %s", cpus, err)
+		}
+		if end < start {
+			return ranges, fmt.Errorf("invalid cpu list '%s': range %d-%d is reversed", cpus, start, end)
+		}
+		ranges = append(ranges, [2]uint32{uint32(start), uint32(end)})
+	}
+	return ranges, nil
+}
+
+// parseHugePageSize returns a page size like 2M or 1G in KiB
+func parseHugePageSize(size string) (uint64, error) {
+	value := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(size), "B"), "I")
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1024
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1024 * 1024
+	default:
+		return 0, fmt.Errorf("invalid hugepage-size '%s', expected a size like 2M or 1G", size)
+	}
+	num, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if err != nil || num == 0 {
+		return 0, fmt.Errorf("invalid hugepage-size '%s', expected a size like 2M or 1G", size)
+	}
+	return num * multiplier, nil
+}
+
+// hostHugePageSize returns the size in KiB of the default huge pages of the host
+func hostHugePageSize() (uint64, error) {
+	fh, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "Hugepagesize:" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("host does not support huge pages")
+}
+
+// checkHugePages returns the huge page size in KiB after checking the host
+// has enough free huge pages for memMB of guest memory
+func checkHugePages(v VMDef, memMB uint32) (uint64, error) {
+	var pageKB uint64
+	var err error
+	if v.HugePageSize == "" {
+		pageKB, err = hostHugePageSize()
+	} else {
+		pageKB, err = parseHugePageSize(v.HugePageSize)
+	}
+	if err != nil {
+		return 0, err
+	}
+	pagesDir := filepath.Join(hostHugePagesDir, fmt.Sprintf("hugepages-%dkB", pageKB))
+	content, err := os.ReadFile(filepath.Join(pagesDir, "free_hugepages"))
+	if err != nil {
+		return 0, fmt.Errorf("host does not support %dkB huge pages: %s", pageKB, err)
+	}
+	free, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse free %dkB huge pages: %s", pageKB, err)
+	}
+	memKB := uint64(memMB) * 1024
+	if memKB%pageKB != 0 {
+		return 0, fmt.Errorf("memory %dM is not a multiple of the %dkB huge page size", memMB, pageKB)
+	}
+	if needed := memKB / pageKB; needed > free {
+		return 0, fmt.Errorf("not enough free %dkB huge pages: need %d, %d free in %s", pageKB, needed, free, pagesDir)
+	}
+	return pageKB, nil
+}
+
+// ConfigureMemory returns the qemu parameters for guest memory which qcli
+// cannot express: NUMA nodes with their own memory, huge pages and the shared
+// memory virtiofs requires.  qcli renders the memory of other VMs.
+func ConfigureMemory(c *qcli.Config, v VMDef) ([]string, error) {
+	shared := false
+	for _, share := range v.Shares {
+		if share.Type == "" || share.Type == ShareTypeVirtioFS {
+			shared = true
+		}
+	}
+	if !shared && !v.HugePages && len(v.NUMA) == 0 {
+		return []string{}, nil
+	}
+
+	memMB := v.Memory
+	if memMB == 0 {
+		memMB = defaultMemoryMB
+	}
+	nodeMB := []uint32{memMB}
+	if len(v.NUMA) > 0 {
+		nodeMB = []uint32{}
+		total := uint32(0)
+		for idx, node := range v.NUMA {
+			if node.Memory == 0 {
+				return []string{}, fmt.Errorf("numa node %d has no memory", idx)
+			}
+			nodeMB = append(nodeMB, node.Memory)
+			total += node.Memory
+		}
+		if v.Memory != 0 && v.Memory != total {
+			return []string{}, fmt.Errorf("numa node memory adds up to %dM, expected memory %dM", total, v.Memory)
+		}
+		memMB = total
+	}
+
+	backend := "memory-backend-ram"
+	options := ""
+	if v.HugePages {
+		pageKB, err := checkHugePages(v, memMB)
+		if err != nil {
+			return []string{}, err
+		}
+		for idx, size := range nodeMB {
+			if (uint64(size)*1024)%pageKB != 0 {
+				return []string{}, fmt.Errorf("numa node %d memory %dM is not a multiple of the %dkB huge page size", idx, size, pageKB)
+			}
+		}
+		// preallocate so a VM without enough huge pages fails to start
+		// instead of being killed later
+		backend = "memory-backend-memfd"
+		options += fmt.Sprintf(",hugetlb=on,hugetlbsize=%dK,prealloc=on", pageKB)
+	}
+	if shared {
+		backend = "memory-backend-memfd"
+		options += ",share=on"
+	}
+
+	log.Infof("VM:%s memory %dM in %d numa nodes hugepages:%v shared:%v", v.Name, memMB, len(v.NUMA), v.HugePages, shared)
+	c.Memory.Size = ""
+	params := []string{"-m", fmt.Sprintf("%dm", memMB)}
+	if len(v.NUMA) == 0 {
+		params = append(params,
+			"-object", fmt.Sprintf("%s,id=%s0,size=%dm%s", backend, guestMemoryID, memMB, options),
+			"-machine", fmt.Sprintf("memory-backend=%s0", guestMemoryID))
+		return params, nil
+	}
+
+	assigned := make(map[uint32]int)
+	for idx, node := range v.NUMA {
+		numa := fmt.Sprintf("node,nodeid=%d,memdev=%s%d", idx, guestMemoryID, idx)
+		if node.CPUs != "" {
+			ranges, err := parseCPUList(node.CPUs)
+			if err != nil {
+				return []string{}, fmt.Errorf("numa node %d: %s", idx, err)
+			}
+			for _, r := range ranges {
+				for cpu := r[0]; cpu <= r[1]; cpu++ {
+					if cpu >= c.SMP.CPUs {
+						return []string{}, fmt.Errorf("numa node %d: cpu %d does not exist, the VM has %d cpus", idx, cpu, c.SMP.CPUs)
+					}
+					if other, ok := assigned[cpu]; ok {
+						return []string{}, fmt.Errorf("numa node %d: cpu %d is already in numa node %d", idx, cpu, other)
+					}
+					assigned[cpu] = idx
+				}
+				if r[0] == r[1] {
+					numa += fmt.Sprintf(",cpus=%d", r[0])
+				} else {
+					numa += fmt.Sprintf(",cpus=%d-%d", r[0], r[1])
+				}
+			}
+		}
+		params = append(params,
+			"-object", fmt.Sprintf("%s,id=%s%d,size=%dm%s", backend, guestMemoryID, idx, node.Memory, options),
+			"-numa", numa)
+	}
+	if uint32(len(assigned)) != c.SMP.CPUs {
+		return []string{}, fmt.Errorf("numa nodes assign %d of the %d cpus, each cpu must be in a numa node", len(assigned), c.SMP.CPUs)
+	}
+	return params, nil
+}
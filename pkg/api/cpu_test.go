@@ -0,0 +1,250 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/raharper/qcli"
+)
+
+func TestParseCPUList(t *testing.T) {
+	testCases := []struct {
+		list string
+		want [][2]uint32
+		err  bool
+	}{
+		{list: "0", want: [][2]uint32{{0, 0}}},
+		{list: "0-3", want: [][2]uint32{{0, 3}}},
+		{list: "0-3,8", want: [][2]uint32{{0, 3}, {8, 8}}},
+		{list: " 1 , 4-5", want: [][2]uint32{{1, 1}, {4, 5}}},
+		{list: "", err: true},
+		{list: "3-1", err: true},
+		{list: "0-", err: true},
+		{list: "a", err: true},
+		{list: "-1", err: true},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseCPUList(tc.list)
+		if tc.err {
+			if err == nil {
+				t.Errorf("cpu list %q: expected an error, parsed %v", tc.list, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cpu list %q: unexpected error: %s", tc.list, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("cpu list %q: parsed %v, expected %v", tc.list, got, tc.want)
+		}
+	}
+}
+
+func TestParseHugePageSize(t *testing.T) {
+	testCases := []struct {
+		size string
+		want uint64
+		err  bool
+	}{
+		{size: "2M", want: 2048},
+		{size: "2MiB", want: 2048},
+		{size: "2mb", want: 2048},
+		{size: "1G", want: 1024 * 1024},
+		{size: "64K", want: 64},
+		{size: "2", err: true},
+		{size: "0M", err: true},
+		{size: "M", err: true},
+		{size: "2T", err: true},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseHugePageSize(tc.size)
+		if tc.err {
+			if err == nil {
+				t.Errorf("size %q: expected an error, parsed %d", tc.size, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("size %q: unexpected error: %s", tc.size, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("size %q: parsed %d KiB, expected %d", tc.size, got, tc.want)
+		}
+	}
+}
+
+func TestConfigureCPU(t *testing.T) {
+	testCases := []struct {
+		name  string
+		vmdef VMDef
+		accel string
+		smp   qcli.SMP
+		flags []string
+		err   bool
+	}{
+		{
+			name:  "defaults",
+			vmdef: VMDef{Cpus: 2},
+			smp:   qcli.SMP{CPUs: 2},
+			flags: []string{"+x2apic"},
+		},
+		{
+			name:  "topology",
+			vmdef: VMDef{Cpus: 8, Topology: CPUTopology{Sockets: 2, Cores: 2, Threads: 2}},
+			smp:   qcli.SMP{CPUs: 8, Sockets: 2, Cores: 2, Threads: 2},
+			flags: []string{"+x2apic"},
+		},
+		{
+			name:  "topology defaults to one",
+			vmdef: VMDef{Cpus: 4, Topology: CPUTopology{Cores: 4}},
+			smp:   qcli.SMP{CPUs: 4, Sockets: 1, Cores: 4, Threads: 1},
+			flags: []string{"+x2apic"},
+		},
+		{
+			name:  "topology mismatch",
+			vmdef: VMDef{Cpus: 4, Topology: CPUTopology{Sockets: 2, Cores: 4}},
+			err:   true,
+		},
+		{
+			name:  "flags",
+			vmdef: VMDef{Cpus: 2, CPUFlags: []string{"-vmx", "pmu=off"}},
+			smp:   qcli.SMP{CPUs: 2},
+			flags: []string{"+x2apic", "-vmx", "pmu=off"},
+		},
+		{
+			name:  "invalid flag",
+			vmdef: VMDef{Cpus: 2, CPUFlags: []string{"vmx"}},
+			err:   true,
+		},
+		{
+			name:  "host model with tcg",
+			vmdef: VMDef{Cpus: 2, CPUModel: CPUModelHost},
+			err:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			accel := tc.accel
+			if accel == "" {
+				accel = AccelTCG
+			}
+			c := &qcli.Config{SMP: qcli.SMP{CPUs: tc.vmdef.Cpus}, CPUModelFlags: []string{"+x2apic"}}
+			err := ConfigureCPU(c, tc.vmdef, ArchX86_64, accel)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, configured smp %+v", c.SMP)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if c.SMP != tc.smp {
+				t.Errorf("smp %+v, expected %+v", c.SMP, tc.smp)
+			}
+			if !reflect.DeepEqual(c.CPUModelFlags, tc.flags) {
+				t.Errorf("cpu flags %v, expected %v", c.CPUModelFlags, tc.flags)
+			}
+		})
+	}
+}
+
+func TestConfigureMemory(t *testing.T) {
+	testCases := []struct {
+		name   string
+		vmdef  VMDef
+		params string
+		err    bool
+	}{
+		{
+			name:  "plain",
+			vmdef: VMDef{Memory: 1024},
+		},
+		{
+			name:  "virtiofs share",
+			vmdef: VMDef{Memory: 1024, Shares: []ShareDef{{Path: "/src", Tag: "src"}}},
+			params: "-m 1024m -object memory-backend-memfd,id=mem0,size=1024m,share=on " +
+				"-machine memory-backend=mem0",
+		},
+		{
+			name:  "9p share",
+			vmdef: VMDef{Memory: 1024, Shares: []ShareDef{{Path: "/src", Tag: "src", Type: ShareType9P}}},
+		},
+		{
+			name: "numa",
+			vmdef: VMDef{Cpus: 4, NUMA: []NUMANode{
+				{CPUs: "0-1", Memory: 512},
+				{CPUs: "2,3", Memory: 1024},
+			}},
+			params: "-m 1536m " +
+				"-object memory-backend-ram,id=mem0,size=512m -numa node,nodeid=0,memdev=mem0,cpus=0-1 " +
+				"-object memory-backend-ram,id=mem1,size=1024m -numa node,nodeid=1,memdev=mem1,cpus=2,cpus=3",
+		},
+		{
+			name:  "numa memory mismatch",
+			vmdef: VMDef{Cpus: 2, Memory: 2048, NUMA: []NUMANode{{CPUs: "0-1", Memory: 1024}}},
+			err:   true,
+		},
+		{
+			name:  "numa node without memory",
+			vmdef: VMDef{Cpus: 2, NUMA: []NUMANode{{CPUs: "0-1"}}},
+			err:   true,
+		},
+		{
+			name:  "numa cpu out of range",
+			vmdef: VMDef{Cpus: 2, NUMA: []NUMANode{{CPUs: "0-2", Memory: 1024}}},
+			err:   true,
+		},
+		{
+			name:  "numa cpu in two nodes",
+			vmdef: VMDef{Cpus: 2, NUMA: []NUMANode{{CPUs: "0-1", Memory: 512}, {CPUs: "1", Memory: 512}}},
+			err:   true,
+		},
+		{
+			name:  "numa cpu without a node",
+			vmdef: VMDef{Cpus: 4, NUMA: []NUMANode{{CPUs: "0-2", Memory: 1024}}},
+			err:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &qcli.Config{SMP: qcli.SMP{CPUs: tc.vmdef.Cpus}}
+			params, err := ConfigureMemory(c, tc.vmdef)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, params %v", params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := strings.Join(params, " "); got != tc.params {
+				t.Errorf("params %q, expected %q", got, tc.params)
+			}
+		})
+	}
+}
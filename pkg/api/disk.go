@@ -16,6 +16,7 @@ limitations under the License.
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"path"
 	"path/filepath"
@@ -42,6 +43,7 @@ func (s *DiskSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
 }
 
 type QemuDisk struct {
+	ID        string   `yaml:"id,omitempty"`
 	File      string   `yaml:"file,omitempty"`
 	Format    string   `yaml:"format,omitempty"`
 	Size      DiskSize `yaml:"size"`
@@ -51,6 +53,145 @@ type QemuDisk struct {
 	BusAddr   string   `yaml:"addr,omitempty"`
 	BootIndex string   `yaml:"bootindex,omitempty"`
 	ReadOnly  bool     `yaml:"read-only,omitempty"`
+
+	// Controller and Unit select the scsi controller (scsi0, scsi1, ...) and
+	// target of scsi attached disks, unset values are allocated.
+	Controller string `yaml:"controller,omitempty"`
+	Unit       string `yaml:"unit,omitempty"`
+
+	// Cache, AIO, Discard and DetectZeroes tune the qemu block backend,
+	// unset values default to unsafe, threads, unmap and unmap.
+	Cache        string       `yaml:"cache,omitempty"`
+	AIO          string       `yaml:"aio,omitempty"`
+	Discard      string       `yaml:"discard,omitempty"`
+	DetectZeroes string       `yaml:"detect-zeroes,omitempty"`
+	Throttle     DiskThrottle `yaml:"throttle,omitempty"`
+
+	// Encrypt creates the disk as a LUKS encrypted qcow2 image with a key
+	// generated and kept by machined.
+	Encrypt string `yaml:"encrypt,omitempty"`
+}
+
+// DiskThrottle limits the IO operations and bandwidth per second of a disk,
+// a zero value is unlimited.  Total limits cannot be combined with the
+// matching read or write limit.
+type DiskThrottle struct {
+	IOPSTotal int64    `yaml:"iops-total,omitempty"`
+	IOPSRead  int64    `yaml:"iops-read,omitempty"`
+	IOPSWrite int64    `yaml:"iops-write,omitempty"`
+	BPSTotal  DiskSize `yaml:"bps-total,omitempty"`
+	BPSRead   DiskSize `yaml:"bps-read,omitempty"`
+	BPSWrite  DiskSize `yaml:"bps-write,omitempty"`
+}
+
+func (t DiskThrottle) IsSet() bool {
+	return t != DiskThrottle{}
+}
+
+func (t DiskThrottle) Validate() error {
+	errors := []string{}
+	values := map[string]int64{
+		"iops-total": t.IOPSTotal,
+		"iops-read":  t.IOPSRead,
+		"iops-write": t.IOPSWrite,
+		"bps-total":  int64(t.BPSTotal),
+		"bps-read":   int64(t.BPSRead),
+		"bps-write":  int64(t.BPSWrite),
+	}
+	for _, name := range []string{"iops-total", "iops-read", "iops-write", "bps-total", "bps-read", "bps-write"} {
+		if values[name] < 0 {
+			errors = append(errors, fmt.Sprintf("invalid throttle %s: %d must not be negative", name, values[name]))
+		}
+	}
+	if t.IOPSTotal > 0 && (t.IOPSRead > 0 || t.IOPSWrite > 0) {
+		errors = append(errors, "throttle iops-total cannot be combined with iops-read or iops-write")
+	}
+	if t.BPSTotal > 0 && (t.BPSRead > 0 || t.BPSWrite > 0) {
+		errors = append(errors, "throttle bps-total cannot be combined with bps-read or bps-write")
+	}
+	if len(errors) != 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "\n"))
+	}
+	return nil
+}
+
+// QMPArgs returns the block_set_io_throttle arguments for the limits
+func (t DiskThrottle) QMPArgs() map[string]interface{} {
+	return map[string]interface{}{
+		"iops":    t.IOPSTotal,
+		"iops_rd": t.IOPSRead,
+		"iops_wr": t.IOPSWrite,
+		"bps":     int64(t.BPSTotal),
+		"bps_rd":  int64(t.BPSRead),
+		"bps_wr":  int64(t.BPSWrite),
+	}
+}
+
+// QemuParams returns -set parameters applying the limits to the -drive
+// with driveID, qcli does not emit throttling options itself.
+func (t DiskThrottle) QemuParams(driveID string) []string {
+	params := []string{}
+	set := func(name string, value int64) {
+		if value > 0 {
+			params = append(params, "-set", fmt.Sprintf("drive.%s.throttling.%s=%d", driveID, name, value))
+		}
+	}
+	set("iops-total", t.IOPSTotal)
+	set("iops-read", t.IOPSRead)
+	set("iops-write", t.IOPSWrite)
+	set("bps-total", int64(t.BPSTotal))
+	set("bps-read", int64(t.BPSRead))
+	set("bps-write", int64(t.BPSWrite))
+	return params
+}
+
+// cacheMode returns the configured cache mode or the default, unsafe.
+func (q *QemuDisk) cacheMode() string {
+	if q.Cache == "" {
+		return "unsafe"
+	}
+	return q.Cache
+}
+
+// cacheOptions maps the cache mode onto the blockdev cache.direct and
+// cache.no-flush options and the device write-cache setting.
+func (q *QemuDisk) cacheOptions() (direct bool, noFlush bool, writeCache bool) {
+	switch q.cacheMode() {
+	case "none":
+		return true, false, true
+	case "writethrough":
+		return false, false, false
+	case "directsync":
+		return true, false, false
+	case "unsafe":
+		return false, true, true
+	}
+	// writeback
+	return false, false, true
+}
+
+func (q *QemuDisk) aioMode() string {
+	if q.AIO == "" {
+		return "threads"
+	}
+	return q.AIO
+}
+
+func (q *QemuDisk) discardMode() string {
+	if q.Discard == "" {
+		return "unmap"
+	}
+	return q.Discard
+}
+
+func (q *QemuDisk) detectZeroesMode() string {
+	if q.DetectZeroes == "" {
+		if q.discardMode() == "unmap" {
+			return "unmap"
+		}
+		return "on"
+	}
+	return q.DetectZeroes
 }
 
 func (q *QemuDisk) Sanitize(basedir string) error {
@@ -97,6 +238,67 @@ func (q *QemuDisk) Sanitize(basedir string) error {
 		errors = append(errors, msg)
 	}
 
+	if q.Attach == "scsi" {
+		if q.Controller != "" {
+			if _, err := scsiControllerIndex(q.Controller); err != nil {
+				errors = append(errors, err.Error())
+			}
+		}
+		if q.Unit != "" {
+			if _, err := scsiUnit(q.Unit); err != nil {
+				errors = append(errors, err.Error())
+			}
+		}
+	} else if q.Controller != "" || q.Unit != "" {
+		errors = append(errors, fmt.Sprintf("controller and unit are only valid for scsi disks, found attach %s", q.Attach))
+	}
+
+	if q.Cache != "" {
+		if msg := validate("cache", q.Cache, "none", "writeback", "writethrough", "directsync", "unsafe"); msg != "" {
+			errors = append(errors, msg)
+		}
+	}
+
+	if q.AIO != "" {
+		if msg := validate("aio", q.AIO, "threads", "native", "io_uring"); msg != "" {
+			errors = append(errors, msg)
+		}
+	}
+
+	if q.AIO == "native" {
+		if direct, _, _ := q.cacheOptions(); !direct {
+			errors = append(errors, fmt.Sprintf("aio native requires cache none or directsync, found cache %s", q.cacheMode()))
+		}
+	}
+
+	if q.Discard != "" {
+		if msg := validate("discard", q.Discard, "ignore", "unmap"); msg != "" {
+			errors = append(errors, msg)
+		}
+	}
+
+	if q.DetectZeroes != "" {
+		if msg := validate("detect-zeroes", q.DetectZeroes, "on", "off", "unmap"); msg != "" {
+			errors = append(errors, msg)
+		}
+		if q.DetectZeroes == "unmap" && q.discardMode() != "unmap" {
+			errors = append(errors, fmt.Sprintf("detect-zeroes unmap requires discard unmap, found discard %s", q.Discard))
+		}
+	}
+
+	if err := q.Throttle.Validate(); err != nil {
+		errors = append(errors, err.Error())
+	}
+
+	if q.Encrypt != "" {
+		if msg := validate("encrypt", q.Encrypt, DiskEncryptLUKS); msg != "" {
+			errors = append(errors, msg)
+		}
+		if q.Format != "qcow2" || q.Type == "cdrom" {
+			errors = append(errors, fmt.Sprintf("encrypt is only valid for qcow2 disks, found format %s type %s", q.Format, q.Type))
+		}
+	}
+
 	if len(errors) != 0 {
 		return fmt.Errorf("bad disk %#v: %s", q, strings.Join(errors, "\n"))
 	}
@@ -104,8 +306,90 @@ func (q *QemuDisk) Sanitize(basedir string) error {
 	return nil
 }
 
+// ImagePath returns the path of the disk image a VM uses for this disk once
+// ImportDiskImage has run against imageDir.
+func (q *QemuDisk) ImagePath(imageDir string) string {
+	if q.Size > 0 || q.Type == "cdrom" {
+		return q.File
+	}
+	return filepath.Join(imageDir, filepath.Base(q.File))
+}
+
+// VirtualSize returns the virtual size of the disk image at imagePath.
+func (q *QemuDisk) VirtualSize(imagePath string) (DiskSize, error) {
+	cmd := []string{"qemu-img", "info", "--output=json", "-f", q.Format, imagePath}
+	out, errOut, rc := RunCommandWithOutputErrorRc(cmd...)
+	if rc != 0 {
+		return 0, fmt.Errorf("qemu-img info failed: %v\n rc: %d\n out: %s\n, err: %s", cmd, rc, out, errOut)
+	}
+	var info struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return 0, fmt.Errorf("Failed to parse qemu-img info output: %s", err)
+	}
+	return DiskSize(info.VirtualSize), nil
+}
+
+// Resize changes the virtual size of the (offline) disk image at imagePath.
+// Shrinking the image requires force.  Encrypted images are unlocked with
+// the disk secret kept under runDir.
+func (q *QemuDisk) Resize(runDir, imagePath string, size DiskSize, force bool) error {
+	current, err := q.VirtualSize(imagePath)
+	if err != nil {
+		return err
+	}
+	cmd, err := q.resizeCommand(runDir, imagePath, current, size, force)
+	if err != nil {
+		return err
+	}
+	log.Infof("Resizing %s from %d to %d bytes", imagePath, current, size)
+	out, errOut, rc := RunCommandWithOutputErrorRc(cmd...)
+	if rc != 0 {
+		return fmt.Errorf("qemu-img resize failed: %v\n rc: %d\n out: %s\n, err: %s", cmd, rc, out, errOut)
+	}
+	return nil
+}
+
+// resizeCommand returns the qemu-img command changing the size of the image
+// at imagePath from current to size.
+func (q *QemuDisk) resizeCommand(runDir, imagePath string, current, size DiskSize, force bool) ([]string, error) {
+	cmd := []string{"qemu-img", "resize"}
+	if size < current {
+		if !force {
+			return cmd, fmt.Errorf("Refusing to shrink disk %s from %d to %d bytes without force", q.DiskID(), current, size)
+		}
+		cmd = append(cmd, "--shrink")
+	}
+	if q.Encrypt != "" {
+		cmd = append(cmd,
+			"--object", secretObject("sec0", q.SecretFile(runDir)),
+			"--image-opts", fmt.Sprintf("driver=%s,file.filename=%s,encrypt.key-secret=sec0", q.Format, imagePath))
+	} else {
+		cmd = append(cmd, "-f", q.Format, imagePath)
+	}
+	cmd = append(cmd, fmt.Sprintf("%d", size))
+	return cmd, nil
+}
+
 // Create - create the qemu disk at fpath or its File if it does not exist.
 func (q *QemuDisk) Create() error {
+	if q.Encrypt != "" {
+		return fmt.Errorf("Encrypted disk %s requires a secret, use CreateEncrypted", q.File)
+	}
+	return q.create()
+}
+
+// CreateEncrypted - create the qemu disk as a LUKS encrypted qcow2 using the
+// base64 encoded key in secretFile.
+func (q *QemuDisk) CreateEncrypted(secretFile string) error {
+	return q.create(
+		"--object", secretObject("sec0", secretFile),
+		"-o", fmt.Sprintf("encrypt.format=%s,encrypt.key-secret=sec0", q.Encrypt),
+	)
+}
+
+func (q *QemuDisk) create(options ...string) error {
 	if q.Type == "cdrom" {
 		log.Debugf("Ignoring Create on QemuDisk.Name:%s wth Type 'cdrom'", q.File)
 		return nil
@@ -114,7 +398,9 @@ func (q *QemuDisk) Create() error {
 		return nil
 	}
 	log.Infof("Creating %s type %s size %d attach %s", q.File, q.Format, q.Size, q.Attach)
-	cmd := []string{"qemu-img", "create", "-f", q.Format, q.File, fmt.Sprintf("%d", q.Size)}
+	cmd := []string{"qemu-img", "create", "-f", q.Format}
+	cmd = append(cmd, options...)
+	cmd = append(cmd, q.File, fmt.Sprintf("%d", q.Size))
 	out, err, rc := RunCommandWithOutputErrorRc(cmd...)
 	if rc != 0 {
 		return fmt.Errorf("qemu-img create failed: %v\n rc: %d\n out: %s\n, err: %s",
@@ -123,6 +409,16 @@ func (q *QemuDisk) Create() error {
 	return nil
 }
 
+// DiskID returns the configured disk ID or the basename of the disk File
+// without its extension.
+func (q *QemuDisk) DiskID() string {
+	if q.ID != "" {
+		return q.ID
+	}
+	ext := filepath.Ext(q.File)
+	return path.Base(q.File[0 : len(q.File)-len(ext)])
+}
+
 func (q *QemuDisk) serial() string {
 	// serial gets basename without extension
 	ext := filepath.Ext(q.File)
@@ -0,0 +1,325 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiskID(t *testing.T) {
+	testCases := []struct {
+		disk QemuDisk
+		want string
+	}{
+		{disk: QemuDisk{File: "/images/root.qcow2"}, want: "root"},
+		{disk: QemuDisk{File: "data.raw"}, want: "data"},
+		{disk: QemuDisk{File: "/images/noext"}, want: "noext"},
+		{disk: QemuDisk{File: "/images/root.disk.qcow2"}, want: "root.disk"},
+		{disk: QemuDisk{ID: "boot", File: "/images/root.qcow2"}, want: "boot"},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.disk.DiskID(); got != tc.want {
+			t.Errorf("DiskID of %+v is %s, expected %s", tc.disk, got, tc.want)
+		}
+	}
+}
+
+func TestDiskSanitize(t *testing.T) {
+	testCases := []struct {
+		name string
+		disk QemuDisk
+		want QemuDisk
+		err  bool
+	}{
+		{
+			name: "defaults",
+			disk: QemuDisk{File: "root.qcow2"},
+			want: QemuDisk{File: "/run/vm1/root.qcow2", Format: "qcow2", Type: "ssd", Attach: "scsi"},
+		},
+		{
+			name: "cdrom",
+			disk: QemuDisk{File: "/images/install.iso", Format: "raw", Type: "cdrom"},
+			want: QemuDisk{File: "/images/install.iso", Format: "raw", Type: "cdrom", Attach: "scsi"},
+		},
+		{
+			name: "absolute file",
+			disk: QemuDisk{File: "/images/root.raw", Format: "raw", Type: "hdd", Attach: "virtio"},
+			want: QemuDisk{File: "/images/root.raw", Format: "raw", Type: "hdd", Attach: "virtio"},
+		},
+		{
+			name: "empty file",
+			disk: QemuDisk{},
+			err:  true,
+		},
+		{
+			name: "invalid format",
+			disk: QemuDisk{File: "root.vmdk", Format: "vmdk"},
+			err:  true,
+		},
+		{
+			name: "invalid attach",
+			disk: QemuDisk{File: "root.qcow2", Attach: "sata"},
+			err:  true,
+		},
+		{
+			name: "invalid type",
+			disk: QemuDisk{File: "root.qcow2", Type: "tape"},
+			err:  true,
+		},
+		{
+			name: "scsi placement",
+			disk: QemuDisk{File: "root.qcow2", Controller: "scsi1", Unit: "4"},
+			want: QemuDisk{File: "/run/vm1/root.qcow2", Format: "qcow2", Type: "ssd", Attach: "scsi", Controller: "scsi1", Unit: "4"},
+		},
+		{
+			name: "tuning",
+			disk: QemuDisk{File: "root.qcow2", Cache: "none", AIO: "native", Discard: "ignore", DetectZeroes: "on"},
+			want: QemuDisk{File: "/run/vm1/root.qcow2", Format: "qcow2", Type: "ssd", Attach: "scsi", Cache: "none", AIO: "native", Discard: "ignore", DetectZeroes: "on"},
+		},
+		{
+			name: "invalid cache",
+			disk: QemuDisk{File: "root.qcow2", Cache: "fast"},
+			err:  true,
+		},
+		{
+			name: "aio native with host cache",
+			disk: QemuDisk{File: "root.qcow2", AIO: "native", Cache: "writeback"},
+			err:  true,
+		},
+		{
+			name: "detect-zeroes unmap without discard",
+			disk: QemuDisk{File: "root.qcow2", Discard: "ignore", DetectZeroes: "unmap"},
+			err:  true,
+		},
+		{
+			name: "invalid throttle",
+			disk: QemuDisk{File: "root.qcow2", Throttle: DiskThrottle{BPSTotal: 1024, BPSRead: 512}},
+			err:  true,
+		},
+		{
+			name: "unit of a virtio disk",
+			disk: QemuDisk{File: "root.qcow2", Attach: "virtio", Unit: "1"},
+			err:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			disk := tc.disk
+			err := disk.Sanitize("/run/vm1")
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, sanitized to %+v", disk)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if disk != tc.want {
+				t.Errorf("sanitized to %+v, expected %+v", disk, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiskImagePath(t *testing.T) {
+	testCases := []struct {
+		name string
+		disk QemuDisk
+		want string
+	}{
+		{
+			name: "created disk",
+			disk: QemuDisk{File: "/run/vm1/root.qcow2", Size: 1024},
+			want: "/run/vm1/root.qcow2",
+		},
+		{
+			name: "imported disk",
+			disk: QemuDisk{File: "/images/root.qcow2"},
+			want: "/run/vm1/root.qcow2",
+		},
+		{
+			name: "cdrom",
+			disk: QemuDisk{File: "/images/install.iso", Type: "cdrom"},
+			want: "/images/install.iso",
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.disk.ImagePath("/run/vm1"); got != tc.want {
+			t.Errorf("%s: image path %s, expected %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDiskResizeCommand(t *testing.T) {
+	testCases := []struct {
+		name    string
+		disk    QemuDisk
+		current DiskSize
+		size    DiskSize
+		force   bool
+		want    string
+		err     bool
+	}{
+		{
+			name:    "grow",
+			disk:    QemuDisk{File: "root.qcow2", Format: "qcow2"},
+			current: 1024,
+			size:    2048,
+			want:    "qemu-img resize -f qcow2 /run/vm1/root.qcow2 2048",
+		},
+		{
+			name:    "shrink",
+			disk:    QemuDisk{File: "root.qcow2", Format: "raw"},
+			current: 2048,
+			size:    1024,
+			force:   true,
+			want:    "qemu-img resize --shrink -f raw /run/vm1/root.qcow2 1024",
+		},
+		{
+			name:    "shrink without force",
+			disk:    QemuDisk{File: "root.qcow2", Format: "qcow2"},
+			current: 2048,
+			size:    1024,
+			err:     true,
+		},
+		{
+			name:    "encrypted",
+			disk:    QemuDisk{File: "root.qcow2", Format: "qcow2", Encrypt: DiskEncryptLUKS},
+			current: 1024,
+			size:    2048,
+			want: "qemu-img resize --object secret,id=sec0,file=/run/vm1/secrets/root.key,format=base64 " +
+				"--image-opts driver=qcow2,file.filename=/run/vm1/root.qcow2,encrypt.key-secret=sec0 2048",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd, err := tc.disk.resizeCommand("/run/vm1", "/run/vm1/root.qcow2", tc.current, tc.size, tc.force)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got command %v", cmd)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := strings.Join(cmd, " "); got != tc.want {
+				t.Errorf("command %q, expected %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiskThrottle(t *testing.T) {
+	testCases := []struct {
+		name     string
+		throttle DiskThrottle
+		qmp      map[string]int64
+		params   string
+		err      bool
+	}{
+		{
+			name: "unlimited",
+			qmp:  map[string]int64{"iops": 0, "iops_rd": 0, "iops_wr": 0, "bps": 0, "bps_rd": 0, "bps_wr": 0},
+		},
+		{
+			name:     "totals",
+			throttle: DiskThrottle{IOPSTotal: 500, BPSTotal: 1048576},
+			qmp:      map[string]int64{"iops": 500, "iops_rd": 0, "iops_wr": 0, "bps": 1048576, "bps_rd": 0, "bps_wr": 0},
+			params:   "-set drive.drive0.throttling.iops-total=500 -set drive.drive0.throttling.bps-total=1048576",
+		},
+		{
+			name:     "read and write",
+			throttle: DiskThrottle{IOPSRead: 100, IOPSWrite: 50, BPSWrite: 4096},
+			qmp:      map[string]int64{"iops": 0, "iops_rd": 100, "iops_wr": 50, "bps": 0, "bps_rd": 0, "bps_wr": 4096},
+			params: "-set drive.drive0.throttling.iops-read=100 -set drive.drive0.throttling.iops-write=50 " +
+				"-set drive.drive0.throttling.bps-write=4096",
+		},
+		{
+			name:     "total and read",
+			throttle: DiskThrottle{IOPSTotal: 500, IOPSRead: 100},
+			err:      true,
+		},
+		{
+			name:     "total and write bandwidth",
+			throttle: DiskThrottle{BPSTotal: 4096, BPSWrite: 1024},
+			err:      true,
+		},
+		{
+			name:     "negative",
+			throttle: DiskThrottle{IOPSWrite: -1},
+			err:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.throttle.Validate()
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error for %+v", tc.throttle)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			args := tc.throttle.QMPArgs()
+			if len(args) != len(tc.qmp) {
+				t.Errorf("QMP args %v, expected %v", args, tc.qmp)
+			}
+			for name, want := range tc.qmp {
+				if got, ok := args[name].(int64); !ok || got != want {
+					t.Errorf("QMP arg %s is %v, expected %d", name, args[name], want)
+				}
+			}
+			if got := strings.Join(tc.throttle.QemuParams("drive0"), " "); got != tc.params {
+				t.Errorf("qemu params %q, expected %q", got, tc.params)
+			}
+		})
+	}
+}
+
+func TestDiskCacheOptions(t *testing.T) {
+	testCases := []struct {
+		cache      string
+		direct     bool
+		noFlush    bool
+		writeCache bool
+	}{
+		{cache: "", direct: false, noFlush: true, writeCache: true},
+		{cache: "unsafe", direct: false, noFlush: true, writeCache: true},
+		{cache: "none", direct: true, noFlush: false, writeCache: true},
+		{cache: "writeback", direct: false, noFlush: false, writeCache: true},
+		{cache: "writethrough", direct: false, noFlush: false, writeCache: false},
+		{cache: "directsync", direct: true, noFlush: false, writeCache: false},
+	}
+
+	for _, tc := range testCases {
+		disk := QemuDisk{Cache: tc.cache}
+		direct, noFlush, writeCache := disk.cacheOptions()
+		if direct != tc.direct || noFlush != tc.noFlush || writeCache != tc.writeCache {
+			t.Errorf("cache %q: direct %v no-flush %v write-cache %v, expected %v %v %v",
+				tc.cache, direct, noFlush, writeCache, tc.direct, tc.noFlush, tc.writeCache)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Encrypted disks use a per-disk random key which machined keeps in the VM
+// run directory, e.g. $stateDir/machines/<name>/<name>/secrets/<disk id>.key
+// The key is base64 encoded and handed to QEMU with -object secret.
+const (
+	DiskSecretsDir    = "secrets"
+	DiskSecretFormat  = "base64"
+	diskSecretBytes   = 32
+	diskSecretExt     = ".key"
+	diskSecretNewExt  = ".key.new"
+	DiskEncryptLUKS   = "luks"
+	diskSecretDirMode = 0700
+	diskSecretMode    = 0600
+)
+
+// DiskSecret is the exported key material of an encrypted disk
+type DiskSecret struct {
+	DiskID  string `json:"disk-id"`
+	Encrypt string `json:"encrypt"`
+	Format  string `json:"format"`
+	Secret  string `json:"secret"`
+}
+
+// SecretID returns the QEMU object id of the disk secret
+func (q *QemuDisk) SecretID() string {
+	return qmpID("sec", q.DiskID())
+}
+
+// SecretFile returns the path of the disk secret under runDir
+func (q *QemuDisk) SecretFile(runDir string) string {
+	return filepath.Join(runDir, DiskSecretsDir, q.DiskID()+diskSecretExt)
+}
+
+func secretObject(id, secretFile string) string {
+	return fmt.Sprintf("secret,id=%s,file=%s,format=%s", id, secretFile, DiskSecretFormat)
+}
+
+func writeDiskSecret(secretFile string) error {
+	secretDir := filepath.Dir(secretFile)
+	if err := os.MkdirAll(secretDir, diskSecretDirMode); err != nil {
+		return fmt.Errorf("Failed to create secrets dir %q: %s", secretDir, err)
+	}
+	if err := os.Chmod(secretDir, diskSecretDirMode); err != nil {
+		return fmt.Errorf("Failed to set permissions on secrets dir %q: %s", secretDir, err)
+	}
+
+	key := make([]byte, diskSecretBytes)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("Failed to generate disk secret: %s", err)
+	}
+	fh, err := os.OpenFile(secretFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, diskSecretMode)
+	if err != nil {
+		return fmt.Errorf("Failed to create disk secret %q: %s", secretFile, err)
+	}
+	defer fh.Close()
+	if _, err := fh.WriteString(base64.StdEncoding.EncodeToString(key)); err != nil {
+		return fmt.Errorf("Failed to write disk secret %q: %s", secretFile, err)
+	}
+	return nil
+}
+
+// EnsureSecret returns the path to the disk secret, generating a new one if
+// the disk does not have one yet.
+func (q *QemuDisk) EnsureSecret(runDir string) (string, error) {
+	secretFile := q.SecretFile(runDir)
+	if PathExists(secretFile) {
+		if err := os.Chmod(secretFile, diskSecretMode); err != nil {
+			return "", fmt.Errorf("Failed to set permissions on disk secret %q: %s", secretFile, err)
+		}
+		return secretFile, nil
+	}
+	log.Infof("Generating secret for encrypted disk %s: %s", q.DiskID(), secretFile)
+	if err := writeDiskSecret(secretFile); err != nil {
+		return "", err
+	}
+	return secretFile, nil
+}
+
+// ExportSecret returns the key material of the encrypted disk
+func (q *QemuDisk) ExportSecret(runDir string) (DiskSecret, error) {
+	if q.Encrypt == "" {
+		return DiskSecret{}, fmt.Errorf("Disk %s is not encrypted", q.DiskID())
+	}
+	content, err := os.ReadFile(q.SecretFile(runDir))
+	if err != nil {
+		return DiskSecret{}, fmt.Errorf("Failed to read secret of disk %s: %s", q.DiskID(), err)
+	}
+	return DiskSecret{
+		DiskID:  q.DiskID(),
+		Encrypt: q.Encrypt,
+		Format:  DiskSecretFormat,
+		Secret:  strings.TrimSpace(string(content)),
+	}, nil
+}
+
+// EncryptionQemuParams returns the parameters which define the disk secret
+// object and point the -drive with driveID at it.
+func (q *QemuDisk) EncryptionQemuParams(runDir, driveID string) []string {
+	if q.Encrypt == "" {
+		return []string{}
+	}
+	return []string{
+		"-object", secretObject(q.SecretID(), q.SecretFile(runDir)),
+		"-set", fmt.Sprintf("drive.%s.encrypt.key-secret=%s", driveID, q.SecretID()),
+	}
+}
+
+// amendCommand returns the qemu-img amend command which opens the image at
+// imagePath with the secret unlockID and applies the encryption options.  The
+// old and new secrets are defined as sec-old and sec-new.
+func (q *QemuDisk) amendCommand(imagePath, oldSecret, newSecret, unlockID, options string) []string {
+	return []string{
+		"qemu-img", "amend",
+		"--object", secretObject("sec-old", oldSecret),
+		"--object", secretObject("sec-new", newSecret),
+		"--image-opts", fmt.Sprintf("driver=%s,file.filename=%s,encrypt.key-secret=%s", q.Format, imagePath, unlockID),
+		"-o", options,
+	}
+}
+
+// RotateSecret replaces the key of the (offline) encrypted disk image at
+// imagePath.  A new LUKS keyslot is added for a fresh key, the new key
+// replaces the stored secret and then the keyslot of the old key is erased.
+func (q *QemuDisk) RotateSecret(runDir, imagePath string) error {
+	if q.Encrypt == "" {
+		return fmt.Errorf("Disk %s is not encrypted", q.DiskID())
+	}
+	oldSecret := q.SecretFile(runDir)
+	if !PathExists(oldSecret) {
+		return fmt.Errorf("Disk %s has no secret %q", q.DiskID(), oldSecret)
+	}
+	newSecret := strings.TrimSuffix(oldSecret, diskSecretExt) + diskSecretNewExt
+	if PathExists(newSecret) {
+		if err := os.Remove(newSecret); err != nil {
+			return fmt.Errorf("Failed to remove stale disk secret %q: %s", newSecret, err)
+		}
+	}
+	if err := writeDiskSecret(newSecret); err != nil {
+		return err
+	}
+
+	amend := func(unlockID string, options string) error {
+		cmd := q.amendCommand(imagePath, oldSecret, newSecret, unlockID, options)
+		out, errOut, rc := RunCommandWithOutputErrorRc(cmd...)
+		if rc != 0 {
+			return fmt.Errorf("qemu-img amend failed: %v\n rc: %d\n out: %s\n, err: %s", cmd, rc, out, errOut)
+		}
+		return nil
+	}
+
+	log.Infof("Adding new key to encrypted disk %s", imagePath)
+	if err := amend("sec-old", "encrypt.state=active,encrypt.new-secret=sec-new"); err != nil {
+		os.Remove(newSecret)
+		return err
+	}
+	// the image now opens with either key, keep the old one until its
+	// keyslot is erased
+	if err := os.Rename(oldSecret, oldSecret+".old"); err != nil {
+		return fmt.Errorf("Failed to save old disk secret: %s", err)
+	}
+	if err := os.Rename(newSecret, oldSecret); err != nil {
+		return fmt.Errorf("Failed to install new disk secret: %s", err)
+	}
+	oldSecret = oldSecret + ".old"
+
+	log.Infof("Removing old key from encrypted disk %s", imagePath)
+	newSecret = q.SecretFile(runDir)
+	if err := amend("sec-new", "encrypt.state=inactive,encrypt.old-secret=sec-old"); err != nil {
+		return fmt.Errorf("New key installed but the old key is still active, old key kept at %q: %s", oldSecret, err)
+	}
+	return os.Remove(oldSecret)
+}
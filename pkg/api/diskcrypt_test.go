@@ -0,0 +1,246 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDiskEnsureSecret(t *testing.T) {
+	runDir := t.TempDir()
+	disk := QemuDisk{File: "/images/root.qcow2", Encrypt: DiskEncryptLUKS}
+
+	secretFile, err := disk.EnsureSecret(runDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := filepath.Join(runDir, "secrets", "root.key"); secretFile != want {
+		t.Errorf("secret file %s, expected %s", secretFile, want)
+	}
+	for path, mode := range map[string]os.FileMode{filepath.Dir(secretFile): 0700, secretFile: 0600} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s", path, err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("%s has mode %o, expected %o", path, info.Mode().Perm(), mode)
+		}
+	}
+	content, err := os.ReadFile(secretFile)
+	if err != nil {
+		t.Fatalf("failed to read secret: %s", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(string(content))
+	if err != nil {
+		t.Fatalf("secret is not base64: %s", err)
+	}
+	if len(key) != 32 {
+		t.Errorf("secret has %d bytes, expected 32", len(key))
+	}
+
+	// an existing secret is kept and its permissions are restored
+	if err := os.Chmod(secretFile, 0644); err != nil {
+		t.Fatalf("failed to chmod secret: %s", err)
+	}
+	if _, err := disk.EnsureSecret(runDir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	again, err := os.ReadFile(secretFile)
+	if err != nil {
+		t.Fatalf("failed to read secret: %s", err)
+	}
+	if string(again) != string(content) {
+		t.Errorf("existing secret was replaced")
+	}
+	info, err := os.Stat(secretFile)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %s", secretFile, err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("existing secret has mode %o, expected 600", info.Mode().Perm())
+	}
+}
+
+func TestDiskExportSecret(t *testing.T) {
+	runDir := t.TempDir()
+
+	plain := QemuDisk{File: "/images/root.qcow2"}
+	if _, err := plain.ExportSecret(runDir); err == nil {
+		t.Errorf("expected an error exporting the secret of an unencrypted disk")
+	}
+
+	disk := QemuDisk{File: "/images/root.qcow2", Encrypt: DiskEncryptLUKS}
+	if _, err := disk.ExportSecret(runDir); err == nil {
+		t.Errorf("expected an error exporting a missing secret")
+	}
+
+	if err := os.MkdirAll(filepath.Join(runDir, "secrets"), 0700); err != nil {
+		t.Fatalf("failed to create secrets dir: %s", err)
+	}
+	if err := os.WriteFile(disk.SecretFile(runDir), []byte("c2VjcmV0\n"), 0600); err != nil {
+		t.Fatalf("failed to write secret: %s", err)
+	}
+	secret, err := disk.ExportSecret(runDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := DiskSecret{DiskID: "root", Encrypt: "luks", Format: "base64", Secret: "c2VjcmV0"}
+	if secret != want {
+		t.Errorf("exported %+v, expected %+v", secret, want)
+	}
+}
+
+func TestDiskEncryptionQemuParams(t *testing.T) {
+	plain := QemuDisk{File: "/images/root.qcow2"}
+	if params := plain.EncryptionQemuParams("/run/vm1", "drive0"); len(params) != 0 {
+		t.Errorf("unencrypted disk has params %v", params)
+	}
+
+	disk := QemuDisk{File: "/images/root.qcow2", Encrypt: DiskEncryptLUKS}
+	want := "-object secret,id=sec-root,file=/run/vm1/secrets/root.key,format=base64 " +
+		"-set drive.drive0.encrypt.key-secret=sec-root"
+	if got := strings.Join(disk.EncryptionQemuParams("/run/vm1", "drive0"), " "); got != want {
+		t.Errorf("params %q, expected %q", got, want)
+	}
+}
+
+// fakeQemuImg puts a qemu-img on PATH which logs its arguments and fails the
+// call with number failCall (counting from 1, 0 never fails).
+func fakeQemuImg(t *testing.T, failCall int) string {
+	binDir := t.TempDir()
+	logFile := filepath.Join(binDir, "qemu-img.log")
+	script := "#!/bin/sh\n" +
+		"echo \"$*\" >> " + logFile + "\n" +
+		"[ \"$(wc -l < " + logFile + ")\" -eq " + strconv.Itoa(failCall) + " ] && exit 1\n" +
+		"exit 0\n"
+	if err := os.WriteFile(filepath.Join(binDir, "qemu-img"), []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write fake qemu-img: %s", err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return logFile
+}
+
+func qemuImgCalls(t *testing.T, logFile string) []string {
+	content, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("failed to read qemu-img log: %s", err)
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestDiskRotateSecret(t *testing.T) {
+	disk := QemuDisk{File: "/images/root.qcow2", Format: "qcow2", Encrypt: DiskEncryptLUKS}
+	imagePath := "/run/vm1/root.qcow2"
+
+	testCases := []struct {
+		name     string
+		failCall int
+		rotated  bool
+		oldKept  bool
+		calls    int
+	}{
+		{name: "rotated", rotated: true, calls: 2},
+		{name: "add key fails", failCall: 1, calls: 1},
+		{name: "remove key fails", failCall: 2, rotated: true, oldKept: true, calls: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logFile := fakeQemuImg(t, tc.failCall)
+			runDir := t.TempDir()
+			secretFile, err := disk.EnsureSecret(runDir)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			before, _ := os.ReadFile(secretFile)
+
+			err = disk.RotateSecret(runDir, imagePath)
+			if tc.failCall != 0 && err == nil {
+				t.Fatalf("expected an error")
+			}
+			if tc.failCall == 0 && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			after, _ := os.ReadFile(secretFile)
+			if rotated := string(after) != string(before); rotated != tc.rotated {
+				t.Errorf("secret rotated %v, expected %v", rotated, tc.rotated)
+			}
+			if PathExists(secretFile + ".new") {
+				t.Errorf("new secret %s.new left behind", secretFile)
+			}
+			oldSecret := strings.TrimSuffix(secretFile, ".key") + ".key.old"
+			if PathExists(oldSecret) != tc.oldKept {
+				t.Errorf("old secret kept %v, expected %v", PathExists(oldSecret), tc.oldKept)
+			}
+			if tc.oldKept {
+				old, _ := os.ReadFile(oldSecret)
+				if string(old) != string(before) {
+					t.Errorf("kept old secret does not match the previous secret")
+				}
+			}
+
+			calls := qemuImgCalls(t, logFile)
+			if len(calls) != tc.calls {
+				t.Fatalf("qemu-img called %d times, expected %d: %v", len(calls), tc.calls, calls)
+			}
+			want := []string{
+				strings.Join(disk.amendCommand(imagePath, secretFile, strings.TrimSuffix(secretFile, ".key")+".key.new",
+					"sec-old", "encrypt.state=active,encrypt.new-secret=sec-new")[1:], " "),
+				strings.Join(disk.amendCommand(imagePath, oldSecret, secretFile,
+					"sec-new", "encrypt.state=inactive,encrypt.old-secret=sec-old")[1:], " "),
+			}
+			for idx, call := range calls {
+				if call != want[idx] {
+					t.Errorf("qemu-img call %d %q, expected %q", idx+1, call, want[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestDiskRotateSecretErrors(t *testing.T) {
+	runDir := t.TempDir()
+
+	plain := QemuDisk{File: "/images/root.qcow2", Format: "qcow2"}
+	if err := plain.RotateSecret(runDir, "/run/vm1/root.qcow2"); err == nil {
+		t.Errorf("expected an error rotating the secret of an unencrypted disk")
+	}
+
+	disk := QemuDisk{File: "/images/root.qcow2", Format: "qcow2", Encrypt: DiskEncryptLUKS}
+	if err := disk.RotateSecret(runDir, "/run/vm1/root.qcow2"); err == nil {
+		t.Errorf("expected an error rotating a missing secret")
+	}
+}
+
+func TestDiskAmendCommand(t *testing.T) {
+	disk := QemuDisk{File: "/images/root.qcow2", Format: "qcow2", Encrypt: DiskEncryptLUKS}
+	cmd := disk.amendCommand("/run/vm1/root.qcow2", "/run/vm1/secrets/root.key", "/run/vm1/secrets/root.key.new",
+		"sec-old", "encrypt.state=active,encrypt.new-secret=sec-new")
+	want := "qemu-img amend " +
+		"--object secret,id=sec-old,file=/run/vm1/secrets/root.key,format=base64 " +
+		"--object secret,id=sec-new,file=/run/vm1/secrets/root.key.new,format=base64 " +
+		"--image-opts driver=qcow2,file.filename=/run/vm1/root.qcow2,encrypt.key-secret=sec-old " +
+		"-o encrypt.state=active,encrypt.new-secret=sec-new"
+	if got := strings.Join(cmd, " "); got != want {
+		t.Errorf("command %q, expected %q", got, want)
+	}
+}
@@ -0,0 +1,408 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/raharper/qcli"
+	log "github.com/sirupsen/logrus"
+)
+
+// FakeBackend simulates machines in-process.  Instances only track their
+// state, disks and cdrom media; the serial console is a unix socket which
+// echoes what is written to it.
+type FakeBackend struct{}
+
+func (b *FakeBackend) Create(ctx context.Context, name string, config VMDef, opts InstanceOptions) (Instance, error) {
+	// like the qemu VM the instance keeps its own copy of the disks
+	config.Disks = append([]QemuDisk{}, config.Disks...)
+	f := &FakeInstance{
+		Config: config,
+		State:  VMInit,
+		opts:   opts,
+		media:  make(map[string]*MediaInfo),
+	}
+	if config.Cdrom != "" {
+		f.media[CdromDiskID] = &MediaInfo{DiskID: CdromDiskID, File: config.Cdrom}
+	}
+	for _, disk := range config.Disks {
+		if disk.Type == "cdrom" {
+			f.media[disk.DiskID()] = &MediaInfo{DiskID: disk.DiskID(), File: disk.File}
+		}
+	}
+	return f, nil
+}
+
+// fakeInstance returns the FakeInstance of an instance the FakeBackend created
+func fakeInstance(instance Instance) (*FakeInstance, error) {
+	f, ok := instance.(*FakeInstance)
+	if !ok {
+		return nil, fmt.Errorf("Instance %s is not a %s machine", instance.Name(), BackendFake)
+	}
+	return f, nil
+}
+
+func (b *FakeBackend) Start(instance Instance) error {
+	f, err := fakeInstance(instance)
+	if err != nil {
+		return err
+	}
+	return f.Start()
+}
+
+func (b *FakeBackend) Stop(instance Instance, force bool) error {
+	f, err := fakeInstance(instance)
+	if err != nil {
+		return err
+	}
+	return f.Stop(force)
+}
+
+func (b *FakeBackend) Status(instance Instance) VMState {
+	f, err := fakeInstance(instance)
+	if err != nil {
+		return VMFailed
+	}
+	return f.Status()
+}
+
+func (b *FakeBackend) Console(instance Instance) (string, error) {
+	f, err := fakeInstance(instance)
+	if err != nil {
+		return "", err
+	}
+	return f.SerialSocket()
+}
+
+func (b *FakeBackend) QMP(instance Instance, command string, args map[string]interface{}) (json.RawMessage, error) {
+	f, err := fakeInstance(instance)
+	if err != nil {
+		return nil, err
+	}
+	return f.QMPControl(command, args)
+}
+
+// fake serial console socket in the FakeInstance socket dir
+const fakeSerialSocket = "console.sock"
+
+type FakeInstance struct {
+	Config VMDef
+	State  VMState
+
+	opts     InstanceOptions
+	sockDir  string
+	listener net.Listener
+	media    map[string]*MediaInfo
+	lock     sync.Mutex
+}
+
+func (f *FakeInstance) Name() string {
+	return f.Config.Name
+}
+
+func (f *FakeInstance) Start() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.State == VMStarted {
+		return fmt.Errorf("VM:%s is already running", f.Name())
+	}
+	sockDir, err := GetTempSocketDir()
+	if err != nil {
+		return fmt.Errorf("Failed to create temp socket dir: %s", err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(sockDir, fakeSerialSocket))
+	if err != nil {
+		os.RemoveAll(sockDir)
+		return fmt.Errorf("Failed to create fake serial console: %s", err)
+	}
+	f.sockDir = sockDir
+	f.listener = listener
+	go f.serveConsole(listener)
+
+	log.Infof("VM:%s fake machine started", f.Name())
+	f.State = VMStarted
+	return nil
+}
+
+// serveConsole greets each console connection and echoes its input
+func (f *FakeInstance) serveConsole(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			fmt.Fprintf(conn, "%s fake serial console\r\n%s login: ", f.Name(), f.Name())
+			io.Copy(conn, conn)
+		}(conn)
+	}
+}
+
+func (f *FakeInstance) stop(state VMState) {
+	if f.listener != nil {
+		f.listener.Close()
+		f.listener = nil
+	}
+	if f.sockDir != "" {
+		os.RemoveAll(f.sockDir)
+		f.sockDir = ""
+	}
+	f.State = state
+}
+
+func (f *FakeInstance) Stop(force bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	log.Infof("VM:%s fake machine stopping, force: %v", f.Name(), force)
+	if f.State != VMFailed {
+		f.stop(VMStopped)
+	} else {
+		f.stop(VMFailed)
+	}
+	return nil
+}
+
+func (f *FakeInstance) Delete() error {
+	return f.Stop(true)
+}
+
+func (f *FakeInstance) Status() VMState {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.State
+}
+
+func (f *FakeInstance) Fail(reason string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	log.Infof("VM:%s fake machine failed: %s", f.Name(), reason)
+	f.stop(VMFailed)
+}
+
+func (f *FakeInstance) running() error {
+	if f.State != VMStarted {
+		return fmt.Errorf("VM:%s is not running", f.Name())
+	}
+	return nil
+}
+
+func (f *FakeInstance) SerialSocket() (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.running(); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.sockDir, fakeSerialSocket), nil
+}
+
+func (f *FakeInstance) SpiceDevice() (qcli.SpiceDevice, error) {
+	return qcli.SpiceDevice{}, fmt.Errorf("VM:%s fake machines do not have a VGA console", f.Name())
+}
+
+// QMPControl answers query-status, other QMP commands are not simulated
+func (f *FakeInstance) QMPControl(command string, args map[string]interface{}) (json.RawMessage, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.running(); err != nil {
+		return nil, err
+	}
+	switch command {
+	case "query-status":
+		return json.Marshal(map[string]interface{}{"status": "running", "running": true})
+	}
+	return nil, fmt.Errorf("VM:%s fake machines do not support QMP command '%s'", f.Name(), command)
+}
+
+func (f *FakeInstance) findDisk(diskID string) (int, error) {
+	for idx := range f.Config.Disks {
+		if f.Config.Disks[idx].DiskID() == diskID {
+			return idx, nil
+		}
+	}
+	return -1, fmt.Errorf("VM:%s has no disk %s", f.Name(), diskID)
+}
+
+func (f *FakeInstance) AttachDisk(disk *QemuDisk) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.running(); err != nil {
+		return err
+	}
+	if _, err := f.findDisk(disk.DiskID()); err == nil {
+		return fmt.Errorf("VM:%s already has a disk %s", f.Name(), disk.DiskID())
+	}
+	f.Config.Disks = append(f.Config.Disks, *disk)
+	if disk.Type == "cdrom" {
+		f.media[disk.DiskID()] = &MediaInfo{DiskID: disk.DiskID(), File: disk.File}
+	}
+	return nil
+}
+
+func (f *FakeInstance) DetachDisk(disk *QemuDisk) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.running(); err != nil {
+		return err
+	}
+	idx, err := f.findDisk(disk.DiskID())
+	if err != nil {
+		return err
+	}
+	f.Config.Disks = append(f.Config.Disks[:idx], f.Config.Disks[idx+1:]...)
+	delete(f.media, disk.DiskID())
+	return nil
+}
+
+func (f *FakeInstance) ResizeDisk(disk *QemuDisk, size DiskSize, force bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.running(); err != nil {
+		return err
+	}
+	idx, err := f.findDisk(disk.DiskID())
+	if err != nil {
+		return err
+	}
+	f.Config.Disks[idx].Size = size
+	return nil
+}
+
+func (f *FakeInstance) SetDiskThrottle(disk *QemuDisk, throttle DiskThrottle) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.running(); err != nil {
+		return err
+	}
+	_, err := f.findDisk(disk.DiskID())
+	return err
+}
+
+func (f *FakeInstance) ListMedia() ([]MediaInfo, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	media := []MediaInfo{}
+	if err := f.running(); err != nil {
+		return media, err
+	}
+	for _, info := range f.media {
+		media = append(media, *info)
+	}
+	sort.Slice(media, func(i, j int) bool { return media[i].DiskID < media[j].DiskID })
+	return media, nil
+}
+
+func (f *FakeInstance) findCdrom(diskID string) (*MediaInfo, error) {
+	if err := f.running(); err != nil {
+		return nil, err
+	}
+	info, ok := f.media[diskID]
+	if !ok {
+		return nil, fmt.Errorf("VM:%s has no cdrom drive %s", f.Name(), diskID)
+	}
+	return info, nil
+}
+
+func (f *FakeInstance) EjectMedia(diskID string, force bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	info, err := f.findCdrom(diskID)
+	if err != nil {
+		return err
+	}
+	if info.File == "" {
+		return fmt.Errorf("VM:%s cdrom %s has no media", f.Name(), diskID)
+	}
+	if info.Locked && !force {
+		return fmt.Errorf("VM:%s guest has locked cdrom %s", f.Name(), diskID)
+	}
+	info.File = ""
+	info.TrayOpen = true
+	return nil
+}
+
+func (f *FakeInstance) InsertMedia(diskID, file, format string, force bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	info, err := f.findCdrom(diskID)
+	if err != nil {
+		return err
+	}
+	if info.Locked && !force {
+		return fmt.Errorf("VM:%s guest has locked cdrom %s, eject it in the guest or use force", f.Name(), diskID)
+	}
+	info.File = file
+	info.TrayOpen = false
+	return nil
+}
+
+func (f *FakeInstance) CgroupUsage() (CgroupUsage, error) {
+	return CgroupUsage{}, fmt.Errorf("VM:%s fake machines do not run in a cgroup", f.Name())
+}
+
+// Stats reports the configured cpus and memory of a running fake machine
+func (f *FakeInstance) Stats() (MachineStats, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.running(); err != nil {
+		return MachineStats{}, err
+	}
+	stats := MachineStats{
+		Timestamp:   time.Now(),
+		CPUs:        f.Config.Cpus,
+		MemoryBytes: uint64(f.Config.Memory) * 1024 * 1024,
+		Disks:       []DiskStats{},
+		Nics:        []NicStats{},
+	}
+	for _, disk := range f.Config.Disks {
+		stats.Disks = append(stats.Disks, DiskStats{Device: disk.DiskID()})
+	}
+	return stats, nil
+}
+
+// TPMStatus reports a running swtpm for machines with a TPM
+func (f *FakeInstance) TPMStatus() *SwTPMStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !f.Config.TPM || f.State != VMStarted {
+		return nil
+	}
+	return &SwTPMStatus{State: SwTPMStateRunning}
+}
@@ -0,0 +1,408 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestController returns a controller with its dirs in a test temp dir
+// and the fake backend registered
+func newTestController(t *testing.T) *Controller {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	t.Setenv("XDG_STATE_HOME", filepath.Join(dir, "state"))
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(dir, "run"))
+	t.Setenv(MachineSystemModeEnv, "")
+	RegisterBackend(BackendFake, &FakeBackend{})
+
+	c := NewController(DefaultMachineDaemonConfig())
+	gin.SetMode(gin.TestMode)
+	c.Router = gin.New()
+	NewRouteHandler(c)
+	return c
+}
+
+func fakeMachine(name string, disks ...QemuDisk) Machine {
+	return Machine{
+		Name: name,
+		Type: BackendFake,
+		Config: VMDef{
+			Name:   name,
+			Cpus:   2,
+			Memory: 1024,
+			Cdrom:  "/images/install.iso",
+			Disks:  disks,
+		},
+	}
+}
+
+func TestAddMachineCdromAttach(t *testing.T) {
+	c := newTestController(t)
+	ctl := &c.MachineController
+
+	disks := []QemuDisk{
+		{File: "/images/drivers.iso", ID: "drivers", Type: "cdrom"},
+		{File: "/images/rescue.iso", ID: "rescue", Type: "cdrom", Attach: "scsi"},
+		{File: "/images/root.qcow2", ID: "root"},
+	}
+	if err := ctl.AddMachine(fakeMachine("vm1", disks...), c.Config); err != nil {
+		t.Fatalf("AddMachine failed: %s", err)
+	}
+	if disks[0].Attach != "" {
+		t.Errorf("AddMachine modified the caller's disks")
+	}
+	machine, err := ctl.GetMachine("vm1")
+	if err != nil {
+		t.Fatalf("GetMachine failed: %s", err)
+	}
+	for idx, want := range []string{"ide", "scsi", ""} {
+		if got := machine.Config.Disks[idx].Attach; got != want {
+			t.Errorf("disk %s attach %q, expected %q", machine.Config.Disks[idx].ID, got, want)
+		}
+	}
+}
+
+func TestFakeMachineLifecycle(t *testing.T) {
+	c := newTestController(t)
+	ctl := &c.MachineController
+
+	if err := ctl.AddMachine(fakeMachine("vm1"), c.Config); err != nil {
+		t.Fatalf("AddMachine failed: %s", err)
+	}
+	if err := ctl.AddMachine(fakeMachine("vm1"), c.Config); err == nil {
+		t.Errorf("AddMachine of a duplicate machine did not fail")
+	}
+	machine, err := ctl.GetMachine("vm1")
+	if err != nil {
+		t.Fatalf("GetMachine failed: %s", err)
+	}
+	if machine.Status != MachineStatusStopped {
+		t.Errorf("added machine status is %s, expected %s", machine.Status, MachineStatusStopped)
+	}
+	configFile := machine.ConfigFile()
+	if !PathExists(configFile) {
+		t.Errorf("machine config %s was not saved", configFile)
+	}
+
+	if err := ctl.StartMachine("vm1"); err != nil {
+		t.Fatalf("StartMachine failed: %s", err)
+	}
+	if machine, _ := ctl.GetMachine("vm1"); machine.Status != MachineStatusRunning {
+		t.Errorf("started machine status is %s, expected %s", machine.Status, MachineStatusRunning)
+	}
+	if err := ctl.StartMachine("vm1"); err == nil {
+		t.Errorf("StartMachine of a running machine did not fail")
+	}
+	stats, err := ctl.GetMachineStats("vm1")
+	if err != nil {
+		t.Fatalf("GetMachineStats failed: %s", err)
+	}
+	if stats.CPUs != 2 || stats.MemoryBytes != 1024*1024*1024 {
+		t.Errorf("unexpected stats cpus %d memory %d", stats.CPUs, stats.MemoryBytes)
+	}
+
+	if err := ctl.StopMachine("vm1", false); err != nil {
+		t.Fatalf("StopMachine failed: %s", err)
+	}
+	if machine, _ := ctl.GetMachine("vm1"); machine.Status != MachineStatusStopped {
+		t.Errorf("stopped machine status is %s, expected %s", machine.Status, MachineStatusStopped)
+	}
+	if err := ctl.StopMachine("vm1", false); err == nil {
+		t.Errorf("StopMachine of a stopped machine did not fail")
+	}
+
+	if err := ctl.DeleteMachine("vm1", c.Config); err != nil {
+		t.Fatalf("DeleteMachine failed: %s", err)
+	}
+	if _, err := ctl.GetMachine("vm1"); err == nil {
+		t.Errorf("deleted machine still exists")
+	}
+	if PathExists(configFile) {
+		t.Errorf("machine config %s was not removed", configFile)
+	}
+}
+
+func TestFakeBackendInstance(t *testing.T) {
+	backend := &FakeBackend{}
+	instance, err := backend.Create(context.Background(), "vm1", fakeMachine("vm1").Config, InstanceOptions{})
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	if _, ok := instance.(DiskInstance); !ok {
+		t.Errorf("fake instance does not support disks")
+	}
+	if _, ok := instance.(MediaInstance); !ok {
+		t.Errorf("fake instance does not support media")
+	}
+	if _, ok := instance.(StatsInstance); !ok {
+		t.Errorf("fake instance does not report stats")
+	}
+
+	if err := backend.Start(instance); err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+	if status := backend.Status(instance); status != VMStarted {
+		t.Errorf("started instance status is %s, expected %s", status, VMStarted)
+	}
+	if _, err := backend.Console(instance); err != nil {
+		t.Errorf("Console failed: %s", err)
+	}
+	if err := backend.Stop(instance, false); err != nil {
+		t.Fatalf("Stop failed: %s", err)
+	}
+	if status := backend.Status(instance); status != VMStopped {
+		t.Errorf("stopped instance status is %s, expected %s", status, VMStopped)
+	}
+
+	// a backend only drives its own instances
+	if err := (&KVMBackend{}).Start(instance); err == nil {
+		t.Errorf("kvm backend started a fake instance")
+	}
+	if status := (&KVMBackend{}).Status(instance); status != VMFailed {
+		t.Errorf("kvm backend status of a fake instance is %s, expected %s", status, VMFailed)
+	}
+}
+
+func TestFakeMachineUnknown(t *testing.T) {
+	c := newTestController(t)
+	ctl := &c.MachineController
+
+	if err := ctl.StartMachine("missing"); err == nil {
+		t.Errorf("StartMachine of an unknown machine did not fail")
+	}
+	if err := ctl.StopMachine("missing", true); err == nil {
+		t.Errorf("StopMachine of an unknown machine did not fail")
+	}
+	if err := ctl.EjectMachineMedia("missing", CdromDiskID, false); err == nil {
+		t.Errorf("EjectMachineMedia of an unknown machine did not fail")
+	}
+}
+
+func TestFakeMachineMedia(t *testing.T) {
+	c := newTestController(t)
+	ctl := &c.MachineController
+
+	if err := ctl.AddMachine(fakeMachine("vm1"), c.Config); err != nil {
+		t.Fatalf("AddMachine failed: %s", err)
+	}
+	if err := ctl.EjectMachineMedia("vm1", CdromDiskID, false); err == nil {
+		t.Errorf("EjectMachineMedia of a stopped machine did not fail")
+	}
+	if err := ctl.StartMachine("vm1"); err != nil {
+		t.Fatalf("StartMachine failed: %s", err)
+	}
+	defer ctl.StopMachine("vm1", true)
+
+	media, err := ctl.ListMachineMedia("vm1")
+	if err != nil {
+		t.Fatalf("ListMachineMedia failed: %s", err)
+	}
+	if len(media) != 1 || media[0].DiskID != CdromDiskID || media[0].File != "/images/install.iso" {
+		t.Fatalf("unexpected media %+v", media)
+	}
+
+	if err := ctl.EjectMachineMedia("vm1", CdromDiskID, false); err != nil {
+		t.Fatalf("EjectMachineMedia failed: %s", err)
+	}
+	if err := ctl.EjectMachineMedia("vm1", CdromDiskID, false); err == nil {
+		t.Errorf("EjectMachineMedia of an empty cdrom did not fail")
+	}
+	media, _ = ctl.ListMachineMedia("vm1")
+	if media[0].File != "" || !media[0].TrayOpen {
+		t.Errorf("ejected media %+v still has a file or a closed tray", media[0])
+	}
+
+	if err := ctl.InsertMachineMedia("vm1", CdromDiskID, "/images/tools.iso", "raw", false); err != nil {
+		t.Fatalf("InsertMachineMedia failed: %s", err)
+	}
+	media, _ = ctl.ListMachineMedia("vm1")
+	if media[0].File != "/images/tools.iso" || media[0].TrayOpen {
+		t.Errorf("inserted media %+v does not have the new file", media[0])
+	}
+	if err := ctl.InsertMachineMedia("vm1", "missing", "/images/tools.iso", "raw", false); err == nil {
+		t.Errorf("InsertMachineMedia into an unknown drive did not fail")
+	}
+}
+
+func TestFakeMachineDisks(t *testing.T) {
+	c := newTestController(t)
+	ctl := &c.MachineController
+
+	if err := ctl.AddMachine(fakeMachine("vm1"), c.Config); err != nil {
+		t.Fatalf("AddMachine failed: %s", err)
+	}
+	if err := ctl.StartMachine("vm1"); err != nil {
+		t.Fatalf("StartMachine failed: %s", err)
+	}
+	defer ctl.StopMachine("vm1", true)
+
+	disk := QemuDisk{File: "/images/data.qcow2", Format: "qcow2", Type: "ssd", Attach: "virtio", Size: 1024 * 1024 * 1024}
+	if err := ctl.AttachMachineDisk("vm1", disk, false); err != nil {
+		t.Fatalf("AttachMachineDisk failed: %s", err)
+	}
+	if err := ctl.AttachMachineDisk("vm1", disk, false); err == nil {
+		t.Errorf("AttachMachineDisk of a duplicate disk did not fail")
+	}
+	machine, _ := ctl.GetMachine("vm1")
+	if len(machine.Config.Disks) != 1 || machine.Config.Disks[0].DiskID() != "data" {
+		t.Fatalf("attached disk is not in the machine config: %+v", machine.Config.Disks)
+	}
+	saved, err := LoadConfig(machine.ConfigFile())
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	if len(saved.Config.Disks) != 1 {
+		t.Errorf("attached disk was not persisted: %+v", saved.Config.Disks)
+	}
+
+	temporary := QemuDisk{File: "/images/scratch.qcow2", Format: "qcow2", Type: "ssd", Attach: "virtio"}
+	if err := ctl.AttachMachineDisk("vm1", temporary, true); err != nil {
+		t.Fatalf("AttachMachineDisk of a temporary disk failed: %s", err)
+	}
+	if machine, _ := ctl.GetMachine("vm1"); len(machine.Config.Disks) != 1 {
+		t.Errorf("temporary disk was added to the machine config: %+v", machine.Config.Disks)
+	}
+
+	if err := ctl.DetachMachineDisk("vm1", "data", false); err != nil {
+		t.Fatalf("DetachMachineDisk failed: %s", err)
+	}
+	if machine, _ := ctl.GetMachine("vm1"); len(machine.Config.Disks) != 0 {
+		t.Errorf("detached disk is still in the machine config: %+v", machine.Config.Disks)
+	}
+	if err := ctl.DetachMachineDisk("vm1", "data", false); err == nil {
+		t.Errorf("DetachMachineDisk of a detached disk did not fail")
+	}
+}
+
+// TestFakeMachineConcurrent runs controller operations on a machine while it
+// is read, go test -race checks the locking
+func TestCPUPinningOverlaps(t *testing.T) {
+	c := newTestController(t)
+	ctl := &c.MachineController
+
+	pinnings := map[string]map[string]string{
+		"vm1": {"0": "2-3", PinEmulator: "0"},
+		"vm2": {PinVCPUs: "3,5"},
+		"vm3": {"0": "7"},
+		"vm4": {"0": "0"},
+	}
+	for _, name := range []string{"vm1", "vm2", "vm3", "vm4"} {
+		if err := ctl.AddMachine(fakeMachine(name), c.Config); err != nil {
+			t.Fatalf("AddMachine %s failed: %s", name, err)
+		}
+		machine, _ := ctl.lockMachine(name)
+		machine.Config.CPUPinning = pinnings[name]
+		machine.opLock.Unlock()
+	}
+	// vm4 overlaps on the emulator cpu but is not running
+	for _, name := range []string{"vm2", "vm3"} {
+		if err := ctl.StartMachine(name); err != nil {
+			t.Fatalf("StartMachine %s failed: %s", name, err)
+		}
+	}
+	if err := ctl.StartMachine("vm1"); err != nil {
+		t.Fatalf("StartMachine vm1 failed: %s", err)
+	}
+	machine, err := ctl.GetMachine("vm1")
+	if err != nil {
+		t.Fatalf("GetMachine failed: %s", err)
+	}
+	want := []string{"vm2: 3"}
+	if len(machine.CPUPinningOverlaps) != len(want) || machine.CPUPinningOverlaps[0] != want[0] {
+		t.Errorf("cpu-pinning overlaps %v, expected %v", machine.CPUPinningOverlaps, want)
+	}
+}
+
+func TestFakeMachineConcurrent(t *testing.T) {
+	c := newTestController(t)
+	ctl := &c.MachineController
+
+	if err := ctl.AddMachine(fakeMachine("vm1"), c.Config); err != nil {
+		t.Fatalf("AddMachine failed: %s", err)
+	}
+	machine, _ := ctl.lockMachine("vm1")
+	machine.Config.Boot = BootOnceCdrom
+	machine.opLock.Unlock()
+
+	collector := &machineCollector{ctl: ctl}
+	var wg sync.WaitGroup
+	var done atomic.Bool
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				ctl.GetMachines()
+				ctl.GetMachine("vm1")
+				ctl.GetMachineConsole("vm1", SerialConsole)
+				collector.samples()
+			}
+		}()
+	}
+
+	run := func(n int, op func() error) int32 {
+		var ok int32
+		var opWG sync.WaitGroup
+		for i := 0; i < n; i++ {
+			opWG.Add(1)
+			go func() {
+				defer opWG.Done()
+				if op() == nil {
+					atomic.AddInt32(&ok, 1)
+				}
+			}()
+		}
+		opWG.Wait()
+		return ok
+	}
+
+	if started := run(4, func() error { return ctl.StartMachine("vm1") }); started != 1 {
+		t.Errorf("%d concurrent starts succeeded, expected 1", started)
+	}
+	run(2, func() error {
+		ctl.completeMachineBootOnce("vm1")
+		return ctl.UpdateMachine(fakeMachine("vm1"), c.Config)
+	})
+	if machine, _ := ctl.GetMachine("vm1"); machine.Status != MachineStatusRunning {
+		t.Errorf("updated machine status is %s, expected %s", machine.Status, MachineStatusRunning)
+	}
+	disk := QemuDisk{File: "/images/data.qcow2", Attach: "virtio", Size: 1024 * 1024 * 1024}
+	if attached := run(4, func() error { return ctl.AttachMachineDisk("vm1", disk, false) }); attached != 1 {
+		t.Errorf("%d concurrent attaches of a disk succeeded, expected 1", attached)
+	}
+	if detached := run(4, func() error { return ctl.DetachMachineDisk("vm1", "data", false) }); detached != 1 {
+		t.Errorf("%d concurrent detaches of a disk succeeded, expected 1", detached)
+	}
+	if stopped := run(4, func() error { return ctl.StopMachine("vm1", false) }); stopped != 1 {
+		t.Errorf("%d concurrent stops succeeded, expected 1", stopped)
+	}
+	run(2, func() error { return ctl.DeleteMachine("vm1", c.Config) })
+	done.Store(true)
+	wg.Wait()
+
+	if machines := ctl.GetMachines(); len(machines) != 0 {
+		t.Errorf("deleted machine still exists: %+v", machines)
+	}
+}
@@ -0,0 +1,377 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/raharper/qcli"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	FirmwareBIOS = "bios"
+	FirmwareUEFI = "uefi"
+)
+
+// QEMU firmware descriptor search path, in order of precedence, see
+// docs/interop/firmware.json in the QEMU source tree.
+var FirmwareDescriptorDirs = []string{
+	"/etc/qemu/firmware",
+	"/usr/share/qemu/firmware",
+}
+
+// FirmwareDef selects the VM firmware.  UEFI firmware is taken from an
+// explicit Code (and Vars template) path, a QEMU firmware descriptor name or
+// the system OVMF files.  BIOS firmware uses QEMU's default SeaBIOS unless
+// Code is set.
+type FirmwareDef struct {
+	Type       string `yaml:"type,omitempty"`
+	Code       string `yaml:"code,omitempty"`
+	Vars       string `yaml:"vars,omitempty"`
+	Descriptor string `yaml:"descriptor,omitempty"`
+}
+
+// FirmwareDescriptor is the subset of a QEMU firmware descriptor used to
+// select firmware.
+type FirmwareDescriptor struct {
+	Path           string   `json:"-"`
+	Description    string   `json:"description"`
+	InterfaceTypes []string `json:"interface-types"`
+	Mapping        struct {
+		Device     string `json:"device"`
+		Filename   string `json:"filename"`
+		Executable struct {
+			Filename string `json:"filename"`
+			Format   string `json:"format"`
+		} `json:"executable"`
+		NVRAMTemplate struct {
+			Filename string `json:"filename"`
+			Format   string `json:"format"`
+		} `json:"nvram-template"`
+	} `json:"mapping"`
+	Targets []struct {
+		Architecture string   `json:"architecture"`
+		Machines     []string `json:"machines"`
+	} `json:"targets"`
+	Features []string `json:"features"`
+}
+
+func (d *FirmwareDescriptor) HasFeature(feature string) bool {
+	for _, f := range d.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckFormat fails unless the executable and nvram-template are raw images,
+// the flash drives are attached with format=raw.
+func (d *FirmwareDescriptor) CheckFormat() error {
+	formats := map[string]string{
+		"executable":     d.Mapping.Executable.Format,
+		"nvram-template": d.Mapping.NVRAMTemplate.Format,
+	}
+	for _, name := range []string{"executable", "nvram-template"} {
+		if format := formats[name]; format != "" && format != "raw" {
+			return fmt.Errorf("Firmware descriptor %q %s format is %s, only raw is supported", d.Path, name, format)
+		}
+	}
+	return nil
+}
+
+func (d *FirmwareDescriptor) HasInterface(iface string) bool {
+	for _, i := range d.InterfaceTypes {
+		if i == iface {
+			return true
+		}
+	}
+	return false
+}
+
+// versionedMachineTypes maps machine type aliases to the name of their
+// versioned types, e.g. q35 is the latest pc-q35-<version>
+var versionedMachineTypes = map[string]string{
+	"q35": "pc-q35",
+	"pc":  "pc-i440fx",
+}
+
+// SupportsTarget reports if the firmware runs on arch machines of
+// machineType, any machine type if empty.  Descriptor machines are globs of
+// versioned types, e.g. virt-*
+func (d *FirmwareDescriptor) SupportsTarget(arch, machineType string) bool {
+	versioned := machineType
+	if name, ok := versionedMachineTypes[machineType]; ok {
+		versioned = name
+	}
+	for _, target := range d.Targets {
+		if target.Architecture != arch {
+			continue
+		}
+		if machineType == "" {
+			return true
+		}
+		for _, machine := range target.Machines {
+			if machine == machineType {
+				return true
+			}
+			if matched, _ := filepath.Match(machine, versioned+"-"); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FindFirmwareDescriptor returns the UEFI flash firmware descriptor with the
+// highest precedence for arch machines of machineType.
+func FindFirmwareDescriptor(arch, machineType string, secureBoot bool) (*FirmwareDescriptor, error) {
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, dir := range FirmwareDescriptorDirs {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			continue
+		}
+		for _, match := range matches {
+			// descriptors in earlier dirs override those with the same name
+			if !seen[filepath.Base(match)] {
+				seen[filepath.Base(match)] = true
+				names = append(names, match)
+			}
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return filepath.Base(names[i]) < filepath.Base(names[j]) })
+
+	for _, name := range names {
+		desc, err := LoadFirmwareDescriptor(name)
+		if err != nil {
+			log.Debugf("Skipping firmware descriptor: %s", err)
+			continue
+		}
+		if !desc.HasInterface(FirmwareUEFI) || desc.Mapping.Device != "flash" || desc.Mapping.NVRAMTemplate.Filename == "" {
+			continue
+		}
+		if !desc.SupportsTarget(arch, machineType) {
+			continue
+		}
+		if secureBoot != (desc.HasFeature("secure-boot") && desc.HasFeature("enrolled-keys")) {
+			continue
+		}
+		if err := desc.CheckFormat(); err != nil {
+			log.Debugf("Skipping firmware descriptor: %s", err)
+			continue
+		}
+		return desc, nil
+	}
+	return nil, fmt.Errorf("No UEFI firmware descriptor for %s %s found in %v", arch, machineType, FirmwareDescriptorDirs)
+}
+
+// LoadFirmwareDescriptor reads the descriptor by path or by name, e.g.
+// 50-edk2-x86_64-secure, from the descriptor search path.
+func LoadFirmwareDescriptor(name string) (*FirmwareDescriptor, error) {
+	descPath := ""
+	if strings.Contains(name, "/") {
+		descPath = name
+	} else {
+		fileName := strings.TrimSuffix(name, ".json") + ".json"
+		for _, dir := range FirmwareDescriptorDirs {
+			if PathExists(filepath.Join(dir, fileName)) {
+				descPath = filepath.Join(dir, fileName)
+				break
+			}
+		}
+		if descPath == "" {
+			return nil, fmt.Errorf("Firmware descriptor '%s' not found in %v", name, FirmwareDescriptorDirs)
+		}
+	}
+
+	content, err := os.ReadFile(descPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read firmware descriptor %q: %s", descPath, err)
+	}
+	desc := FirmwareDescriptor{Path: descPath}
+	if err := json.Unmarshal(content, &desc); err != nil {
+		return nil, fmt.Errorf("Failed to parse firmware descriptor %q: %s", descPath, err)
+	}
+	return &desc, nil
+}
+
+// insecureOVMFCode lists OVMF builds shipped by distros without secure boot
+var insecureOVMFCode = []string{
+	"OVMF_CODE.fd",
+	"OVMF_CODE_4M.fd",
+	"OVMF_CODE.pure-efi.fd",
+}
+
+// Sanitize validates the firmware of arch guests and resolves its paths
+func (f *FirmwareDef) Sanitize(arch string, secureBoot bool) error {
+	if f.Type == "" {
+		f.Type = FirmwareUEFI
+	}
+	switch f.Type {
+	case FirmwareBIOS:
+		if arch != ArchX86_64 {
+			return fmt.Errorf("firmware type %s is only supported on %s guests, found %s", f.Type, ArchX86_64, arch)
+		}
+		if secureBoot {
+			return fmt.Errorf("secure-boot requires UEFI firmware, found firmware type %s", f.Type)
+		}
+		if f.Vars != "" || f.Descriptor != "" {
+			return fmt.Errorf("firmware vars and descriptor are only valid for UEFI firmware")
+		}
+	case FirmwareUEFI:
+		if f.Descriptor != "" && (f.Code != "" || f.Vars != "") {
+			return fmt.Errorf("firmware descriptor cannot be combined with code or vars paths")
+		}
+		if f.Vars != "" && f.Code == "" {
+			return fmt.Errorf("firmware vars requires a firmware code path")
+		}
+		if secureBoot && f.Code != "" {
+			for _, insecure := range insecureOVMFCode {
+				if filepath.Base(f.Code) == insecure {
+					return fmt.Errorf("secure-boot requested but firmware code %q does not support secure boot", f.Code)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("invalid firmware type: found %s expected [%s %s]", f.Type, FirmwareBIOS, FirmwareUEFI)
+	}
+
+	for _, p := range []*string{&f.Code, &f.Vars} {
+		if *p == "" {
+			continue
+		}
+		fullPath, err := localPath(*p)
+		if err != nil {
+			return err
+		}
+		if !PathExists(fullPath) {
+			return fmt.Errorf("firmware file %q does not exist", fullPath)
+		}
+		*p = fullPath
+	}
+	return nil
+}
+
+const securePFlashGlobal = "driver=cfi.pflash01,property=secure,value=on"
+
+// setSMM toggles SMM, a secure pflash is only writable from SMM so the
+// secure pflash property is dropped when SMM is off.
+func setSMM(c *qcli.Config, enable bool) {
+	if enable {
+		c.Machine.SMM = "on"
+		return
+	}
+	c.Machine.SMM = "off"
+	globals := []string{}
+	for _, param := range c.GlobalParams {
+		if param != securePFlashGlobal {
+			globals = append(globals, param)
+		}
+	}
+	c.GlobalParams = globals
+}
+
+// ConfigureFirmware sets up BIOS or UEFI firmware for the VM and enables
+// SMM only when the firmware requires it.
+func ConfigureFirmware(c *qcli.Config, v VMDef, runDir string) error {
+	arch, err := v.GuestArch()
+	if err != nil {
+		return err
+	}
+	fw := v.Firmware
+	if err := fw.Sanitize(arch, v.SecureBoot); err != nil {
+		return err
+	}
+	qemuArch := QemuArches[arch]
+
+	if fw.Type == FirmwareBIOS {
+		log.Infof("Firmware: BIOS %s", fw.Code)
+		c.Bios = fw.Code
+		c.UEFIFirmwareDevices = []qcli.UEFIFirmwareDevice{}
+		if qemuArch.SMM {
+			setSMM(c, false)
+		}
+		return nil
+	}
+
+	requiresSMM := v.SecureBoot
+	var uefiDev *qcli.UEFIFirmwareDevice
+	switch {
+	case fw.Descriptor != "":
+		desc, err := LoadFirmwareDescriptor(fw.Descriptor)
+		if err != nil {
+			return err
+		}
+		if !desc.HasInterface(FirmwareUEFI) || desc.Mapping.Device != "flash" {
+			return fmt.Errorf("Firmware descriptor %q is not a UEFI flash firmware", desc.Path)
+		}
+		if len(desc.Targets) > 0 && !desc.SupportsTarget(arch, "") {
+			return fmt.Errorf("Firmware descriptor %q does not support %s guests", desc.Path, arch)
+		}
+		if v.SecureBoot && !(desc.HasFeature("secure-boot") && desc.HasFeature("enrolled-keys")) {
+			return fmt.Errorf("secure-boot requested but firmware descriptor %q lacks secure-boot with enrolled-keys", desc.Path)
+		}
+		if desc.Mapping.NVRAMTemplate.Filename == "" {
+			return fmt.Errorf("Firmware descriptor %q has no nvram-template", desc.Path)
+		}
+		if err := desc.CheckFormat(); err != nil {
+			return err
+		}
+		if desc.HasFeature("requires-smm") {
+			requiresSMM = true
+		}
+		uefiDev = &qcli.UEFIFirmwareDevice{
+			Code: desc.Mapping.Executable.Filename,
+			Vars: desc.Mapping.NVRAMTemplate.Filename,
+		}
+		log.Infof("Firmware: UEFI descriptor %s: %s", desc.Path, desc.Description)
+	case fw.Code != "":
+		uefiDev = &qcli.UEFIFirmwareDevice{Code: fw.Code, Vars: fw.Vars}
+		if fw.Vars == "" {
+			systemDev, err := systemUEFIFirmware(arch, qemuArch.MachineType, v.SecureBoot)
+			if err != nil {
+				return fmt.Errorf("failed to find a UEFI Vars template for %q: %s", fw.Code, err)
+			}
+			uefiDev.Vars = systemDev.Vars
+		}
+	default:
+		systemDev, err := systemUEFIFirmware(arch, qemuArch.MachineType, v.SecureBoot)
+		if err != nil {
+			return fmt.Errorf("failed to create a UEFI Firmware Device: %s", err)
+		}
+		uefiDev = systemDev
+	}
+	if uefiDev.Code == qcli.SecCodePath {
+		requiresSMM = true
+	}
+
+	if err := ConfigureUEFIVars(c, uefiDev, v.UEFIVars, runDir); err != nil {
+		return fmt.Errorf("Error configuring UEFI Vars: %s", err)
+	}
+	if qemuArch.SMM {
+		setSMM(c, requiresSMM)
+	}
+	log.Infof("Firmware: UEFI code %s vars %s smm %s", uefiDev.Code, c.UEFIFirmwareDevices[0].Vars, c.Machine.SMM)
+	return nil
+}
@@ -0,0 +1,241 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFirmwareSanitize(t *testing.T) {
+	dir := t.TempDir()
+	code := filepath.Join(dir, "OVMF_CODE.secboot.fd")
+	insecureCode := filepath.Join(dir, "OVMF_CODE.fd")
+	vars := filepath.Join(dir, "OVMF_VARS.fd")
+	for _, name := range []string{code, insecureCode, vars} {
+		if err := os.WriteFile(name, []byte("fw"), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		fw         FirmwareDef
+		arch       string
+		secureBoot bool
+		want       FirmwareDef
+		err        bool
+	}{
+		{
+			name: "defaults to uefi",
+			arch: ArchX86_64,
+			want: FirmwareDef{Type: FirmwareUEFI},
+		},
+		{
+			name: "bios",
+			fw:   FirmwareDef{Type: FirmwareBIOS},
+			arch: ArchX86_64,
+			want: FirmwareDef{Type: FirmwareBIOS},
+		},
+		{
+			name: "bios on aarch64",
+			fw:   FirmwareDef{Type: FirmwareBIOS},
+			arch: ArchAarch64,
+			err:  true,
+		},
+		{
+			name:       "bios with secure-boot",
+			fw:         FirmwareDef{Type: FirmwareBIOS},
+			arch:       ArchX86_64,
+			secureBoot: true,
+			err:        true,
+		},
+		{
+			name: "bios with vars",
+			fw:   FirmwareDef{Type: FirmwareBIOS, Vars: vars},
+			arch: ArchX86_64,
+			err:  true,
+		},
+		{
+			name: "uefi code and vars",
+			fw:   FirmwareDef{Code: code, Vars: vars},
+			arch: ArchX86_64,
+			want: FirmwareDef{Type: FirmwareUEFI, Code: code, Vars: vars},
+		},
+		{
+			name: "descriptor with code",
+			fw:   FirmwareDef{Descriptor: "50-edk2-x86_64", Code: code},
+			arch: ArchX86_64,
+			err:  true,
+		},
+		{
+			name: "vars without code",
+			fw:   FirmwareDef{Vars: vars},
+			arch: ArchX86_64,
+			err:  true,
+		},
+		{
+			name:       "secure-boot with insecure code",
+			fw:         FirmwareDef{Code: insecureCode},
+			arch:       ArchX86_64,
+			secureBoot: true,
+			err:        true,
+		},
+		{
+			name: "missing code",
+			fw:   FirmwareDef{Code: filepath.Join(dir, "missing.fd")},
+			arch: ArchX86_64,
+			err:  true,
+		},
+		{
+			name: "invalid type",
+			fw:   FirmwareDef{Type: "coreboot"},
+			arch: ArchX86_64,
+			err:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fw := tc.fw
+			err := fw.Sanitize(tc.arch, tc.secureBoot)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, sanitized to %+v", fw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if fw != tc.want {
+				t.Errorf("sanitized to %+v, expected %+v", fw, tc.want)
+			}
+		})
+	}
+}
+
+func TestFirmwareDescriptorSupportsTarget(t *testing.T) {
+	desc := FirmwareDescriptor{}
+	desc.Targets = append(desc.Targets, struct {
+		Architecture string   `json:"architecture"`
+		Machines     []string `json:"machines"`
+	}{Architecture: ArchX86_64, Machines: []string{"pc-q35-*"}})
+
+	testCases := []struct {
+		arch        string
+		machineType string
+		want        bool
+	}{
+		{arch: ArchX86_64, machineType: "", want: true},
+		{arch: ArchX86_64, machineType: "q35", want: true},
+		{arch: ArchX86_64, machineType: "pc-q35", want: true},
+		{arch: ArchX86_64, machineType: "pc", want: false},
+		{arch: ArchX86_64, machineType: "pc-i440fx", want: false},
+		{arch: ArchAarch64, machineType: "", want: false},
+	}
+
+	for _, tc := range testCases {
+		if got := desc.SupportsTarget(tc.arch, tc.machineType); got != tc.want {
+			t.Errorf("SupportsTarget(%s, %q) is %v, expected %v", tc.arch, tc.machineType, got, tc.want)
+		}
+	}
+}
+
+// writeDescriptor writes a UEFI flash firmware descriptor for x86_64 q35
+func writeDescriptor(t *testing.T, dir, name, description, format string, features ...string) {
+	t.Helper()
+	featureList := ""
+	for idx, feature := range features {
+		if idx > 0 {
+			featureList += ", "
+		}
+		featureList += `"` + feature + `"`
+	}
+	content := `{
+  "description": "` + description + `",
+  "interface-types": ["uefi"],
+  "mapping": {
+    "device": "flash",
+    "executable": {"filename": "/fw/` + name + `_CODE.fd", "format": "` + format + `"},
+    "nvram-template": {"filename": "/fw/` + name + `_VARS.fd", "format": "` + format + `"}
+  },
+  "targets": [{"architecture": "x86_64", "machines": ["pc-q35-*"]}],
+  "features": [` + featureList + `]
+}`
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create %s: %s", dir, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write descriptor %s: %s", name, err)
+	}
+}
+
+func TestFindFirmwareDescriptor(t *testing.T) {
+	etcDir := filepath.Join(t.TempDir(), "etc")
+	shareDir := filepath.Join(t.TempDir(), "share")
+	saved := FirmwareDescriptorDirs
+	FirmwareDescriptorDirs = []string{etcDir, shareDir}
+	defer func() { FirmwareDescriptorDirs = saved }()
+
+	writeDescriptor(t, shareDir, "40-edk2-qcow2", "qcow2 firmware", "qcow2")
+	writeDescriptor(t, shareDir, "50-edk2", "shipped firmware", "raw")
+	writeDescriptor(t, shareDir, "60-edk2-secure", "shipped secure firmware", "raw", "secure-boot", "enrolled-keys", "requires-smm")
+	// an admin override of a shipped descriptor takes precedence
+	writeDescriptor(t, etcDir, "50-edk2", "local firmware", "raw")
+
+	testCases := []struct {
+		name        string
+		arch        string
+		machineType string
+		secureBoot  bool
+		want        string
+		err         bool
+	}{
+		{name: "insecure", arch: ArchX86_64, machineType: "q35", want: "local firmware"},
+		{name: "secure", arch: ArchX86_64, machineType: "q35", secureBoot: true, want: "shipped secure firmware"},
+		{name: "other arch", arch: ArchAarch64, machineType: "virt", err: true},
+		{name: "other machine", arch: ArchX86_64, machineType: "pc-i440fx", err: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			desc, err := FindFirmwareDescriptor(tc.arch, tc.machineType, tc.secureBoot)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, found %s", desc.Path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if desc.Description != tc.want {
+				t.Errorf("found %q, expected %q", desc.Description, tc.want)
+			}
+		})
+	}
+
+	desc, err := LoadFirmwareDescriptor("40-edk2-qcow2")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := desc.CheckFormat(); err == nil {
+		t.Errorf("expected an error checking a qcow2 firmware descriptor")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/raharper/qcli"
+	log "github.com/sirupsen/logrus"
+)
+
+// VMs get a virtio-serial channel for the QEMU guest agent, qemu-ga in the
+// guest.  QEMU reports the guest opening the channel with a VSERPORT_CHANGE
+// event, machined only talks to agents which have it open.
+const (
+	GuestAgentSocketName = "qga.sock"
+	guestAgentChardevID  = "charqga0"
+	guestAgentPortID     = "qga0"
+	guestAgentPortName   = "org.qemu.guest_agent.0"
+	guestAgentTimeout    = time.Second * 2
+)
+
+// GuestAgentQemuParams returns the qemu parameters of the guest agent
+// channel, qcli does not support virtio-serial ports.
+func GuestAgentQemuParams(sockDir string) []string {
+	return []string{
+		"-device", "virtio-serial-pci,id=vser0",
+		"-chardev", fmt.Sprintf("socket,id=%s,path=%s,server=on,wait=off", guestAgentChardevID, filepath.Join(sockDir, GuestAgentSocketName)),
+		"-device", fmt.Sprintf("virtserialport,id=%s,chardev=%s,name=%s", guestAgentPortID, guestAgentChardevID, guestAgentPortName),
+	}
+}
+
+// BalloonQemuParams returns the qemu parameters of the memory balloon which
+// reports the memory the guest has, qcli.Config has no balloon devices.
+func BalloonQemuParams(c *qcli.Config) []string {
+	balloon := qcli.BalloonDevice{
+		ID:           "balloon0",
+		DeflateOnOOM: true,
+		Transport:    qcli.TransportPCI,
+	}
+	return balloon.QemuParams(c)
+}
+
+// GuestAgentCommand connects to the guest agent socket, synchronizes with
+// guest-sync and executes a single command returning the raw 'return' value.
+// The guest agent serves one client at a time, callers serialize commands.
+func GuestAgentCommand(ctx context.Context, socket, command string, args map[string]interface{}) (json.RawMessage, error) {
+	dialer := net.Dialer{Timeout: guestAgentTimeout}
+	conn, err := dialer.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to guest agent socket %s: %s", socket, err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(guestAgentTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+
+	// replies to commands of earlier clients which gave up may still be
+	// queued, read until the reply to our sync id
+	syncID := rand.Int63n(1 << 31)
+	if err := encoder.Encode(qmpCommand{Execute: "guest-sync", Arguments: map[string]interface{}{"id": syncID}}); err != nil {
+		return nil, fmt.Errorf("Failed to send guest-sync: %s", err)
+	}
+	for {
+		var msg qmpMessage
+		if err := decoder.Decode(&msg); err != nil {
+			return nil, fmt.Errorf("Failed to read guest agent reply to guest-sync: %s", err)
+		}
+		var id int64
+		if err := json.Unmarshal(msg.Return, &id); err == nil && id == syncID {
+			break
+		}
+	}
+
+	log.Debugf("guest agent %s executing '%s' args: %v", socket, command, args)
+	if err := encoder.Encode(qmpCommand{Execute: command, Arguments: args}); err != nil {
+		return nil, fmt.Errorf("Failed to send guest agent command '%s': %s", command, err)
+	}
+	var msg qmpMessage
+	if err := decoder.Decode(&msg); err != nil {
+		return nil, fmt.Errorf("Failed to read guest agent reply to '%s': %s", command, err)
+	}
+	if msg.Error != nil {
+		return nil, fmt.Errorf("guest agent command '%s' failed: %s: %s", command, msg.Error.Class, msg.Error.Description)
+	}
+	return msg.Return, nil
+}
@@ -18,11 +18,14 @@ package api
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/raharper/qcli"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
@@ -41,7 +44,12 @@ const (
 type StopChannel chan struct{}
 
 type MachineController struct {
-	Machines []Machine
+	Machines []*Machine
+
+	// lock guards the Machines slice, it is held for writing to add or
+	// remove machines and for reading to look machines up.  It is not held
+	// while operating on a machine, the machine serializes its operations.
+	lock sync.RWMutex
 }
 
 type Machine struct {
@@ -54,47 +62,113 @@ type Machine struct {
 	Status      string
 	statusCode  int64
 	vmCount     sync.WaitGroup
-	instance    *VM
+	instance    Instance
+	backend     Backend
+	bootOnceFn  func()
+
+	// Resources limits the processes of the running machine
+	Resources MachineResources `yaml:"resources,omitempty"`
+
+	// TPMStatus reports the swtpm of a running machine with a TPM
+	TPMStatus    *SwTPMStatus `yaml:"-"`
+	tpmRestartFn func()
+	tpmRestarts  int
+
+	// CPUPinningOverlaps reports the running machines pinned to the same
+	// host cpus as the machine when it started, e.g. "vm2: 2-3"
+	CPUPinningOverlaps []string `yaml:"-"`
+
+	// opLock serializes the operations on the machine, e.g. start, stop
+	// and disk hotplug, and is held across their backend calls.  lock
+	// guards the fields operations change against readers and is only held
+	// briefly.  Locks are taken in the order opLock, controller lock, lock.
+	opLock  sync.Mutex
+	lock    sync.RWMutex
+	deleted bool
 }
 
-func (ctl *MachineController) GetMachineByName(machineName string) (*Machine, error) {
-	for id := range ctl.Machines {
-		machine := ctl.Machines[id]
+// a machine with tpm-failure-policy restart is restarted at most this many
+// times before it is marked failed
+const swTPMMaxRestarts = 3
+
+// findMachine returns the machine named machineName, the caller holds the
+// controller lock
+func (ctl *MachineController) findMachine(machineName string) (*Machine, error) {
+	for _, machine := range ctl.Machines {
 		if machine.Name == machineName {
-			machine.GetStatus()
-			ctl.Machines[id] = machine
-			return &machine, nil
+			return machine, nil
 		}
 	}
-	return &Machine{}, fmt.Errorf("Failed to find machine with Name: %s", machineName)
+	return nil, fmt.Errorf("Failed to find machine with Name: %s", machineName)
 }
 
-func (ctl *MachineController) GetMachines() []Machine {
-	for id := range ctl.Machines {
-		machine := ctl.Machines[id]
-		machine.GetStatus()
-		ctl.Machines[id] = machine
+// GetMachineByName returns the machine named machineName for reading, use
+// lockMachine to operate on it
+func (ctl *MachineController) GetMachineByName(machineName string) (*Machine, error) {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
+
+	return ctl.findMachine(machineName)
+}
+
+// lockMachine returns the machine named machineName with its operation lock
+// held, the caller releases it with opLock.Unlock()
+func (ctl *MachineController) lockMachine(machineName string) (*Machine, error) {
+	machine, err := ctl.GetMachineByName(machineName)
+	if err != nil {
+		return nil, err
 	}
+	machine.opLock.Lock()
+	if machine.deleted {
+		machine.opLock.Unlock()
+		return nil, fmt.Errorf("Failed to find machine with Name: %s", machineName)
+	}
+	return machine, nil
+}
+
+func (ctl *MachineController) GetMachines() []Machine {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
 
-	return ctl.Machines
+	machines := []Machine{}
+	for _, machine := range ctl.Machines {
+		machines = append(machines, machine.snapshot())
+	}
+	return machines
 }
 
 func (ctl *MachineController) GetMachine(machineName string) (Machine, error) {
-	for id := range ctl.Machines {
-		machine := ctl.Machines[id]
-		if machine.Name == machineName {
-			machine.GetStatus()
-			ctl.Machines[id] = machine
-			return machine, nil
-		}
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
+
+	machine, err := ctl.findMachine(machineName)
+	if err != nil {
+		return Machine{}, err
 	}
-	return Machine{}, fmt.Errorf("Failed to find machine with Name: %s", machineName)
+	return machine.snapshot(), nil
 }
 
 func (ctl *MachineController) AddMachine(newMachine Machine, cfg *MachineDaemonConfig) error {
-	if _, err := ctl.GetMachineByName(newMachine.Name); err == nil {
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+
+	if _, err := ctl.findMachine(newMachine.Name); err == nil {
 		return fmt.Errorf("Machine '%s' is already defined", newMachine.Name)
 	}
+	if _, err := GetBackend(newMachine.Type); err != nil {
+		return fmt.Errorf("Could not add '%s' machine: %s", newMachine.Name, err)
+	}
+	if err := newMachine.Resources.Validate(); err != nil {
+		return fmt.Errorf("Could not add '%s' machine: %s", newMachine.Name, err)
+	}
+	// cdroms of new machines attach to ide, which has a tray for changing
+	// media, machines defined before keep the scsi default
+	newMachine.Config.Disks = append([]QemuDisk{}, newMachine.Config.Disks...)
+	for idx := range newMachine.Config.Disks {
+		if newMachine.Config.Disks[idx].Type == "cdrom" && newMachine.Config.Disks[idx].Attach == "" {
+			newMachine.Config.Disks[idx].Attach = "ide"
+		}
+	}
 	newMachine.Status = MachineStatusStopped
 	newMachine.ctx = cfg.GetConfigContext()
 	if !newMachine.Ephemeral {
@@ -102,34 +176,47 @@ func (ctl *MachineController) AddMachine(newMachine Machine, cfg *MachineDaemonC
 			return fmt.Errorf("Could not save '%s' machine to %q: %s", newMachine.Name, newMachine.ConfigFile(), err)
 		}
 	}
-	ctl.Machines = append(ctl.Machines, newMachine)
+	ctl.Machines = append(ctl.Machines, &newMachine)
 	return nil
 }
 
 func (ctl *MachineController) StopMachines() error {
-	for idx, _ := range ctl.Machines {
-		machine := ctl.Machines[idx]
-		if machine.IsRunning() {
+	ctl.lock.RLock()
+	machines := append([]*Machine{}, ctl.Machines...)
+	ctl.lock.RUnlock()
+
+	for _, machine := range machines {
+		machine.opLock.Lock()
+		if !machine.deleted && machine.IsRunning() {
 			if err := machine.Stop(false); err != nil {
 				log.Infof("Error while stopping machine '%s': %s", machine.Name, err)
 			}
 		}
+		machine.opLock.Unlock()
 	}
 	return nil
 }
 
 func (ctl *MachineController) DeleteMachine(machineName string, cfg *MachineDaemonConfig) error {
-	machines := []Machine{}
-	for idx, _ := range ctl.Machines {
-		machine := ctl.Machines[idx]
-		if machine.Name != machineName {
-			machines = append(machines, machine)
-		} else {
-			err := machine.Delete()
-			if err != nil {
-				return fmt.Errorf("Machine:%s delete failed: %s", machine.Name, err)
-			}
-			log.Infof("Deleted machine: %s", machine.Name)
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		// deleting an unknown machine is a no-op
+		return nil
+	}
+	defer machine.opLock.Unlock()
+
+	if err := machine.Delete(); err != nil {
+		return fmt.Errorf("Machine:%s delete failed: %s", machine.Name, err)
+	}
+	log.Infof("Deleted machine: %s", machine.Name)
+	machine.deleted = true
+
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+	machines := []*Machine{}
+	for _, m := range ctl.Machines {
+		if m != machine {
+			machines = append(machines, m)
 		}
 	}
 	ctl.Machines = machines
@@ -141,46 +228,405 @@ func (ctl *MachineController) UpdateMachine(updateMachine Machine, cfg *MachineD
 	// maybe only the on-disk format if it's running? but what does subsequent
 	// GET return (on-disk or in-memory?)
 
-	for idx, machine := range ctl.Machines {
-		if machine.Name == updateMachine.Name {
-			updateMachine.ctx = cfg.GetConfigContext()
-			ctl.Machines[idx] = updateMachine
-			if !updateMachine.Ephemeral {
-				if err := updateMachine.SaveConfig(); err != nil {
-					return fmt.Errorf("Could not save '%s' machine to %q: %s", updateMachine.Name, updateMachine.ConfigFile(), err)
-				}
-			}
-			log.Infof("Updated machine '%s'", updateMachine.Name)
-			break
+	if err := updateMachine.Resources.Validate(); err != nil {
+		return fmt.Errorf("Could not update '%s' machine: %s", updateMachine.Name, err)
+	}
+	machine, err := ctl.lockMachine(updateMachine.Name)
+	if err != nil {
+		// updating an unknown machine is a no-op
+		return nil
+	}
+	defer machine.opLock.Unlock()
+
+	// the definition is updated in place, a running machine keeps its
+	// instance
+	machine.lock.Lock()
+	machine.Type = updateMachine.Type
+	machine.Config = updateMachine.Config
+	machine.Description = updateMachine.Description
+	machine.Ephemeral = updateMachine.Ephemeral
+	machine.Resources = updateMachine.Resources
+	machine.lock.Unlock()
+	if !machine.Ephemeral {
+		if err := machine.SaveConfig(); err != nil {
+			return fmt.Errorf("Could not save '%s' machine to %q: %s", machine.Name, machine.ConfigFile(), err)
 		}
 	}
+	log.Infof("Updated machine '%s'", machine.Name)
 	return nil
 }
 
 func (ctl *MachineController) StartMachine(machineName string) error {
-	for idx, machine := range ctl.Machines {
-		if machine.Name == machineName {
-			err := ctl.Machines[idx].Start()
-			if err != nil {
-				return fmt.Errorf("Could not start '%s' machine: %s", machineName, err)
-			}
-			return nil
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot start unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	overlaps := ctl.cpuPinningOverlaps(machineName)
+	machine.lock.Lock()
+	machine.bootOnceFn = func() {
+		ctl.completeMachineBootOnce(machineName)
+	}
+	machine.tpmRestarts = 0
+	machine.tpmRestartFn = func() {
+		ctl.restartMachineAfterTPMFailure(machineName)
+	}
+	machine.CPUPinningOverlaps = overlaps
+	machine.lock.Unlock()
+
+	if err := machine.Start(); err != nil {
+		return fmt.Errorf("Could not start '%s' machine: %s", machineName, err)
+	}
+	return nil
+}
+
+// cpuPinningOverlaps returns the running machines with cpu-pinning on the
+// same host cpus as machineName.  Overlaps are reported, not refused, as
+// sharing host cpus is only a problem for benchmarks.
+func (ctl *MachineController) cpuPinningOverlaps(machineName string) []string {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
+
+	machine, err := ctl.findMachine(machineName)
+	if err != nil {
+		return []string{}
+	}
+	machine.lock.RLock()
+	pinning := machine.Config.CPUPinning
+	machine.lock.RUnlock()
+	if len(pinning) == 0 {
+		return []string{}
+	}
+	overlaps := []string{}
+	for _, other := range ctl.Machines {
+		if other.Name == machineName || !other.IsRunning() {
+			continue
+		}
+		other.lock.RLock()
+		cpus := CPUPinningOverlap(pinning, other.Config.CPUPinning)
+		other.lock.RUnlock()
+		if len(cpus) > 0 {
+			log.Warnf("Machine %s cpu-pinning overlaps running machine %s on host cpus %s", machineName, other.Name, formatCPUList(cpus))
+			overlaps = append(overlaps, fmt.Sprintf("%s: %s", other.Name, formatCPUList(cpus)))
 		}
 	}
-	return fmt.Errorf("Failed to find machine '%s', cannot start unknown machine", machineName)
+	return overlaps
+}
+
+// completeMachineBootOnce switches a boot-once machine to boot from disk, the
+// machine is looked up by name as it may have been deleted since it started.
+func (ctl *MachineController) completeMachineBootOnce(machineName string) {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return
+	}
+	defer machine.opLock.Unlock()
+
+	if err := machine.CompleteBootOnce(); err != nil {
+		log.Errorf("Could not complete boot-once of '%s' machine: %s", machineName, err)
+	}
+}
+
+// restartMachineAfterTPMFailure restarts a machine whose swtpm failed, after
+// swTPMMaxRestarts restarts the machine is marked failed instead.
+func (ctl *MachineController) restartMachineAfterTPMFailure(machineName string) {
+	m, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return
+	}
+	defer m.opLock.Unlock()
+
+	if m.instance == nil {
+		return
+	}
+	if m.tpmRestarts >= swTPMMaxRestarts {
+		m.instance.Fail(fmt.Sprintf("swtpm failed after %d restarts", m.tpmRestarts))
+		return
+	}
+	m.lock.Lock()
+	m.tpmRestarts++
+	m.lock.Unlock()
+	log.Infof("Restarting machine %s after swtpm failure, restart %d of %d", machineName, m.tpmRestarts, swTPMMaxRestarts)
+	if err := m.Stop(true); err != nil {
+		log.Errorf("Could not stop '%s' machine after swtpm failure: %s", machineName, err)
+		return
+	}
+	if err := m.Start(); err != nil {
+		log.Errorf("Could not restart '%s' machine after swtpm failure: %s", machineName, err)
+	}
 }
 
 func (ctl *MachineController) StopMachine(machineName string, force bool) error {
-	for idx, machine := range ctl.Machines {
-		if machine.Name == machineName {
-			err := ctl.Machines[idx].Stop(force)
-			if err != nil {
-				return fmt.Errorf("Could not stop '%s' machine: %s", machineName, err)
-			}
-			return nil
-		}
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot stop unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	if err := machine.Stop(force); err != nil {
+		return fmt.Errorf("Could not stop '%s' machine: %s", machineName, err)
+	}
+	return nil
+}
+
+func (ctl *MachineController) AttachMachineDisk(machineName string, disk QemuDisk, temporary bool) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot attach disk to unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	if err := machine.AttachDisk(disk, temporary); err != nil {
+		return fmt.Errorf("Could not attach disk to '%s' machine: %s", machineName, err)
+	}
+	return nil
+}
+
+func (ctl *MachineController) DetachMachineDisk(machineName string, diskID string, temporary bool) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot detach disk from unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	if err := machine.DetachDisk(diskID, temporary); err != nil {
+		return fmt.Errorf("Could not detach disk from '%s' machine: %s", machineName, err)
+	}
+	return nil
+}
+
+func (ctl *MachineController) ResizeMachineDisk(machineName string, diskID string, size DiskSize, force bool) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot resize disk of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	if err := machine.ResizeDisk(diskID, size, force); err != nil {
+		return fmt.Errorf("Could not resize disk of '%s' machine: %s", machineName, err)
+	}
+	return nil
+}
+
+func (ctl *MachineController) ThrottleMachineDisk(machineName string, diskID string, throttle DiskThrottle, temporary bool) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot set disk throttle of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	if err := machine.ThrottleDisk(diskID, throttle, temporary); err != nil {
+		return fmt.Errorf("Could not set disk throttle of '%s' machine: %s", machineName, err)
+	}
+	return nil
+}
+
+func (ctl *MachineController) ListMachineMedia(machineName string) ([]MediaInfo, error) {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return []MediaInfo{}, fmt.Errorf("Failed to find machine '%s', cannot list media of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	return machine.ListMedia()
+}
+
+func (ctl *MachineController) EjectMachineMedia(machineName string, diskID string, force bool) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot eject media of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	if err := machine.EjectMedia(diskID, force); err != nil {
+		return fmt.Errorf("Could not eject media of '%s' machine: %s", machineName, err)
+	}
+	return nil
+}
+
+func (ctl *MachineController) InsertMachineMedia(machineName string, diskID string, file string, format string, force bool) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot insert media into unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	if err := machine.InsertMedia(diskID, file, format, force); err != nil {
+		return fmt.Errorf("Could not insert media into '%s' machine: %s", machineName, err)
+	}
+	return nil
+}
+
+func (ctl *MachineController) GetMachineResourceUsage(machineName string) (CgroupUsage, error) {
+	machine, err := ctl.GetMachineByName(machineName)
+	if err != nil {
+		return CgroupUsage{}, fmt.Errorf("Failed to find machine '%s', cannot get resource usage of unknown machine", machineName)
+	}
+	return machine.ResourceUsage()
+}
+
+func (ctl *MachineController) GetMachineStats(machineName string) (MachineStats, error) {
+	machine, err := ctl.GetMachineByName(machineName)
+	if err != nil {
+		return MachineStats{}, fmt.Errorf("Failed to find machine '%s', cannot get stats of unknown machine", machineName)
+	}
+	return machine.Stats()
+}
+
+func (ctl *MachineController) GetMachineTPMInfo(machineName string) (TPMInfo, error) {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return TPMInfo{}, fmt.Errorf("Failed to find machine '%s', cannot get TPM of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	return machine.TPMInfo()
+}
+
+func (ctl *MachineController) GetMachineTPMCertificates(machineName string, platform bool) ([]byte, error) {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find machine '%s', cannot get TPM certificates of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	return machine.TPMCertificates(platform)
+}
+
+func (ctl *MachineController) ResetMachineTPM(machineName string) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot reset TPM of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	if err := machine.ResetTPM(); err != nil {
+		return fmt.Errorf("Could not reset TPM of '%s' machine: %s", machineName, err)
+	}
+	return nil
+}
+
+func (ctl *MachineController) BackupMachineTPM(machineName string, w io.Writer) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot backup TPM of unknown machine", machineName)
 	}
-	return fmt.Errorf("Failed to find machine '%s', cannot stop unknown machine", machineName)
+	defer machine.opLock.Unlock()
+
+	if err := machine.BackupTPM(w); err != nil {
+		return fmt.Errorf("Could not backup TPM of '%s' machine: %s", machineName, err)
+	}
+	return nil
+}
+
+func (ctl *MachineController) RestoreMachineTPM(machineName string, r io.Reader) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot restore TPM of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	if err := machine.RestoreTPM(r); err != nil {
+		return fmt.Errorf("Could not restore TPM of '%s' machine: %s", machineName, err)
+	}
+	return nil
+}
+
+func (ctl *MachineController) RotateMachineDiskSecret(machineName string, diskID string) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot rotate disk secret of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	if err := machine.RotateDiskSecret(diskID); err != nil {
+		return fmt.Errorf("Could not rotate disk secret of '%s' machine: %s", machineName, err)
+	}
+	return nil
+}
+
+func (ctl *MachineController) ExportMachineDiskSecret(machineName string, diskID string) (DiskSecret, error) {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return DiskSecret{}, fmt.Errorf("Failed to find machine '%s', cannot export disk secret of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	secret, err := machine.ExportDiskSecret(diskID)
+	if err != nil {
+		return DiskSecret{}, fmt.Errorf("Could not export disk secret of '%s' machine: %s", machineName, err)
+	}
+	return secret, nil
+}
+
+func (ctl *MachineController) ListMachineUEFIVars(machineName string) ([]UEFIVariable, error) {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return []UEFIVariable{}, fmt.Errorf("Failed to find machine '%s', cannot access UEFI variables of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	return machine.ListUEFIVars()
+}
+
+func (ctl *MachineController) GetMachineUEFIVar(machineName, varName, guid string) (UEFIVariable, error) {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return UEFIVariable{}, fmt.Errorf("Failed to find machine '%s', cannot access UEFI variables of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	return machine.GetUEFIVar(varName, guid)
+}
+
+func (ctl *MachineController) SetMachineUEFIVar(machineName, varName, guid string, attributes uint32, data []byte) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot access UEFI variables of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	return machine.SetUEFIVar(varName, guid, attributes, data)
+}
+
+func (ctl *MachineController) DeleteMachineUEFIVar(machineName, varName, guid string) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot access UEFI variables of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	return machine.DeleteUEFIVar(varName, guid)
+}
+
+func (ctl *MachineController) EnrollMachineUEFIKeys(machineName, varName string, certificates [][]byte, owner string, appendCerts bool) error {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return fmt.Errorf("Failed to find machine '%s', cannot access UEFI variables of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	return machine.EnrollUEFIKeys(varName, certificates, owner, appendCerts)
+}
+
+// GetMachineUEFIVarsFile returns a copy of the machine's UEFI variable store
+// which stays consistent after the machine lock is released.
+func (ctl *MachineController) GetMachineUEFIVarsFile(machineName string) ([]byte, error) {
+	machine, err := ctl.lockMachine(machineName)
+	if err != nil {
+		return []byte{}, fmt.Errorf("Failed to find machine '%s', cannot access UEFI variables of unknown machine", machineName)
+	}
+	defer machine.opLock.Unlock()
+
+	if machine.IsRunning() {
+		return []byte{}, fmt.Errorf("Cannot export UEFI variables, machine %s is running", machine.Name)
+	}
+	varsFile, err := machine.UEFIVarsFile()
+	if err != nil {
+		return []byte{}, err
+	}
+	return os.ReadFile(varsFile)
 }
 
 type ConsoleInfo struct {
@@ -193,33 +639,32 @@ type ConsoleInfo struct {
 
 func (ctl *MachineController) GetMachineConsole(machineName string, consoleType string) (ConsoleInfo, error) {
 	consoleInfo := ConsoleInfo{Type: consoleType}
-	for _, machine := range ctl.Machines {
-		if machine.Name == machineName {
-			if consoleType == SerialConsole {
-				path, err := machine.SerialSocket()
-				if err != nil {
-					return consoleInfo, fmt.Errorf("Failed to get serial socket info: %s", err)
-				}
-				consoleInfo.Path = path
-				return consoleInfo, nil
-			}
-			if consoleType == VGAConsole {
-				spiceInfo, err := machine.SpiceConnection()
-				if err != nil {
-					return consoleInfo, fmt.Errorf("Failed to get spice connection info: %s", err)
-				}
-				consoleInfo.Addr = spiceInfo.HostAddress
-				consoleInfo.Port = spiceInfo.Port
-				if spiceInfo.TLSPort != "" {
-					consoleInfo.Port = spiceInfo.TLSPort
-					consoleInfo.Secure = true
-				}
-				return consoleInfo, nil
-			}
-			return consoleInfo, fmt.Errorf("Unknown console type '%s'", consoleType)
+	machine, err := ctl.GetMachineByName(machineName)
+	if err != nil {
+		return consoleInfo, fmt.Errorf("Failed to find machine '%s', cannot connect console to unknown machine", machineName)
+	}
+	if consoleType == SerialConsole {
+		path, err := machine.SerialSocket()
+		if err != nil {
+			return consoleInfo, fmt.Errorf("Failed to get serial socket info: %s", err)
+		}
+		consoleInfo.Path = path
+		return consoleInfo, nil
+	}
+	if consoleType == VGAConsole {
+		spiceInfo, err := machine.SpiceConnection()
+		if err != nil {
+			return consoleInfo, fmt.Errorf("Failed to get spice connection info: %s", err)
 		}
+		consoleInfo.Addr = spiceInfo.HostAddress
+		consoleInfo.Port = spiceInfo.Port
+		if spiceInfo.TLSPort != "" {
+			consoleInfo.Port = spiceInfo.TLSPort
+			consoleInfo.Secure = true
+		}
+		return consoleInfo, nil
 	}
-	return consoleInfo, fmt.Errorf("Failed to find machine '%s', cannot connect console to unknown machine", machineName)
+	return consoleInfo, fmt.Errorf("Unknown console type '%s'", consoleType)
 }
 
 //
@@ -252,6 +697,11 @@ func (cls *Machine) Context() context.Context {
 	return ctx
 }
 
+// RunDir is the VM run directory which holds the machine disk images
+func (cls *Machine) RunDir() string {
+	return filepath.Join(cls.StateDir(), cls.Config.Name)
+}
+
 func (cls *Machine) ConfigFile() string {
 	// FIXME: need to decide on the name of this yaml file
 	return filepath.Join(cls.ConfigDir(), "machine.yaml")
@@ -266,7 +716,9 @@ func (cls *Machine) SaveConfig() error {
 			return fmt.Errorf("Failed to create machinesDir %q: %s", machinesDir, err)
 		}
 	}
-	contents, err := yaml.Marshal(cls)
+	// marshal a copy, the encoder reads the locks of the machine as well
+	machine := cls.snapshot()
+	contents, err := yaml.Marshal(&machine)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal machine config: %s", err)
 	}
@@ -288,25 +740,66 @@ func LoadConfig(configFile string) (Machine, error) {
 	return newMachine, nil
 }
 
+// instanceStatus returns the machine status of a machine with an instance
+// of backend
+func instanceStatus(backend Backend, instance Instance) string {
+	if instance == nil {
+		return MachineStatusStopped
+	}
+	status := backend.Status(instance)
+	log.Debugf("VM:%s instance status: %s", instance.Name(), status.String())
+	// VMInit, VMStarted, VMStopped, VMFailed
+	switch status {
+	case VMInit:
+		return MachineStatusInitialized
+	case VMStarted:
+		return MachineStatusRunning
+	case VMFailed:
+		return MachineStatusFailed
+	}
+	return MachineStatusStopped
+}
+
+// state returns the instance, its backend and the status of the machine
+func (m *Machine) state() (Instance, Backend, string) {
+	m.lock.RLock()
+	instance := m.instance
+	backend := m.backend
+	m.lock.RUnlock()
+	return instance, backend, instanceStatus(backend, instance)
+}
+
 func (m *Machine) GetStatus() string {
-	if m.instance == nil {
-		m.Status = MachineStatusStopped
-	} else {
-		status := m.instance.Status()
-		log.Debugf("VM:%s instance status: %s", m.instance.Name(), status.String())
-		// VMInit, VMStarted, VMStopped, VMFailed
-		switch status {
-		case VMInit:
-			m.Status = MachineStatusInitialized
-		case VMStarted:
-			m.Status = MachineStatusRunning
-		case VMStopped:
-			m.Status = MachineStatusStopped
-		case VMFailed:
-			m.Status = MachineStatusFailed
+	_, _, status := m.state()
+	return status
+}
+
+// snapshot returns a copy of the machine for reporting with its status and
+// the status of its TPM
+func (m *Machine) snapshot() Machine {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	config := m.Config
+	config.Disks = append([]QemuDisk{}, m.Config.Disks...)
+	var tpmStatus *SwTPMStatus
+	if tpm, ok := m.instance.(TPMInstance); ok {
+		if tpmStatus = tpm.TPMStatus(); tpmStatus != nil {
+			tpmStatus.Restarts = m.tpmRestarts
 		}
 	}
-	return m.Status
+	return Machine{
+		ctx:                m.ctx,
+		Type:               m.Type,
+		Config:             config,
+		Description:        m.Description,
+		Ephemeral:          m.Ephemeral,
+		Name:               m.Name,
+		Status:             instanceStatus(m.backend, m.instance),
+		Resources:          m.Resources,
+		TPMStatus:          tpmStatus,
+		CPUPinningOverlaps: append([]string{}, m.CPUPinningOverlaps...),
+	}
 }
 
 func (m *Machine) Start() error {
@@ -315,23 +808,57 @@ func (m *Machine) Start() error {
 	if m.IsRunning() {
 		return fmt.Errorf("Machine is already running")
 	}
+	if err := m.start(); err != nil {
+		metricMachineStartFailures.WithLabelValues(m.Name, m.backendType()).Inc()
+		return err
+	}
+	return nil
+}
+
+func (m *Machine) start() error {
+	startTime := time.Now()
+
+	trustStore := ""
+	if m.Config.TPM && m.Config.TrustStore != "" {
+		dir, err := ResolveTrustStore(m.ctx.Value(mdcCtxDataDir).(string), m.Config.TrustStore)
+		if err != nil {
+			return fmt.Errorf("Failed to start machine '%s': %s", m.Name, err)
+		}
+		trustStore = dir
+	}
 
+	backend, err := GetBackend(m.Type)
+	if err != nil {
+		return fmt.Errorf("Failed to start machine '%s': %s", m.Name, err)
+	}
+	if err := m.placeSCSIDisks(); err != nil {
+		return fmt.Errorf("Failed to start machine '%s': %s", m.Name, err)
+	}
 	vmCtx := m.Context()
-	vm, err := newVM(vmCtx, m.Name, m.Config)
+	vm, err := backend.Create(vmCtx, m.Name, m.Config, InstanceOptions{
+		BootOnceFn:    m.bootOnceFn,
+		TPMRestartFn:  m.tpmRestartFn,
+		TPMTrustStore: trustStore,
+		Resources:     m.Resources,
+	})
 	if err != nil {
 		return fmt.Errorf("Failed to create new VM '%s': %s", m.Name, err)
 	}
+	m.lock.Lock()
 	m.instance = vm
+	m.backend = backend
+	m.lock.Unlock()
 	log.Infof("machine.Start()")
 
-	err = vm.Start()
+	err = backend.Start(vm)
 	if err != nil {
 		forceStop := true
-		vm.Stop(forceStop)
-		return fmt.Errorf("Failed to start VM '%s.%s': %s", m.Name, vm.Config.Name, err)
+		backend.Stop(vm, forceStop)
+		return fmt.Errorf("Failed to start VM '%s.%s': %s", m.Name, vm.Name(), err)
 	}
 
 	m.vmCount.Add(1)
+	observeMachineDuration(metricMachineStartSeconds, m, startTime)
 	return nil
 }
 
@@ -345,15 +872,16 @@ func (m *Machine) Stop(force bool) error {
 
 	if m.instance != nil {
 		log.Infof("Machine.Stop, VM instance: %s, calling stop", m.Name)
-		err := m.instance.Stop(force)
+		startTime := time.Now()
+		err := m.backend.Stop(m.instance, force)
 		if err != nil {
 			return fmt.Errorf("Failed to stop VM '%s': %s", m.Name, err)
 		}
+		observeMachineDuration(metricMachineStopSeconds, m, startTime)
 		m.vmCount.Done()
 	} else {
 		log.Debugf("Machine instanace was nil, marking stop")
 	}
-	m.Status = MachineStatusStopped
 	return nil
 }
 
@@ -383,17 +911,40 @@ func (m *Machine) Delete() error {
 		}
 	}
 
+	m.lock.Lock()
 	m.instance = nil
+	m.backend = nil
+	m.lock.Unlock()
 
 	return nil
 }
 
+// CompleteBootOnce records that the boot-once cdrom boot is done so the
+// machine boots from disk from now on.
+func (m *Machine) CompleteBootOnce() error {
+	if m.Config.Boot != BootOnceCdrom {
+		return nil
+	}
+	log.Infof("Machine %s boot-once complete, switching boot to %s", m.Name, BootDisk)
+	m.lock.Lock()
+	m.Config.Boot = BootDisk
+	m.lock.Unlock()
+	if m.Ephemeral {
+		return nil
+	}
+	return m.SaveConfig()
+}
+
 func (m *Machine) IsRunning() bool {
 	return m.GetStatus() == MachineStatusRunning
 }
 
 func (m *Machine) SerialSocket() (string, error) {
-	return m.instance.SerialSocket()
+	instance, backend, _ := m.state()
+	if instance == nil {
+		return "", fmt.Errorf("Machine %s is not running", m.Name)
+	}
+	return backend.Console(instance)
 }
 
 type SpiceConnection struct {
@@ -406,7 +957,15 @@ type SpiceConnection struct {
 func (m *Machine) SpiceConnection() (SpiceConnection, error) {
 	spiceCon := SpiceConnection{}
 
-	spiceDev, err := m.instance.SpiceDevice()
+	instance, _, _ := m.state()
+	if instance == nil {
+		return SpiceConnection{}, fmt.Errorf("Machine %s is not running", m.Name)
+	}
+	spice, ok := instance.(SpiceInstance)
+	if !ok {
+		return SpiceConnection{}, fmt.Errorf("Machine %s does not have a SPICE console", m.Name)
+	}
+	spiceDev, err := spice.SpiceDevice()
 	if err != nil {
 		return SpiceConnection{}, err
 	}
@@ -417,3 +976,535 @@ func (m *Machine) SpiceConnection() (SpiceConnection, error) {
 
 	return spiceCon, nil
 }
+
+// diskInstance returns the instance of the running machine for changing its
+// disks, the caller holds the operation lock
+func (m *Machine) diskInstance() (DiskInstance, error) {
+	disks, ok := m.instance.(DiskInstance)
+	if !ok {
+		return nil, fmt.Errorf("Machine %s does not support changing disks while running", m.Name)
+	}
+	return disks, nil
+}
+
+// mediaInstance returns the instance of the running machine for changing its
+// cdrom media, the caller holds the operation lock
+func (m *Machine) mediaInstance() (MediaInstance, error) {
+	media, ok := m.instance.(MediaInstance)
+	if !ok {
+		return nil, fmt.Errorf("Machine %s does not support removable media", m.Name)
+	}
+	return media, nil
+}
+
+func (m *Machine) findDisk(diskID string) (int, error) {
+	for idx := range m.Config.Disks {
+		if m.Config.Disks[idx].DiskID() == diskID {
+			return idx, nil
+		}
+	}
+	return -1, fmt.Errorf("Machine %s has no disk with id '%s'", m.Name, diskID)
+}
+
+// AttachDisk adds disk to the machine, hot-adding it if the machine is
+// running.  Unless temporary is set, the disk is persisted to the machine
+// config.
+func (m *Machine) AttachDisk(disk QemuDisk, temporary bool) error {
+	if _, err := m.findDisk(disk.DiskID()); err == nil {
+		return fmt.Errorf("Machine %s already has a disk with id '%s'", m.Name, disk.DiskID())
+	}
+
+	if m.IsRunning() {
+		attached := disk
+		disks, err := m.diskInstance()
+		if err != nil {
+			return err
+		}
+		if err := disks.AttachDisk(&attached); err != nil {
+			return err
+		}
+		// keep the disk on the controller and unit it was hotplugged on
+		disk.Controller = attached.Controller
+		disk.Unit = attached.Unit
+	} else {
+		if temporary {
+			return fmt.Errorf("Cannot attach temporary disk, machine %s is not running", m.Name)
+		}
+		// validate a copy, the disk is created on next start
+		check := disk
+		if err := check.Sanitize(m.StateDir()); err != nil {
+			return err
+		}
+	}
+
+	if temporary {
+		return nil
+	}
+	m.lock.Lock()
+	m.Config.Disks = append(m.Config.Disks, disk)
+	m.lock.Unlock()
+	if !m.Ephemeral {
+		return m.SaveConfig()
+	}
+	return nil
+}
+
+// placeSCSIDisks records the controller and unit of the scsi disks in the
+// machine config.  Without this the units of the remaining disks would change
+// on the next start once a disk is detached.
+func (m *Machine) placeSCSIDisks() error {
+	planned, err := PlanSCSIDisks(m.RunDir(), m.Config.Disks)
+	if err != nil {
+		return err
+	}
+	changed := false
+	m.lock.Lock()
+	for idx := range m.Config.Disks {
+		disk := &m.Config.Disks[idx]
+		if planned[idx].Attach != "scsi" {
+			continue
+		}
+		if disk.Controller != planned[idx].Controller || disk.Unit != planned[idx].Unit {
+			disk.Controller = planned[idx].Controller
+			disk.Unit = planned[idx].Unit
+			changed = true
+		}
+	}
+	m.lock.Unlock()
+	if changed && !m.Ephemeral {
+		return m.SaveConfig()
+	}
+	return nil
+}
+
+// DetachDisk removes the disk with diskID from the machine, hot-removing it
+// if the machine is running.  Unless temporary is set, the disk is removed
+// from the machine config.
+func (m *Machine) DetachDisk(diskID string, temporary bool) error {
+	idx, err := m.findDisk(diskID)
+	if err != nil {
+		return err
+	}
+
+	if m.IsRunning() {
+		disk := m.Config.Disks[idx]
+		disks, err := m.diskInstance()
+		if err != nil {
+			return err
+		}
+		if err := disks.DetachDisk(&disk); err != nil {
+			return err
+		}
+	} else if temporary {
+		return fmt.Errorf("Cannot detach disk temporarily, machine %s is not running", m.Name)
+	}
+
+	if temporary {
+		return nil
+	}
+	m.lock.Lock()
+	m.Config.Disks = append(m.Config.Disks[:idx], m.Config.Disks[idx+1:]...)
+	m.lock.Unlock()
+	if !m.Ephemeral {
+		return m.SaveConfig()
+	}
+	return nil
+}
+
+// ResizeDisk changes the size of the disk with diskID, online via QMP if the
+// machine is running, or with qemu-img if it is stopped.  The new size is
+// persisted to the machine config.
+func (m *Machine) ResizeDisk(diskID string, size DiskSize, force bool) error {
+	idx, err := m.findDisk(diskID)
+	if err != nil {
+		return err
+	}
+	if size <= 0 {
+		return fmt.Errorf("Invalid disk size %d", size)
+	}
+
+	disk := m.Config.Disks[idx]
+	if disk.Type == "cdrom" {
+		return fmt.Errorf("Cannot resize cdrom disk '%s'", diskID)
+	}
+	if m.IsRunning() {
+		disks, err := m.diskInstance()
+		if err != nil {
+			return err
+		}
+		if err := disks.ResizeDisk(&disk, size, force); err != nil {
+			return err
+		}
+	} else {
+		if err := disk.Sanitize(m.RunDir()); err != nil {
+			return err
+		}
+		imagePath := disk.ImagePath(m.RunDir())
+		if !PathExists(imagePath) {
+			return fmt.Errorf("Disk image %q does not exist, start the machine once to create it", imagePath)
+		}
+		if err := disk.Resize(m.RunDir(), imagePath, size, force); err != nil {
+			return err
+		}
+	}
+
+	// imported disks now refer to the resized image instead of the source
+	updated := m.Config.Disks[idx]
+	if updated.Size == 0 {
+		if err := disk.Sanitize(m.RunDir()); err != nil {
+			return err
+		}
+		updated.File = disk.ImagePath(m.RunDir())
+	}
+	updated.Size = size
+	m.lock.Lock()
+	m.Config.Disks[idx] = updated
+	m.lock.Unlock()
+	if !m.Ephemeral {
+		return m.SaveConfig()
+	}
+	return nil
+}
+
+// ThrottleDisk sets the IO limits of the disk with diskID, applying them
+// immediately if the machine is running.  Unless temporary is set, the limits
+// are persisted to the machine config.
+func (m *Machine) ThrottleDisk(diskID string, throttle DiskThrottle, temporary bool) error {
+	idx, err := m.findDisk(diskID)
+	if err != nil {
+		return err
+	}
+	if err := throttle.Validate(); err != nil {
+		return err
+	}
+
+	if m.IsRunning() {
+		disk := m.Config.Disks[idx]
+		disks, err := m.diskInstance()
+		if err != nil {
+			return err
+		}
+		if err := disks.SetDiskThrottle(&disk, throttle); err != nil {
+			return err
+		}
+	} else if temporary {
+		return fmt.Errorf("Cannot set temporary disk throttle, machine %s is not running", m.Name)
+	}
+
+	if temporary {
+		return nil
+	}
+	m.lock.Lock()
+	m.Config.Disks[idx].Throttle = throttle
+	m.lock.Unlock()
+	if !m.Ephemeral {
+		return m.SaveConfig()
+	}
+	return nil
+}
+
+// RotateDiskSecret replaces the key of the encrypted disk with diskID.  The
+// machine must be stopped.
+func (m *Machine) RotateDiskSecret(diskID string) error {
+	idx, err := m.findDisk(diskID)
+	if err != nil {
+		return err
+	}
+	if m.IsRunning() {
+		return fmt.Errorf("Cannot rotate disk secret, machine %s is running", m.Name)
+	}
+	disk := m.Config.Disks[idx]
+	if err := disk.Sanitize(m.RunDir()); err != nil {
+		return err
+	}
+	imagePath := disk.ImagePath(m.RunDir())
+	if !PathExists(imagePath) {
+		return fmt.Errorf("Disk image %q does not exist, start the machine once to create it", imagePath)
+	}
+	return disk.RotateSecret(m.RunDir(), imagePath)
+}
+
+// ExportDiskSecret returns the key of the encrypted disk with diskID
+func (m *Machine) ExportDiskSecret(diskID string) (DiskSecret, error) {
+	idx, err := m.findDisk(diskID)
+	if err != nil {
+		return DiskSecret{}, err
+	}
+	disk := m.Config.Disks[idx]
+	return disk.ExportSecret(m.RunDir())
+}
+
+// ListMedia returns the cdrom drives of the running machine
+func (m *Machine) ListMedia() ([]MediaInfo, error) {
+	if !m.IsRunning() {
+		return []MediaInfo{}, fmt.Errorf("Cannot list media, machine %s is not running", m.Name)
+	}
+	media, err := m.mediaInstance()
+	if err != nil {
+		return []MediaInfo{}, err
+	}
+	return media.ListMedia()
+}
+
+// EjectMedia removes the media from cdrom diskID of the running machine.
+// Media changes are not persisted to the machine config.
+func (m *Machine) EjectMedia(diskID string, force bool) error {
+	if !m.IsRunning() {
+		return fmt.Errorf("Cannot eject media, machine %s is not running", m.Name)
+	}
+	media, err := m.mediaInstance()
+	if err != nil {
+		return err
+	}
+	return media.EjectMedia(diskID, force)
+}
+
+// InsertMedia replaces the media of cdrom diskID of the running machine.
+// Media changes are not persisted to the machine config.
+func (m *Machine) InsertMedia(diskID, file, format string, force bool) error {
+	if !m.IsRunning() {
+		return fmt.Errorf("Cannot insert media, machine %s is not running", m.Name)
+	}
+	media, err := m.mediaInstance()
+	if err != nil {
+		return err
+	}
+	return media.InsertMedia(diskID, file, format, force)
+}
+
+// ResourceUsage returns the cgroup usage of the running machine
+func (m *Machine) ResourceUsage() (CgroupUsage, error) {
+	instance, _, status := m.state()
+	if instance == nil || status != MachineStatusRunning {
+		return CgroupUsage{}, fmt.Errorf("Machine %s is not running", m.Name)
+	}
+	stats, ok := instance.(StatsInstance)
+	if !ok {
+		return CgroupUsage{}, fmt.Errorf("Machine %s does not report resource usage", m.Name)
+	}
+	return stats.CgroupUsage()
+}
+
+// Stats samples the resource usage of the running machine
+func (m *Machine) Stats() (MachineStats, error) {
+	instance, _, status := m.state()
+	if instance == nil || status != MachineStatusRunning {
+		return MachineStats{}, fmt.Errorf("Machine %s is not running", m.Name)
+	}
+	sampler, ok := instance.(StatsInstance)
+	if !ok {
+		return MachineStats{}, fmt.Errorf("Machine %s does not report stats", m.Name)
+	}
+	stats, err := sampler.Stats()
+	if err != nil {
+		return MachineStats{}, err
+	}
+	m.lock.RLock()
+	stats.Name = m.Name
+	stats.Type = m.backendType()
+	m.lock.RUnlock()
+	stats.Status = status
+	return stats, nil
+}
+
+// backendType returns the machine type, an empty type is the default
+// backend.  The caller holds the machine lock or the operation lock.
+func (m *Machine) backendType() string {
+	if m.Type == "" {
+		return DefaultBackend
+	}
+	return m.Type
+}
+
+// swTPM returns the SwTPM of the machine for managing its state, the state
+// must only be changed while the machine is stopped.
+func (m *Machine) swTPM() (*SwTPM, error) {
+	if !m.Config.TPM {
+		return nil, fmt.Errorf("Machine %s does not have a TPM", m.Name)
+	}
+	return &SwTPM{
+		StateDir: filepath.Join(m.RunDir(), SwTPMStateDirName),
+		Version:  m.Config.TPMVersion,
+	}, nil
+}
+
+func (m *Machine) TPMInfo() (TPMInfo, error) {
+	tpm, err := m.swTPM()
+	if err != nil {
+		return TPMInfo{}, err
+	}
+	return tpm.Info()
+}
+
+func (m *Machine) TPMCertificates(platform bool) ([]byte, error) {
+	tpm, err := m.swTPM()
+	if err != nil {
+		return nil, err
+	}
+	return tpm.Certificates(platform)
+}
+
+func (m *Machine) ResetTPM() error {
+	if m.IsRunning() {
+		return fmt.Errorf("Cannot reset TPM, machine %s is running", m.Name)
+	}
+	tpm, err := m.swTPM()
+	if err != nil {
+		return err
+	}
+	return tpm.Reset()
+}
+
+func (m *Machine) BackupTPM(w io.Writer) error {
+	if m.IsRunning() {
+		return fmt.Errorf("Cannot backup TPM, machine %s is running", m.Name)
+	}
+	tpm, err := m.swTPM()
+	if err != nil {
+		return err
+	}
+	return tpm.Backup(w)
+}
+
+func (m *Machine) RestoreTPM(r io.Reader) error {
+	if m.IsRunning() {
+		return fmt.Errorf("Cannot restore TPM, machine %s is running", m.Name)
+	}
+	tpm, err := m.swTPM()
+	if err != nil {
+		return err
+	}
+	return tpm.Restore(r)
+}
+
+// UEFIVarsFile returns the path to the machine's copy of the UEFI variable
+// store, creating it from the firmware vars template if needed.
+func (m *Machine) UEFIVarsFile() (string, error) {
+	varsFile := filepath.Join(m.RunDir(), qcli.UEFIVarsFileName)
+	if PathExists(varsFile) {
+		return varsFile, nil
+	}
+	arch, err := m.Config.GuestArch()
+	if err != nil {
+		return "", err
+	}
+	fw := m.Config.Firmware
+	if err := fw.Sanitize(arch, m.Config.SecureBoot); err != nil {
+		return "", err
+	}
+	if fw.Type != FirmwareUEFI {
+		return "", fmt.Errorf("Machine %s does not use UEFI firmware", m.Name)
+	}
+	if err := EnsureDir(m.RunDir()); err != nil {
+		return "", err
+	}
+	if err := ConfigureFirmware(&qcli.Config{}, m.Config, m.RunDir()); err != nil {
+		return "", err
+	}
+	return varsFile, nil
+}
+
+// loadUEFIVars opens the machine's UEFI variable store, which the firmware
+// owns while the machine is running.
+func (m *Machine) loadUEFIVars() (*UEFIVarStore, error) {
+	if m.IsRunning() {
+		return nil, fmt.Errorf("Cannot access UEFI variables, machine %s is running", m.Name)
+	}
+	varsFile, err := m.UEFIVarsFile()
+	if err != nil {
+		return nil, err
+	}
+	return LoadUEFIVarStore(varsFile)
+}
+
+func (m *Machine) ListUEFIVars() ([]UEFIVariable, error) {
+	store, err := m.loadUEFIVars()
+	if err != nil {
+		return []UEFIVariable{}, err
+	}
+	vars := []UEFIVariable{}
+	for _, v := range store.Variables {
+		v.Data = nil
+		vars = append(vars, v)
+	}
+	return vars, nil
+}
+
+func uefiVarGUID(varName, guid string) (EFIGUID, error) {
+	if guid == "" {
+		return DefaultEFIVariableGUID(varName), nil
+	}
+	return ParseEFIGUID(guid)
+}
+
+func (m *Machine) GetUEFIVar(varName, guid string) (UEFIVariable, error) {
+	vendor, err := uefiVarGUID(varName, guid)
+	if err != nil {
+		return UEFIVariable{}, err
+	}
+	store, err := m.loadUEFIVars()
+	if err != nil {
+		return UEFIVariable{}, err
+	}
+	return store.Get(varName, vendor)
+}
+
+func (m *Machine) SetUEFIVar(varName, guid string, attributes uint32, data []byte) error {
+	vendor, err := uefiVarGUID(varName, guid)
+	if err != nil {
+		return err
+	}
+	store, err := m.loadUEFIVars()
+	if err != nil {
+		return err
+	}
+	store.Set(varName, vendor, attributes, data)
+	return store.Save()
+}
+
+func (m *Machine) DeleteUEFIVar(varName, guid string) error {
+	vendor, err := uefiVarGUID(varName, guid)
+	if err != nil {
+		return err
+	}
+	store, err := m.loadUEFIVars()
+	if err != nil {
+		return err
+	}
+	if err := store.Delete(varName, vendor); err != nil {
+		return err
+	}
+	return store.Save()
+}
+
+// EnrollUEFIKeys enrolls the PEM or DER certificates into the Secure Boot
+// key variable varName (PK, KEK, db or dbx).
+func (m *Machine) EnrollUEFIKeys(varName string, certificates [][]byte, owner string, appendCerts bool) error {
+	ownerGUID := MachineOwnerGUID
+	if owner != "" {
+		guid, err := ParseEFIGUID(owner)
+		if err != nil {
+			return err
+		}
+		ownerGUID = guid
+	}
+	certs := [][]byte{}
+	for _, certData := range certificates {
+		parsed, err := ParseCertificates(certData)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, parsed...)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("No certificates to enroll into %s", varName)
+	}
+	store, err := m.loadUEFIVars()
+	if err != nil {
+		return err
+	}
+	if err := store.EnrollCertificates(varName, certs, ownerGUID, appendCerts); err != nil {
+		return err
+	}
+	return store.Save()
+}
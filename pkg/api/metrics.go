@@ -0,0 +1,315 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// MetricsPath is served on MachineDaemonConfig.MetricsAddress
+const (
+	MetricsPath      = "/metrics"
+	metricsNamespace = "machined"
+
+	// a machine whose stats take longer is left out of the scrape
+	metricsStatsTimeout = time.Second * 3
+)
+
+var machineLabels = []string{"machine", "type"}
+
+// event metrics, the machine metrics are sampled on each scrape by
+// machineCollector
+var (
+	metricMachineStartSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "machine_start_duration_seconds",
+		Help:      "Time taken to start a machine.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, machineLabels)
+	metricMachineStopSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "machine_stop_duration_seconds",
+		Help:      "Time taken to stop a machine.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, machineLabels)
+	metricMachineStartFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "machine_start_failures_total",
+		Help:      "Number of failed machine starts.",
+	}, machineLabels)
+	metricQMPErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "qmp_errors_total",
+		Help:      "Number of failed QMP connections and commands.",
+	}, machineLabels)
+	metricAPIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_requests_total",
+		Help:      "Number of REST API requests by route and status code.",
+	}, []string{"method", "route", "code", "machine"})
+)
+
+var (
+	descMachines = prometheus.NewDesc(metricsNamespace+"_machines",
+		"Number of machines by status.", []string{"status"}, nil)
+	descMachineStatus = prometheus.NewDesc(metricsNamespace+"_machine_status",
+		"Status of a machine, 1 for its current status.", append(machineLabels, "status"), nil)
+	descMachineCPUs = prometheus.NewDesc(metricsNamespace+"_machine_cpus",
+		"Number of vcpus of a running machine.", machineLabels, nil)
+	descMachineCPUSeconds = prometheus.NewDesc(metricsNamespace+"_machine_cpu_seconds_total",
+		"Host cpu time used by a running machine.", machineLabels, nil)
+	descMachineRSSBytes = prometheus.NewDesc(metricsNamespace+"_machine_rss_bytes",
+		"Resident memory of the QEMU process of a running machine.", machineLabels, nil)
+	descMachineMemoryBytes = prometheus.NewDesc(metricsNamespace+"_machine_memory_bytes",
+		"Guest memory of a running machine.", machineLabels, nil)
+	descMachineBalloonBytes = prometheus.NewDesc(metricsNamespace+"_machine_balloon_bytes",
+		"Guest memory reported by the memory balloon of a running machine.", machineLabels, nil)
+	descMachineDiskReadBytes = prometheus.NewDesc(metricsNamespace+"_machine_disk_read_bytes_total",
+		"Bytes read by a disk of a running machine.", append(machineLabels, "device"), nil)
+	descMachineDiskWriteBytes = prometheus.NewDesc(metricsNamespace+"_machine_disk_write_bytes_total",
+		"Bytes written by a disk of a running machine.", append(machineLabels, "device"), nil)
+	descMachineDiskReadOps = prometheus.NewDesc(metricsNamespace+"_machine_disk_read_ops_total",
+		"Read operations of a disk of a running machine.", append(machineLabels, "device"), nil)
+	descMachineDiskWriteOps = prometheus.NewDesc(metricsNamespace+"_machine_disk_write_ops_total",
+		"Write operations of a disk of a running machine.", append(machineLabels, "device"), nil)
+	descMachineNetRxBytes = prometheus.NewDesc(metricsNamespace+"_machine_network_receive_bytes_total",
+		"Bytes received by a nic of a running machine, requires the guest agent.", append(machineLabels, "nic"), nil)
+	descMachineNetTxBytes = prometheus.NewDesc(metricsNamespace+"_machine_network_transmit_bytes_total",
+		"Bytes transmitted by a nic of a running machine, requires the guest agent.", append(machineLabels, "nic"), nil)
+	descMachineCgroupMemoryBytes = prometheus.NewDesc(metricsNamespace+"_machine_cgroup_memory_bytes",
+		"Memory charged to the cgroup of a running machine.", machineLabels, nil)
+	descMachineCgroupThrottledSeconds = prometheus.NewDesc(metricsNamespace+"_machine_cgroup_cpu_throttled_seconds_total",
+		"Time the cgroup of a running machine was throttled by its cpu-quota.", machineLabels, nil)
+	descMachineCgroupOOMKills = prometheus.NewDesc(metricsNamespace+"_machine_cgroup_oom_kills_total",
+		"Processes of a running machine killed by its memory-max.", machineLabels, nil)
+
+	machineStatuses = []string{
+		MachineStatusInitialized,
+		MachineStatusStopped,
+		MachineStatusStarting,
+		MachineStatusRunning,
+		MachineStatusStopping,
+		MachineStatusFailed,
+	}
+)
+
+// machineCollector samples the status and stats of the machines on scrape
+type machineCollector struct {
+	ctl *MachineController
+}
+
+// machineSample is a machine copied from the controller for a scrape
+type machineSample struct {
+	labels []string
+	status string
+	// stats is nil when the machine is not running or its backend does not
+	// report stats
+	stats StatsInstance
+}
+
+func (mc *machineCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		descMachines, descMachineStatus, descMachineCPUs, descMachineCPUSeconds,
+		descMachineRSSBytes, descMachineMemoryBytes, descMachineBalloonBytes,
+		descMachineDiskReadBytes, descMachineDiskWriteBytes, descMachineDiskReadOps, descMachineDiskWriteOps,
+		descMachineNetRxBytes, descMachineNetTxBytes,
+		descMachineCgroupMemoryBytes, descMachineCgroupThrottledSeconds, descMachineCgroupOOMKills,
+	} {
+		ch <- desc
+	}
+}
+
+// samples copies the machines, the controller is not held while sampling
+// their stats
+func (mc *machineCollector) samples() []machineSample {
+	mc.ctl.lock.RLock()
+	defer mc.ctl.lock.RUnlock()
+
+	samples := []machineSample{}
+	for _, m := range mc.ctl.Machines {
+		// the status is read from the same instance that is sampled
+		m.lock.RLock()
+		labels := []string{m.Name, m.backendType()}
+		instance := m.instance
+		backend := m.backend
+		m.lock.RUnlock()
+		stats, _ := instance.(StatsInstance)
+		samples = append(samples, machineSample{
+			labels: labels,
+			status: instanceStatus(backend, instance),
+			stats:  stats,
+		})
+	}
+	return samples
+}
+
+func (mc *machineCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := make(map[string]int)
+	for _, status := range machineStatuses {
+		counts[status] = 0
+	}
+	var wg sync.WaitGroup
+	for _, sample := range mc.samples() {
+		counts[sample.status]++
+		ch <- prometheus.MustNewConstMetric(descMachineStatus, prometheus.GaugeValue, 1, append(sample.labels, sample.status)...)
+		if sample.status != MachineStatusRunning || sample.stats == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(sample machineSample) {
+			defer wg.Done()
+			mc.collectStats(ch, sample)
+		}(sample)
+	}
+	wg.Wait()
+	for status, count := range counts {
+		ch <- prometheus.MustNewConstMetric(descMachines, prometheus.GaugeValue, float64(count), status)
+	}
+}
+
+// machineStats is the result of sampling a machine
+type machineStats struct {
+	stats    MachineStats
+	usage    CgroupUsage
+	err      error
+	usageErr error
+}
+
+// sampleStats samples the stats of a running machine, giving up after
+// metricsStatsTimeout so a hung QMP or guest agent does not stall the scrape
+func sampleStats(instance StatsInstance) (machineStats, error) {
+	done := make(chan machineStats, 1)
+	go func() {
+		var result machineStats
+		result.stats, result.err = instance.Stats()
+		if result.err == nil {
+			result.usage, result.usageErr = instance.CgroupUsage()
+		}
+		done <- result
+	}()
+	select {
+	case result := <-done:
+		return result, result.err
+	case <-time.After(metricsStatsTimeout):
+		return machineStats{}, fmt.Errorf("timed out after %s", metricsStatsTimeout)
+	}
+}
+
+func (mc *machineCollector) collectStats(ch chan<- prometheus.Metric, sample machineSample) {
+	labels := sample.labels
+	gauge := func(desc *prometheus.Desc, value float64, extra ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, append(labels, extra...)...)
+	}
+	counter := func(desc *prometheus.Desc, value float64, extra ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, append(labels, extra...)...)
+	}
+
+	result, err := sampleStats(sample.stats)
+	if err != nil {
+		log.Debugf("metrics: failed to get stats of machine %s: %s", labels[0], err)
+		return
+	}
+	stats := result.stats
+	gauge(descMachineCPUs, float64(stats.CPUs))
+	counter(descMachineCPUSeconds, float64(stats.CPUTimeUsec)/1e6)
+	gauge(descMachineRSSBytes, float64(stats.RSSBytes))
+	gauge(descMachineMemoryBytes, float64(stats.MemoryBytes))
+	if stats.BalloonActual > 0 {
+		gauge(descMachineBalloonBytes, float64(stats.BalloonActual))
+	}
+	for _, disk := range stats.Disks {
+		counter(descMachineDiskReadBytes, float64(disk.ReadBytes), disk.Device)
+		counter(descMachineDiskWriteBytes, float64(disk.WriteBytes), disk.Device)
+		counter(descMachineDiskReadOps, float64(disk.ReadOps), disk.Device)
+		counter(descMachineDiskWriteOps, float64(disk.WriteOps), disk.Device)
+	}
+	for _, nic := range stats.Nics {
+		counter(descMachineNetRxBytes, float64(nic.RxBytes), nic.ID)
+		counter(descMachineNetTxBytes, float64(nic.TxBytes), nic.ID)
+	}
+
+	// machines without a cgroup have no cgroup metrics
+	if result.usageErr != nil {
+		return
+	}
+	usage := result.usage
+	gauge(descMachineCgroupMemoryBytes, float64(usage.MemoryCurrent))
+	counter(descMachineCgroupThrottledSeconds, float64(usage.CPUThrottledUsec)/1e6)
+	counter(descMachineCgroupOOMKills, float64(usage.OOMKills))
+}
+
+// NewMetricsRegistry returns a registry with the machined process, machine
+// and event metrics of the controller
+func NewMetricsRegistry(c *Controller) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+		&machineCollector{ctl: &c.MachineController},
+		metricMachineStartSeconds,
+		metricMachineStopSeconds,
+		metricMachineStartFailures,
+		metricQMPErrors,
+		metricAPIRequests,
+	)
+	return registry
+}
+
+// apiMetricsMiddleware counts the REST API requests
+func apiMetricsMiddleware(ctx *gin.Context) {
+	ctx.Next()
+	route := ctx.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	metricAPIRequests.WithLabelValues(ctx.Request.Method, route, strconv.Itoa(ctx.Writer.Status()), ctx.Param("machinename")).Inc()
+}
+
+// observeMachineDuration records the duration of a machine start or stop
+func observeMachineDuration(histogram *prometheus.HistogramVec, m *Machine, start time.Time) {
+	histogram.WithLabelValues(m.Name, m.backendType()).Observe(time.Since(start).Seconds())
+}
+
+// StartMetricsServer serves the metrics on the TCP address, the listener is
+// created before returning so address errors are reported to the caller
+func (c *Controller) StartMetricsServer(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("Failed to listen for metrics on %s: %s", address, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, promhttp.HandlerFor(NewMetricsRegistry(c), promhttp.HandlerOpts{}))
+	c.MetricsServer = &http.Server{Handler: mux}
+
+	log.Infof("machined metrics available on: http://%s%s", listener.Addr(), MetricsPath)
+	go func() {
+		if err := c.MetricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("metrics server failed: %s", err)
+		}
+	}()
+	return nil
+}
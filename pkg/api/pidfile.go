@@ -0,0 +1,177 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// MachinedPidFileName is created in the machined runtime dir, so it stays
+// in place when socket-path points elsewhere
+const (
+	MachinedPidFileName = "machined.pid"
+	socketProbeTimeout  = time.Second * 2
+)
+
+// PidFile is a pidfile locked with flock for the life of the process, the
+// kernel releases the lock if the process dies
+type PidFile struct {
+	Path string
+	file *os.File
+}
+
+// LockPidFile locks the pidfile at path and writes the pid of machined to
+// it.  It fails with the pid of the running machined if another holds it.
+func LockPidFile(path string) (*PidFile, error) {
+	if err := EnsureDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	var file *os.File
+	for file == nil {
+		locked, err := openLockedFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// a machined releasing the pidfile removes it after we opened it,
+		// the lock on the removed file is worthless so lock the new one
+		same, err := isSameFile(locked, path)
+		if err != nil {
+			locked.Close()
+			return nil, fmt.Errorf("Failed to check pidfile %s: %s", path, err)
+		}
+		if !same {
+			locked.Close()
+			continue
+		}
+		file = locked
+	}
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Failed to write pidfile %s: %s", path, err)
+	}
+	if _, err := file.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Failed to write pidfile %s: %s", path, err)
+	}
+	return &PidFile{Path: path, file: file}, nil
+}
+
+// openLockedFile opens the pidfile at path and locks it
+func openLockedFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open pidfile %s: %s", path, err)
+	}
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		defer file.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			content, _ := os.ReadFile(path)
+			pid := strings.TrimSpace(string(content))
+			if pid == "" {
+				pid = "unknown"
+			}
+			return nil, fmt.Errorf("machined is already running with pid %s, it holds the lock on %s", pid, path)
+		}
+		return nil, fmt.Errorf("Failed to lock pidfile %s: %s", path, err)
+	}
+	return file, nil
+}
+
+// isSameFile reports if the open file is still the file at path
+func isSameFile(file *os.File, path string) (bool, error) {
+	var fileStat, pathStat unix.Stat_t
+	if err := unix.Fstat(int(file.Fd()), &fileStat); err != nil {
+		return false, err
+	}
+	if err := unix.Stat(path, &pathStat); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return false, nil
+		}
+		return false, err
+	}
+	return fileStat.Dev == pathStat.Dev && fileStat.Ino == pathStat.Ino, nil
+}
+
+// Release removes the pidfile and drops the lock
+func (p *PidFile) Release() error {
+	// remove before unlocking, a machined which opened the file before it
+	// was removed gets the lock on the removed file afterwards and retries
+	// with a new file in LockPidFile
+	err := os.Remove(p.Path)
+	p.file.Close()
+	return err
+}
+
+// RemoveStaleSocket removes the unix socket at path unless a process still
+// accepts connections on it, the socket of a machined which did not exit
+// cleanly is left behind.
+func RemoveStaleSocket(path string) error {
+	if !PathExists(path) {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", path, socketProbeTimeout)
+	if err == nil {
+		defer conn.Close()
+		owner := "another process"
+		if pid, err := socketPeerPid(conn); err == nil {
+			owner = fmt.Sprintf("the process with pid %d", pid)
+		}
+		return fmt.Errorf("socket %s is in use by %s, is another machined running?", path, owner)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("Failed to probe existing socket %s: %s", path, err)
+	}
+	log.Infof("Removing stale socket %s", path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove stale socket %s: %s", path, err)
+	}
+	return nil
+}
+
+// socketPeerPid returns the pid of the process listening on the other end
+// of a unix socket connection
+func socketPeerPid(conn net.Conn) (int32, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("not a unix socket connection")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return cred.Pid, nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLockPidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", MachinedPidFileName)
+	pid := fmt.Sprintf("%d", os.Getpid())
+
+	pidFile, err := LockPidFile(path)
+	if err != nil {
+		t.Fatalf("LockPidFile failed: %s", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read pidfile: %s", err)
+	}
+	if strings.TrimSpace(string(content)) != pid {
+		t.Errorf("pidfile contains %q, expected %s", content, pid)
+	}
+
+	// flock locks the open file, so a second lock fails within a process too
+	_, err = LockPidFile(path)
+	if err == nil {
+		t.Fatalf("LockPidFile of a locked pidfile did not fail")
+	}
+	if !strings.Contains(err.Error(), "pid "+pid) {
+		t.Errorf("error %q does not name the pid of the lock holder %s", err, pid)
+	}
+
+	if err := pidFile.Release(); err != nil {
+		t.Fatalf("Release failed: %s", err)
+	}
+	if PathExists(path) {
+		t.Errorf("released pidfile %s was not removed", path)
+	}
+
+	// the pidfile of a machined which died is not locked
+	if err := os.WriteFile(path, []byte("999999\n"), 0644); err != nil {
+		t.Fatalf("failed to write stale pidfile: %s", err)
+	}
+	pidFile, err = LockPidFile(path)
+	if err != nil {
+		t.Fatalf("LockPidFile of a stale pidfile failed: %s", err)
+	}
+	defer pidFile.Release()
+	content, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read pidfile: %s", err)
+	}
+	if strings.TrimSpace(string(content)) != pid {
+		t.Errorf("stale pidfile contains %q, expected %s", content, pid)
+	}
+}
+
+func TestIsSameFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), MachinedPidFileName)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", path, err)
+	}
+	defer file.Close()
+
+	if same, err := isSameFile(file, path); err != nil || !same {
+		t.Errorf("open file is not the file at its path: %v %v", same, err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("failed to remove %s: %s", path, err)
+	}
+	if same, err := isSameFile(file, path); err != nil || same {
+		t.Errorf("removed file is the file at its path: %v %v", same, err)
+	}
+	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatalf("failed to write %s: %s", path, err)
+	}
+	if same, err := isSameFile(file, path); err != nil || same {
+		t.Errorf("removed file is the new file at its path: %v %v", same, err)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := RemoveStaleSocket(filepath.Join(dir, "missing.socket")); err != nil {
+		t.Errorf("unexpected error for a missing socket: %s", err)
+	}
+
+	// a socket in use is kept
+	inUse := filepath.Join(dir, "inuse.socket")
+	listener, err := net.Listen("unix", inUse)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %s", inUse, err)
+	}
+	defer listener.Close()
+	err = RemoveStaleSocket(inUse)
+	if err == nil {
+		t.Errorf("RemoveStaleSocket of a socket in use did not fail")
+	} else if !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+		t.Errorf("error %q does not name the pid of the listener", err)
+	}
+	if !PathExists(inUse) {
+		t.Errorf("socket in use %s was removed", inUse)
+	}
+
+	// the socket of a listener which did not clean up is removed
+	stale := filepath.Join(dir, "stale.socket")
+	staleListener, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %s", stale, err)
+	}
+	staleListener.(*net.UnixListener).SetUnlinkOnClose(false)
+	staleListener.Close()
+	if !PathExists(stale) {
+		t.Fatalf("closed listener removed its socket %s", stale)
+	}
+	if err := RemoveStaleSocket(stale); err != nil {
+		t.Errorf("RemoveStaleSocket of a stale socket failed: %s", err)
+	}
+	if PathExists(stale) {
+		t.Errorf("stale socket %s was not removed", stale)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// cpu-pinning keys besides vCPU indexes: vcpus pins the vCPUs without their
+// own entry, emulator the QEMU main loop and worker threads and iothreads the
+// QEMU IO threads.
+const (
+	PinVCPUs     = "vcpus"
+	PinEmulator  = "emulator"
+	PinIOThreads = "iothreads"
+)
+
+// hostCPUList returns the host cpus of a cpu list like 2-3,6
+func hostCPUList(list string) ([]int, error) {
+	ranges, err := parseCPUList(list)
+	if err != nil {
+		return []int{}, err
+	}
+	cpus := []int{}
+	for _, r := range ranges {
+		for cpu := r[0]; cpu <= r[1]; cpu++ {
+			cpus = append(cpus, int(cpu))
+		}
+	}
+	return cpus, nil
+}
+
+// formatCPUList returns cpus as a cpu list like 2-3,6
+func formatCPUList(cpus []int) string {
+	sort.Ints(cpus)
+	items := []string{}
+	for idx := 0; idx < len(cpus); {
+		end := idx
+		for end+1 < len(cpus) && cpus[end+1] == cpus[end]+1 {
+			end++
+		}
+		if end == idx {
+			items = append(items, fmt.Sprintf("%d", cpus[idx]))
+		} else {
+			items = append(items, fmt.Sprintf("%d-%d", cpus[idx], cpus[end]))
+		}
+		idx = end + 1
+	}
+	return strings.Join(items, ",")
+}
+
+// ValidateCPUPinning checks the cpu-pinning keys are vCPUs of a VM with
+// numCPUs cpus, vcpus, emulator or iothreads and that machined may run
+// threads on the pinned host cpus.
+func ValidateCPUPinning(pinning map[string]string, numCPUs uint32) error {
+	var allowed unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &allowed); err != nil {
+		return fmt.Errorf("Failed to get the host cpus of machined: %s", err)
+	}
+	for key, list := range pinning {
+		switch key {
+		case PinVCPUs, PinEmulator, PinIOThreads:
+		default:
+			vcpu, err := strconv.ParseUint(key, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid cpu-pinning key '%s', expected a vCPU index, %s, %s or %s", key, PinVCPUs, PinEmulator, PinIOThreads)
+			}
+			if uint32(vcpu) >= numCPUs {
+				return fmt.Errorf("invalid cpu-pinning key '%s', the VM has %d cpus", key, numCPUs)
+			}
+		}
+		cpus, err := hostCPUList(list)
+		if err != nil {
+			return fmt.Errorf("invalid cpu-pinning %s: %s", key, err)
+		}
+		for _, cpu := range cpus {
+			if !allowed.IsSet(cpu) {
+				return fmt.Errorf("invalid cpu-pinning %s: host cpu %d is offline or not available to machined", key, cpu)
+			}
+		}
+	}
+	return nil
+}
+
+// pinnedHostCPUs returns the host cpus used by a cpu-pinning
+func pinnedHostCPUs(pinning map[string]string) map[int]bool {
+	pinned := make(map[int]bool)
+	for _, list := range pinning {
+		cpus, err := hostCPUList(list)
+		if err != nil {
+			continue
+		}
+		for _, cpu := range cpus {
+			pinned[cpu] = true
+		}
+	}
+	return pinned
+}
+
+// CPUPinningOverlap returns the host cpus pinned by both cpu-pinnings
+func CPUPinningOverlap(a, b map[string]string) []int {
+	other := pinnedHostCPUs(b)
+	overlap := []int{}
+	for cpu := range pinnedHostCPUs(a) {
+		if other[cpu] {
+			overlap = append(overlap, cpu)
+		}
+	}
+	sort.Ints(overlap)
+	return overlap
+}
+
+func setThreadAffinity(tid int, list string) error {
+	cpus, err := hostCPUList(list)
+	if err != nil {
+		return err
+	}
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(tid, &set)
+}
+
+// applyCPUPinning sets the affinity of the QEMU threads of the VM.  vCPU
+// thread IDs come from query-cpus-fast and IO thread IDs from
+// query-iothreads, every other QEMU thread is an emulator thread.  It is
+// called whenever machined attaches to the QMP socket of the VM.
+func (v *VM) applyCPUPinning() error {
+	pinning := v.Config.CPUPinning
+	if len(pinning) == 0 || v.qmp == nil || v.Cmd.Process == nil {
+		return nil
+	}
+	cpus, err := v.qmp.ExecQueryCpusFast(v.Ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to query vCPU threads: %s", err)
+	}
+	pinned := make(map[int]bool)
+	for _, cpu := range cpus {
+		list, ok := pinning[fmt.Sprintf("%d", cpu.CPUIndex)]
+		if !ok {
+			list, ok = pinning[PinVCPUs]
+		}
+		pinned[cpu.ThreadID] = true
+		if !ok {
+			continue
+		}
+		if err := setThreadAffinity(cpu.ThreadID, list); err != nil {
+			return fmt.Errorf("Failed to pin vCPU %d thread %d to host cpus %s: %s", cpu.CPUIndex, cpu.ThreadID, list, err)
+		}
+		log.Infof("VM:%s pinned vCPU %d thread %d to host cpus %s", v.Name(), cpu.CPUIndex, cpu.ThreadID, list)
+	}
+
+	out, err := v.QMPControl("query-iothreads", nil)
+	if err != nil {
+		return fmt.Errorf("Failed to query IO threads: %s", err)
+	}
+	var ioThreads []struct {
+		ID       string `json:"id"`
+		ThreadID int    `json:"thread-id"`
+	}
+	if err := json.Unmarshal(out, &ioThreads); err != nil {
+		return fmt.Errorf("Failed to parse query-iothreads output: %s", err)
+	}
+	for _, thread := range ioThreads {
+		pinned[thread.ThreadID] = true
+		list, ok := pinning[PinIOThreads]
+		if !ok {
+			continue
+		}
+		if err := setThreadAffinity(thread.ThreadID, list); err != nil {
+			return fmt.Errorf("Failed to pin IO thread %s to host cpus %s: %s", thread.ID, list, err)
+		}
+		log.Infof("VM:%s pinned IO thread %s thread %d to host cpus %s", v.Name(), thread.ID, thread.ThreadID, list)
+	}
+	if _, ok := pinning[PinIOThreads]; ok && len(ioThreads) == 0 {
+		log.Warnf("VM:%s has no IO threads to pin", v.Name())
+	}
+
+	list, ok := pinning[PinEmulator]
+	if !ok {
+		return nil
+	}
+	// threads QEMU creates later inherit the affinity of the emulator
+	// thread creating them
+	tasks, err := os.ReadDir(filepath.Join("/proc", fmt.Sprintf("%d", v.Cmd.Process.Pid), "task"))
+	if err != nil {
+		return fmt.Errorf("Failed to list QEMU threads: %s", err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil || pinned[tid] {
+			continue
+		}
+		if err := setThreadAffinity(tid, list); err != nil {
+			return fmt.Errorf("Failed to pin emulator thread %d to host cpus %s: %s", tid, list, err)
+		}
+	}
+	log.Infof("VM:%s pinned emulator threads to host cpus %s", v.Name(), list)
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCPUListFormat(t *testing.T) {
+	testCases := []struct {
+		list string
+		cpus []int
+		want string
+	}{
+		{list: "0", cpus: []int{0}, want: "0"},
+		{list: "2-3,6", cpus: []int{2, 3, 6}, want: "2-3,6"},
+		{list: "6,0-1,3", cpus: []int{6, 0, 1, 3}, want: "0-1,3,6"},
+		{list: "0-2,3-4", cpus: []int{0, 1, 2, 3, 4}, want: "0-4"},
+	}
+
+	for _, tc := range testCases {
+		cpus, err := hostCPUList(tc.list)
+		if err != nil {
+			t.Errorf("cpu list %q: unexpected error: %s", tc.list, err)
+			continue
+		}
+		if !reflect.DeepEqual(cpus, tc.cpus) {
+			t.Errorf("cpu list %q: cpus %v, expected %v", tc.list, cpus, tc.cpus)
+		}
+		if got := formatCPUList(cpus); got != tc.want {
+			t.Errorf("cpu list %q: formatted %q, expected %q", tc.list, got, tc.want)
+		}
+	}
+
+	if cpus, err := hostCPUList("1-0"); err == nil {
+		t.Errorf("expected an error for a reversed cpu list, found %v", cpus)
+	}
+}
+
+func TestValidateCPUPinning(t *testing.T) {
+	// host cpu 0 is available to the test, 4095 is not
+	testCases := []struct {
+		name    string
+		pinning map[string]string
+		err     bool
+	}{
+		{name: "vcpu", pinning: map[string]string{"0": "0", "1": "0"}},
+		{name: "named keys", pinning: map[string]string{PinVCPUs: "0", PinEmulator: "0", PinIOThreads: "0"}},
+		{name: "vcpu out of range", pinning: map[string]string{"2": "0"}, err: true},
+		{name: "invalid key", pinning: map[string]string{"qemu": "0"}, err: true},
+		{name: "invalid cpu list", pinning: map[string]string{PinVCPUs: "0-"}, err: true},
+		{name: "unavailable host cpu", pinning: map[string]string{PinVCPUs: "4095"}, err: true},
+	}
+
+	for _, tc := range testCases {
+		err := ValidateCPUPinning(tc.pinning, 2)
+		if tc.err && err == nil {
+			t.Errorf("%s: expected an error for %v", tc.name, tc.pinning)
+		}
+		if !tc.err && err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+		}
+	}
+}
+
+func TestCPUPinningOverlap(t *testing.T) {
+	testCases := []struct {
+		a    map[string]string
+		b    map[string]string
+		want []int
+	}{
+		{a: map[string]string{"0": "0-1"}, b: map[string]string{"0": "2-3"}, want: []int{}},
+		{a: map[string]string{"0": "0-3"}, b: map[string]string{PinEmulator: "3", PinVCPUs: "1"}, want: []int{1, 3}},
+		{a: map[string]string{"0": "0-1", "1": "1-2"}, b: map[string]string{PinVCPUs: "1-2"}, want: []int{1, 2}},
+		{a: map[string]string{}, b: map[string]string{PinVCPUs: "0"}, want: []int{}},
+	}
+
+	for _, tc := range testCases {
+		if got := CPUPinningOverlap(tc.a, tc.b); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("overlap of %v and %v is %v, expected %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
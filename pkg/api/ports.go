@@ -22,3 +22,17 @@ func NextFreePort(first int) int {
 		}
 	}
 }
+
+// NextFreePortInRange returns the first free port of a range like 5900-5999
+func NextFreePortInRange(ports string) (int, error) {
+	first, last, err := parsePortRange(ports)
+	if err != nil {
+		return 0, err
+	}
+	for p := first; p <= last; p++ {
+		if portAvail(p) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port in range %s", ports)
+}
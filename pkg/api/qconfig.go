@@ -3,7 +3,6 @@ package api
 import (
 	"fmt"
 	"os"
-	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -13,50 +12,65 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// GetKvmPath returns the QEMU binary for host architecture guests
 func GetKvmPath() (string, error) {
-	// perfer qemu-kvm, qemu-system-x86_64, kvm
-	emulators := []string{"qemu-kvm", "qemu-system-x86_64", "kvm"}
-	paths := []string{"/usr/libexec", "/usr/bin"}
-
-	for _, emulator := range emulators {
-		for _, prefix := range paths {
-			kvmPath := path.Join(prefix, emulator)
-			if _, err := os.Stat(kvmPath); err == nil {
-				return kvmPath, nil
-			}
-		}
-	}
-	return "", fmt.Errorf("Failed to find QEMU/KVM binary [%s] in paths [%s]\n", emulators, paths)
+	return GetQemuPath(HostImageArch())
 }
 
-func NewDefaultConfig(name string, numCpus, numMemMB uint32, sockDir string) (*qcli.Config, error) {
+// cpus and memory of VMs which do not set them
+const (
+	defaultCPUs     = 4
+	defaultMemoryMB = 4096
+)
+
+func NewDefaultConfig(name string, numCpus, numMemMB uint32, sockDir, arch, accel string) (*qcli.Config, error) {
 	smp := qcli.SMP{CPUs: numCpus}
 	if numCpus < 1 {
-		smp.CPUs = 4
+		smp.CPUs = defaultCPUs
 	}
 
 	mem := qcli.Memory{
 		Size: fmt.Sprintf("%dm", numMemMB),
 	}
 	if numMemMB < 1 {
-		mem.Size = "4096m"
+		mem.Size = fmt.Sprintf("%dm", defaultMemoryMB)
 	}
 
-	path, err := GetKvmPath()
+	qemuArch, ok := QemuArches[arch]
+	if !ok {
+		return &qcli.Config{}, fmt.Errorf("Failed creating new default config: unsupported arch %s", arch)
+	}
+	path, err := GetQemuPath(arch)
 	if err != nil {
 		return &qcli.Config{}, fmt.Errorf("Failed creating new default config: %s", err)
 	}
+	daemonCfg := currentDaemonConfig()
+	spicePort, err := NextFreePortInRange(daemonCfg.SpicePorts)
+	if err != nil {
+		return &qcli.Config{}, fmt.Errorf("Failed creating new default config: spice-ports: %s", err)
+	}
+	cpuModel := qemuArch.KVMCPUModel
+	if accel == AccelTCG {
+		cpuModel = qemuArch.TCGCPUModel
+	}
+	globalParams := []string{}
+	smm := ""
+	if qemuArch.SMM {
+		globalParams = append(globalParams, "ICH9-LPC.disable_s3=1", securePFlashGlobal)
+		smm = "on"
+	}
 
 	c := &qcli.Config{
 		Name: name,
 		Path: path,
 		Machine: qcli.Machine{
-			Type:         qcli.MachineTypePC35,
-			Acceleration: qcli.MachineAccelerationKVM,
-			SMM:          "on",
+			Type:         qemuArch.MachineType,
+			Acceleration: accel,
+			Options:      qemuArch.MachineOptions,
+			SMM:          smm,
 		},
-		CPUModel:      "qemu64",
-		CPUModelFlags: []string{"+x2apic"},
+		CPUModel:      cpuModel,
+		CPUModelFlags: qemuArch.CPUModelFlags,
 		SMP:           smp,
 		Memory:        mem,
 		RngDevices: []qcli.RngDevice{
@@ -97,7 +111,13 @@ func NewDefaultConfig(name string, numCpus, numMemMB uint32, sockDir string) (*q
 				Type:   "unix",
 				Server: true,
 				NoWait: true,
-				Name:   filepath.Join(sockDir, "qmp.sock"),
+				Name:   filepath.Join(sockDir, QMPSocketName),
+			},
+			qcli.QMPSocket{
+				Type:   "unix",
+				Server: true,
+				NoWait: true,
+				Name:   filepath.Join(sockDir, QMPControlSocketName),
 			},
 		},
 		PCIeRootPortDevices: []qcli.PCIeRootPortDevice{
@@ -119,19 +139,35 @@ func NewDefaultConfig(name string, numCpus, numMemMB uint32, sockDir string) (*q
 				Addr:          "0x5.0x1",
 				Multifunction: false,
 			},
+			qcli.PCIeRootPortDevice{
+				ID:            "root-port.0x4.2",
+				Bus:           "pcie.0",
+				Chassis:       "0x2",
+				Slot:          "0x00",
+				Port:          "0x2",
+				Addr:          "0x5.0x2",
+				Multifunction: false,
+			},
+			qcli.PCIeRootPortDevice{
+				ID:            "root-port.0x4.3",
+				Bus:           "pcie.0",
+				Chassis:       "0x3",
+				Slot:          "0x00",
+				Port:          "0x3",
+				Addr:          "0x5.0x3",
+				Multifunction: false,
+			},
 		},
-		VGA: "qxl",
+		VGA: qemuArch.VGA,
 		SpiceDevice: qcli.SpiceDevice{
-			HostAddress:      "127.0.0.1",
-			Port:             fmt.Sprintf("%d", NextFreePort(qcli.RemoteDisplayPortBase)),
+			HostAddress:      daemonCfg.SpiceAddress,
+			Port:             fmt.Sprintf("%d", spicePort),
 			DisableTicketing: true,
 		},
-		GlobalParams: []string{
-			"ICH9-LPC.disable_s3=1",
-			"driver=cfi.pflash01,property=secure,value=on",
-		},
+		GlobalParams: globalParams,
 		Knobs: qcli.Knobs{
-			NoHPET:    true,
+			// the HPET only exists on x86 machines
+			NoHPET:    arch == ArchX86_64,
 			NoGraphic: true,
 		},
 	}
@@ -145,18 +181,33 @@ func (qd *QemuDisk) ImportDiskImage(imageDir string) error {
 	// What to do about sparse? use reflink and sparse=auto for now.
 	if qd.Size > 0 {
 		if PathExists(qd.File) {
+			if qd.Encrypt != "" && !PathExists(qd.SecretFile(imageDir)) {
+				return fmt.Errorf("Encrypted disk %q has no secret %q", qd.File, qd.SecretFile(imageDir))
+			}
 			log.Infof("Skipping creation of existing disk: %s", qd.File)
 			return nil
 		}
+		if qd.Encrypt != "" {
+			secretFile, err := qd.EnsureSecret(imageDir)
+			if err != nil {
+				return err
+			}
+			return qd.CreateEncrypted(secretFile)
+		}
 		return qd.Create()
 	}
 
+	if qd.Encrypt != "" && !PathExists(qd.SecretFile(imageDir)) {
+		return fmt.Errorf("Encrypted disk %q has no secret %q", qd.File, qd.SecretFile(imageDir))
+	}
+
 	if !PathExists(qd.File) {
 		return fmt.Errorf("Disk File %q does not exist", qd.File)
 	}
 
 	if qd.Type == "cdrom" {
 		log.Infof("Skipping import of cdrom: %s", qd.File)
+		return nil
 	}
 
 	srcFilePath := qd.File
@@ -176,23 +227,30 @@ func (qd *QemuDisk) ImportDiskImage(imageDir string) error {
 	return nil
 }
 
+// the q35 ahci controller has six ports, ide.0 - ide.5
+const ideMaxPorts = 6
+
 func (qd *QemuDisk) QBlockDevice(qti *qcli.QemuTypeIndex) (qcli.BlockDevice, error) {
 	log.Debugf("QemuDisk -> QBlockDevice() %+v", qd)
 	blk := qcli.BlockDevice{
 		ID:           fmt.Sprintf("drive%d", qti.NextDriveIndex()),
 		File:         qd.File,
 		Interface:    qcli.NoInterface,
-		AIO:          qcli.Threads,
+		AIO:          qcli.BlockDeviceAIO(qd.aioMode()),
 		BusAddr:      qd.BusAddr,
 		ReadOnly:     qd.ReadOnly,
-		Cache:        qcli.CacheModeUnsafe,
-		Discard:      qcli.DiscardUnmap,
-		DetectZeroes: qcli.DetectZeroesUnmap,
+		Cache:        qcli.CacheMode(qd.cacheMode()),
+		Discard:      qcli.DiscardMode(qd.discardMode()),
+		DetectZeroes: qcli.DetectZeroesMode(qd.detectZeroesMode()),
 		Serial:       qd.serial(),
 	}
 	if blk.BlockSize == 0 {
 		blk.BlockSize = 512
 	}
+	// cdrom drives are found by disk ID to change media at runtime
+	if qd.Type == "cdrom" {
+		blk.ID = qmpID("cd", qd.DiskID())
+	}
 	if qd.BootIndex != "" {
 		bootindex, err := strconv.Atoi(qd.BootIndex)
 		if err != nil {
@@ -220,9 +278,8 @@ func (qd *QemuDisk) QBlockDevice(qti *qcli.QemuTypeIndex) (qcli.BlockDevice, err
 	case "scsi":
 		blk.Driver = qcli.SCSIHD
 		blk.SCSI = true
-		// FIXME: we should scan disks for buses, create buses, then
-		// walk disks a second time to configure bus= for each device
-		blk.Bus = "scsi0.0" // this is the default scsi bus
+		// the device is emitted from SCSIDevice with its target and lun
+		blk.DriveOnly = true
 	case "nvme":
 		blk.Driver = qcli.NVME
 	case "virtio":
@@ -238,7 +295,12 @@ func (qd *QemuDisk) QBlockDevice(qti *qcli.QemuTypeIndex) (qcli.BlockDevice, err
 		} else {
 			blk.Driver = qcli.IDEHardDisk
 		}
-		blk.Bus = "ide.0"
+		// each q35 ahci port holds a single device
+		port := qti.Next("ide-port")
+		if port >= ideMaxPorts {
+			return blk, fmt.Errorf("Too many ide disks, disk %s needs port %d of %d", qd.File, port, ideMaxPorts)
+		}
+		blk.Bus = fmt.Sprintf("ide.%d", port)
 	case "usb":
 		blk.Driver = qcli.USBStorage
 	default:
@@ -278,12 +340,7 @@ func (nd NicDef) QNetDevice(qti *qcli.QemuTypeIndex) (qcli.NetDevice, error) {
 	return ndev, nil
 }
 
-func ConfigureUEFIVars(c *qcli.Config, srcVars, runDir string, secureBoot bool) error {
-	uefiDev, err := qcli.NewSystemUEFIFirmwareDevice(secureBoot)
-	if err != nil {
-		return fmt.Errorf("failed to create a UEFI Firmware Device: %s", err)
-	}
-
+func ConfigureUEFIVars(c *qcli.Config, uefiDev *qcli.UEFIFirmwareDevice, srcVars, runDir string) error {
 	src := uefiDev.Vars
 	if len(srcVars) > 0 && PathExists(srcVars) {
 		src = srcVars
@@ -300,37 +357,161 @@ func ConfigureUEFIVars(c *qcli.Config, srcVars, runDir string, secureBoot bool)
 	return nil
 }
 
-func GenerateQConfig(runDir, sockDir string, v VMDef) (*qcli.Config, error) {
-	c, err := NewDefaultConfig(v.Name, v.Cpus, v.Memory, sockDir)
-	if err != nil {
-		return c, err
+// localPath returns p relative to the current working dir if not absolute
+func localPath(p string) (string, error) {
+	if strings.HasPrefix(p, "/") {
+		return p, nil
 	}
-
-	err = ConfigureUEFIVars(c, v.UEFIVars, runDir, v.SecureBoot)
+	cwd, err := os.Getwd()
 	if err != nil {
-		return c, fmt.Errorf("Error configuring UEFI Vars: %s", err)
+		return "", fmt.Errorf("Failed to get current working dir: %s", err)
 	}
+	return filepath.Join(cwd, p), nil
+}
 
-	cdromPath := v.Cdrom
-	if !strings.HasPrefix(v.Cdrom, "/") {
-		cwd, err := os.Getwd()
+// ConfigureKernelBoot configures direct kernel boot and returns the extra
+// parameters for a device tree which qcli does not support.
+func ConfigureKernelBoot(c *qcli.Config, v VMDef) ([]string, error) {
+	params := []string{}
+	if v.Kernel == "" {
+		if v.Initrd != "" || v.Append != "" || v.DTB != "" {
+			return params, fmt.Errorf("initrd, append and dtb require a kernel")
+		}
+		return params, nil
+	}
+	if v.SecureBoot {
+		// OVMF verifies the kernel loaded via fw_cfg against db, unsigned
+		// development kernels would fail to boot.
+		return params, fmt.Errorf("Direct kernel boot is not supported with secure-boot enabled")
+	}
+	if v.BootFromCdrom() {
+		return params, fmt.Errorf("Direct kernel boot cannot be combined with boot: %s", v.Boot)
+	}
+	if v.DTB != "" {
+		arch, err := v.GuestArch()
 		if err != nil {
-			return c, fmt.Errorf("Failed to get current working dir: %s", err)
+			return params, err
+		}
+		if arch == ArchX86_64 {
+			return params, fmt.Errorf("dtb is not supported on %s machines", arch)
 		}
-		cdromPath = filepath.Join(cwd, v.Cdrom)
+	}
+
+	// the client resolves relative paths against its working dir before
+	// sending the machine, machined's working dir means nothing to the user
+	resolve := func(name, p string) (string, error) {
+		if p == "" {
+			return "", nil
+		}
+		if !filepath.IsAbs(p) {
+			return "", fmt.Errorf("%s file %q is not an absolute path", name, p)
+		}
+		if !PathExists(p) {
+			return "", fmt.Errorf("%s file %q does not exist", name, p)
+		}
+		return p, nil
+	}
+
+	kernel, err := resolve("kernel", v.Kernel)
+	if err != nil {
+		return params, err
+	}
+	initrd, err := resolve("initrd", v.Initrd)
+	if err != nil {
+		return params, err
+	}
+	dtb, err := resolve("dtb", v.DTB)
+	if err != nil {
+		return params, err
+	}
+
+	log.Infof("Direct kernel boot: kernel=%s initrd=%s append=%q dtb=%s", kernel, initrd, v.Append, dtb)
+	c.Kernel = qcli.Kernel{
+		Path:       kernel,
+		InitrdPath: initrd,
+		Params:     v.Append,
+	}
+	if dtb != "" {
+		params = append(params, "-dtb", dtb)
+	}
+	return params, nil
+}
+
+// GenerateQConfig returns the qcli Config for the VM definition and any
+// additional qemu parameters which qcli cannot express.
+func GenerateQConfig(runDir, sockDir string, v VMDef) (*qcli.Config, []string, error) {
+	extraParams := []string{}
+	// the disks are sanitized and planned in place, keep them off the
+	// caller's array
+	v.Disks = append([]QemuDisk{}, v.Disks...)
+	arch, err := v.GuestArch()
+	if err != nil {
+		return &qcli.Config{}, extraParams, err
+	}
+	accel, err := v.Accelerator(arch)
+	if err != nil {
+		return &qcli.Config{}, extraParams, err
+	}
+	c, err := NewDefaultConfig(v.Name, v.Cpus, v.Memory, sockDir, arch, accel)
+	if err != nil {
+		return c, extraParams, err
+	}
+	log.Infof("VM:%s arch %s accel %s machine %s", v.Name, arch, accel, c.Machine.Type)
+	extraParams = append(extraParams, QemuArches[arch].ExtraParams...)
+	if v.Balloon {
+		extraParams = append(extraParams, BalloonQemuParams(c)...)
+	}
+	if v.GuestAgent {
+		extraParams = append(extraParams, GuestAgentQemuParams(sockDir)...)
+	}
+
+	if err := ConfigureCPU(c, v, arch, accel); err != nil {
+		return c, extraParams, fmt.Errorf("Error configuring cpu: %s", err)
+	}
+
+	if err := ValidateCPUPinning(v.CPUPinning, c.SMP.CPUs); err != nil {
+		return c, extraParams, fmt.Errorf("Error configuring cpu: %s", err)
+	}
+
+	memParams, err := ConfigureMemory(c, v)
+	if err != nil {
+		return c, extraParams, fmt.Errorf("Error configuring memory: %s", err)
+	}
+	extraParams = append(extraParams, memParams...)
+
+	if err := ConfigureFirmware(c, v, runDir); err != nil {
+		return c, extraParams, fmt.Errorf("Error configuring firmware: %s", err)
+	}
+
+	kernelParams, err := ConfigureKernelBoot(c, v)
+	if err != nil {
+		return c, extraParams, fmt.Errorf("Error configuring kernel boot: %s", err)
+	}
+	extraParams = append(extraParams, kernelParams...)
+
+	shareParams, err := ConfigureShares(c, v, sockDir)
+	if err != nil {
+		return c, extraParams, fmt.Errorf("Error configuring shares: %s", err)
+	}
+	extraParams = append(extraParams, shareParams...)
+
+	cdromPath, err := localPath(v.Cdrom)
+	if err != nil {
+		return c, extraParams, err
 	}
 
 	qti := qcli.NewQemuTypeIndex()
 
 	if v.Cdrom != "" {
 		qd := QemuDisk{
+			ID:       CdromDiskID,
 			File:     cdromPath,
 			Format:   "raw",
 			Attach:   "ide",
 			Type:     "cdrom",
 			ReadOnly: true,
 		}
-		if v.Boot == "cdrom" {
+		if v.BootFromCdrom() {
 			qd.BootIndex = "0"
 			log.Infof("Boot from cdrom requested: bootindex=%s", qd.BootIndex)
 		}
@@ -338,39 +519,53 @@ func GenerateQConfig(runDir, sockDir string, v VMDef) (*qcli.Config, error) {
 	}
 
 	if err := v.AdjustBootIndicies(qti); err != nil {
-		return c, err
+		return c, extraParams, err
 	}
 
-	busses := make(map[string]bool)
 	for i := range v.Disks {
 		var disk *QemuDisk
 		disk = &v.Disks[i]
 
 		if err := disk.Sanitize(runDir); err != nil {
-			return c, err
+			return c, extraParams, err
 		}
 
 		// import/create files into stateDir/images/basename(File)
 		if err := disk.ImportDiskImage(runDir); err != nil {
-			return c, err
+			return c, extraParams, err
 		}
+	}
+
+	// controllers must be planned once all disks have their attach type
+	scsiControllers, err := v.PlanSCSIBus(qti)
+	if err != nil {
+		return c, extraParams, fmt.Errorf("Error planning scsi bus: %s", err)
+	}
+	c.SCSIControllerDevices = append(c.SCSIControllerDevices, scsiControllers...)
+
+	busses := make(map[string]bool)
+	for i := range v.Disks {
+		var disk *QemuDisk
+		disk = &v.Disks[i]
 
 		qblk, err := disk.QBlockDevice(qti)
 		if err != nil {
-			return c, err
+			return c, extraParams, err
 		}
 		c.BlkDevices = append(c.BlkDevices, qblk)
+		if disk.Attach == "scsi" {
+			scsiDev, err := disk.SCSIDevice(qblk)
+			if err != nil {
+				return c, extraParams, err
+			}
+			extraParams = append(extraParams, scsiDev.QemuParams()...)
+		}
+		extraParams = append(extraParams, disk.Throttle.QemuParams(qblk.ID)...)
+		extraParams = append(extraParams, disk.EncryptionQemuParams(runDir, qblk.ID)...)
 
 		_, ok := busses[disk.Attach]
 		// we only need one controller per attach
 		if !ok {
-			if disk.Attach == "scsi" {
-				scsiCon := qcli.SCSIControllerDevice{
-					ID:       fmt.Sprintf("scsi%d", qti.Next("scsi")),
-					IOThread: fmt.Sprintf("iothread%d", qti.Next("iothread")),
-				}
-				c.SCSIControllerDevices = append(c.SCSIControllerDevices, scsiCon)
-			}
 			if disk.Attach == "ide" {
 				ideCon := qcli.IDEControllerDevice{
 					Driver: qcli.ICH9AHCIController,
@@ -378,27 +573,35 @@ func GenerateQConfig(runDir, sockDir string, v VMDef) (*qcli.Config, error) {
 				}
 				c.IDEControllerDevices = append(c.IDEControllerDevices, ideCon)
 			}
+			busses[disk.Attach] = true
 		}
 	}
 
 	for _, nic := range v.Nics {
 		qnet, err := nic.QNetDevice(qti)
 		if err != nil {
-			return c, err
+			return c, extraParams, err
 		}
 		c.NetDevices = append(c.NetDevices, qnet)
 	}
 
 	if v.TPM {
+		switch v.TPMFailurePolicy {
+		case "", TPMFailurePolicyFail, TPMFailurePolicyRestart, TPMFailurePolicyIgnore:
+		default:
+			return c, extraParams, fmt.Errorf("invalid tpm-failure-policy: found %s expected [%s %s %s]", v.TPMFailurePolicy, TPMFailurePolicyFail, TPMFailurePolicyRestart, TPMFailurePolicyIgnore)
+		}
 		c.TPM = qcli.TPMDevice{
 			ID:     "tpm0",
-			Driver: qcli.TPMTISDevice,
+			Driver: QemuArches[arch].TPMDriver,
 			Path:   filepath.Join(runDir, "tpm0.sock"),
 			Type:   qcli.TPMEmulatorDevice,
 		}
+	} else if v.TrustStore != "" {
+		return c, extraParams, fmt.Errorf("truststore %s requires tpm: true", v.TrustStore)
 	}
 
-	return c, nil
+	return c, extraParams, nil
 }
 
 type QMPMachineLogger struct{}
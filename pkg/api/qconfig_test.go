@@ -0,0 +1,118 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raharper/qcli"
+)
+
+func TestConfigureKernelBoot(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"vmlinuz", "initrd.img", "board.dtb"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+	kernel := filepath.Join(dir, "vmlinuz")
+	initrd := filepath.Join(dir, "initrd.img")
+	dtb := filepath.Join(dir, "board.dtb")
+
+	testCases := []struct {
+		name   string
+		vmdef  VMDef
+		kernel qcli.Kernel
+		params string
+		err    bool
+	}{
+		{
+			name: "no kernel",
+		},
+		{
+			name:   "kernel initrd append",
+			vmdef:  VMDef{Arch: ArchX86_64, Kernel: kernel, Initrd: initrd, Append: "console=ttyS0"},
+			kernel: qcli.Kernel{Path: kernel, InitrdPath: initrd, Params: "console=ttyS0"},
+		},
+		{
+			name:   "dtb",
+			vmdef:  VMDef{Arch: ArchAarch64, Kernel: kernel, DTB: dtb},
+			kernel: qcli.Kernel{Path: kernel},
+			params: "-dtb " + dtb,
+		},
+		{
+			name:  "dtb on x86_64",
+			vmdef: VMDef{Arch: ArchX86_64, Kernel: kernel, DTB: dtb},
+			err:   true,
+		},
+		{
+			name:  "initrd without kernel",
+			vmdef: VMDef{Initrd: initrd},
+			err:   true,
+		},
+		{
+			name:  "secure-boot",
+			vmdef: VMDef{Arch: ArchX86_64, Kernel: kernel, SecureBoot: true},
+			err:   true,
+		},
+		{
+			name:  "cdrom boot",
+			vmdef: VMDef{Arch: ArchX86_64, Kernel: kernel, Boot: BootCdrom},
+			err:   true,
+		},
+		{
+			name:  "relative kernel",
+			vmdef: VMDef{Arch: ArchX86_64, Kernel: "vmlinuz"},
+			err:   true,
+		},
+		{
+			name:  "relative initrd",
+			vmdef: VMDef{Arch: ArchX86_64, Kernel: kernel, Initrd: "initrd.img"},
+			err:   true,
+		},
+		{
+			name:  "missing kernel",
+			vmdef: VMDef{Arch: ArchX86_64, Kernel: filepath.Join(dir, "missing")},
+			err:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &qcli.Config{}
+			params, err := ConfigureKernelBoot(c, tc.vmdef)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, configured %+v", c.Kernel)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if c.Kernel != tc.kernel {
+				t.Errorf("kernel %+v, expected %+v", c.Kernel, tc.kernel)
+			}
+			if got := strings.Join(params, " "); got != tc.params {
+				t.Errorf("params %q, expected %q", got, tc.params)
+			}
+		})
+	}
+}
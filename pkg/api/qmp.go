@@ -0,0 +1,111 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The qcli QMP session owns the first QMP socket for lifecycle events and
+// only exposes a fixed set of commands.  VMs also get a second QMP socket,
+// the control socket, which machined uses to issue arbitrary QMP commands
+// (block_resize, blockdev-change-medium, query-blockstats, ...).
+const (
+	QMPSocketName        = "qmp.sock"
+	QMPControlSocketName = "qmp-ctl.sock"
+	qmpCommandTimeout    = time.Second * 30
+	qmpReattachDelay     = time.Second * 2
+)
+
+type qmpMessage struct {
+	QMP    json.RawMessage `json:"QMP,omitempty"`
+	Return json.RawMessage `json:"return,omitempty"`
+	Error  *qmpError       `json:"error,omitempty"`
+	Event  string          `json:"event,omitempty"`
+}
+
+type qmpError struct {
+	Class       string `json:"class"`
+	Description string `json:"desc"`
+}
+
+type qmpCommand struct {
+	Execute   string                 `json:"execute"`
+	Arguments map[string]interface{} `json:"arguments,omitempty"`
+}
+
+// QMPCommand connects to the QMP socket, negotiates capabilities and executes
+// a single command returning the raw 'return' value.  Asynchronous events
+// received while waiting for the reply are logged and discarded.
+func QMPCommand(ctx context.Context, socket, command string, args map[string]interface{}) (json.RawMessage, error) {
+	dialer := net.Dialer{Timeout: qmpCommandTimeout}
+	conn, err := dialer.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to QMP socket %s: %s", socket, err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(qmpCommandTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+
+	var greeting qmpMessage
+	if err := decoder.Decode(&greeting); err != nil {
+		return nil, fmt.Errorf("Failed to read QMP greeting: %s", err)
+	}
+	if greeting.QMP == nil {
+		return nil, fmt.Errorf("Unexpected QMP greeting on %s", socket)
+	}
+
+	execute := func(cmd qmpCommand) (json.RawMessage, error) {
+		if err := encoder.Encode(cmd); err != nil {
+			return nil, fmt.Errorf("Failed to send QMP command '%s': %s", cmd.Execute, err)
+		}
+		for {
+			var msg qmpMessage
+			if err := decoder.Decode(&msg); err != nil {
+				return nil, fmt.Errorf("Failed to read QMP reply to '%s': %s", cmd.Execute, err)
+			}
+			if msg.Event != "" {
+				log.Debugf("QMP event while waiting on '%s': %s", cmd.Execute, msg.Event)
+				continue
+			}
+			if msg.Error != nil {
+				return nil, fmt.Errorf("QMP command '%s' failed: %s: %s", cmd.Execute, msg.Error.Class, msg.Error.Description)
+			}
+			return msg.Return, nil
+		}
+	}
+
+	if _, err := execute(qmpCommand{Execute: "qmp_capabilities"}); err != nil {
+		return nil, err
+	}
+	log.Debugf("QMP %s executing '%s' args: %v", socket, command, args)
+	return execute(qmpCommand{Execute: command, Arguments: args})
+}
@@ -16,9 +16,11 @@ limitations under the License.
 package api
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 
+	humanize "github.com/dustin/go-humanize"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
@@ -43,6 +45,38 @@ func (rh *RouteHandler) SetupRoutes() {
 	rh.c.Router.POST("/machines/:machinename/start", rh.StartMachine)
 	rh.c.Router.POST("/machines/:machinename/stop", rh.StopMachine)
 	rh.c.Router.POST("/machines/:machinename/console", rh.GetMachineConsole)
+	rh.c.Router.POST("/machines/:machinename/disks", rh.AttachMachineDisk)
+	rh.c.Router.DELETE("/machines/:machinename/disks/:diskid", rh.DetachMachineDisk)
+	rh.c.Router.POST("/machines/:machinename/disks/:diskid/resize", rh.ResizeMachineDisk)
+	rh.c.Router.PUT("/machines/:machinename/disks/:diskid/throttle", rh.ThrottleMachineDisk)
+	rh.c.Router.GET("/machines/:machinename/disks/:diskid/secret", rh.ExportMachineDiskSecret)
+	rh.c.Router.POST("/machines/:machinename/disks/:diskid/secret/rotate", rh.RotateMachineDiskSecret)
+	rh.c.Router.GET("/machines/:machinename/media", rh.ListMachineMedia)
+	rh.c.Router.POST("/machines/:machinename/media/:diskid/eject", rh.EjectMachineMedia)
+	rh.c.Router.POST("/machines/:machinename/media/:diskid/insert", rh.InsertMachineMedia)
+	rh.c.Router.GET("/machines/:machinename/resources", rh.GetMachineResourceUsage)
+	rh.c.Router.GET("/machines/:machinename/stats", rh.GetMachineStats)
+	rh.c.Router.GET("/machines/:machinename/tpm", rh.GetMachineTPMInfo)
+	rh.c.Router.GET("/machines/:machinename/tpm/ekcert", rh.GetMachineTPMCertificates)
+	rh.c.Router.POST("/machines/:machinename/tpm/reset", rh.ResetMachineTPM)
+	rh.c.Router.GET("/machines/:machinename/tpm/backup", rh.BackupMachineTPM)
+	rh.c.Router.POST("/machines/:machinename/tpm/restore", rh.RestoreMachineTPM)
+	rh.c.Router.GET("/machines/:machinename/uefi/vars", rh.ListMachineUEFIVars)
+	rh.c.Router.GET("/machines/:machinename/uefi/vars/:varname", rh.GetMachineUEFIVar)
+	rh.c.Router.PUT("/machines/:machinename/uefi/vars/:varname", rh.SetMachineUEFIVar)
+	rh.c.Router.DELETE("/machines/:machinename/uefi/vars/:varname", rh.DeleteMachineUEFIVar)
+	rh.c.Router.POST("/machines/:machinename/uefi/enroll", rh.EnrollMachineUEFIKeys)
+	rh.c.Router.GET("/machines/:machinename/uefi/nvram", rh.GetMachineUEFIVarsFile)
+	rh.c.Router.GET("/remotes", rh.GetRemotes)
+	rh.c.Router.POST("/remotes", rh.PostRemote)
+	rh.c.Router.DELETE("/remotes/:remotename", rh.DeleteRemote)
+	rh.c.Router.GET("/images", rh.SearchImages)
+	rh.c.Router.GET("/truststores", rh.GetTrustStores)
+	rh.c.Router.POST("/truststores", rh.PostTrustStore)
+	rh.c.Router.GET("/truststores/:storename", rh.GetTrustStore)
+	rh.c.Router.GET("/truststores/:storename/cert", rh.GetTrustStoreCertificate)
+	rh.c.Router.POST("/images/resolve", rh.ResolveImage)
+	rh.c.Router.GET("/config", rh.GetConfig)
 }
 
 func (rh *RouteHandler) GetMachines(ctx *gin.Context) {
@@ -161,3 +195,376 @@ func (rh *RouteHandler) GetMachineConsole(ctx *gin.Context) {
 		return
 	}
 }
+
+type MachineDiskRequest struct {
+	Disk      QemuDisk `json:"disk"`
+	Temporary bool     `json:"temporary"`
+}
+
+func (rh *RouteHandler) AttachMachineDisk(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	var request MachineDiskRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.c.MachineController.AttachMachineDisk(machineName, request.Disk, request.Temporary); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) DetachMachineDisk(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	diskID := ctx.Param("diskid")
+	temporary := ctx.Query("temporary") == "true"
+	if err := rh.c.MachineController.DetachMachineDisk(machineName, diskID, temporary); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+type MachineDiskResizeRequest struct {
+	Size  string `json:"size"`
+	Force bool   `json:"force"`
+}
+
+func (rh *RouteHandler) ResizeMachineDisk(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	diskID := ctx.Param("diskid")
+	var request MachineDiskResizeRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	size, err := humanize.ParseBytes(request.Size)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid disk size '%s': %s", request.Size, err)})
+		return
+	}
+	if err := rh.c.MachineController.ResizeMachineDisk(machineName, diskID, DiskSize(size), request.Force); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+type MachineDiskThrottleRequest struct {
+	Throttle  DiskThrottle `json:"throttle"`
+	Temporary bool         `json:"temporary"`
+}
+
+func (rh *RouteHandler) ThrottleMachineDisk(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	diskID := ctx.Param("diskid")
+	var request MachineDiskThrottleRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.c.MachineController.ThrottleMachineDisk(machineName, diskID, request.Throttle, request.Temporary); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) ExportMachineDiskSecret(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	diskID := ctx.Param("diskid")
+	secret, err := rh.c.MachineController.ExportMachineDiskSecret(machineName, diskID)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, secret)
+}
+
+func (rh *RouteHandler) RotateMachineDiskSecret(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	diskID := ctx.Param("diskid")
+	if err := rh.c.MachineController.RotateMachineDiskSecret(machineName, diskID); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) ListMachineMedia(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	media, err := rh.c.MachineController.ListMachineMedia(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, media)
+}
+
+type MachineMediaRequest struct {
+	File   string `json:"file"`
+	Format string `json:"format"`
+	Force  bool   `json:"force"`
+}
+
+func (rh *RouteHandler) EjectMachineMedia(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	diskID := ctx.Param("diskid")
+	var request MachineMediaRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.c.MachineController.EjectMachineMedia(machineName, diskID, request.Force); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) InsertMachineMedia(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	diskID := ctx.Param("diskid")
+	var request MachineMediaRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.c.MachineController.InsertMachineMedia(machineName, diskID, request.File, request.Format, request.Force); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) GetMachineResourceUsage(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	usage, err := rh.c.MachineController.GetMachineResourceUsage(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, usage)
+}
+
+func (rh *RouteHandler) GetMachineStats(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	stats, err := rh.c.MachineController.GetMachineStats(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, stats)
+}
+
+func (rh *RouteHandler) GetMachineTPMInfo(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	info, err := rh.c.MachineController.GetMachineTPMInfo(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, info)
+}
+
+// GetMachineTPMCertificates returns the PEM encoded EK certificates, or the
+// platform certificates with ?platform=true
+func (rh *RouteHandler) GetMachineTPMCertificates(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	platform := ctx.Query("platform") == "true"
+	certs, err := rh.c.MachineController.GetMachineTPMCertificates(machineName, platform)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Data(http.StatusOK, "application/x-pem-file", certs)
+}
+
+func (rh *RouteHandler) ResetMachineTPM(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	if err := rh.c.MachineController.ResetMachineTPM(machineName); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) BackupMachineTPM(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	var backup bytes.Buffer
+	if err := rh.c.MachineController.BackupMachineTPM(machineName, &backup); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Data(http.StatusOK, "application/gzip", backup.Bytes())
+}
+
+func (rh *RouteHandler) RestoreMachineTPM(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	if err := rh.c.MachineController.RestoreMachineTPM(machineName, ctx.Request.Body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) ListMachineUEFIVars(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	vars, err := rh.c.MachineController.ListMachineUEFIVars(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, vars)
+}
+
+// UEFI variables are addressed by name and an optional ?guid= vendor GUID,
+// which defaults to the well known GUID of the variable name.
+func (rh *RouteHandler) GetMachineUEFIVar(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	varName := ctx.Param("varname")
+	variable, err := rh.c.MachineController.GetMachineUEFIVar(machineName, varName, ctx.Query("guid"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, variable)
+}
+
+type UEFIVarRequest struct {
+	Attributes uint32 `json:"attributes"`
+	Data       []byte `json:"data"`
+}
+
+func (rh *RouteHandler) SetMachineUEFIVar(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	varName := ctx.Param("varname")
+	var request UEFIVarRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.c.MachineController.SetMachineUEFIVar(machineName, varName, ctx.Query("guid"), request.Attributes, request.Data); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) DeleteMachineUEFIVar(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	varName := ctx.Param("varname")
+	if err := rh.c.MachineController.DeleteMachineUEFIVar(machineName, varName, ctx.Query("guid")); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+type UEFIEnrollRequest struct {
+	Variable     string   `json:"variable"`
+	Certificates [][]byte `json:"certificates"`
+	Owner        string   `json:"owner"`
+	Append       bool     `json:"append"`
+}
+
+func (rh *RouteHandler) EnrollMachineUEFIKeys(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	var request UEFIEnrollRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.c.MachineController.EnrollMachineUEFIKeys(machineName, request.Variable, request.Certificates, request.Owner, request.Append); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) GetMachineUEFIVarsFile(ctx *gin.Context) {
+	machineName := ctx.Param("machinename")
+	nvram, err := rh.c.MachineController.GetMachineUEFIVarsFile(machineName)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Data(http.StatusOK, "application/octet-stream", nvram)
+}
+
+func (rh *RouteHandler) GetRemotes(ctx *gin.Context) {
+	ctx.IndentedJSON(http.StatusOK, rh.c.ImageController.GetRemotes())
+}
+
+func (rh *RouteHandler) PostRemote(ctx *gin.Context) {
+	var newRemote ImageRemote
+	if err := ctx.ShouldBindJSON(&newRemote); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rh.c.ImageController.AddRemote(newRemote, rh.c.Config); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) DeleteRemote(ctx *gin.Context) {
+	remoteName := ctx.Param("remotename")
+	if err := rh.c.ImageController.DeleteRemote(remoteName, rh.c.Config); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+func (rh *RouteHandler) SearchImages(ctx *gin.Context) {
+	results, err := rh.c.ImageController.SearchImages(ctx.Query("query"), ctx.Query("arch"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, results)
+}
+
+type ImageResolveRequest struct {
+	Ref  string `json:"ref"`
+	Arch string `json:"arch"`
+}
+
+func (rh *RouteHandler) ResolveImage(ctx *gin.Context) {
+	var request ImageResolveRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	localImage, err := rh.c.ImageController.ResolveImage(request.Ref, request.Arch, rh.c.Config)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, localImage)
+}
+
+func (rh *RouteHandler) GetTrustStores(ctx *gin.Context) {
+	stores, err := rh.c.TrustStoreController.ListTrustStores(rh.c.Config)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, stores)
+}
+
+func (rh *RouteHandler) PostTrustStore(ctx *gin.Context) {
+	var request TrustStoreRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	store, err := rh.c.TrustStoreController.CreateTrustStore(request, rh.c.Config)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, store)
+}
+
+func (rh *RouteHandler) GetTrustStore(ctx *gin.Context) {
+	storeName := ctx.Param("storename")
+	store, err := rh.c.TrustStoreController.GetTrustStore(storeName, rh.c.Config)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.IndentedJSON(http.StatusOK, store)
+}
+
+// GetTrustStoreCertificate returns the PEM encoded CA certificate of a trust
+// store for attestation servers to trust
+func (rh *RouteHandler) GetTrustStoreCertificate(ctx *gin.Context) {
+	storeName := ctx.Param("storename")
+	cert, err := rh.c.TrustStoreController.TrustStoreCertificate(storeName, rh.c.Config)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Data(http.StatusOK, "application/x-pem-file", cert)
+}
+
+// GetConfig returns the machined config
+func (rh *RouteHandler) GetConfig(ctx *gin.Context) {
+	ctx.IndentedJSON(http.StatusOK, rh.c.GetConfig())
+}
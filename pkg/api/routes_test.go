@@ -0,0 +1,161 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// request serves a REST request with the controller router, body is
+// marshalled to JSON unless it is nil
+func request(t *testing.T, c *Controller, method, url string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatalf("Failed to marshal %s %s request: %s", method, url, err)
+		}
+	}
+	req := httptest.NewRequest(method, url, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	c.Router.ServeHTTP(rec, req)
+	return rec
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, code int, what string) {
+	t.Helper()
+	if rec.Code != code {
+		t.Fatalf("%s returned %d, expected %d: %s", what, rec.Code, code, rec.Body.String())
+	}
+}
+
+func TestRoutesMachineLifecycle(t *testing.T) {
+	c := newTestController(t)
+
+	rec := request(t, c, http.MethodPost, "/machines", fakeMachine("vm1"))
+	expectStatus(t, rec, http.StatusOK, "POST /machines")
+	rec = request(t, c, http.MethodPost, "/machines", fakeMachine("vm1"))
+	expectStatus(t, rec, http.StatusBadRequest, "POST /machines of a duplicate machine")
+
+	rec = request(t, c, http.MethodGet, "/machines", nil)
+	expectStatus(t, rec, http.StatusOK, "GET /machines")
+	var machines []Machine
+	if err := json.Unmarshal(rec.Body.Bytes(), &machines); err != nil {
+		t.Fatalf("Failed to unmarshal machines: %s", err)
+	}
+	if len(machines) != 1 || machines[0].Name != "vm1" || machines[0].Status != MachineStatusStopped {
+		t.Fatalf("unexpected machines %+v", machines)
+	}
+
+	rec = request(t, c, http.MethodPost, "/machines/vm1/start", map[string]string{"status": "running"})
+	expectStatus(t, rec, http.StatusOK, "POST /machines/vm1/start")
+	rec = request(t, c, http.MethodPost, "/machines/vm1/start", map[string]string{"status": "running"})
+	expectStatus(t, rec, http.StatusBadRequest, "POST /machines/vm1/start of a running machine")
+	rec = request(t, c, http.MethodPost, "/machines/missing/start", map[string]string{"status": "running"})
+	expectStatus(t, rec, http.StatusBadRequest, "POST /machines/missing/start")
+
+	rec = request(t, c, http.MethodGet, "/machines/vm1", nil)
+	expectStatus(t, rec, http.StatusOK, "GET /machines/vm1")
+	var machine Machine
+	if err := json.Unmarshal(rec.Body.Bytes(), &machine); err != nil {
+		t.Fatalf("Failed to unmarshal machine: %s", err)
+	}
+	if machine.Status != MachineStatusRunning {
+		t.Errorf("started machine status is %s, expected %s", machine.Status, MachineStatusRunning)
+	}
+
+	rec = request(t, c, http.MethodGet, "/machines/vm1/stats", nil)
+	expectStatus(t, rec, http.StatusOK, "GET /machines/vm1/stats")
+
+	rec = request(t, c, http.MethodPost, "/machines/vm1/stop", map[string]interface{}{"status": "stopped", "force": false})
+	expectStatus(t, rec, http.StatusOK, "POST /machines/vm1/stop")
+	rec = request(t, c, http.MethodPost, "/machines/vm1/stop", map[string]interface{}{"status": "running"})
+	expectStatus(t, rec, http.StatusBadRequest, "POST /machines/vm1/stop with a bad status")
+
+	rec = request(t, c, http.MethodDelete, "/machines/vm1", nil)
+	expectStatus(t, rec, http.StatusOK, "DELETE /machines/vm1")
+	rec = request(t, c, http.MethodGet, "/machines", nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &machines); err != nil {
+		t.Fatalf("Failed to unmarshal machines: %s", err)
+	}
+	if len(machines) != 0 {
+		t.Errorf("deleted machine is still listed: %+v", machines)
+	}
+}
+
+func TestRoutesMachineMedia(t *testing.T) {
+	c := newTestController(t)
+
+	expectStatus(t, request(t, c, http.MethodPost, "/machines", fakeMachine("vm1")), http.StatusOK, "POST /machines")
+	rec := request(t, c, http.MethodPost, "/machines/vm1/media/cdrom/eject", MachineMediaRequest{})
+	expectStatus(t, rec, http.StatusBadRequest, "eject from a stopped machine")
+	expectStatus(t, request(t, c, http.MethodPost, "/machines/vm1/start", map[string]string{"status": "running"}), http.StatusOK, "start")
+	defer c.MachineController.StopMachine("vm1", true)
+
+	rec = request(t, c, http.MethodPost, "/machines/vm1/media/cdrom/eject", MachineMediaRequest{})
+	expectStatus(t, rec, http.StatusOK, "POST /machines/vm1/media/cdrom/eject")
+
+	rec = request(t, c, http.MethodPost, "/machines/vm1/media/cdrom/insert", MachineMediaRequest{File: "/images/tools.iso", Format: "raw"})
+	expectStatus(t, rec, http.StatusOK, "POST /machines/vm1/media/cdrom/insert")
+
+	rec = request(t, c, http.MethodGet, "/machines/vm1/media", nil)
+	expectStatus(t, rec, http.StatusOK, "GET /machines/vm1/media")
+	var media []MediaInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &media); err != nil {
+		t.Fatalf("Failed to unmarshal media: %s", err)
+	}
+	if len(media) != 1 || media[0].File != "/images/tools.iso" {
+		t.Errorf("unexpected media %+v", media)
+	}
+
+	rec = request(t, c, http.MethodPost, "/machines/vm1/media/missing/insert", MachineMediaRequest{File: "/images/tools.iso"})
+	expectStatus(t, rec, http.StatusBadRequest, "insert into an unknown drive")
+}
+
+func TestRoutesMachineDisks(t *testing.T) {
+	c := newTestController(t)
+
+	expectStatus(t, request(t, c, http.MethodPost, "/machines", fakeMachine("vm1")), http.StatusOK, "POST /machines")
+	expectStatus(t, request(t, c, http.MethodPost, "/machines/vm1/start", map[string]string{"status": "running"}), http.StatusOK, "start")
+	defer c.MachineController.StopMachine("vm1", true)
+
+	disk := MachineDiskRequest{
+		Disk: QemuDisk{File: "/images/data.qcow2", Format: "qcow2", Type: "ssd", Attach: "virtio"},
+	}
+	rec := request(t, c, http.MethodPost, "/machines/vm1/disks", disk)
+	expectStatus(t, rec, http.StatusOK, "POST /machines/vm1/disks")
+	rec = request(t, c, http.MethodPost, "/machines/vm1/disks", disk)
+	expectStatus(t, rec, http.StatusBadRequest, "POST /machines/vm1/disks of a duplicate disk")
+
+	machine, _ := c.MachineController.GetMachine("vm1")
+	if len(machine.Config.Disks) != 1 {
+		t.Fatalf("attached disk is not in the machine config: %+v", machine.Config.Disks)
+	}
+
+	rec = request(t, c, http.MethodDelete, "/machines/vm1/disks/data", nil)
+	expectStatus(t, rec, http.StatusOK, "DELETE /machines/vm1/disks/data")
+	rec = request(t, c, http.MethodDelete, "/machines/vm1/disks/data", nil)
+	expectStatus(t, rec, http.StatusBadRequest, "DELETE /machines/vm1/disks/data of a detached disk")
+
+	if machine, _ := c.MachineController.GetMachine("vm1"); len(machine.Config.Disks) != 0 {
+		t.Errorf("detached disk is still in the machine config: %+v", machine.Config.Disks)
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/raharper/qcli"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SCSIControllerPrefix = "scsi"
+	// virtio-scsi supports scsi-id 0-255 on a single channel; we place one
+	// disk per target with lun 0.
+	SCSIMaxUnits = 256
+)
+
+// scsiControllerIndex parses a controller name, e.g. scsi1, into its index
+func scsiControllerIndex(name string) (int, error) {
+	if !strings.HasPrefix(name, SCSIControllerPrefix) {
+		return -1, fmt.Errorf("invalid scsi controller '%s', expected %s<N>", name, SCSIControllerPrefix)
+	}
+	idx, err := strconv.Atoi(strings.TrimPrefix(name, SCSIControllerPrefix))
+	if err != nil || idx < 0 {
+		return -1, fmt.Errorf("invalid scsi controller '%s', expected %s<N>", name, SCSIControllerPrefix)
+	}
+	return idx, nil
+}
+
+func scsiUnit(unit string) (int, error) {
+	u, err := strconv.Atoi(unit)
+	if err != nil || u < 0 || u >= SCSIMaxUnits {
+		return -1, fmt.Errorf("invalid scsi unit '%s', expected 0-%d", unit, SCSIMaxUnits-1)
+	}
+	return u, nil
+}
+
+type scsiBusPlan struct {
+	// controller index -> set of allocated units
+	units map[int]map[int]bool
+}
+
+func (p *scsiBusPlan) reserve(ctrl, unit int) error {
+	if _, ok := p.units[ctrl]; !ok {
+		p.units[ctrl] = make(map[int]bool)
+	}
+	if p.units[ctrl][unit] {
+		return fmt.Errorf("scsi unit %d on controller %s%d is already in use", unit, SCSIControllerPrefix, ctrl)
+	}
+	p.units[ctrl][unit] = true
+	return nil
+}
+
+func (p *scsiBusPlan) nextUnit(ctrl int) (int, bool) {
+	for unit := 0; unit < SCSIMaxUnits; unit++ {
+		if !p.units[ctrl][unit] {
+			return unit, true
+		}
+	}
+	return -1, false
+}
+
+// PlanSCSIBus assigns every scsi attached disk a controller and unit and
+// returns the controllers required.  Disks are processed in definition order
+// in three passes: disks with a controller and unit, disks with only a
+// controller, and then the remaining disks fill the lowest numbered controller
+// with a free unit, spilling over onto new controllers.  The same disk list
+// always yields the same allocation.
+func (v *VMDef) PlanSCSIBus(qti *qcli.QemuTypeIndex) ([]qcli.SCSIControllerDevice, error) {
+	controllers := []qcli.SCSIControllerDevice{}
+	plan, err := planSCSIUnits(v.Disks)
+	if err != nil {
+		return controllers, err
+	}
+
+	ctrlIndices := []int{}
+	for ctrl := range plan.units {
+		ctrlIndices = append(ctrlIndices, ctrl)
+	}
+	sort.Ints(ctrlIndices)
+
+	// each controller gets a dedicated iothread
+	for _, ctrl := range ctrlIndices {
+		if err := qti.Set("scsi", ctrl); err != nil {
+			return controllers, fmt.Errorf("Failed to allocate scsi controller %d: %s", ctrl, err)
+		}
+		scsiCon := qcli.SCSIControllerDevice{
+			ID:       fmt.Sprintf("%s%d", SCSIControllerPrefix, ctrl),
+			IOThread: fmt.Sprintf("iothread%d", qti.Next("iothread")),
+		}
+		log.Infof("scsi: controller %s with iothread %s, %d disk(s)", scsiCon.ID, scsiCon.IOThread, len(plan.units[ctrl]))
+		controllers = append(controllers, scsiCon)
+	}
+	return controllers, nil
+}
+
+// planSCSIUnits assigns the scsi attached disks a controller and unit in the
+// three passes of PlanSCSIBus
+func planSCSIUnits(disks []QemuDisk) (scsiBusPlan, error) {
+	plan := scsiBusPlan{units: make(map[int]map[int]bool)}
+
+	// pass 1: fully specified placement
+	for n := range disks {
+		disk := &disks[n]
+		if disk.Attach != "scsi" || disk.Unit == "" {
+			continue
+		}
+		if disk.Controller == "" {
+			disk.Controller = SCSIControllerPrefix + "0"
+		}
+		ctrl, err := scsiControllerIndex(disk.Controller)
+		if err != nil {
+			return plan, fmt.Errorf("disk %s: %s", disk.File, err)
+		}
+		unit, err := scsiUnit(disk.Unit)
+		if err != nil {
+			return plan, fmt.Errorf("disk %s: %s", disk.File, err)
+		}
+		if err := plan.reserve(ctrl, unit); err != nil {
+			return plan, fmt.Errorf("disk %s: %s", disk.File, err)
+		}
+	}
+
+	// pass 2: controller specified, allocate unit
+	for n := range disks {
+		disk := &disks[n]
+		if disk.Attach != "scsi" || disk.Unit != "" || disk.Controller == "" {
+			continue
+		}
+		ctrl, err := scsiControllerIndex(disk.Controller)
+		if err != nil {
+			return plan, fmt.Errorf("disk %s: %s", disk.File, err)
+		}
+		unit, ok := plan.nextUnit(ctrl)
+		if !ok {
+			return plan, fmt.Errorf("disk %s: no free units on scsi controller %s", disk.File, disk.Controller)
+		}
+		plan.reserve(ctrl, unit)
+		disk.Unit = fmt.Sprintf("%d", unit)
+	}
+
+	// pass 3: allocate controller and unit
+	for n := range disks {
+		disk := &disks[n]
+		if disk.Attach != "scsi" || disk.Controller != "" {
+			continue
+		}
+		for ctrl := 0; ; ctrl++ {
+			if unit, ok := plan.nextUnit(ctrl); ok {
+				plan.reserve(ctrl, unit)
+				disk.Controller = fmt.Sprintf("%s%d", SCSIControllerPrefix, ctrl)
+				disk.Unit = fmt.Sprintf("%d", unit)
+				break
+			}
+		}
+	}
+	return plan, nil
+}
+
+// PlanSCSIDisks returns a sanitized copy of disks with the scsi attached
+// disks placed on the controller and unit GenerateQConfig uses for them.
+// disks itself is not modified.
+func PlanSCSIDisks(basedir string, disks []QemuDisk) ([]QemuDisk, error) {
+	planned := append([]QemuDisk{}, disks...)
+	for idx := range planned {
+		if err := planned[idx].Sanitize(basedir); err != nil {
+			return planned, err
+		}
+	}
+	if _, err := planSCSIUnits(planned); err != nil {
+		return planned, err
+	}
+	return planned, nil
+}
+
+// PlanSCSIHotplug assigns disk, hotplugged onto its controller next to the
+// placed scsi disks of the running VM, a free unit or checks its unit is free.
+func PlanSCSIHotplug(disks []QemuDisk, disk *QemuDisk) error {
+	plan, err := planSCSIUnits(append([]QemuDisk{}, disks...))
+	if err != nil {
+		return err
+	}
+	ctrl, err := scsiControllerIndex(disk.Controller)
+	if err != nil {
+		return fmt.Errorf("disk %s: %s", disk.File, err)
+	}
+	if disk.Unit != "" {
+		unit, err := scsiUnit(disk.Unit)
+		if err != nil {
+			return fmt.Errorf("disk %s: %s", disk.File, err)
+		}
+		if err := plan.reserve(ctrl, unit); err != nil {
+			return fmt.Errorf("disk %s: %s", disk.File, err)
+		}
+		return nil
+	}
+	unit, ok := plan.nextUnit(ctrl)
+	if !ok {
+		return fmt.Errorf("disk %s: no free units on scsi controller %s", disk.File, disk.Controller)
+	}
+	disk.Unit = fmt.Sprintf("%d", unit)
+	return nil
+}
+
+// SCSIDevice is the scsi-hd device of a disk placed on a virtio-scsi
+// controller.  qcli only emits the bus of scsi-hd devices, so the disk drive
+// is emitted by qcli and the device, with its target and lun, by QemuParams.
+type SCSIDevice struct {
+	Drive     string
+	Bus       string
+	Channel   int
+	SCSIID    int
+	Lun       int
+	Serial    string
+	BootIndex string
+	BlockSize int
+}
+
+// SCSIDevice returns the device for the planned disk with the drive blk
+func (q *QemuDisk) SCSIDevice(blk qcli.BlockDevice) (SCSIDevice, error) {
+	if q.Controller == "" || q.Unit == "" {
+		return SCSIDevice{}, fmt.Errorf("disk %s has no scsi controller/unit assigned", q.File)
+	}
+	unit, err := scsiUnit(q.Unit)
+	if err != nil {
+		return SCSIDevice{}, err
+	}
+	return SCSIDevice{
+		Drive:     blk.ID,
+		Bus:       q.Controller + ".0",
+		Channel:   0,
+		SCSIID:    unit,
+		Lun:       0,
+		Serial:    blk.Serial,
+		BootIndex: blk.BootIndex,
+		BlockSize: blk.BlockSize,
+	}, nil
+}
+
+func (d SCSIDevice) QemuParams() []string {
+	deviceParams := []string{
+		string(qcli.SCSIHD),
+		fmt.Sprintf("drive=%s", d.Drive),
+		fmt.Sprintf("serial=%s", d.Serial),
+	}
+	if d.BootIndex != "" {
+		deviceParams = append(deviceParams, fmt.Sprintf("bootindex=%s", d.BootIndex))
+	}
+	deviceParams = append(deviceParams,
+		fmt.Sprintf("bus=%s", d.Bus),
+		fmt.Sprintf("channel=%d", d.Channel),
+		fmt.Sprintf("scsi-id=%d", d.SCSIID),
+		fmt.Sprintf("lun=%d", d.Lun),
+	)
+	if d.BlockSize > 0 {
+		deviceParams = append(deviceParams, fmt.Sprintf("logical_block_size=%d", d.BlockSize))
+		deviceParams = append(deviceParams, fmt.Sprintf("physical_block_size=%d", d.BlockSize))
+	}
+	return []string{"-device", strings.Join(deviceParams, ",")}
+}
@@ -0,0 +1,402 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/raharper/qcli"
+)
+
+func diskPlacement(disks []QemuDisk) map[string]string {
+	placement := make(map[string]string)
+	for _, disk := range disks {
+		if disk.Attach == "scsi" {
+			placement[disk.DiskID()] = disk.Controller + ":" + disk.Unit
+		}
+	}
+	return placement
+}
+
+func TestPlanSCSIDisks(t *testing.T) {
+	testCases := []struct {
+		name  string
+		disks []QemuDisk
+		want  map[string]string
+		err   bool
+	}{
+		{
+			name:  "definition order",
+			disks: []QemuDisk{{File: "a.qcow2"}, {File: "b.qcow2"}, {File: "c.qcow2", Attach: "virtio"}},
+			want:  map[string]string{"a": "scsi0:0", "b": "scsi0:1"},
+		},
+		{
+			name: "placed disks first",
+			disks: []QemuDisk{
+				{File: "a.qcow2"},
+				{File: "b.qcow2", Unit: "0"},
+				{File: "c.qcow2", Controller: "scsi1"},
+			},
+			want: map[string]string{"a": "scsi0:1", "b": "scsi0:0", "c": "scsi1:0"},
+		},
+		{
+			name:  "unit in use",
+			disks: []QemuDisk{{File: "a.qcow2", Unit: "1"}, {File: "b.qcow2", Controller: "scsi0", Unit: "1"}},
+			err:   true,
+		},
+		{
+			name:  "invalid unit",
+			disks: []QemuDisk{{File: "a.qcow2", Unit: "256"}},
+			err:   true,
+		},
+		{
+			name:  "invalid controller",
+			disks: []QemuDisk{{File: "a.qcow2", Controller: "ide0"}},
+			err:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			disks := append([]QemuDisk{}, tc.disks...)
+			planned, err := PlanSCSIDisks(t.TempDir(), disks)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, planned %v", diskPlacement(planned))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got := diskPlacement(planned)
+			if len(got) != len(tc.want) {
+				t.Fatalf("placement %v, expected %v", got, tc.want)
+			}
+			for id, want := range tc.want {
+				if got[id] != want {
+					t.Errorf("disk %s placed on %s, expected %s", id, got[id], want)
+				}
+			}
+			for idx := range disks {
+				if disks[idx] != tc.disks[idx] {
+					t.Errorf("disk %d was modified: %+v", idx, disks[idx])
+				}
+			}
+		})
+	}
+}
+
+// TestSCSIAttachDetachAttach follows the disks of a machine and of its
+// running VM through hotplug.  The machine config changes on every step while
+// the VM keeps its own copy of the disks it was started with.
+func TestSCSIAttachDetachAttach(t *testing.T) {
+	runDir := t.TempDir()
+	config := []QemuDisk{{File: "a.qcow2"}, {File: "b.qcow2"}, {File: "c.qcow2"}}
+	// as Machine.start and newVM
+	config, err := PlanSCSIDisks(runDir, config)
+	if err != nil {
+		t.Fatalf("failed to plan disks: %s", err)
+	}
+	vmDisks := append([]QemuDisk{}, config...)
+	scsiDisks, err := placedSCSIDisks(runDir, vmDisks)
+	if err != nil {
+		t.Fatalf("failed to place disks: %s", err)
+	}
+	v := &VM{
+		Config: VMDef{Name: "vm1", Disks: vmDisks},
+		RunDir: runDir,
+		qcli: &qcli.Config{
+			SCSIControllerDevices: []qcli.SCSIControllerDevice{{ID: "scsi0"}, {ID: "scsi1"}},
+		},
+		scsiDisks: scsiDisks,
+	}
+
+	steps := []struct {
+		op   string
+		disk QemuDisk
+		want string
+		err  bool
+	}{
+		{op: "detach", disk: QemuDisk{File: "a.qcow2"}},
+		{op: "attach", disk: QemuDisk{File: "d.qcow2"}, want: "scsi0:0"},
+		{op: "detach", disk: QemuDisk{File: "b.qcow2"}},
+		{op: "attach", disk: QemuDisk{File: "e.qcow2", Unit: "2"}, err: true},
+		{op: "attach", disk: QemuDisk{File: "e.qcow2"}, want: "scsi0:1"},
+		{op: "attach", disk: QemuDisk{File: "f.qcow2"}, want: "scsi0:3"},
+		{op: "attach", disk: QemuDisk{File: "g.qcow2", Controller: "scsi1", Unit: "2"}, want: "scsi1:2"},
+		{op: "attach", disk: QemuDisk{File: "h.qcow2", Controller: "scsi2"}, err: true},
+	}
+
+	for n, step := range steps {
+		disk := step.disk
+		if err := disk.Sanitize(runDir); err != nil {
+			t.Fatalf("step %d: failed to sanitize disk: %s", n, err)
+		}
+		switch step.op {
+		case "attach":
+			err := v.placeSCSIDisk(&disk)
+			if step.err {
+				if err == nil {
+					t.Errorf("step %d: attach %s placed on %s:%s, expected an error", n, disk.DiskID(), disk.Controller, disk.Unit)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("step %d: attach %s failed: %s", n, disk.DiskID(), err)
+			}
+			if got := disk.Controller + ":" + disk.Unit; got != step.want {
+				t.Errorf("step %d: attach %s placed on %s, expected %s", n, disk.DiskID(), got, step.want)
+			}
+			// as VM.AttachDisk and Machine.AttachDisk
+			v.scsiDisks[disk.DiskID()] = disk
+			config = append(config, disk)
+		case "detach":
+			// as VM.DetachDisk and Machine.DetachDisk
+			delete(v.scsiDisks, disk.DiskID())
+			for idx := range config {
+				if config[idx].DiskID() == disk.DiskID() {
+					config = append(config[:idx], config[idx+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	for idx, id := range []string{"a", "b", "c"} {
+		if got := v.Config.Disks[idx].DiskID(); got != id {
+			t.Errorf("VM disk %d is %s, expected %s", idx, got, id)
+		}
+	}
+	want := map[string]string{"c": "scsi0:2", "d": "scsi0:0", "e": "scsi0:1", "f": "scsi0:3", "g": "scsi1:2"}
+	got := diskPlacement(config)
+	if len(got) != len(want) {
+		t.Fatalf("machine disks %v, expected %v", got, want)
+	}
+	for id := range want {
+		if got[id] != want[id] {
+			t.Errorf("machine disk %s placed on %s, expected %s", id, got[id], want[id])
+		}
+	}
+	// the next start places the disks where they were hotplugged
+	planned, err := PlanSCSIDisks(runDir, config)
+	if err != nil {
+		t.Fatalf("failed to plan disks for restart: %s", err)
+	}
+	for id, placement := range diskPlacement(planned) {
+		if placement != want[id] {
+			t.Errorf("restart places disk %s on %s, expected %s", id, placement, want[id])
+		}
+	}
+}
+
+func scsiTestDisks(n int) []QemuDisk {
+	disks := []QemuDisk{}
+	for i := 0; i < n; i++ {
+		disks = append(disks, QemuDisk{File: fmt.Sprintf("disk%d.qcow2", i)})
+	}
+	return disks
+}
+
+func TestPlanSCSIBusSpillOver(t *testing.T) {
+	testCases := []struct {
+		name        string
+		disks       []QemuDisk
+		controllers []string
+		last        string
+	}{
+		{
+			name:        "single controller",
+			disks:       scsiTestDisks(SCSIMaxUnits),
+			controllers: []string{"scsi0"},
+			last:        fmt.Sprintf("scsi0:%d", SCSIMaxUnits-1),
+		},
+		{
+			name:        "spill over",
+			disks:       scsiTestDisks(SCSIMaxUnits + 1),
+			controllers: []string{"scsi0", "scsi1"},
+			last:        "scsi1:0",
+		},
+		{
+			name:        "spill over past a placed controller",
+			disks:       append([]QemuDisk{{File: "placed.qcow2", Controller: "scsi1", Unit: "0"}}, scsiTestDisks(SCSIMaxUnits+1)...),
+			controllers: []string{"scsi0", "scsi1"},
+			last:        "scsi1:1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := VMDef{Disks: tc.disks}
+			planned, err := PlanSCSIDisks(t.TempDir(), v.Disks)
+			if err != nil {
+				t.Fatalf("failed to plan disks: %s", err)
+			}
+			last := planned[len(planned)-1]
+			if got := last.Controller + ":" + last.Unit; got != tc.last {
+				t.Errorf("last disk placed on %s, expected %s", got, tc.last)
+			}
+
+			v.Disks = planned
+			controllers, err := v.PlanSCSIBus(qcli.NewQemuTypeIndex())
+			if err != nil {
+				t.Fatalf("failed to plan scsi bus: %s", err)
+			}
+			if len(controllers) != len(tc.controllers) {
+				t.Fatalf("planned %d controllers, expected %v", len(controllers), tc.controllers)
+			}
+			iothreads := make(map[string]bool)
+			for idx, ctrl := range controllers {
+				if ctrl.ID != tc.controllers[idx] {
+					t.Errorf("controller %d is %s, expected %s", idx, ctrl.ID, tc.controllers[idx])
+				}
+				if iothreads[ctrl.IOThread] {
+					t.Errorf("controller %s shares iothread %s", ctrl.ID, ctrl.IOThread)
+				}
+				iothreads[ctrl.IOThread] = true
+			}
+		})
+	}
+}
+
+func TestSCSIHotplugSpillOver(t *testing.T) {
+	runDir := t.TempDir()
+	newVM := func(disks []QemuDisk) *VM {
+		scsiDisks, err := placedSCSIDisks(runDir, disks)
+		if err != nil {
+			t.Fatalf("failed to place disks: %s", err)
+		}
+		return &VM{
+			Config: VMDef{Name: "vm1"},
+			qcli: &qcli.Config{
+				SCSIControllerDevices: []qcli.SCSIControllerDevice{{ID: "scsi0"}, {ID: "scsi1"}},
+			},
+			scsiDisks: scsiDisks,
+		}
+	}
+
+	testCases := []struct {
+		name  string
+		disks []QemuDisk
+		disk  QemuDisk
+		want  string
+		err   bool
+	}{
+		{
+			name:  "first controller",
+			disks: scsiTestDisks(1),
+			disk:  QemuDisk{File: "new.qcow2", Attach: "scsi"},
+			want:  "scsi0:1",
+		},
+		{
+			name:  "first controller full",
+			disks: scsiTestDisks(SCSIMaxUnits),
+			disk:  QemuDisk{File: "new.qcow2", Attach: "scsi"},
+			want:  "scsi1:0",
+		},
+		{
+			name:  "requested controller full",
+			disks: scsiTestDisks(SCSIMaxUnits),
+			disk:  QemuDisk{File: "new.qcow2", Attach: "scsi", Controller: "scsi0"},
+			err:   true,
+		},
+		{
+			name:  "unit without controller",
+			disks: scsiTestDisks(SCSIMaxUnits),
+			disk:  QemuDisk{File: "new.qcow2", Attach: "scsi", Unit: "3"},
+			err:   true,
+		},
+		{
+			name:  "all controllers full",
+			disks: scsiTestDisks(2 * SCSIMaxUnits),
+			disk:  QemuDisk{File: "new.qcow2", Attach: "scsi"},
+			err:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newVM(tc.disks)
+			disk := tc.disk
+			err := v.placeSCSIDisk(&disk)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, placed on %s:%s", disk.Controller, disk.Unit)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := disk.Controller + ":" + disk.Unit; got != tc.want {
+				t.Errorf("placed on %s, expected %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSCSIDeviceQemuParams(t *testing.T) {
+	testCases := []struct {
+		name string
+		disk QemuDisk
+		blk  qcli.BlockDevice
+		want string
+		err  bool
+	}{
+		{
+			name: "placed disk",
+			disk: QemuDisk{File: "a.qcow2", Controller: "scsi1", Unit: "7"},
+			blk:  qcli.BlockDevice{ID: "drive0", Serial: "a", BlockSize: 512},
+			want: "scsi-hd,drive=drive0,serial=a,bus=scsi1.0,channel=0,scsi-id=7,lun=0,logical_block_size=512,physical_block_size=512",
+		},
+		{
+			name: "boot disk",
+			disk: QemuDisk{File: "a.qcow2", Controller: "scsi0", Unit: "0"},
+			blk:  qcli.BlockDevice{ID: "drive1", Serial: "a", BootIndex: "1"},
+			want: "scsi-hd,drive=drive1,serial=a,bootindex=1,bus=scsi0.0,channel=0,scsi-id=0,lun=0",
+		},
+		{
+			name: "not placed",
+			disk: QemuDisk{File: "a.qcow2", Controller: "scsi0"},
+			err:  true,
+		},
+		{
+			name: "invalid unit",
+			disk: QemuDisk{File: "a.qcow2", Controller: "scsi0", Unit: "x"},
+			err:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dev, err := tc.disk.SCSIDevice(tc.blk)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got device %+v", dev)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			params := dev.QemuParams()
+			if len(params) != 2 || params[0] != "-device" || params[1] != tc.want {
+				t.Errorf("params %v, expected -device %s", params, tc.want)
+			}
+		})
+	}
+}
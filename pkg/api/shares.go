@@ -0,0 +1,239 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/raharper/qcli"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ShareTypeVirtioFS = "virtiofs"
+	ShareType9P       = "9p"
+)
+
+// ShareDef exports a host directory to the guest, which mounts it by Tag,
+// e.g. mount -t virtiofs <tag> /mnt or mount -t 9p -o trans=virtio <tag> /mnt
+type ShareDef struct {
+	Path     string `yaml:"path"`
+	Tag      string `yaml:"tag"`
+	ReadOnly bool   `yaml:"read-only,omitempty"`
+	Type     string `yaml:"type,omitempty"`
+}
+
+func (s *ShareDef) Sanitize() error {
+	errors := []string{}
+
+	if s.Type == "" {
+		s.Type = ShareTypeVirtioFS
+	}
+	if s.Type != ShareTypeVirtioFS && s.Type != ShareType9P {
+		errors = append(errors, fmt.Sprintf("invalid type: found %s expected [%s %s]", s.Type, ShareTypeVirtioFS, ShareType9P))
+	}
+	if s.Tag == "" {
+		errors = append(errors, "empty Tag")
+	} else if qmpInvalidIDChars.MatchString(s.Tag) {
+		errors = append(errors, fmt.Sprintf("invalid tag '%s', only [A-Za-z0-9_.-] are allowed", s.Tag))
+	}
+	if s.Path == "" {
+		errors = append(errors, "empty Path")
+	} else {
+		fullPath, err := localPath(s.Path)
+		if err != nil {
+			errors = append(errors, err.Error())
+		} else if info, err := os.Stat(fullPath); err != nil || !info.IsDir() {
+			errors = append(errors, fmt.Sprintf("path %q is not a directory", fullPath))
+		} else {
+			s.Path = fullPath
+		}
+	}
+
+	if len(errors) != 0 {
+		return fmt.Errorf("bad share %#v: %s", s, strings.Join(errors, "\n"))
+	}
+	return nil
+}
+
+// VirtioFSSocket returns the vhost-user socket path of the share's virtiofsd
+func (s *ShareDef) VirtioFSSocket(sockDir string) string {
+	return filepath.Join(sockDir, "virtiofs-"+s.Tag+".sock")
+}
+
+// QemuParams returns the qemu parameters for the share, qcli does not
+// support vhost-user-fs devices or read-only fsdevs.
+func (s *ShareDef) QemuParams(sockDir string) []string {
+	if s.Type == ShareType9P {
+		fsdev := fmt.Sprintf("local,id=fs-%s,path=%s,security_model=%s", s.Tag, s.Path, qcli.MappedXattr)
+		if s.ReadOnly {
+			fsdev += ",readonly=on"
+		}
+		return []string{
+			"-fsdev", fsdev,
+			"-device", fmt.Sprintf("%s,fsdev=fs-%s,mount_tag=%s", qcli.Virtio9PTransport[qcli.TransportPCI], s.Tag, s.Tag),
+		}
+	}
+	return []string{
+		"-chardev", fmt.Sprintf("socket,id=char-fs-%s,path=%s", s.Tag, s.VirtioFSSocket(sockDir)),
+		"-device", fmt.Sprintf("vhost-user-fs-pci,queue-size=1024,chardev=char-fs-%s,tag=%s", s.Tag, s.Tag),
+	}
+}
+
+// ConfigureShares validates the shares and returns their qemu parameters.
+// virtiofs requires guest memory which virtiofsd can map, ConfigureMemory
+// backs the guest memory of VMs with virtiofs shares with a shared memfd.
+func ConfigureShares(c *qcli.Config, v VMDef, sockDir string) ([]string, error) {
+	params := []string{}
+	tags := make(map[string]bool)
+	for idx := range v.Shares {
+		share := v.Shares[idx]
+		if err := share.Sanitize(); err != nil {
+			return params, err
+		}
+		if tags[share.Tag] {
+			return params, fmt.Errorf("duplicate share tag '%s'", share.Tag)
+		}
+		tags[share.Tag] = true
+		log.Infof("share: %s %s -> tag %s read-only:%v", share.Type, share.Path, share.Tag, share.ReadOnly)
+		params = append(params, share.QemuParams(sockDir)...)
+	}
+	return params, nil
+}
+
+// VirtioFSD runs and supervises the virtiofsd daemon of a share
+type VirtioFSD struct {
+	Share   ShareDef
+	Socket  string
+	LogFile string
+	// Cgroup virtiofsd is started in, nil for the cgroup of machined
+	Cgroup   *MachineCgroup
+	cmd      *exec.Cmd
+	logFH    *os.File
+	finished chan error
+	stopping bool
+}
+
+func findVirtioFSD() string {
+	if path := Which("virtiofsd"); path != "" {
+		return path
+	}
+	// distros ship virtiofsd outside of PATH
+	for _, path := range []string{"/usr/libexec/virtiofsd", "/usr/lib/qemu/virtiofsd", "/usr/lib/virtiofsd"} {
+		if PathExists(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+func (d *VirtioFSD) Start() error {
+	virtiofsd := findVirtioFSD()
+	if virtiofsd == "" {
+		return fmt.Errorf("no 'virtiofsd' command found in PATH or /usr/libexec")
+	}
+
+	args := []string{
+		"--socket-path=" + d.Socket,
+		"--shared-dir=" + d.Share.Path,
+		"--cache=auto",
+	}
+	if d.Share.ReadOnly {
+		args = append(args, "--readonly")
+	}
+	// namespace sandboxing requires root
+	if os.Geteuid() != 0 {
+		args = append(args, "--sandbox=none")
+	}
+
+	logFH, err := os.OpenFile(d.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to open virtiofsd log %q: %s", d.LogFile, err)
+	}
+
+	cmd := exec.Command(virtiofsd, args...)
+	cmd.Stdout = logFH
+	cmd.Stderr = logFH
+	log.Infof("virtiofsd args: %s", cmd.String())
+	if err := d.Cgroup.StartCommand(cmd); err != nil {
+		logFH.Close()
+		return fmt.Errorf("Failed to start virtiofsd for share %s: %s", d.Share.Tag, err)
+	}
+	d.cmd = cmd
+	d.logFH = logFH
+	d.finished = make(chan error, 1)
+
+	go func() {
+		err := d.cmd.Wait()
+		// virtiofsd exits cleanly when QEMU disconnects
+		if err != nil && !d.stopping {
+			log.Errorf("virtiofsd for share %s pid %d failed: %v, see %s", d.Share.Tag, d.cmd.Process.Pid, err, d.LogFile)
+		}
+		d.logFH.Close()
+		d.finished <- err
+	}()
+
+	// wait up to 10 seconds for the vhost-user socket to appear
+	if !WaitForPath(d.Socket, 10, 1) {
+		d.Stop()
+		return fmt.Errorf("virtiofsd start failed, socket %s does not exist after 10 seconds", d.Socket)
+	}
+	log.Infof("virtiofsd for share %s started with pid %d", d.Share.Tag, cmd.Process.Pid)
+	return nil
+}
+
+// Pid returns the pid of the started virtiofsd
+func (d *VirtioFSD) Pid() int {
+	if d.cmd == nil {
+		return 0
+	}
+	return d.cmd.Process.Pid
+}
+
+func (d *VirtioFSD) Stop() error {
+	// never started.
+	if d.cmd == nil {
+		return nil
+	}
+	d.stopping = true
+
+	pid := d.cmd.Process.Pid
+	if err := d.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		if err == os.ErrProcessDone {
+			return nil
+		}
+		log.Warnf("Failed to kill %d: %v", pid, err)
+		return err
+	}
+
+	timeout := time.Duration(2) * time.Second
+	select {
+	case <-d.finished:
+		log.Infof("virtiofsd pid %d exited after sigterm", pid)
+	case <-time.After(timeout):
+		log.Infof("virtiofsd pid %d didn't die right away, killing.", pid)
+		if err := d.cmd.Process.Kill(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/raharper/qcli"
+)
+
+func TestShareSanitize(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("file"), 0644); err != nil {
+		t.Fatalf("failed to write %s: %s", file, err)
+	}
+
+	testCases := []struct {
+		name  string
+		share ShareDef
+		want  ShareDef
+		err   bool
+	}{
+		{
+			name:  "defaults",
+			share: ShareDef{Path: dir, Tag: "src"},
+			want:  ShareDef{Path: dir, Tag: "src", Type: ShareTypeVirtioFS},
+		},
+		{
+			name:  "9p read-only",
+			share: ShareDef{Path: dir, Tag: "src.1", Type: ShareType9P, ReadOnly: true},
+			want:  ShareDef{Path: dir, Tag: "src.1", Type: ShareType9P, ReadOnly: true},
+		},
+		{
+			name:  "invalid type",
+			share: ShareDef{Path: dir, Tag: "src", Type: "nfs"},
+			err:   true,
+		},
+		{
+			name:  "empty tag",
+			share: ShareDef{Path: dir},
+			err:   true,
+		},
+		{
+			name:  "invalid tag",
+			share: ShareDef{Path: dir, Tag: "my src"},
+			err:   true,
+		},
+		{
+			name:  "empty path",
+			share: ShareDef{Tag: "src"},
+			err:   true,
+		},
+		{
+			name:  "missing path",
+			share: ShareDef{Path: filepath.Join(dir, "missing"), Tag: "src"},
+			err:   true,
+		},
+		{
+			name:  "file path",
+			share: ShareDef{Path: file, Tag: "src"},
+			err:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			share := tc.share
+			err := share.Sanitize()
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, sanitized to %+v", share)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if share != tc.want {
+				t.Errorf("sanitized to %+v, expected %+v", share, tc.want)
+			}
+		})
+	}
+}
+
+func TestShareQemuParams(t *testing.T) {
+	testCases := []struct {
+		name  string
+		share ShareDef
+		want  string
+	}{
+		{
+			name:  "virtiofs",
+			share: ShareDef{Path: "/src", Tag: "src", Type: ShareTypeVirtioFS},
+			want: "-chardev socket,id=char-fs-src,path=/run/vm1/virtiofs-src.sock " +
+				"-device vhost-user-fs-pci,queue-size=1024,chardev=char-fs-src,tag=src",
+		},
+		{
+			name:  "9p",
+			share: ShareDef{Path: "/src", Tag: "src", Type: ShareType9P},
+			want: "-fsdev local,id=fs-src,path=/src,security_model=mapped-xattr " +
+				"-device virtio-9p-pci,fsdev=fs-src,mount_tag=src",
+		},
+		{
+			name:  "9p read-only",
+			share: ShareDef{Path: "/src", Tag: "src", Type: ShareType9P, ReadOnly: true},
+			want: "-fsdev local,id=fs-src,path=/src,security_model=mapped-xattr,readonly=on " +
+				"-device virtio-9p-pci,fsdev=fs-src,mount_tag=src",
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := strings.Join(tc.share.QemuParams("/run/vm1"), " "); got != tc.want {
+			t.Errorf("%s: params %q, expected %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConfigureShares(t *testing.T) {
+	dir := t.TempDir()
+
+	v := VMDef{Shares: []ShareDef{{Path: dir, Tag: "src"}, {Path: dir, Tag: "data", Type: ShareType9P}}}
+	params, err := ConfigureShares(&qcli.Config{}, v, "/run/vm1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(params) != 8 {
+		t.Errorf("params %v, expected the params of two shares", params)
+	}
+	// the shares of the VM definition are not modified
+	if v.Shares[0].Type != "" {
+		t.Errorf("share sanitized in place to %+v", v.Shares[0])
+	}
+
+	v = VMDef{Shares: []ShareDef{{Path: dir, Tag: "src"}, {Path: dir, Tag: "src", Type: ShareType9P}}}
+	if _, err := ConfigureShares(&qcli.Config{}, v, "/run/vm1"); err == nil {
+		t.Errorf("expected an error for a duplicate share tag")
+	}
+}
@@ -16,15 +16,25 @@ limitations under the License.
 package api
 
 import (
+	"os"
 	"path/filepath"
 )
 
-const MachineUnixSocketName = "machine.socket"
+const (
+	MachineUnixSocketName = "machine.socket"
+
+	// overrides the API socket path of machined and the machine client, it
+	// is the socket-path setting of the machined config
+	MachineSocketPathEnv = "MACHINED_SOCKET_PATH"
+)
 
 func APISocketPath() string {
-	udd, err := UserDataDir()
+	if socketPath := os.Getenv(MachineSocketPathEnv); socketPath != "" {
+		return socketPath
+	}
+	runtimeDir, err := MachineRuntimeDir()
 	if err != nil {
 		return ""
 	}
-	return filepath.Join(udd, "machined", MachineUnixSocketName)
+	return filepath.Join(runtimeDir, MachineUnixSocketName)
 }
@@ -0,0 +1,257 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// /proc/<pid>/stat times are in USER_HZ ticks, which is 100 on Linux
+const procTicksPerSecond = 100
+
+// MachineStats is a sample of the resource usage of a running machine.
+// Counters are totals since the machine started, clients compute rates
+// from two samples and their Timestamps.
+type MachineStats struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+	CPUs      uint32    `json:"cpus"`
+	// CPUTimeUsec is the cpu time of the machine cgroup, or of the QEMU
+	// process if the machine has no cgroup
+	CPUTimeUsec   uint64      `json:"cpu-time-usec"`
+	RSSBytes      uint64      `json:"rss-bytes"`
+	MemoryBytes   uint64      `json:"memory-bytes"`
+	BalloonActual uint64      `json:"balloon-actual"`
+	Disks         []DiskStats `json:"disks"`
+	// Nics are only reported while the guest runs the QEMU guest agent
+	Nics []NicStats `json:"nics"`
+}
+
+type DiskStats struct {
+	Device     string `json:"device"`
+	ReadBytes  uint64 `json:"read-bytes"`
+	WriteBytes uint64 `json:"write-bytes"`
+	ReadOps    uint64 `json:"read-ops"`
+	WriteOps   uint64 `json:"write-ops"`
+}
+
+// NicStats are the counters of a guest network interface
+type NicStats struct {
+	ID        string `json:"id"`
+	MAC       string `json:"mac"`
+	Interface string `json:"interface"`
+	RxBytes   uint64 `json:"rx-bytes"`
+	TxBytes   uint64 `json:"tx-bytes"`
+	RxPackets uint64 `json:"rx-packets"`
+	TxPackets uint64 `json:"tx-packets"`
+	RxErrors  uint64 `json:"rx-errors"`
+	TxErrors  uint64 `json:"tx-errors"`
+}
+
+// procCPUTimeUsec returns the user and system cpu time of a process
+func procCPUTimeUsec(pid int) (uint64, error) {
+	content, err := os.ReadFile(filepath.Join("/proc", fmt.Sprintf("%d", pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// the command name may contain spaces, fields start after its ')'
+	stat := string(content)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("Failed to parse /proc/%d/stat", pid)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return (utime + stime) * (1000000 / procTicksPerSecond), nil
+}
+
+// procRSSBytes returns the resident memory of a process
+func procRSSBytes(pid int) (uint64, error) {
+	content, err := os.ReadFile(filepath.Join("/proc", fmt.Sprintf("%d", pid), "status"))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			return kb * 1024, err
+		}
+	}
+	return 0, fmt.Errorf("no VmRSS in /proc/%d/status", pid)
+}
+
+func (v *VM) blockStats() ([]DiskStats, error) {
+	out, err := v.QMPControl("query-blockstats", nil)
+	if err != nil {
+		return []DiskStats{}, err
+	}
+	var blockStats []struct {
+		Device string `json:"device"`
+		QDev   string `json:"qdev"`
+		Stats  struct {
+			ReadBytes  uint64 `json:"rd_bytes"`
+			WriteBytes uint64 `json:"wr_bytes"`
+			ReadOps    uint64 `json:"rd_operations"`
+			WriteOps   uint64 `json:"wr_operations"`
+		} `json:"stats"`
+	}
+	if err := json.Unmarshal(out, &blockStats); err != nil {
+		return []DiskStats{}, fmt.Errorf("Failed to parse query-blockstats output: %s", err)
+	}
+	disks := []DiskStats{}
+	for _, stat := range blockStats {
+		device := stat.Device
+		if device == "" {
+			device = stat.QDev
+		}
+		disks = append(disks, DiskStats{
+			Device:     device,
+			ReadBytes:  stat.Stats.ReadBytes,
+			WriteBytes: stat.Stats.WriteBytes,
+			ReadOps:    stat.Stats.ReadOps,
+			WriteOps:   stat.Stats.WriteOps,
+		})
+	}
+	return disks, nil
+}
+
+// nicStats returns the guest interface counters of the VM nics from the guest
+// agent, matching guest interfaces to nics by MAC address
+func (v *VM) nicStats() ([]NicStats, error) {
+	if !v.guestAgentOpen.Load() {
+		return []NicStats{}, nil
+	}
+	v.guestAgentLock.Lock()
+	defer v.guestAgentLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(v.Ctx, guestAgentTimeout)
+	defer cancel()
+	out, err := GuestAgentCommand(ctx, filepath.Join(v.sockDir, GuestAgentSocketName), "guest-network-get-interfaces", nil)
+	if err != nil {
+		return []NicStats{}, err
+	}
+	var ifaces []struct {
+		Name       string `json:"name"`
+		MAC        string `json:"hardware-address"`
+		Statistics struct {
+			RxBytes   uint64 `json:"rx-bytes"`
+			TxBytes   uint64 `json:"tx-bytes"`
+			RxPackets uint64 `json:"rx-packets"`
+			TxPackets uint64 `json:"tx-packets"`
+			RxErrors  uint64 `json:"rx-errs"`
+			TxErrors  uint64 `json:"tx-errs"`
+		} `json:"statistics"`
+	}
+	if err := json.Unmarshal(out, &ifaces); err != nil {
+		return []NicStats{}, fmt.Errorf("Failed to parse guest-network-get-interfaces output: %s", err)
+	}
+	nics := []NicStats{}
+	for _, ndev := range v.qcli.NetDevices {
+		for _, iface := range ifaces {
+			if !strings.EqualFold(iface.MAC, ndev.MACAddress) {
+				continue
+			}
+			nics = append(nics, NicStats{
+				ID:        ndev.ID,
+				MAC:       ndev.MACAddress,
+				Interface: iface.Name,
+				RxBytes:   iface.Statistics.RxBytes,
+				TxBytes:   iface.Statistics.TxBytes,
+				RxPackets: iface.Statistics.RxPackets,
+				TxPackets: iface.Statistics.TxPackets,
+				RxErrors:  iface.Statistics.RxErrors,
+				TxErrors:  iface.Statistics.TxErrors,
+			})
+			break
+		}
+	}
+	return nics, nil
+}
+
+// Stats samples the resource usage of the running VM.  Only a failure to
+// read the QEMU process is an error, QMP and guest agent failures leave the
+// values they provide empty.
+func (v *VM) Stats() (MachineStats, error) {
+	if !v.IsRunning() || v.Cmd.Process == nil {
+		return MachineStats{}, fmt.Errorf("VM:%s is not running", v.Name())
+	}
+	pid := v.Cmd.Process.Pid
+	stats := MachineStats{
+		Timestamp: time.Now(),
+		CPUs:      v.qcli.SMP.CPUs,
+		Disks:     []DiskStats{},
+		Nics:      []NicStats{},
+	}
+
+	var err error
+	if usage, cgErr := v.CgroupUsage(); cgErr == nil {
+		stats.CPUTimeUsec = usage.CPUUsageUsec
+	} else if stats.CPUTimeUsec, err = procCPUTimeUsec(pid); err != nil {
+		return MachineStats{}, fmt.Errorf("Failed to read cpu time of QEMU pid %d: %s", pid, err)
+	}
+	if stats.RSSBytes, err = procRSSBytes(pid); err != nil {
+		return MachineStats{}, fmt.Errorf("Failed to read RSS of QEMU pid %d: %s", pid, err)
+	}
+	if v.Config.Memory > 0 {
+		stats.MemoryBytes = uint64(v.Config.Memory) * 1024 * 1024
+	} else {
+		stats.MemoryBytes = defaultMemoryMB * 1024 * 1024
+	}
+
+	if v.Config.Balloon {
+		if out, err := v.QMPControl("query-balloon", nil); err != nil {
+			log.Debugf("VM:%s query-balloon failed: %s", v.Name(), err)
+		} else {
+			var balloon struct {
+				Actual uint64 `json:"actual"`
+			}
+			if err := json.Unmarshal(out, &balloon); err == nil {
+				stats.BalloonActual = balloon.Actual
+			}
+		}
+	}
+	if disks, err := v.blockStats(); err != nil {
+		log.Debugf("VM:%s query-blockstats failed: %s", v.Name(), err)
+	} else {
+		stats.Disks = disks
+	}
+	if nics, err := v.nicStats(); err != nil {
+		log.Debugf("VM:%s guest agent network stats failed: %s", v.Name(), err)
+	} else {
+		stats.Nics = nics
+	}
+	sort.Slice(stats.Disks, func(i, j int) bool { return stats.Disks[i].Device < stats.Disks[j].Device })
+	return stats, nil
+}
@@ -26,6 +26,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -36,17 +37,61 @@ type SwTPM struct {
 	StateDir string
 	Socket   string
 	Version  string
+
+	// TrustStore is the trust store dir whose CA signs the TPM certificates,
+	// if empty swtpm_localca creates a CA in StateDir
+	TrustStore string
+
+	// OnExit is called if swtpm exits while it is not being stopped
+	OnExit func(status SwTPMStatus)
+
+	// Cgroup swtpm is started in, nil for the cgroup of machined
+	Cgroup *MachineCgroup
+
 	cmd      *exec.Cmd
+	output   bytes.Buffer
 	finished chan error
+
+	// lock guards stopping and status, written by the wait goroutine
+	lock     sync.Mutex
+	stopping bool
+	status   SwTPMStatus
+}
+
+const (
+	SwTPMStateRunning = "running"
+	SwTPMStateStopped = "stopped"
+	SwTPMStateFailed  = "failed"
+
+	// swtpm log lines added to the machine event log when swtpm fails
+	swTPMLogTailLines = 20
+
+	// time for QEMU to exit after swtpm before swtpm is considered failed
+	swTPMExitGrace = 5 * time.Second
+)
+
+// SwTPMStatus reports the state of the swtpm process of a running machine
+type SwTPMStatus struct {
+	State      string `json:"state"`
+	Pid        int    `json:"pid,omitempty"`
+	ExitStatus string `json:"exit-status,omitempty"`
+	Restarts   int    `json:"restarts,omitempty"`
 }
 
+// TPM failure policies, applied when swtpm exits while the VM is running
+const (
+	TPMFailurePolicyFail    = "fail"
+	TPMFailurePolicyRestart = "restart"
+	TPMFailurePolicyIgnore  = "ignore"
+)
+
 // ${StateDir}/swtpm-localca.conf
 const swTPMLocalCaConf = "swtpm-localca.conf"
 const swTPMLocalCaConfTpl = `
-statedir = {{.StateDir}}
-signingkey = {{.StateDir}}/signingkey.pem
-issuercert = {{.StateDir}}/issuercert.pem
-certserial = {{.StateDir}}/certserial
+statedir = {{.CaDir}}
+signingkey = {{.CaDir}}/signingkey.pem
+issuercert = {{.CaDir}}/issuercert.pem
+certserial = {{.CaDir}}/certserial
 `
 
 // ${StateDir}/swtpm-localca.options
@@ -143,6 +188,11 @@ func (s *SwTPM) Setup() error {
 	data["StateDir"] = s.StateDir
 	data["Version"] = s.Version
 	data["CertsTool"] = certsTool
+	data["CaDir"] = s.StateDir
+	if s.TrustStore != "" {
+		log.Infof("SwTPM: signing TPM certificates with trust store %s", s.TrustStore)
+		data["CaDir"] = s.TrustStore
+	}
 
 	for fname, tpl := range swTPMSetupTemplates {
 		if err := renderSwTPMTemplate(tpl, filepath.Join(s.StateDir, fname), data); err != nil {
@@ -213,31 +263,90 @@ func (s *SwTPM) Start() error {
 	}
 
 	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &s.output
+	cmd.Stderr = &s.output
 	log.Infof("swtpm args: %s", cmd.String())
-	if err := cmd.Start(); err != nil {
+	if err := s.Cgroup.StartCommand(cmd); err != nil {
 		return err
 	}
+	s.lock.Lock()
+	s.cmd = cmd
+	s.finished = make(chan error, 1)
+	s.status = SwTPMStatus{State: SwTPMStateRunning, Pid: cmd.Process.Pid}
+	s.lock.Unlock()
+
+	go func() {
+		err := s.cmd.Wait()
+		status := SwTPMStatus{
+			State:      SwTPMStateStopped,
+			ExitStatus: s.cmd.ProcessState.String(),
+		}
+		log.Infof("swtpm pid %d exited: %s", s.cmd.Process.Pid, status.ExitStatus)
+		s.lock.Lock()
+		stopping := s.stopping
+		if !stopping {
+			status.State = SwTPMStateFailed
+		}
+		s.status = status
+		s.lock.Unlock()
+		if !stopping && s.OnExit != nil {
+			s.OnExit(status)
+		}
+		s.finished <- err
+	}()
 
 	// wait up to 10 seconds for the SwTPM socket to appear
 	if !WaitForPath(s.Socket, 10, 1) {
+		s.Stop()
 		return fmt.Errorf("SwTPM start failed, socket %s does not exist after 10 seconds", s.Socket)
 	}
 
 	log.Infof("swtpm TPM Version %s started with pid %d", s.Version, cmd.Process.Pid)
-	s.cmd = cmd
+	return nil
+}
 
-	go func() {
-		s.finished <- s.cmd.Wait()
-	}()
+// Status returns the state of the swtpm process
+func (s *SwTPM) Status() SwTPMStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cmd == nil {
+		return SwTPMStatus{State: SwTPMStateStopped}
+	}
+	return s.status
+}
 
-	return nil
+func (s *SwTPM) setState(state string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.State = state
+}
+
+// LogTail returns the output of swtpm and the end of its log file
+func (s *SwTPM) LogTail() []string {
+	lines := []string{}
+	if output := strings.TrimSpace(s.output.String()); output != "" {
+		lines = append(lines, strings.Split(output, "\n")...)
+	}
+	content, err := os.ReadFile(path.Join(s.StateDir, "log"))
+	if err != nil {
+		return lines
+	}
+	logLines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(logLines) > swTPMLogTailLines {
+		logLines = logLines[len(logLines)-swTPMLogTailLines:]
+	}
+	return append(lines, logLines...)
 }
 
 func (s *SwTPM) Stop() error {
+	s.lock.Lock()
 	// never started.
 	if s.cmd == nil {
+		s.lock.Unlock()
 		return nil
 	}
+	s.stopping = true
+	s.lock.Unlock()
 
 	pid := s.cmd.Process.Pid
 	if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
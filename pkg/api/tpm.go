@@ -0,0 +1,281 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The swtpm state of a VM lives in a flat directory under the VM run dir,
+// e.g. $stateDir/machines/<name>/<name>/tpm, holding the TPM NVRAM in
+// tpm-00.permall, the certificates swtpm_setup created and the local CA.
+const (
+	SwTPMStateDirName = "tpm"
+	swTPMPermall      = "tpm-00.permall"
+	swTPMCertExt      = ".cert"
+	swTPMBackupMode   = 0600
+)
+
+// files swtpm only needs while running, they are not part of a backup
+var swTPMRuntimeFiles = []string{"pid", ".lock"}
+
+// TPMInfo describes the TPM of a machine
+type TPMInfo struct {
+	Version       string    `json:"version"`
+	SwTPMVersion  string    `json:"swtpm-version"`
+	StateDir      string    `json:"state-dir"`
+	Initialized   bool      `json:"initialized"`
+	StateModified time.Time `json:"state-modified,omitempty"`
+	Certificates  []string  `json:"certificates"`
+}
+
+// SwTPMVersion returns the version of the installed swtpm
+func SwTPMVersion() (string, error) {
+	if Which("swtpm") == "" {
+		return "", fmt.Errorf("no 'swtpm' command found in PATH.")
+	}
+	stdout, stderr, rc := RunCommandWithOutputErrorRc("swtpm", "--version")
+	if rc != 0 {
+		return "", fmt.Errorf("failed to run 'swtpm --version', rc:%d stdout: %s, stderr: %s", rc, string(stdout), string(stderr))
+	}
+	// expected output: TPM emulator version 0.7.3, Copyright (c) 2014-2021 IBM Corp.
+	toks := strings.Fields(string(stdout))
+	for idx, tok := range toks {
+		if tok == "version" && idx+1 < len(toks) {
+			return strings.TrimSuffix(toks[idx+1], ","), nil
+		}
+	}
+	return "", fmt.Errorf("Failed to parse swtpm version string '%s'", strings.TrimSpace(string(stdout)))
+}
+
+// Initialized reports if the TPM has been manufactured by swtpm_setup or
+// a previous start of swtpm.
+func (s *SwTPM) Initialized() bool {
+	return PathExists(filepath.Join(s.StateDir, swTPMPermall))
+}
+
+// certificateFiles returns the certificate files swtpm_setup wrote for the
+// TPM, ek*.cert and platform*.cert.
+func (s *SwTPM) certificateFiles() ([]string, error) {
+	certs, err := filepath.Glob(filepath.Join(s.StateDir, "*"+swTPMCertExt))
+	if err != nil {
+		return []string{}, err
+	}
+	sort.Strings(certs)
+	return certs, nil
+}
+
+func (s *SwTPM) Info() (TPMInfo, error) {
+	info := TPMInfo{
+		Version:      s.Version,
+		StateDir:     s.StateDir,
+		Initialized:  s.Initialized(),
+		Certificates: []string{},
+	}
+	swtpmVersion, err := SwTPMVersion()
+	if err != nil {
+		log.Warnf("SwTPM: %s", err)
+	}
+	info.SwTPMVersion = swtpmVersion
+
+	if info.Initialized {
+		stat, err := os.Stat(filepath.Join(s.StateDir, swTPMPermall))
+		if err != nil {
+			return info, err
+		}
+		info.StateModified = stat.ModTime()
+	}
+	certs, err := s.certificateFiles()
+	if err != nil {
+		return info, err
+	}
+	for _, cert := range certs {
+		info.Certificates = append(info.Certificates, filepath.Base(cert))
+	}
+	return info, nil
+}
+
+// Certificates returns the EK certificates, or the platform certificates,
+// of the TPM PEM encoded.
+func (s *SwTPM) Certificates(platform bool) ([]byte, error) {
+	prefix := "ek"
+	if platform {
+		prefix = "platform"
+	}
+	certs, err := s.certificateFiles()
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	for _, cert := range certs {
+		if !strings.HasPrefix(filepath.Base(cert), prefix) {
+			continue
+		}
+		content, err := os.ReadFile(cert)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read TPM certificate %q: %s", cert, err)
+		}
+		if block, _ := pem.Decode(content); block != nil {
+			out.Write(content)
+			continue
+		}
+		if err := pem.Encode(&out, &pem.Block{Type: "CERTIFICATE", Bytes: content}); err != nil {
+			return nil, fmt.Errorf("Failed to encode TPM certificate %q: %s", cert, err)
+		}
+	}
+	if out.Len() == 0 {
+		return nil, fmt.Errorf("TPM in %q has no %s certificates, swtpm_setup did not create any", s.StateDir, prefix)
+	}
+	return out.Bytes(), nil
+}
+
+// Reset removes the TPM state, a new TPM with new keys and certificates is
+// manufactured on the next start.
+func (s *SwTPM) Reset() error {
+	if !PathExists(s.StateDir) {
+		return nil
+	}
+	log.Infof("SwTPM: resetting TPM state in %s", s.StateDir)
+	if err := os.RemoveAll(s.StateDir); err != nil {
+		return fmt.Errorf("Failed to remove TPM state %q: %s", s.StateDir, err)
+	}
+	return nil
+}
+
+// Backup writes a tar.gz archive of the TPM state to w
+func (s *SwTPM) Backup(w io.Writer) error {
+	if !s.Initialized() {
+		return fmt.Errorf("TPM in %q has no state to backup", s.StateDir)
+	}
+	entries, err := os.ReadDir(s.StateDir)
+	if err != nil {
+		return fmt.Errorf("Failed to read TPM state %q: %s", s.StateDir, err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || isSwTPMRuntimeFile(entry.Name()) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(s.StateDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("Failed to read TPM state file %q: %s", entry.Name(), err)
+		}
+		hdr := &tar.Header{
+			Name:    entry.Name(),
+			Mode:    swTPMBackupMode,
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func isSwTPMRuntimeFile(name string) bool {
+	for _, runtimeFile := range swTPMRuntimeFiles {
+		if name == runtimeFile {
+			return true
+		}
+	}
+	return false
+}
+
+// Restore replaces the TPM state with the tar.gz archive from r written by
+// Backup.  The archive is unpacked next to the state dir and swapped in only
+// once it is complete.
+func (s *SwTPM) Restore(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("Invalid TPM backup: %s", err)
+	}
+	defer gz.Close()
+
+	restoreDir := s.StateDir + ".restore"
+	if err := os.RemoveAll(restoreDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(restoreDir, 0755); err != nil {
+		return fmt.Errorf("Failed to create TPM restore dir %q: %s", restoreDir, err)
+	}
+	defer os.RemoveAll(restoreDir)
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid TPM backup: %s", err)
+		}
+		// the state dir is flat, anything else did not come from Backup
+		if hdr.Typeflag != tar.TypeReg || hdr.Name != filepath.Base(hdr.Name) || strings.HasPrefix(hdr.Name, "..") {
+			return fmt.Errorf("Invalid TPM backup, unexpected entry '%s'", hdr.Name)
+		}
+		fh, err := os.OpenFile(filepath.Join(restoreDir, hdr.Name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, swTPMBackupMode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fh, tr)
+		fh.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to restore TPM state file '%s': %s", hdr.Name, err)
+		}
+	}
+	if !PathExists(filepath.Join(restoreDir, swTPMPermall)) {
+		return fmt.Errorf("Invalid TPM backup, no %s found", swTPMPermall)
+	}
+
+	oldDir := s.StateDir + ".old"
+	if err := os.RemoveAll(oldDir); err != nil {
+		return err
+	}
+	if PathExists(s.StateDir) {
+		if err := os.Rename(s.StateDir, oldDir); err != nil {
+			return fmt.Errorf("Failed to move aside TPM state %q: %s", s.StateDir, err)
+		}
+	}
+	if err := os.Rename(restoreDir, s.StateDir); err != nil {
+		if PathExists(oldDir) {
+			os.Rename(oldDir, s.StateDir)
+		}
+		return fmt.Errorf("Failed to restore TPM state %q: %s", s.StateDir, err)
+	}
+	log.Infof("SwTPM: restored TPM state in %s", s.StateDir)
+	return os.RemoveAll(oldDir)
+}
@@ -0,0 +1,327 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A trust store is a CA shared by the TPMs of a project.  swtpm_localca signs
+// the EK and platform certificates of each machine using the trust store
+// with the truststore setting, so an attestation server only needs to trust
+// the trust store CA certificate.  The files use the swtpm_localca layout:
+//
+// $DataDirectory/trust/<name>/
+//   signingkey.pem  CA private key
+//   issuercert.pem  CA certificate
+//   certserial      last certificate serial number, maintained by swtpm_localca
+const (
+	TrustStoreDirName    = "trust"
+	trustStoreKeyFile    = "signingkey.pem"
+	trustStoreCertFile   = "issuercert.pem"
+	trustStoreCAKeyBits  = 2048
+	trustStoreCAValidity = 10 * 365 * 24 * time.Hour
+)
+
+// TrustStore describes the CA of a trust store
+type TrustStore struct {
+	Name        string    `json:"name"`
+	Path        string    `json:"path"`
+	Subject     string    `json:"subject"`
+	NotBefore   time.Time `json:"not-before"`
+	NotAfter    time.Time `json:"not-after"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+// TrustStoreRequest creates a trust store.  A new CA named CommonName is
+// generated unless an existing CA Key and Certificate, PEM encoded, are
+// imported.
+type TrustStoreRequest struct {
+	Name        string `json:"name"`
+	CommonName  string `json:"common-name"`
+	Key         []byte `json:"key"`
+	Certificate []byte `json:"certificate"`
+}
+
+type TrustStoreController struct {
+	lock sync.Mutex
+}
+
+func (tc *TrustStoreController) TrustStoresDir(cfg *MachineDaemonConfig) string {
+	return filepath.Join(cfg.DataDirectory, TrustStoreDirName)
+}
+
+func validTrustStoreName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, os.PathSeparator) {
+		return fmt.Errorf("Invalid trust store name '%s'", name)
+	}
+	return nil
+}
+
+// ResolveTrustStore returns the directory of the trust store of a machine
+// config.  truststore is either the name of a trust store managed by machined
+// or the path to a trust store directory, $XDG_DATA_DIR and $XDG_DATA_HOME
+// in the path expand to the parent of the machined data directory.
+func ResolveTrustStore(dataDir, truststore string) (string, error) {
+	dir := os.Expand(truststore, func(key string) string {
+		if key == "XDG_DATA_DIR" || key == "XDG_DATA_HOME" {
+			return filepath.Dir(dataDir)
+		}
+		return os.Getenv(key)
+	})
+	if !strings.ContainsRune(dir, os.PathSeparator) {
+		if err := validTrustStoreName(dir); err != nil {
+			return "", err
+		}
+		dir = filepath.Join(dataDir, TrustStoreDirName, dir)
+	}
+	for _, fname := range []string{trustStoreKeyFile, trustStoreCertFile} {
+		if !PathExists(filepath.Join(dir, fname)) {
+			return "", fmt.Errorf("Trust store '%s' is missing %s, create it with 'machine truststore create'", truststore, fname)
+		}
+	}
+	return dir, nil
+}
+
+func (tc *TrustStoreController) ListTrustStores(cfg *MachineDaemonConfig) ([]TrustStore, error) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	stores := []TrustStore{}
+	storesDir := tc.TrustStoresDir(cfg)
+	if !PathExists(storesDir) {
+		return stores, nil
+	}
+	entries, err := os.ReadDir(storesDir)
+	if err != nil {
+		return stores, fmt.Errorf("Failed to read trust stores dir %q: %s", storesDir, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		store, err := loadTrustStore(entry.Name(), filepath.Join(storesDir, entry.Name()))
+		if err != nil {
+			log.Warnf("Skipping trust store '%s': %s", entry.Name(), err)
+			continue
+		}
+		stores = append(stores, store)
+	}
+	sort.Slice(stores, func(i, j int) bool { return stores[i].Name < stores[j].Name })
+	return stores, nil
+}
+
+func (tc *TrustStoreController) GetTrustStore(name string, cfg *MachineDaemonConfig) (TrustStore, error) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if err := validTrustStoreName(name); err != nil {
+		return TrustStore{}, err
+	}
+	return loadTrustStore(name, filepath.Join(tc.TrustStoresDir(cfg), name))
+}
+
+// TrustStoreCertificate returns the PEM encoded CA certificate of a trust store
+func (tc *TrustStoreController) TrustStoreCertificate(name string, cfg *MachineDaemonConfig) ([]byte, error) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if err := validTrustStoreName(name); err != nil {
+		return nil, err
+	}
+	certFile := filepath.Join(tc.TrustStoresDir(cfg), name, trustStoreCertFile)
+	if !PathExists(certFile) {
+		return nil, fmt.Errorf("Failed to find trust store '%s'", name)
+	}
+	return os.ReadFile(certFile)
+}
+
+func (tc *TrustStoreController) CreateTrustStore(request TrustStoreRequest, cfg *MachineDaemonConfig) (TrustStore, error) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if err := validTrustStoreName(request.Name); err != nil {
+		return TrustStore{}, err
+	}
+	storeDir := filepath.Join(tc.TrustStoresDir(cfg), request.Name)
+	if PathExists(storeDir) {
+		return TrustStore{}, fmt.Errorf("Trust store '%s' already exists", request.Name)
+	}
+
+	var keyPEM, certPEM []byte
+	var err error
+	if len(request.Key) > 0 || len(request.Certificate) > 0 {
+		if len(request.Key) == 0 || len(request.Certificate) == 0 {
+			return TrustStore{}, fmt.Errorf("Importing a trust store CA requires both the key and the certificate")
+		}
+		if err := validateTrustStoreCA(request.Key, request.Certificate); err != nil {
+			return TrustStore{}, err
+		}
+		keyPEM, certPEM = request.Key, request.Certificate
+		log.Infof("Importing CA into trust store '%s'", request.Name)
+	} else {
+		commonName := request.CommonName
+		if commonName == "" {
+			commonName = fmt.Sprintf("machine %s TPM CA", request.Name)
+		}
+		keyPEM, certPEM, err = newTrustStoreCA(commonName)
+		if err != nil {
+			return TrustStore{}, err
+		}
+		log.Infof("Created CA '%s' for trust store '%s'", commonName, request.Name)
+	}
+
+	if err := os.MkdirAll(storeDir, 0700); err != nil {
+		return TrustStore{}, fmt.Errorf("Failed to create trust store dir %q: %s", storeDir, err)
+	}
+	if err := os.WriteFile(filepath.Join(storeDir, trustStoreKeyFile), keyPEM, 0600); err != nil {
+		os.RemoveAll(storeDir)
+		return TrustStore{}, fmt.Errorf("Failed to write trust store key: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(storeDir, trustStoreCertFile), certPEM, 0644); err != nil {
+		os.RemoveAll(storeDir)
+		return TrustStore{}, fmt.Errorf("Failed to write trust store certificate: %s", err)
+	}
+	return loadTrustStore(request.Name, storeDir)
+}
+
+func loadTrustStore(name, storeDir string) (TrustStore, error) {
+	certFile := filepath.Join(storeDir, trustStoreCertFile)
+	if !PathExists(certFile) {
+		return TrustStore{}, fmt.Errorf("Failed to find trust store '%s'", name)
+	}
+	content, err := os.ReadFile(certFile)
+	if err != nil {
+		return TrustStore{}, fmt.Errorf("Failed to read trust store certificate %q: %s", certFile, err)
+	}
+	cert, err := parseCertificatePEM(content)
+	if err != nil {
+		return TrustStore{}, fmt.Errorf("Invalid trust store certificate %q: %s", certFile, err)
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	return TrustStore{
+		Name:        name,
+		Path:        storeDir,
+		Subject:     cert.Subject.String(),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}, nil
+}
+
+func parseCertificatePEM(content []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePrivateKeyPEM(content []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+	if x509.IsEncryptedPEMBlock(block) {
+		return nil, fmt.Errorf("encrypted private keys are not supported")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key: %s", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// validateTrustStoreCA checks that an imported certificate is a CA which may
+// sign certificates and that the key belongs to it.
+func validateTrustStoreCA(keyPEM, certPEM []byte) error {
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return fmt.Errorf("Invalid CA certificate: %s", err)
+	}
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return fmt.Errorf("Invalid CA certificate: '%s' is not a CA", cert.Subject)
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return fmt.Errorf("Invalid CA certificate: '%s' may not sign certificates", cert.Subject)
+	}
+	key, err := parsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return fmt.Errorf("Invalid CA key: %s", err)
+	}
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return fmt.Errorf("CA key does not match certificate '%s'", cert.Subject)
+	}
+	return nil
+}
+
+// newTrustStoreCA returns the PEM encoded key and self signed certificate of
+// a new CA
+func newTrustStoreCA(commonName string) ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, trustStoreCAKeyBits)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to generate CA key: %s", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to generate CA serial number: %s", err)
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(trustStoreCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to create CA certificate: %s", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return keyPEM, certPEM, nil
+}
@@ -0,0 +1,519 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OVMF keeps the non-volatile UEFI variables in a firmware volume:
+//
+//	EFI_FIRMWARE_VOLUME_HEADER  (signature _FVH, HeaderLength)
+//	VARIABLE_STORE_HEADER       (store GUID, Size, Format, State)
+//	variables                   (header, UTF-16 name, data, 4 byte aligned)
+//	0xff ...                    (free space up to the store Size)
+//	fault tolerant write areas  (left untouched)
+//
+// Variables are never rewritten in place by the firmware, updates add a new
+// copy and mark the old one deleted.  Edits here compact the store to only
+// the live variables.
+
+const (
+	efiFVSignature          = "_FVH"
+	efiVarStoreHeaderSize   = 28
+	efiVarStoreFormatted    = 0x5a
+	efiVarStoreHealthy      = 0xfe
+	efiVarStartID           = 0x55aa
+	efiVarAdded             = 0x3f
+	efiVarInDeletedTransit  = 0xfe
+	efiVarHeaderAlignment   = 4
+	efiAuthVarHeaderSize    = 60
+	efiVarHeaderSize        = 32
+	efiSignatureListHdrSize = 28
+)
+
+// EFI variable attributes
+const (
+	EFIVariableNonVolatile                       = 0x01
+	EFIVariableBootServiceAccess                 = 0x02
+	EFIVariableRuntimeAccess                     = 0x04
+	EFIVariableTimeBasedAuthenticatedWriteAccess = 0x20
+)
+
+type EFIGUID [16]byte
+
+var (
+	EFIGlobalVariableGUID        = MustParseEFIGUID("8be4df61-93ca-11d2-aa0d-00e098032b8c")
+	EFIImageSecurityDatabaseGUID = MustParseEFIGUID("d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+	EFISecureBootEnableGUID      = MustParseEFIGUID("f0a30bc7-af08-4556-99c4-001009c93a44")
+	EFICustomModeGUID            = MustParseEFIGUID("c076ec0c-7028-4399-a072-71ee5c448b9f")
+	EFICertX509GUID              = MustParseEFIGUID("a5c059a1-94e4-4aa7-87b5-ab155c2bf072")
+	efiAuthenticatedVariableGUID = MustParseEFIGUID("aaf32c78-947b-439a-a180-2e144ec37792")
+	efiVariableGUID              = MustParseEFIGUID("ddcf3616-3275-4164-98b6-fe85707ffe7d")
+
+	// MachineOwnerGUID is the default owner of enrolled certificates
+	MachineOwnerGUID = MustParseEFIGUID("c2f4e2f1-8a3a-4d3e-9c1d-6d6163686e65")
+)
+
+// EFIGUIDAliases maps short names accepted by ParseEFIGUID to well known
+// variable vendor GUIDs.
+var EFIGUIDAliases = map[string]EFIGUID{
+	"global":      EFIGlobalVariableGUID,
+	"security-db": EFIImageSecurityDatabaseGUID,
+	"secure-boot": EFISecureBootEnableGUID,
+	"custom-mode": EFICustomModeGUID,
+}
+
+// ParseEFIGUID parses the registry format, e.g.
+// 8be4df61-93ca-11d2-aa0d-00e098032b8c, or an EFIGUIDAliases name.  The
+// first three fields are stored little endian.
+func ParseEFIGUID(s string) (EFIGUID, error) {
+	if alias, ok := EFIGUIDAliases[s]; ok {
+		return alias, nil
+	}
+	return parseEFIGUID(s)
+}
+
+func parseEFIGUID(s string) (EFIGUID, error) {
+	var guid EFIGUID
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 || len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return guid, fmt.Errorf("Invalid GUID '%s'", s)
+	}
+	raw, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return guid, fmt.Errorf("Invalid GUID '%s': %s", s, err)
+	}
+	binary.LittleEndian.PutUint32(guid[0:4], binary.BigEndian.Uint32(raw[0:4]))
+	binary.LittleEndian.PutUint16(guid[4:6], binary.BigEndian.Uint16(raw[4:6]))
+	binary.LittleEndian.PutUint16(guid[6:8], binary.BigEndian.Uint16(raw[6:8]))
+	copy(guid[8:], raw[8:])
+	return guid, nil
+}
+
+func MustParseEFIGUID(s string) EFIGUID {
+	guid, err := parseEFIGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return guid
+}
+
+func (g EFIGUID) String() string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10], g[10:16])
+}
+
+// DefaultEFIVariableGUID returns the vendor GUID of the Secure Boot key
+// variables, db and dbx belong to the image security database, everything
+// else defaults to the global variable GUID.
+func DefaultEFIVariableGUID(name string) EFIGUID {
+	switch name {
+	case "db", "dbx", "dbt", "dbr":
+		return EFIImageSecurityDatabaseGUID
+	}
+	return EFIGlobalVariableGUID
+}
+
+// UEFIVariable is a single variable in the store
+type UEFIVariable struct {
+	Name           string    `json:"name"`
+	GUID           string    `json:"guid"`
+	Attributes     uint32    `json:"attributes"`
+	MonotonicCount uint64    `json:"monotonic-count,omitempty"`
+	Timestamp      time.Time `json:"timestamp,omitempty"`
+	PubKeyIndex    uint32    `json:"pubkey-index,omitempty"`
+	Size           int       `json:"size"`
+	Data           []byte    `json:"data,omitempty"`
+	state          uint8
+	vendor         EFIGUID
+}
+
+// UEFIVarStore is a parsed OVMF varstore file
+type UEFIVarStore struct {
+	Path          string
+	Authenticated bool
+	Variables     []UEFIVariable
+	raw           []byte
+	storeOffset   int
+	storeSize     int
+}
+
+func decodeUTF16Name(raw []byte) string {
+	u16 := make([]uint16, 0, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		c := binary.LittleEndian.Uint16(raw[i:])
+		if c == 0 {
+			break
+		}
+		u16 = append(u16, c)
+	}
+	return string(utf16.Decode(u16))
+}
+
+func encodeUTF16Name(name string) []byte {
+	u16 := append(utf16.Encode([]rune(name)), 0)
+	buf := make([]byte, len(u16)*2)
+	for i, c := range u16 {
+		binary.LittleEndian.PutUint16(buf[i*2:], c)
+	}
+	return buf
+}
+
+func decodeEFITime(raw []byte) time.Time {
+	year := binary.LittleEndian.Uint16(raw[0:2])
+	if year == 0 {
+		return time.Time{}
+	}
+	return time.Date(int(year), time.Month(raw[2]), int(raw[3]), int(raw[4]), int(raw[5]), int(raw[6]),
+		int(binary.LittleEndian.Uint32(raw[8:12])), time.UTC)
+}
+
+func encodeEFITime(t time.Time) []byte {
+	raw := make([]byte, 16)
+	if t.IsZero() {
+		return raw
+	}
+	t = t.UTC()
+	binary.LittleEndian.PutUint16(raw[0:2], uint16(t.Year()))
+	raw[2] = uint8(t.Month())
+	raw[3] = uint8(t.Day())
+	raw[4] = uint8(t.Hour())
+	raw[5] = uint8(t.Minute())
+	raw[6] = uint8(t.Second())
+	return raw
+}
+
+func alignVarHeader(offset int) int {
+	return (offset + efiVarHeaderAlignment - 1) &^ (efiVarHeaderAlignment - 1)
+}
+
+// LoadUEFIVarStore parses the OVMF varstore at path
+func LoadUEFIVarStore(path string) (*UEFIVarStore, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read UEFI varstore %q: %s", path, err)
+	}
+	if len(raw) < 0x48 || string(raw[40:44]) != efiFVSignature {
+		return nil, fmt.Errorf("UEFI varstore %q has no firmware volume header", path)
+	}
+	store := &UEFIVarStore{Path: path, raw: raw}
+	store.storeOffset = int(binary.LittleEndian.Uint16(raw[48:50]))
+	if store.storeOffset+efiVarStoreHeaderSize > len(raw) {
+		return nil, fmt.Errorf("UEFI varstore %q is truncated", path)
+	}
+
+	var storeGUID EFIGUID
+	copy(storeGUID[:], raw[store.storeOffset:store.storeOffset+16])
+	switch storeGUID {
+	case efiAuthenticatedVariableGUID:
+		store.Authenticated = true
+	case efiVariableGUID:
+		store.Authenticated = false
+	default:
+		return nil, fmt.Errorf("UEFI varstore %q has unknown variable store GUID %s", path, storeGUID)
+	}
+	store.storeSize = int(binary.LittleEndian.Uint32(raw[store.storeOffset+16:]))
+	format := raw[store.storeOffset+20]
+	state := raw[store.storeOffset+21]
+	if format != efiVarStoreFormatted || state != efiVarStoreHealthy {
+		return nil, fmt.Errorf("UEFI varstore %q is not formatted and healthy (format 0x%x state 0x%x)", path, format, state)
+	}
+	if store.storeOffset+store.storeSize > len(raw) {
+		return nil, fmt.Errorf("UEFI varstore %q variable store size %d exceeds file", path, store.storeSize)
+	}
+
+	if err := store.parseVariables(); err != nil {
+		return nil, fmt.Errorf("UEFI varstore %q: %s", path, err)
+	}
+	return store, nil
+}
+
+func (s *UEFIVarStore) headerSize() int {
+	if s.Authenticated {
+		return efiAuthVarHeaderSize
+	}
+	return efiVarHeaderSize
+}
+
+func (s *UEFIVarStore) parseVariables() error {
+	end := s.storeOffset + s.storeSize
+	offset := alignVarHeader(s.storeOffset + efiVarStoreHeaderSize)
+	found := []UEFIVariable{}
+	for offset+s.headerSize() <= end {
+		hdr := s.raw[offset:]
+		if binary.LittleEndian.Uint16(hdr[0:2]) != efiVarStartID {
+			break
+		}
+		v := UEFIVariable{state: hdr[2]}
+		v.Attributes = binary.LittleEndian.Uint32(hdr[4:8])
+		var nameSize, dataSize int
+		if s.Authenticated {
+			v.MonotonicCount = binary.LittleEndian.Uint64(hdr[8:16])
+			v.Timestamp = decodeEFITime(hdr[16:32])
+			v.PubKeyIndex = binary.LittleEndian.Uint32(hdr[32:36])
+			nameSize = int(binary.LittleEndian.Uint32(hdr[36:40]))
+			dataSize = int(binary.LittleEndian.Uint32(hdr[40:44]))
+			copy(v.vendor[:], hdr[44:60])
+		} else {
+			nameSize = int(binary.LittleEndian.Uint32(hdr[8:12]))
+			dataSize = int(binary.LittleEndian.Uint32(hdr[12:16]))
+			copy(v.vendor[:], hdr[16:32])
+		}
+		nameOffset := offset + s.headerSize()
+		dataOffset := nameOffset + nameSize
+		if dataOffset+dataSize > end {
+			return fmt.Errorf("variable at offset 0x%x overruns the store", offset)
+		}
+		v.Name = decodeUTF16Name(s.raw[nameOffset:dataOffset])
+		v.GUID = v.vendor.String()
+		v.Data = append([]byte{}, s.raw[dataOffset:dataOffset+dataSize]...)
+		v.Size = dataSize
+		found = append(found, v)
+		offset = alignVarHeader(dataOffset + dataSize)
+	}
+
+	// a variable which was being replaced is live only if the update never
+	// completed
+	s.Variables = []UEFIVariable{}
+	for _, v := range found {
+		switch v.state {
+		case efiVarAdded:
+			s.Variables = append(s.Variables, v)
+		case efiVarAdded & efiVarInDeletedTransit:
+			replaced := false
+			for _, other := range found {
+				if other.state == efiVarAdded && other.Name == v.Name && other.vendor == v.vendor {
+					replaced = true
+				}
+			}
+			if !replaced {
+				v.state = efiVarAdded
+				s.Variables = append(s.Variables, v)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *UEFIVarStore) find(name string, guid EFIGUID) int {
+	for idx, v := range s.Variables {
+		if v.Name == name && v.vendor == guid {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Get returns the variable name with vendor guid
+func (s *UEFIVarStore) Get(name string, guid EFIGUID) (UEFIVariable, error) {
+	idx := s.find(name, guid)
+	if idx < 0 {
+		return UEFIVariable{}, fmt.Errorf("UEFI variable %s-%s not found", name, guid)
+	}
+	return s.Variables[idx], nil
+}
+
+// Set adds or replaces the variable name with vendor guid
+func (s *UEFIVarStore) Set(name string, guid EFIGUID, attributes uint32, data []byte) {
+	v := UEFIVariable{
+		Name:       name,
+		GUID:       guid.String(),
+		Attributes: attributes,
+		Data:       data,
+		Size:       len(data),
+		state:      efiVarAdded,
+		vendor:     guid,
+	}
+	if s.Authenticated && attributes&EFIVariableTimeBasedAuthenticatedWriteAccess != 0 {
+		v.Timestamp = time.Now().UTC()
+	}
+	if idx := s.find(name, guid); idx >= 0 {
+		s.Variables[idx] = v
+		return
+	}
+	s.Variables = append(s.Variables, v)
+}
+
+// Delete removes the variable name with vendor guid
+func (s *UEFIVarStore) Delete(name string, guid EFIGUID) error {
+	idx := s.find(name, guid)
+	if idx < 0 {
+		return fmt.Errorf("UEFI variable %s-%s not found", name, guid)
+	}
+	s.Variables = append(s.Variables[:idx], s.Variables[idx+1:]...)
+	return nil
+}
+
+// Save writes the compacted variable store back to Path
+func (s *UEFIVarStore) Save() error {
+	var buf bytes.Buffer
+	offset := alignVarHeader(s.storeOffset + efiVarStoreHeaderSize)
+	for _, v := range s.Variables {
+		if pad := alignVarHeader(offset+buf.Len()) - (offset + buf.Len()); pad > 0 {
+			buf.Write(bytes.Repeat([]byte{0xff}, pad))
+		}
+		name := encodeUTF16Name(v.Name)
+		hdr := make([]byte, s.headerSize())
+		binary.LittleEndian.PutUint16(hdr[0:2], efiVarStartID)
+		hdr[2] = efiVarAdded
+		binary.LittleEndian.PutUint32(hdr[4:8], v.Attributes)
+		if s.Authenticated {
+			binary.LittleEndian.PutUint64(hdr[8:16], v.MonotonicCount)
+			copy(hdr[16:32], encodeEFITime(v.Timestamp))
+			binary.LittleEndian.PutUint32(hdr[32:36], v.PubKeyIndex)
+			binary.LittleEndian.PutUint32(hdr[36:40], uint32(len(name)))
+			binary.LittleEndian.PutUint32(hdr[40:44], uint32(len(v.Data)))
+			copy(hdr[44:60], v.vendor[:])
+		} else {
+			binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(name)))
+			binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(v.Data)))
+			copy(hdr[16:32], v.vendor[:])
+		}
+		buf.Write(hdr)
+		buf.Write(name)
+		buf.Write(v.Data)
+	}
+
+	available := s.storeOffset + s.storeSize - offset
+	if buf.Len() > available {
+		return fmt.Errorf("UEFI variables need %d bytes, varstore %q only has %d", buf.Len(), s.Path, available)
+	}
+	raw := append([]byte{}, s.raw...)
+	copy(raw[offset:], buf.Bytes())
+	free := raw[offset+buf.Len() : s.storeOffset+s.storeSize]
+	for i := range free {
+		free[i] = 0xff
+	}
+
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return err
+	}
+	tmpFile := s.Path + ".tmp"
+	if err := os.WriteFile(tmpFile, raw, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("Failed to write UEFI varstore %q: %s", tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, s.Path); err != nil {
+		return fmt.Errorf("Failed to replace UEFI varstore %q: %s", s.Path, err)
+	}
+	s.raw = raw
+	log.Infof("Saved %d UEFI variables to %s", len(s.Variables), s.Path)
+	return nil
+}
+
+// ParseCertificates returns the DER encoded X509 certificates from PEM or
+// DER input.
+func ParseCertificates(data []byte) ([][]byte, error) {
+	certs := [][]byte{}
+	if block, _ := pem.Decode(data); block == nil {
+		if _, err := x509.ParseCertificate(data); err != nil {
+			return certs, fmt.Errorf("Input is neither PEM nor a DER certificate: %s", err)
+		}
+		return append(certs, data), nil
+	}
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return certs, fmt.Errorf("Invalid PEM certificate: %s", err)
+		}
+		certs = append(certs, block.Bytes)
+	}
+	if len(certs) == 0 {
+		return certs, fmt.Errorf("No certificates found in PEM input")
+	}
+	return certs, nil
+}
+
+// EFISignatureList returns an EFI_SIGNATURE_LIST per certificate
+func EFISignatureList(owner EFIGUID, certs [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		sigSize := 16 + len(cert)
+		hdr := make([]byte, efiSignatureListHdrSize)
+		copy(hdr[0:16], EFICertX509GUID[:])
+		binary.LittleEndian.PutUint32(hdr[16:20], uint32(efiSignatureListHdrSize+sigSize))
+		binary.LittleEndian.PutUint32(hdr[20:24], 0)
+		binary.LittleEndian.PutUint32(hdr[24:28], uint32(sigSize))
+		buf.Write(hdr)
+		buf.Write(owner[:])
+		buf.Write(cert)
+	}
+	return buf.Bytes()
+}
+
+// SecureBootKeyVariables are the variables EnrollCertificates manages
+var SecureBootKeyVariables = []string{"PK", "KEK", "db", "dbx"}
+
+// EnrollCertificates sets (or appends to) the Secure Boot key variable name
+// with the certificates.  Enrolling a PK also enables Secure Boot and turns
+// off custom mode so the firmware leaves setup mode on the next boot.
+func (s *UEFIVarStore) EnrollCertificates(name string, certs [][]byte, owner EFIGUID, appendCerts bool) error {
+	valid := false
+	for _, keyVar := range SecureBootKeyVariables {
+		if name == keyVar {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("Cannot enroll certificates into '%s', expected one of %v", name, SecureBootKeyVariables)
+	}
+	if !s.Authenticated {
+		return fmt.Errorf("UEFI varstore %q does not support authenticated variables required for Secure Boot", s.Path)
+	}
+	if name == "PK" && (appendCerts || len(certs) != 1) {
+		return fmt.Errorf("PK holds exactly one certificate")
+	}
+
+	guid := DefaultEFIVariableGUID(name)
+	data := EFISignatureList(owner, certs)
+	if appendCerts {
+		if current, err := s.Get(name, guid); err == nil {
+			data = append(current.Data, data...)
+		}
+	}
+	attrs := uint32(EFIVariableNonVolatile | EFIVariableBootServiceAccess | EFIVariableRuntimeAccess | EFIVariableTimeBasedAuthenticatedWriteAccess)
+	s.Set(name, guid, attrs, data)
+
+	if name == "PK" {
+		s.Set("SecureBootEnable", EFISecureBootEnableGUID, EFIVariableNonVolatile|EFIVariableBootServiceAccess, []byte{1})
+		s.Set("CustomMode", EFICustomModeGUID, EFIVariableNonVolatile|EFIVariableBootServiceAccess, []byte{0})
+	}
+	log.Infof("Enrolled %d certificate(s) into %s-%s in %s", len(certs), name, guid, s.Path)
+	return nil
+}
@@ -0,0 +1,482 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testFVHeaderSize = 0x48
+	testVarStoreSize = 0x1000
+)
+
+type testVar struct {
+	name  string
+	guid  EFIGUID
+	state uint8
+	attrs uint32
+	data  []byte
+}
+
+// writeTestVarStore writes a varstore with a firmware volume header, a
+// variable store of testVarStoreSize bytes holding vars and a trailing fault
+// tolerant write area.
+func writeTestVarStore(t *testing.T, authenticated bool, vars []testVar) string {
+	raw := bytes.Repeat([]byte{0xff}, testFVHeaderSize+testVarStoreSize+0x100)
+	copy(raw[0:40], make([]byte, 40))
+	copy(raw[40:44], efiFVSignature)
+	binary.LittleEndian.PutUint16(raw[48:50], testFVHeaderSize)
+
+	store := raw[testFVHeaderSize:]
+	storeGUID := efiVariableGUID
+	hdrSize := efiVarHeaderSize
+	if authenticated {
+		storeGUID = efiAuthenticatedVariableGUID
+		hdrSize = efiAuthVarHeaderSize
+	}
+	copy(store[0:16], storeGUID[:])
+	binary.LittleEndian.PutUint32(store[16:20], testVarStoreSize)
+	store[20] = efiVarStoreFormatted
+	store[21] = efiVarStoreHealthy
+	copy(store[22:28], make([]byte, 6))
+
+	offset := alignVarHeader(efiVarStoreHeaderSize)
+	for _, v := range vars {
+		name := encodeUTF16Name(v.name)
+		hdr := make([]byte, hdrSize)
+		binary.LittleEndian.PutUint16(hdr[0:2], efiVarStartID)
+		hdr[2] = v.state
+		binary.LittleEndian.PutUint32(hdr[4:8], v.attrs)
+		if authenticated {
+			binary.LittleEndian.PutUint32(hdr[36:40], uint32(len(name)))
+			binary.LittleEndian.PutUint32(hdr[40:44], uint32(len(v.data)))
+			copy(hdr[44:60], v.guid[:])
+		} else {
+			binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(name)))
+			binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(v.data)))
+			copy(hdr[16:32], v.guid[:])
+		}
+		offset += copy(store[offset:], hdr)
+		offset += copy(store[offset:], name)
+		offset += copy(store[offset:], v.data)
+		offset = alignVarHeader(offset)
+	}
+
+	path := filepath.Join(t.TempDir(), "uefi-vars.fd")
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatalf("failed to write varstore: %s", err)
+	}
+	return path
+}
+
+func testCertificate(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "machine test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	return der
+}
+
+func TestParseEFIGUID(t *testing.T) {
+	testCases := []struct {
+		input string
+		want  EFIGUID
+		err   bool
+	}{
+		{input: "8be4df61-93ca-11d2-aa0d-00e098032b8c", want: EFIGlobalVariableGUID},
+		{input: "global", want: EFIGlobalVariableGUID},
+		{input: "security-db", want: EFIImageSecurityDatabaseGUID},
+		{input: "8be4df61-93ca-11d2-aa0d", err: true},
+		{input: "8be4df6193ca11d2aa0d00e098032b8c", err: true},
+		{input: "zze4df61-93ca-11d2-aa0d-00e098032b8c", err: true},
+	}
+
+	for _, tc := range testCases {
+		guid, err := ParseEFIGUID(tc.input)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expected an error parsing %q", tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %s", tc.input, err)
+			continue
+		}
+		if guid != tc.want {
+			t.Errorf("parsed %q as %s, expected %s", tc.input, guid, tc.want)
+		}
+	}
+
+	// the first three fields are little endian on disk
+	guid := MustParseEFIGUID("8be4df61-93ca-11d2-aa0d-00e098032b8c")
+	want := []byte{0x61, 0xdf, 0xe4, 0x8b, 0xca, 0x93, 0xd2, 0x11, 0xaa, 0x0d, 0x00, 0xe0, 0x98, 0x03, 0x2b, 0x8c}
+	if !bytes.Equal(guid[:], want) {
+		t.Errorf("GUID bytes %x, expected %x", guid[:], want)
+	}
+	if guid.String() != "8be4df61-93ca-11d2-aa0d-00e098032b8c" {
+		t.Errorf("GUID string %s", guid)
+	}
+}
+
+func TestDefaultEFIVariableGUID(t *testing.T) {
+	for name, want := range map[string]EFIGUID{
+		"PK":        EFIGlobalVariableGUID,
+		"KEK":       EFIGlobalVariableGUID,
+		"db":        EFIImageSecurityDatabaseGUID,
+		"dbx":       EFIImageSecurityDatabaseGUID,
+		"BootOrder": EFIGlobalVariableGUID,
+	} {
+		if got := DefaultEFIVariableGUID(name); got != want {
+			t.Errorf("default GUID of %s is %s, expected %s", name, got, want)
+		}
+	}
+}
+
+func TestUTF16Name(t *testing.T) {
+	for _, name := range []string{"BootOrder", "Boot0001", "", "Lang☃"} {
+		raw := encodeUTF16Name(name)
+		if len(raw)%2 != 0 || raw[len(raw)-1] != 0 || raw[len(raw)-2] != 0 {
+			t.Errorf("encoded name %q is not NUL terminated UTF-16: %x", name, raw)
+		}
+		if got := decodeUTF16Name(raw); got != name {
+			t.Errorf("decoded %q, expected %q", got, name)
+		}
+	}
+}
+
+func TestEFITime(t *testing.T) {
+	if got := decodeEFITime(encodeEFITime(time.Time{})); !got.IsZero() {
+		t.Errorf("zero time decoded as %s", got)
+	}
+	when := time.Date(2023, time.March, 4, 5, 6, 7, 0, time.UTC)
+	if got := decodeEFITime(encodeEFITime(when)); !got.Equal(when) {
+		t.Errorf("decoded %s, expected %s", got, when)
+	}
+}
+
+func TestLoadUEFIVarStore(t *testing.T) {
+	vendor := MustParseEFIGUID("11111111-2222-3333-4444-555555555555")
+	attrs := uint32(EFIVariableNonVolatile | EFIVariableBootServiceAccess)
+	vars := []testVar{
+		{name: "Live", guid: vendor, state: efiVarAdded, attrs: attrs, data: []byte{1, 2, 3}},
+		{name: "Deleted", guid: vendor, state: efiVarAdded & 0xfd, attrs: attrs, data: []byte{4}},
+		// an update which completed, only the new copy is live
+		{name: "Updated", guid: vendor, state: efiVarAdded & efiVarInDeletedTransit, attrs: attrs, data: []byte{5}},
+		{name: "Updated", guid: vendor, state: efiVarAdded, attrs: attrs, data: []byte{6}},
+		// an update which never completed, the old copy is still live
+		{name: "Interrupted", guid: vendor, state: efiVarAdded & efiVarInDeletedTransit, attrs: attrs, data: []byte{7}},
+	}
+
+	for _, authenticated := range []bool{false, true} {
+		store, err := LoadUEFIVarStore(writeTestVarStore(t, authenticated, vars))
+		if err != nil {
+			t.Fatalf("authenticated %v: unexpected error: %s", authenticated, err)
+		}
+		if store.Authenticated != authenticated {
+			t.Errorf("store authenticated %v, expected %v", store.Authenticated, authenticated)
+		}
+		got := map[string][]byte{}
+		for _, v := range store.Variables {
+			got[v.Name] = v.Data
+			if v.GUID != vendor.String() || v.Attributes != attrs || v.Size != len(v.Data) {
+				t.Errorf("unexpected variable %+v", v)
+			}
+		}
+		want := map[string][]byte{"Live": {1, 2, 3}, "Updated": {6}, "Interrupted": {7}}
+		if len(got) != len(want) || len(store.Variables) != len(want) {
+			t.Errorf("authenticated %v: variables %v, expected %v", authenticated, got, want)
+		}
+		for name, data := range want {
+			if !bytes.Equal(got[name], data) {
+				t.Errorf("authenticated %v: variable %s is %v, expected %v", authenticated, name, got[name], data)
+			}
+		}
+	}
+}
+
+func TestLoadUEFIVarStoreInvalid(t *testing.T) {
+	testCases := []struct {
+		name    string
+		corrupt func(raw []byte) []byte
+	}{
+		{name: "short", corrupt: func(raw []byte) []byte { return raw[:0x20] }},
+		{name: "no signature", corrupt: func(raw []byte) []byte { copy(raw[40:44], "XXXX"); return raw }},
+		{name: "unknown store", corrupt: func(raw []byte) []byte { raw[testFVHeaderSize] ^= 0xff; return raw }},
+		{name: "not healthy", corrupt: func(raw []byte) []byte { raw[testFVHeaderSize+21] = 0; return raw }},
+		{name: "store too large", corrupt: func(raw []byte) []byte {
+			binary.LittleEndian.PutUint32(raw[testFVHeaderSize+16:], 0x10000)
+			return raw
+		}},
+		{name: "variable overruns", corrupt: func(raw []byte) []byte {
+			binary.LittleEndian.PutUint32(raw[testFVHeaderSize+efiVarStoreHeaderSize+12:], 0x10000)
+			return raw
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestVarStore(t, false, []testVar{
+				{name: "Live", guid: EFIGlobalVariableGUID, state: efiVarAdded, data: []byte{1}},
+			})
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read varstore: %s", err)
+			}
+			if err := os.WriteFile(path, tc.corrupt(raw), 0644); err != nil {
+				t.Fatalf("failed to write varstore: %s", err)
+			}
+			if _, err := LoadUEFIVarStore(path); err == nil {
+				t.Errorf("expected an error loading the varstore")
+			}
+		})
+	}
+}
+
+func TestUEFIVarStoreSave(t *testing.T) {
+	vendor := MustParseEFIGUID("11111111-2222-3333-4444-555555555555")
+	attrs := uint32(EFIVariableNonVolatile | EFIVariableBootServiceAccess)
+	path := writeTestVarStore(t, true, []testVar{
+		{name: "Keep", guid: vendor, state: efiVarAdded, attrs: attrs, data: []byte{1}},
+		{name: "Stale", guid: vendor, state: efiVarAdded & 0xfd, attrs: attrs, data: []byte{2}},
+		{name: "Remove", guid: vendor, state: efiVarAdded, attrs: attrs, data: []byte{3}},
+		{name: "Replace", guid: vendor, state: efiVarAdded, attrs: attrs, data: []byte{4}},
+	})
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read varstore: %s", err)
+	}
+
+	store, err := LoadUEFIVarStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := store.Delete("Remove", vendor); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := store.Delete("Remove", vendor); err == nil {
+		t.Errorf("expected an error deleting a missing variable")
+	}
+	store.Set("Replace", vendor, attrs, []byte{5, 5})
+	store.Set("Added", EFIGlobalVariableGUID, attrs, []byte{6, 6, 6})
+	if err := store.Save(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read varstore: %s", err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("varstore size changed from %d to %d", len(before), len(after))
+	}
+	if !bytes.Equal(after[:testFVHeaderSize+efiVarStoreHeaderSize], before[:testFVHeaderSize+efiVarStoreHeaderSize]) {
+		t.Errorf("varstore headers changed")
+	}
+	if !bytes.Equal(after[testFVHeaderSize+testVarStoreSize:], before[testFVHeaderSize+testVarStoreSize:]) {
+		t.Errorf("data after the variable store changed")
+	}
+
+	reloaded, err := LoadUEFIVarStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error reloading: %s", err)
+	}
+	want := []struct {
+		name string
+		guid EFIGUID
+		data []byte
+	}{
+		{name: "Keep", guid: vendor, data: []byte{1}},
+		{name: "Replace", guid: vendor, data: []byte{5, 5}},
+		{name: "Added", guid: EFIGlobalVariableGUID, data: []byte{6, 6, 6}},
+	}
+	if len(reloaded.Variables) != len(want) {
+		t.Fatalf("reloaded %d variables, expected %d", len(reloaded.Variables), len(want))
+	}
+	for idx, w := range want {
+		v := reloaded.Variables[idx]
+		if v.Name != w.name || v.GUID != w.guid.String() || !bytes.Equal(v.Data, w.data) {
+			t.Errorf("variable %d is %s-%s %v, expected %s-%s %v", idx, v.Name, v.GUID, v.Data, w.name, w.guid, w.data)
+		}
+	}
+	if _, err := reloaded.Get("Stale", vendor); err == nil {
+		t.Errorf("deleted variable survived compaction")
+	}
+
+	// the store cannot grow past its size
+	store.Set("Big", vendor, attrs, make([]byte, testVarStoreSize))
+	if err := store.Save(); err == nil {
+		t.Errorf("expected an error saving an overfull store")
+	}
+}
+
+func TestParseCertificates(t *testing.T) {
+	der := testCertificate(t)
+	other := testCertificate(t)
+	pemData := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}})...)
+	pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other})...)
+
+	testCases := []struct {
+		name  string
+		input []byte
+		want  [][]byte
+		err   bool
+	}{
+		{name: "der", input: der, want: [][]byte{der}},
+		{name: "pem", input: pemData, want: [][]byte{der, other}},
+		{name: "garbage", input: []byte("not a certificate"), err: true},
+		{name: "pem without certificates", input: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}}), err: true},
+		{name: "invalid pem certificate", input: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}}), err: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			certs, err := ParseCertificates(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(certs) != len(tc.want) {
+				t.Fatalf("parsed %d certificates, expected %d", len(certs), len(tc.want))
+			}
+			for idx := range certs {
+				if !bytes.Equal(certs[idx], tc.want[idx]) {
+					t.Errorf("certificate %d does not match", idx)
+				}
+			}
+		})
+	}
+}
+
+func TestEFISignatureList(t *testing.T) {
+	certs := [][]byte{{1, 2, 3}, {4, 5}}
+	list := EFISignatureList(MachineOwnerGUID, certs)
+
+	offset := 0
+	for _, cert := range certs {
+		hdr := list[offset:]
+		if !bytes.Equal(hdr[0:16], EFICertX509GUID[:]) {
+			t.Errorf("signature type %x, expected X509", hdr[0:16])
+		}
+		listSize := int(binary.LittleEndian.Uint32(hdr[16:20]))
+		sigSize := int(binary.LittleEndian.Uint32(hdr[24:28]))
+		if sigSize != 16+len(cert) || listSize != efiSignatureListHdrSize+sigSize {
+			t.Errorf("list size %d signature size %d for %d byte certificate", listSize, sigSize, len(cert))
+		}
+		if binary.LittleEndian.Uint32(hdr[20:24]) != 0 {
+			t.Errorf("signature header size is not 0")
+		}
+		if !bytes.Equal(hdr[28:44], MachineOwnerGUID[:]) {
+			t.Errorf("signature owner %x, expected %x", hdr[28:44], MachineOwnerGUID[:])
+		}
+		if !bytes.Equal(hdr[44:44+len(cert)], cert) {
+			t.Errorf("signature data %x, expected %x", hdr[44:44+len(cert)], cert)
+		}
+		offset += listSize
+	}
+	if offset != len(list) {
+		t.Errorf("signature lists are %d bytes, expected %d", len(list), offset)
+	}
+}
+
+func TestEnrollCertificates(t *testing.T) {
+	cert := testCertificate(t)
+	other := testCertificate(t)
+
+	store, err := LoadUEFIVarStore(writeTestVarStore(t, true, nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := store.EnrollCertificates("PK", [][]byte{cert}, MachineOwnerGUID, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	pk, err := store.Get("PK", EFIGlobalVariableGUID)
+	if err != nil {
+		t.Fatalf("PK not enrolled: %s", err)
+	}
+	if !bytes.Equal(pk.Data, EFISignatureList(MachineOwnerGUID, [][]byte{cert})) {
+		t.Errorf("PK data does not match the signature list")
+	}
+	if pk.Attributes&EFIVariableTimeBasedAuthenticatedWriteAccess == 0 || pk.Timestamp.IsZero() {
+		t.Errorf("PK is not a time based authenticated variable: %+v", pk)
+	}
+	for name, guid := range map[string]EFIGUID{"SecureBootEnable": EFISecureBootEnableGUID, "CustomMode": EFICustomModeGUID} {
+		if _, err := store.Get(name, guid); err != nil {
+			t.Errorf("enrolling PK did not set %s: %s", name, err)
+		}
+	}
+
+	if err := store.EnrollCertificates("db", [][]byte{cert}, MachineOwnerGUID, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := store.EnrollCertificates("db", [][]byte{other}, MachineOwnerGUID, true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	db, err := store.Get("db", EFIImageSecurityDatabaseGUID)
+	if err != nil {
+		t.Fatalf("db not enrolled: %s", err)
+	}
+	if !bytes.Equal(db.Data, EFISignatureList(MachineOwnerGUID, [][]byte{cert, other})) {
+		t.Errorf("appended db data does not match the signature lists")
+	}
+
+	if err := store.EnrollCertificates("BootOrder", [][]byte{cert}, MachineOwnerGUID, false); err == nil {
+		t.Errorf("expected an error enrolling into a non key variable")
+	}
+	if err := store.EnrollCertificates("PK", [][]byte{cert, other}, MachineOwnerGUID, false); err == nil {
+		t.Errorf("expected an error enrolling two PK certificates")
+	}
+	if err := store.EnrollCertificates("PK", [][]byte{cert}, MachineOwnerGUID, true); err == nil {
+		t.Errorf("expected an error appending to PK")
+	}
+
+	plain, err := LoadUEFIVarStore(writeTestVarStore(t, false, nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := plain.EnrollCertificates("db", [][]byte{cert}, MachineOwnerGUID, false); err == nil {
+		t.Errorf("expected an error enrolling into an unauthenticated varstore")
+	}
+}
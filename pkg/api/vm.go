@@ -19,12 +19,14 @@ package api
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/raharper/qcli"
@@ -59,6 +61,21 @@ func (v VMState) String() string {
 	}
 }
 
+// Boot values, once-cdrom boots the cdrom until the guest finishes with it
+// (e.g. an OS installer reboots) and then switches the machine to disk.
+const (
+	BootCdrom     = "cdrom"
+	BootOnceCdrom = "once-cdrom"
+	BootDisk      = "disk"
+
+	// CdromDiskID is the disk ID of the VMDef Cdrom drive
+	CdromDiskID = "cdrom"
+
+	// a reset only completes a boot-once once the guest read this much from
+	// the cdrom, firmware may reset before it boots anything
+	bootOnceMinRead = 32 * 1024 * 1024
+)
+
 type VMDef struct {
 	Name       string     `yaml:"name"`
 	Cpus       uint32     `yaml:"cpus" default:1`
@@ -71,8 +88,51 @@ type VMDef struct {
 	UEFIVars   string     `yaml:"uefi-vars"`
 	TPM        bool       `yaml:"tpm"`
 	TPMVersion string     `yaml:"tpm-version"`
-	SecureBoot bool       `yaml:"secure-boot"`
-	Gui        bool       `yaml:"gui"`
+	// TPMFailurePolicy is fail (default), restart or ignore
+	TPMFailurePolicy string `yaml:"tpm-failure-policy,omitempty"`
+	// TrustStore is the name or path of the trust store signing the TPM
+	// certificates
+	TrustStore string `yaml:"truststore,omitempty"`
+	SecureBoot bool   `yaml:"secure-boot"`
+	Gui        bool   `yaml:"gui"`
+
+	// Arch is the guest architecture, default the host architecture, and
+	// Accel is kvm, tcg or auto (default)
+	Arch  string `yaml:"arch,omitempty"`
+	Accel string `yaml:"accel,omitempty"`
+
+	// CPUModel is host, a QEMU cpu model or unset for the arch default
+	// model, CPUFlags like +avx2 are added to the model
+	CPUModel string      `yaml:"cpu-model,omitempty"`
+	CPUFlags []string    `yaml:"cpu-flags,omitempty"`
+	Topology CPUTopology `yaml:"topology,omitempty"`
+	NUMA     []NUMANode  `yaml:"numa,omitempty"`
+
+	// HugePages backs guest memory with huge pages of HugePageSize, default
+	// the host default huge page size
+	HugePages    bool   `yaml:"hugepages,omitempty"`
+	HugePageSize string `yaml:"hugepage-size,omitempty"`
+
+	// CPUPinning maps vCPU indexes, vcpus, emulator and iothreads to the
+	// host cpus (a cpu list like 2-3,6) their QEMU threads may run on
+	CPUPinning map[string]string `yaml:"cpu-pinning,omitempty"`
+
+	// Kernel, Initrd, Append and DTB boot the VM directly from a kernel
+	// instead of the disks.
+	Kernel string `yaml:"kernel,omitempty"`
+	Initrd string `yaml:"initrd,omitempty"`
+	Append string `yaml:"append,omitempty"`
+	DTB    string `yaml:"dtb,omitempty"`
+
+	Shares []ShareDef `yaml:"shares,omitempty"`
+
+	Firmware FirmwareDef `yaml:"firmware,omitempty"`
+
+	// Balloon adds a memory balloon reporting the guest memory and
+	// GuestAgent a channel for qemu-ga, both change the guest hardware so
+	// they are opt-in
+	Balloon    bool `yaml:"balloon,omitempty"`
+	GuestAgent bool `yaml:"guest-agent,omitempty"`
 }
 
 func (v *VMDef) adjustDiskBootIdx(qti *qcli.QemuTypeIndex) ([]string, error) {
@@ -150,6 +210,11 @@ func (v *VMDef) adjustNetBootIdx(qti *qcli.QemuTypeIndex) ([]string, error) {
 	return allocated, nil
 }
 
+// BootFromCdrom reports if the cdrom is the first boot device
+func (v *VMDef) BootFromCdrom() bool {
+	return v.Boot == BootCdrom || v.Boot == BootOnceCdrom
+}
+
 func (v *VMDef) AdjustBootIndicies(qti *qcli.QemuTypeIndex) error {
 
 	_, err := v.adjustDiskBootIdx(qti)
@@ -167,18 +232,131 @@ func (v *VMDef) AdjustBootIndicies(qti *qcli.QemuTypeIndex) error {
 
 // TODO: Rename fields
 type VM struct {
-	Ctx     context.Context
-	Cancel  context.CancelFunc
-	Config  VMDef
-	State   VMState
-	RunDir  string
-	sockDir string
-	Cmd     *exec.Cmd
-	SwTPM   *SwTPM
-	qcli    *qcli.Config
-	qmp     *qcli.QMP
-	qmpCh   chan struct{}
-	wg      sync.WaitGroup
+	Ctx        context.Context
+	Cancel     context.CancelFunc
+	Config     VMDef
+	State      VMState
+	RunDir     string
+	sockDir    string
+	Cmd        *exec.Cmd
+	SwTPM      *SwTPM
+	VirtioFSDs []*VirtioFSD
+	qcli       *qcli.Config
+	qmp        *qcli.QMP
+	qmpCh      chan struct{}
+	wg         sync.WaitGroup
+
+	// closed once the QEMU process has exited
+	exited chan struct{}
+
+	// pcie root port ID -> hotplugged device ID
+	hotplugPorts map[string]string
+
+	// disk ID -> scsi disk attached to the VM, with its controller and unit
+	scsiDisks map[string]QemuDisk
+
+	// name of the machine running the VM, the machine label of its metrics
+	machineName string
+
+	// called once a boot-once cdrom boot is complete
+	bootOnceFn   func()
+	bootOnceDone bool
+
+	// set once Stop asked the guest to power down, the guest SHUTDOWN which
+	// follows does not complete a boot-once boot
+	powerdownRequested atomic.Bool
+
+	// called to restart the machine when swtpm fails with policy restart
+	tpmRestartFn func()
+
+	// resolved trust store dir of Config.TrustStore
+	tpmTrustStore string
+
+	// cgroup of the QEMU, swtpm and virtiofsd processes
+	resources MachineResources
+	cgroup    *MachineCgroup
+
+	// serializes stopHelpers between Stop and the exit of QEMU
+	helpersLock sync.Mutex
+
+	// set by the QMP event loop while the guest has the guest agent
+	// channel open, guestAgentLock serializes guest agent commands
+	guestAgentOpen atomic.Bool
+	guestAgentLock sync.Mutex
+}
+
+// EventLogName is the machine event log in the VM run dir, failures of the
+// helper daemons of the VM are recorded there.
+const EventLogName = "events.log"
+
+// LogEvent records a machine event in the VM event log
+func (v *VM) LogEvent(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Infof("VM:%s event: %s", v.Name(), msg)
+	eventLog := filepath.Join(v.RunDir, EventLogName)
+	fh, err := os.OpenFile(eventLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Errorf("VM:%s failed to open event log %q: %s", v.Name(), eventLog, err)
+		return
+	}
+	defer fh.Close()
+	fmt.Fprintf(fh, "%s %s\n", time.Now().Format(time.RFC3339), msg)
+}
+
+// swtpmExited applies the TPM failure policy when swtpm dies while the VM
+// is running.  QEMU does not reconnect to a new swtpm, so restart restarts
+// the whole machine.
+func (v *VM) swtpmExited(status SwTPMStatus) {
+	// swtpm exits when QEMU shuts down the TPM, only an exit while QEMU keeps
+	// running is a failure
+	if v.waitForExit(swTPMExitGrace) {
+		v.SwTPM.setState(SwTPMStateStopped)
+		return
+	}
+	v.LogEvent("swtpm exited unexpectedly: %s", status.ExitStatus)
+	for _, line := range v.SwTPM.LogTail() {
+		v.LogEvent("swtpm: %s", line)
+	}
+
+	switch v.Config.TPMFailurePolicy {
+	case TPMFailurePolicyIgnore:
+		v.LogEvent("tpm-failure-policy %s: VM continues without a TPM", TPMFailurePolicyIgnore)
+	case TPMFailurePolicyRestart:
+		if v.tpmRestartFn != nil {
+			v.LogEvent("tpm-failure-policy %s: restarting machine", TPMFailurePolicyRestart)
+			go v.tpmRestartFn()
+			return
+		}
+		fallthrough
+	default:
+		v.Fail("swtpm failed")
+	}
+}
+
+// waitForExit reports if the QEMU process exits within timeout
+func (v *VM) waitForExit(timeout time.Duration) bool {
+	exited := make(chan struct{})
+	go func() {
+		v.wg.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Fail marks the VM failed and stops it
+func (v *VM) Fail(reason string) {
+	v.LogEvent("VM failed: %s, stopping", reason)
+	v.State = VMFailed
+	go func() {
+		if err := v.Stop(true); err != nil {
+			log.Errorf("VM:%s failed to stop failed VM: %s", v.Name(), err)
+		}
+	}()
 }
 
 // note VM.sockDir is the path to the real sockets and runDir/sockets is a symlink to the socket
@@ -222,6 +400,103 @@ func (v *VM) TPMSocket() (string, error) {
 	return v.qcli.TPM.Path, nil
 }
 
+func (v *VM) QMPControlSocket() (string, error) {
+	for _, qmpSocket := range v.qcli.QMPSockets {
+		if filepath.Base(qmpSocket.Name) == QMPControlSocketName {
+			return qmpSocket.Name, nil
+		}
+	}
+	return "", fmt.Errorf("Failed to find QMP control socket %s", QMPControlSocketName)
+}
+
+// QMPControl executes a QMP command on the running VM via the control socket.
+func (v *VM) QMPControl(command string, args map[string]interface{}) (json.RawMessage, error) {
+	if !v.IsRunning() {
+		return nil, fmt.Errorf("VM:%s is not running", v.Name())
+	}
+	qmpSocket, err := v.QMPControlSocket()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(v.Ctx, qmpCommandTimeout)
+	defer cancel()
+	out, err := QMPCommand(ctx, qmpSocket, command, args)
+	if err != nil {
+		v.countQMPError()
+	}
+	return out, err
+}
+
+// countQMPError counts a failed QMP connection or command of the machine
+func (v *VM) countQMPError() {
+	metricQMPErrors.WithLabelValues(v.machineName, BackendKVM).Inc()
+}
+
+// KVMBackend runs machines as QEMU/KVM processes
+type KVMBackend struct{}
+
+func (b *KVMBackend) Create(ctx context.Context, name string, config VMDef, opts InstanceOptions) (Instance, error) {
+	vm, err := newVM(ctx, name, config)
+	if err != nil {
+		return nil, err
+	}
+	vm.machineName = name
+	vm.bootOnceFn = opts.BootOnceFn
+	vm.tpmRestartFn = opts.TPMRestartFn
+	vm.tpmTrustStore = opts.TPMTrustStore
+	vm.resources = opts.Resources
+	return vm, nil
+}
+
+// kvmVM returns the VM of an instance the KVMBackend created
+func kvmVM(instance Instance) (*VM, error) {
+	vm, ok := instance.(*VM)
+	if !ok {
+		return nil, fmt.Errorf("Instance %s is not a %s machine", instance.Name(), BackendKVM)
+	}
+	return vm, nil
+}
+
+func (b *KVMBackend) Start(instance Instance) error {
+	vm, err := kvmVM(instance)
+	if err != nil {
+		return err
+	}
+	return vm.Start()
+}
+
+func (b *KVMBackend) Stop(instance Instance, force bool) error {
+	vm, err := kvmVM(instance)
+	if err != nil {
+		return err
+	}
+	return vm.Stop(force)
+}
+
+func (b *KVMBackend) Status(instance Instance) VMState {
+	vm, err := kvmVM(instance)
+	if err != nil {
+		return VMFailed
+	}
+	return vm.Status()
+}
+
+func (b *KVMBackend) Console(instance Instance) (string, error) {
+	vm, err := kvmVM(instance)
+	if err != nil {
+		return "", err
+	}
+	return vm.SerialSocket()
+}
+
+func (b *KVMBackend) QMP(instance Instance, command string, args map[string]interface{}) (json.RawMessage, error) {
+	vm, err := kvmVM(instance)
+	if err != nil {
+		return nil, err
+	}
+	return vm.QMPControl(command, args)
+}
+
 func newVM(ctx context.Context, clusterName string, vmConfig VMDef) (*VM, error) {
 	ctx, cancelFn := context.WithCancel(ctx)
 	runDir := filepath.Join(ctx.Value(clsCtxStateDir).(string), vmConfig.Name)
@@ -249,8 +524,16 @@ func newVM(ctx context.Context, clusterName string, vmConfig VMDef) (*VM, error)
 		return &VM{}, fmt.Errorf("Failed to link socket dir: %s", err)
 	}
 
+	// the VM keeps its own copy of the disks, the machine config changes
+	// when disks are attached and detached while the VM runs
+	vmConfig.Disks = append([]QemuDisk{}, vmConfig.Disks...)
+	scsiDisks, err := placedSCSIDisks(runDir, vmConfig.Disks)
+	if err != nil {
+		return &VM{}, fmt.Errorf("Failed to place scsi disks: %s", err)
+	}
+
 	log.Infof("newVM: Generating QEMU Config")
-	qcfg, err := GenerateQConfig(runDir, tmpSockDir, vmConfig)
+	qcfg, extraParams, err := GenerateQConfig(runDir, tmpSockDir, vmConfig)
 	if err != nil {
 		return &VM{}, fmt.Errorf("Failed to generate qcli Config from VM definition: %s", err)
 	}
@@ -259,6 +542,7 @@ func newVM(ctx context.Context, clusterName string, vmConfig VMDef) (*VM, error)
 	if err != nil {
 		return &VM{}, fmt.Errorf("Failed to generate new VM command parameters: %s", err)
 	}
+	cmdParams = append(cmdParams, extraParams...)
 	log.Infof("newVM: generated qcli config parameters: %s", cmdParams)
 
 	return &VM{
@@ -270,6 +554,10 @@ func newVM(ctx context.Context, clusterName string, vmConfig VMDef) (*VM, error)
 		qcli:    qcfg,
 		RunDir:  runDir,
 		sockDir: tmpSockDir, // this must point to the /tmp path to remain short
+
+		exited:       make(chan struct{}),
+		hotplugPorts: make(map[string]string),
+		scsiDisks:    scsiDisks,
 	}, nil
 }
 
@@ -285,14 +573,23 @@ func (v *VM) runVM() error {
 	go func() {
 		var stderr bytes.Buffer
 		defer func() {
+			// the QEMU process is gone, stop its helpers so the cgroup
+			// is removed on guest poweroff and crashes as well
+			v.stopHelpers()
 			v.wg.Done()
 			if v.State != VMFailed {
 				v.State = VMStopped
 			}
+			close(v.exited)
 		}()
 
+		if err := v.setupCgroup(); err != nil {
+			errCh <- err
+			return
+		}
+
 		if v.Config.TPM {
-			tpmDir := filepath.Join(v.RunDir, "tpm")
+			tpmDir := filepath.Join(v.RunDir, SwTPMStateDirName)
 			if err := EnsureDir(tpmDir); err != nil {
 				errCh <- fmt.Errorf("Failed to create tpm state dir: %s", err)
 				return
@@ -303,9 +600,12 @@ func (v *VM) runVM() error {
 				return
 			}
 			v.SwTPM = &SwTPM{
-				StateDir: tpmDir,
-				Socket:   tpmSocket,
-				Version:  v.Config.TPMVersion,
+				StateDir:   tpmDir,
+				Socket:     tpmSocket,
+				Version:    v.Config.TPMVersion,
+				TrustStore: v.tpmTrustStore,
+				OnExit:     v.swtpmExited,
+				Cgroup:     v.cgroup,
 			}
 			if err := v.SwTPM.Start(); err != nil {
 				errCh <- fmt.Errorf("Failed to start SwTPM: %s", err)
@@ -313,11 +613,33 @@ func (v *VM) runVM() error {
 			}
 		}
 
+		for idx := range v.Config.Shares {
+			share := v.Config.Shares[idx]
+			if err := share.Sanitize(); err != nil {
+				errCh <- err
+				return
+			}
+			if share.Type != ShareTypeVirtioFS {
+				continue
+			}
+			virtiofsd := &VirtioFSD{
+				Share:   share,
+				Socket:  share.VirtioFSSocket(v.sockDir),
+				LogFile: filepath.Join(v.RunDir, "virtiofsd-"+share.Tag+".log"),
+				Cgroup:  v.cgroup,
+			}
+			v.VirtioFSDs = append(v.VirtioFSDs, virtiofsd)
+			if err := virtiofsd.Start(); err != nil {
+				errCh <- fmt.Errorf("Failed to start virtiofsd: %s", err)
+				return
+			}
+		}
+
 		log.Infof("VM:%s starting QEMU process", v.Name())
 		v.Cmd.Stderr = &stderr
-		err := v.Cmd.Start()
+		err := v.cgroup.StartCommand(v.Cmd)
 		if err != nil {
-			errCh <- fmt.Errorf("VM:%s failed with: %s", stderr.String())
+			errCh <- fmt.Errorf("VM:%s failed with: %s", v.Name(), err)
 			return
 		}
 
@@ -348,10 +670,10 @@ func (v *VM) StartQMP() error {
 	var wg sync.WaitGroup
 	errCh := make(chan error, 1)
 
-	// FIXME: are there more than one qmp sockets allowed?
+	// the first QMP socket is for qcli, the second is the control socket
 	numQMP := len(v.qcli.QMPSockets)
-	if numQMP != 1 {
-		return fmt.Errorf("StartQMP failed, expected 1 QMP socket, found: %d", numQMP)
+	if numQMP < 1 {
+		return fmt.Errorf("StartQMP failed, expected at least 1 QMP socket, found: %d", numQMP)
 	}
 
 	// start qmp goroutine
@@ -373,36 +695,12 @@ func (v *VM) StartQMP() error {
 			}
 		}
 
-		qmpCfg := qcli.QMPConfig{
-			Logger: QMPMachineLogger{},
-		}
-
-		qmpSocketFile := v.qcli.QMPSockets[0].Name
-		attempt := 0
-		for {
-			qmpCh := make(chan struct{})
-			attempt = attempt + 1
-			log.Infof("VM:%s connecting to QMP socket %s attempt %d", v.Name(), qmpSocketFile, attempt)
-			q, qver, err := qcli.QMPStart(v.Ctx, qmpSocketFile, qmpCfg, qmpCh)
-			if err != nil {
-				errCh <- fmt.Errorf("Failed to connect to qmp socket: %s, retrying...", err.Error())
-				time.Sleep(time.Second * 1)
-				continue
-			}
-			log.Infof("VM:%s QMP:%v QMPVersion:%v", v.Name(), q, qver)
-
-			// This has to be the first command executed in a QMP session.
-			err = q.ExecuteQMPCapabilities(v.Ctx)
-			if err != nil {
-				errCh <- err
-				time.Sleep(time.Second * 1)
-				continue
-			}
-			log.Infof("VM:%s QMP ready", v.Name())
-			v.qmp = q
-			v.qmpCh = qmpCh
-			break
+		qmpCh, err := v.connectQMP()
+		if err != nil {
+			errCh <- err
+			return
 		}
+		go v.watchQMP(qmpCh)
 		errCh <- nil
 	}()
 
@@ -420,6 +718,92 @@ func (v *VM) StartQMP() error {
 	return nil
 }
 
+// connectQMP connects to the qcli QMP socket of the VM, retrying until QEMU
+// accepts the connection or exits, and applies the cpu pinning.  It returns
+// the channel which is closed when the QMP connection closes.
+func (v *VM) connectQMP() (chan struct{}, error) {
+	qmpCfg := qcli.QMPConfig{
+		Logger: QMPMachineLogger{},
+	}
+
+	qmpSocketFile := v.qcli.QMPSockets[0].Name
+	attempt := 0
+	for {
+		select {
+		case <-v.exited:
+			return nil, fmt.Errorf("VM:%s exited before QMP was ready", v.Name())
+		case <-v.Ctx.Done():
+			return nil, fmt.Errorf("VM:%s cancelled before QMP was ready", v.Name())
+		default:
+		}
+
+		qmpCh := make(chan struct{})
+		eventCh := make(chan qcli.QMPEvent)
+		qmpCfg.EventCh = eventCh
+		attempt = attempt + 1
+		log.Infof("VM:%s connecting to QMP socket %s attempt %d", v.Name(), qmpSocketFile, attempt)
+		q, qver, err := qcli.QMPStart(v.Ctx, qmpSocketFile, qmpCfg, qmpCh)
+		if err != nil {
+			v.countQMPError()
+			log.Warnf("VM:%s failed to connect to qmp socket: %s, retrying...", v.Name(), err)
+			time.Sleep(time.Second * 1)
+			continue
+		}
+		go v.handleQMPEvents(eventCh)
+		log.Infof("VM:%s QMP:%v QMPVersion:%v", v.Name(), q, qver)
+
+		// This has to be the first command executed in a QMP session.
+		err = q.ExecuteQMPCapabilities(v.Ctx)
+		if err != nil {
+			v.countQMPError()
+			log.Warnf("VM:%s failed to negotiate QMP capabilities: %s, retrying...", v.Name(), err)
+			q.Shutdown()
+			time.Sleep(time.Second * 1)
+			continue
+		}
+		log.Infof("VM:%s QMP ready", v.Name())
+		v.qmp = q
+		v.qmpCh = qmpCh
+		// thread affinity is not part of the QMP session, it is applied
+		// again on every attach so threads QEMU created since are pinned
+		if err := v.applyCPUPinning(); err != nil {
+			v.LogEvent("cpu-pinning failed: %s", err)
+		}
+		return qmpCh, nil
+	}
+}
+
+// watchQMP reattaches to the QMP socket when the connection qmpCh belongs to
+// closes while QEMU keeps running.
+func (v *VM) watchQMP(qmpCh chan struct{}) {
+	for {
+		select {
+		case <-qmpCh:
+		case <-v.exited:
+			return
+		case <-v.Ctx.Done():
+			return
+		}
+		// QEMU closes the QMP socket when it exits, give runVM the chance
+		// to notice before reattaching
+		select {
+		case <-v.exited:
+			return
+		case <-v.Ctx.Done():
+			return
+		case <-time.After(qmpReattachDelay):
+		}
+
+		log.Warnf("VM:%s QMP connection closed while QEMU is running, reattaching", v.Name())
+		var err error
+		qmpCh, err = v.connectQMP()
+		if err != nil {
+			log.Infof("VM:%s not reattaching to QMP: %s", v.Name(), err)
+			return
+		}
+	}
+}
+
 func (v *VM) BackgroundRun() error {
 
 	// start vm command in background goroutine
@@ -470,11 +854,143 @@ func (v *VM) Status() VMState {
 	return v.State
 }
 
+// setupCgroup creates the cgroup of the VM.  VMs without resource limits
+// run outside of a cgroup if machined cannot create one.
+func (v *VM) setupCgroup() error {
+	cg, err := NewMachineCgroup(v.Name(), v.resources)
+	if err != nil {
+		if v.resources.IsSet() {
+			return fmt.Errorf("Failed to create cgroup for resources: %s", err)
+		}
+		log.Warnf("VM:%s running without a cgroup: %s", v.Name(), err)
+		return nil
+	}
+	log.Infof("VM:%s cgroup %s", v.Name(), cg.Path)
+	v.cgroup = cg
+	return nil
+}
+
+// stopHelpers stops swtpm and virtiofsd and removes the cgroup once the
+// processes of the VM have exited
+func (v *VM) stopHelpers() {
+	v.helpersLock.Lock()
+	defer v.helpersLock.Unlock()
+
+	if v.SwTPM != nil {
+		v.SwTPM.Stop()
+	}
+
+	for _, virtiofsd := range v.VirtioFSDs {
+		virtiofsd.Stop()
+	}
+	v.VirtioFSDs = []*VirtioFSD{}
+
+	if v.cgroup != nil {
+		if err := v.cgroup.Remove(); err != nil {
+			log.Warnf("VM:%s %s", v.Name(), err)
+		}
+	}
+}
+
+func (v *VM) CgroupUsage() (CgroupUsage, error) {
+	if v.cgroup == nil {
+		return CgroupUsage{}, fmt.Errorf("VM:%s is not running in a cgroup", v.Name())
+	}
+	return v.cgroup.Usage()
+}
+
+func (v *VM) TPMStatus() *SwTPMStatus {
+	if v.SwTPM == nil {
+		return nil
+	}
+	status := v.SwTPM.Status()
+	return &status
+}
+
+// handleQMPEvents consumes the QMP events of the VM until the QMP connection
+// is closed.
+func (v *VM) handleQMPEvents(eventCh <-chan qcli.QMPEvent) {
+	for ev := range eventCh {
+		log.Debugf("VM:%s QMP event %s: %v", v.Name(), ev.Name, ev.Data)
+		switch ev.Name {
+		case "RESET", "SHUTDOWN":
+			guest, _ := ev.Data["guest"].(bool)
+			if ev.Name == "SHUTDOWN" && v.powerdownRequested.Load() {
+				log.Infof("VM:%s guest shut down as requested by stop", v.Name())
+				guest = false
+			}
+			if guest {
+				v.completeBootOnce(ev.Name == "RESET")
+			}
+		case "VSERPORT_CHANGE":
+			if id, _ := ev.Data["id"].(string); id == guestAgentPortID {
+				open, _ := ev.Data["open"].(bool)
+				v.guestAgentOpen.Store(open)
+				log.Infof("VM:%s guest agent connected: %v", v.Name(), open)
+			}
+		}
+	}
+}
+
+// driveReadBytes returns the number of bytes the guest read from driveID
+func (v *VM) driveReadBytes(driveID string) (uint64, error) {
+	out, err := v.QMPControl("query-blockstats", nil)
+	if err != nil {
+		return 0, err
+	}
+	var blockStats []struct {
+		Device string `json:"device"`
+		Stats  struct {
+			ReadBytes uint64 `json:"rd_bytes"`
+		} `json:"stats"`
+	}
+	if err := json.Unmarshal(out, &blockStats); err != nil {
+		return 0, fmt.Errorf("Failed to parse query-blockstats output: %s", err)
+	}
+	for _, stat := range blockStats {
+		if stat.Device == driveID {
+			return stat.Stats.ReadBytes, nil
+		}
+	}
+	return 0, fmt.Errorf("VM:%s no block stats for drive %s", v.Name(), driveID)
+}
+
+// completeBootOnce ends a boot-once cdrom boot on the first guest poweroff or
+// on the first guest reset after the guest booted from the cdrom.  On reset
+// the cdrom media is ejected so the firmware falls through to the disks.
+func (v *VM) completeBootOnce(reset bool) {
+	if v.Config.Boot != BootOnceCdrom || v.bootOnceDone {
+		return
+	}
+	if reset {
+		driveID := qmpID("cd", CdromDiskID)
+		readBytes, err := v.driveReadBytes(driveID)
+		if err != nil {
+			log.Errorf("VM:%s boot-once: failed to query cdrom reads: %s", v.Name(), err)
+			return
+		}
+		if readBytes < bootOnceMinRead {
+			log.Infof("VM:%s boot-once: ignoring reset, guest only read %d bytes from the cdrom", v.Name(), readBytes)
+			return
+		}
+		log.Infof("VM:%s boot-once: ejecting cdrom after reset", v.Name())
+		if err := v.EjectMedia(CdromDiskID, true); err != nil {
+			log.Errorf("VM:%s boot-once: failed to eject cdrom: %s", v.Name(), err)
+		}
+	}
+	v.bootOnceDone = true
+	if v.bootOnceFn != nil {
+		// the callback locks the machine controller, which may be held
+		// while the machine is stopped waiting on the QMP event loop
+		go v.bootOnceFn()
+	}
+}
+
 func (v *VM) Start() error {
 	log.Infof("VM:%s starting...", v.Name())
 	err := v.BackgroundRun()
 	if err != nil {
-		log.Errorf("VM:%s failed to start VM:%s %s", v.Name(), err)
+		log.Errorf("VM:%s failed to start VM: %s", v.Name(), err)
 		v.Stop(true)
 		return err
 	}
@@ -491,9 +1007,9 @@ func (v *VM) Stop(force bool) error {
 
 	if v.qmp != nil {
 		log.Infof("VM:%s PID:%d qmp is not nill, sending qmp command", v.Name(), pid)
-		// FIXME: configurable?
-		// Try shutdown via QMP, wait up to 10 seconds before force shutting down
-		timeout := time.Second * 10
+		// Try shutdown via QMP, wait up to stop-timeout seconds before force
+		// shutting down
+		timeout := time.Second * time.Duration(currentDaemonConfig().StopTimeout)
 
 		if force {
 			// Let's force quit
@@ -504,9 +1020,10 @@ func (v *VM) Stop(force bool) error {
 				log.Errorf("VM:%s error:%s", v.Name(), err.Error())
 			}
 		} else {
-			// Let's try to shutdown the VM.  If it hasn't shutdown in 10 seconds we'll
-			// send a poweroff message.
+			// Let's try to shutdown the VM.  If it hasn't shutdown in timeout
+			// seconds we'll send a poweroff message.
 			log.Infof("VM:%s trying graceful shutdown via system_powerdown (%s timeout before cancelling)..", v.Name(), timeout.String())
+			v.powerdownRequested.Store(true)
 			err := v.qmp.ExecuteSystemPowerdown(v.Ctx)
 			if err != nil {
 				log.Errorf("VM:%s error:%s", v.Name(), err.Error())
@@ -522,7 +1039,7 @@ func (v *VM) Stop(force bool) error {
 		case <-time.After(timeout):
 			log.Warnf("VM:%s timed out, killing via cancel context...", v.Name())
 			v.Cancel()
-			log.Warnf("VM:%s cancel() complete")
+			log.Warnf("VM:%s cancel() complete", v.Name())
 		}
 		v.wg.Wait()
 	} else {
@@ -532,9 +1049,7 @@ func (v *VM) Stop(force bool) error {
 		}
 	}
 
-	if v.Config.TPM {
-		v.SwTPM.Stop()
-	}
+	v.stopHelpers()
 
 	// when runVM goroutine exits, it marks v.State = VMStopped
 	return nil
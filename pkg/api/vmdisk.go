@@ -0,0 +1,478 @@
+/*
+Copyright © 2023 Ryan Harper <rharper@woxford.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QMPBlockInfo is the subset of a query-block entry used to map machine disks
+// to the QEMU block backends and devices.
+type QMPBlockInfo struct {
+	Device    string `json:"device"`
+	QDev      string `json:"qdev"`
+	Removable bool   `json:"removable"`
+	Locked    bool   `json:"locked"`
+	TrayOpen  bool   `json:"tray_open"`
+	Inserted  *struct {
+		File     string `json:"file"`
+		NodeName string `json:"node-name"`
+		ReadOnly bool   `json:"ro"`
+		Image    struct {
+			VirtualSize int64 `json:"virtual-size"`
+		} `json:"image"`
+	} `json:"inserted,omitempty"`
+}
+
+var qmpInvalidIDChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// qmpID converts a disk ID into a valid QMP identifier with prefix.
+func qmpID(prefix, id string) string {
+	return prefix + "-" + qmpInvalidIDChars.ReplaceAllString(id, "_")
+}
+
+func (v *VM) QueryBlock() ([]QMPBlockInfo, error) {
+	blocks := []QMPBlockInfo{}
+	resp, err := v.QMPControl("query-block", nil)
+	if err != nil {
+		return blocks, err
+	}
+	if err := json.Unmarshal(resp, &blocks); err != nil {
+		return blocks, fmt.Errorf("Failed to parse query-block response: %s", err)
+	}
+	return blocks, nil
+}
+
+func (v *VM) findBlockByFile(file string) (QMPBlockInfo, error) {
+	blocks, err := v.QueryBlock()
+	if err != nil {
+		return QMPBlockInfo{}, err
+	}
+	for _, block := range blocks {
+		if block.Inserted != nil && block.Inserted.File == file {
+			return block, nil
+		}
+	}
+	return QMPBlockInfo{}, fmt.Errorf("VM:%s has no block device with file %s", v.Name(), file)
+}
+
+// nextHotplugPort returns a pcie root port with no hotplugged device
+func (v *VM) nextHotplugPort() (string, error) {
+	for _, port := range v.qcli.PCIeRootPortDevices {
+		if _, ok := v.hotplugPorts[port.ID]; !ok {
+			return port.ID, nil
+		}
+	}
+	return "", fmt.Errorf("VM:%s has no free pcie root ports for hotplug", v.Name())
+}
+
+// AttachDisk creates (if needed) and hot-adds disk to the running VM using
+// blockdev-add and device_add.
+func (v *VM) AttachDisk(disk *QemuDisk) error {
+	if err := disk.Sanitize(v.RunDir); err != nil {
+		return err
+	}
+	if disk.Type == "cdrom" {
+		return fmt.Errorf("Hotplug of cdrom disks is not supported")
+	}
+	if err := disk.ImportDiskImage(v.RunDir); err != nil {
+		return err
+	}
+	if _, err := v.findBlockByFile(disk.File); err == nil {
+		return fmt.Errorf("VM:%s disk file %s is already attached", v.Name(), disk.File)
+	}
+
+	diskID := disk.DiskID()
+	nodeName := qmpID("blk", diskID)
+	devID := qmpID("disk", diskID)
+
+	direct, noFlush, writeCache := disk.cacheOptions()
+	blockdevArgs := map[string]interface{}{
+		"driver":        disk.Format,
+		"node-name":     nodeName,
+		"read-only":     disk.ReadOnly,
+		"discard":       disk.discardMode(),
+		"detect-zeroes": disk.detectZeroesMode(),
+		"cache": map[string]interface{}{
+			"direct":   direct,
+			"no-flush": noFlush,
+		},
+		"file": map[string]interface{}{
+			"driver":   "file",
+			"filename": disk.File,
+			"aio":      disk.aioMode(),
+			"cache": map[string]interface{}{
+				"direct":   direct,
+				"no-flush": noFlush,
+			},
+		},
+	}
+
+	deviceArgs := map[string]interface{}{
+		"id":          devID,
+		"drive":       nodeName,
+		"serial":      disk.serial(),
+		"write-cache": map[bool]string{true: "on", false: "off"}[writeCache],
+	}
+
+	hotplugPort := ""
+	switch disk.Attach {
+	case "virtio", "nvme":
+		port, err := v.nextHotplugPort()
+		if err != nil {
+			return err
+		}
+		hotplugPort = port
+		deviceArgs["bus"] = port
+		deviceArgs["driver"] = "virtio-blk-pci"
+		if disk.Attach == "nvme" {
+			deviceArgs["driver"] = "nvme"
+		}
+	case "scsi":
+		if err := v.placeSCSIDisk(disk); err != nil {
+			return err
+		}
+		unit, err := scsiUnit(disk.Unit)
+		if err != nil {
+			return err
+		}
+		deviceArgs["driver"] = "scsi-hd"
+		deviceArgs["bus"] = disk.Controller + ".0"
+		deviceArgs["channel"] = 0
+		deviceArgs["scsi-id"] = unit
+		deviceArgs["lun"] = 0
+	default:
+		return fmt.Errorf("Hotplug of disk attach type '%s' is not supported", disk.Attach)
+	}
+
+	if disk.Encrypt != "" {
+		blockdevArgs["encrypt"] = map[string]interface{}{
+			"format":     disk.Encrypt,
+			"key-secret": disk.SecretID(),
+		}
+		if _, err := v.QMPControl("object-add", map[string]interface{}{
+			"qom-type": "secret",
+			"id":       disk.SecretID(),
+			"file":     disk.SecretFile(v.RunDir),
+			"format":   DiskSecretFormat,
+		}); err != nil {
+			return err
+		}
+	}
+	removeSecret := func() {
+		if disk.Encrypt == "" {
+			return
+		}
+		if _, err := v.QMPControl("object-del", map[string]interface{}{"id": disk.SecretID()}); err != nil {
+			log.Warnf("VM:%s failed to remove secret %s: %s", v.Name(), disk.SecretID(), err)
+		}
+	}
+
+	log.Infof("VM:%s hot-adding disk %s (%s) attach:%s", v.Name(), diskID, disk.File, disk.Attach)
+	if _, err := v.QMPControl("blockdev-add", blockdevArgs); err != nil {
+		removeSecret()
+		return err
+	}
+	if _, err := v.QMPControl("device_add", deviceArgs); err != nil {
+		if _, delErr := v.QMPControl("blockdev-del", map[string]interface{}{"node-name": nodeName}); delErr != nil {
+			log.Warnf("VM:%s failed to remove blockdev %s after failed device_add: %s", v.Name(), nodeName, delErr)
+		}
+		removeSecret()
+		return err
+	}
+	if hotplugPort != "" {
+		v.hotplugPorts[hotplugPort] = devID
+	}
+	if disk.Attach == "scsi" {
+		v.scsiDisks[diskID] = *disk
+	}
+	if disk.Throttle.IsSet() {
+		args := disk.Throttle.QMPArgs()
+		args["id"] = devID
+		if _, err := v.QMPControl("block_set_io_throttle", args); err != nil {
+			return fmt.Errorf("Disk %s attached but setting IO throttle failed: %s", diskID, err)
+		}
+	}
+	return nil
+}
+
+// DetachDisk hot-removes disk from the running VM.  Disks from the VM
+// definition and disks added with AttachDisk are both supported.
+func (v *VM) DetachDisk(disk *QemuDisk) error {
+	if err := disk.Sanitize(v.RunDir); err != nil {
+		return err
+	}
+	imagePath := disk.ImagePath(v.RunDir)
+	block, err := v.findBlockByFile(imagePath)
+	if err != nil {
+		return err
+	}
+	if block.QDev == "" {
+		return fmt.Errorf("VM:%s disk %s is not attached to a device", v.Name(), disk.DiskID())
+	}
+
+	// virtio devices report the virtio-backend child as the qdev
+	devPath := strings.TrimSuffix(block.QDev, "/virtio-backend")
+	log.Infof("VM:%s hot-removing disk %s device %s", v.Name(), disk.DiskID(), devPath)
+	if _, err := v.QMPControl("device_del", map[string]interface{}{"id": devPath}); err != nil {
+		return err
+	}
+
+	// device removal requires guest cooperation, wait for it to complete
+	removed := false
+	for i := 0; i < 10; i++ {
+		if _, err := v.findBlockByFile(imagePath); err != nil {
+			removed = true
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	nodeName := qmpID("blk", disk.DiskID())
+	if block.Inserted.NodeName == nodeName {
+		if !removed {
+			return fmt.Errorf("VM:%s timed out waiting for guest to release disk %s", v.Name(), disk.DiskID())
+		}
+		if _, err := v.QMPControl("blockdev-del", map[string]interface{}{"node-name": nodeName}); err != nil {
+			return err
+		}
+		if disk.Encrypt != "" {
+			if _, err := v.QMPControl("object-del", map[string]interface{}{"id": disk.SecretID()}); err != nil {
+				return err
+			}
+		}
+	} else if !removed {
+		return fmt.Errorf("VM:%s timed out waiting for guest to release disk %s", v.Name(), disk.DiskID())
+	}
+
+	devID := qmpID("disk", disk.DiskID())
+	for port, portDev := range v.hotplugPorts {
+		if portDev == devID {
+			delete(v.hotplugPorts, port)
+		}
+	}
+	delete(v.scsiDisks, disk.DiskID())
+	return nil
+}
+
+// placedSCSIDisks returns the scsi attached disks of a VM with disks by disk
+// ID, placed on their controller and unit
+func placedSCSIDisks(runDir string, disks []QemuDisk) (map[string]QemuDisk, error) {
+	scsiDisks := make(map[string]QemuDisk)
+	planned, err := PlanSCSIDisks(runDir, disks)
+	if err != nil {
+		return scsiDisks, err
+	}
+	for _, disk := range planned {
+		if disk.Attach == "scsi" {
+			scsiDisks[disk.DiskID()] = disk
+		}
+	}
+	return scsiDisks, nil
+}
+
+// placeSCSIDisk assigns disk, to be hotplugged, a controller of the VM and a
+// unit no attached scsi disk uses.  The disk is placed explicitly, the unit
+// qemu picks may be the unit of a detached disk in the machine config, and
+// the caller persists the placement.
+func (v *VM) placeSCSIDisk(disk *QemuDisk) error {
+	if len(v.qcli.SCSIControllerDevices) == 0 {
+		return fmt.Errorf("VM:%s has no SCSI controller, cannot hotplug scsi disk %s", v.Name(), disk.DiskID())
+	}
+
+	// sorted by id for stable error messages
+	ids := []string{}
+	for id := range v.scsiDisks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	disks := []QemuDisk{}
+	for _, id := range ids {
+		disks = append(disks, v.scsiDisks[id])
+	}
+
+	if disk.Controller == "" && disk.Unit != "" {
+		// as at start, a unit without a controller is on the first one
+		disk.Controller = SCSIControllerPrefix + "0"
+	}
+	if disk.Controller != "" {
+		for _, scsiCon := range v.qcli.SCSIControllerDevices {
+			if scsiCon.ID == disk.Controller {
+				return PlanSCSIHotplug(disks, disk)
+			}
+		}
+		return fmt.Errorf("VM:%s has no SCSI controller %s, cannot hotplug scsi disk %s", v.Name(), disk.Controller, disk.DiskID())
+	}
+
+	// controllers cannot be added at runtime, spill over onto the next
+	// controller of the VM with a free unit
+	for _, scsiCon := range v.qcli.SCSIControllerDevices {
+		placed := *disk
+		placed.Controller = scsiCon.ID
+		if err := PlanSCSIHotplug(disks, &placed); err == nil {
+			*disk = placed
+			return nil
+		}
+	}
+	return fmt.Errorf("VM:%s has no free SCSI units, cannot hotplug scsi disk %s", v.Name(), disk.DiskID())
+}
+
+// ResizeDisk grows or shrinks a disk of the running VM with block_resize
+func (v *VM) ResizeDisk(disk *QemuDisk, size DiskSize, force bool) error {
+	if err := disk.Sanitize(v.RunDir); err != nil {
+		return err
+	}
+	block, err := v.findBlockByFile(disk.ImagePath(v.RunDir))
+	if err != nil {
+		return err
+	}
+	current := DiskSize(block.Inserted.Image.VirtualSize)
+	if size < current && !force {
+		return fmt.Errorf("Refusing to shrink disk %s from %d to %d bytes without force", disk.DiskID(), current, size)
+	}
+	log.Infof("VM:%s resizing disk %s node %s from %d to %d bytes", v.Name(), disk.DiskID(), block.Inserted.NodeName, current, size)
+	_, err = v.QMPControl("block_resize", map[string]interface{}{
+		"node-name": block.Inserted.NodeName,
+		"size":      int64(size),
+	})
+	return err
+}
+
+// SetDiskThrottle applies the IO limits to a disk of the running VM with
+// block_set_io_throttle, a zero DiskThrottle removes all limits.
+func (v *VM) SetDiskThrottle(disk *QemuDisk, throttle DiskThrottle) error {
+	if err := throttle.Validate(); err != nil {
+		return err
+	}
+	if err := disk.Sanitize(v.RunDir); err != nil {
+		return err
+	}
+	block, err := v.findBlockByFile(disk.ImagePath(v.RunDir))
+	if err != nil {
+		return err
+	}
+	if block.QDev == "" {
+		return fmt.Errorf("VM:%s disk %s is not attached to a device", v.Name(), disk.DiskID())
+	}
+	args := throttle.QMPArgs()
+	args["id"] = strings.TrimSuffix(block.QDev, "/virtio-backend")
+	log.Infof("VM:%s setting disk %s IO throttle %+v", v.Name(), disk.DiskID(), throttle)
+	_, err = v.QMPControl("block_set_io_throttle", args)
+	return err
+}
+
+// MediaInfo describes the removable media drive of a cdrom disk
+type MediaInfo struct {
+	DiskID   string `json:"disk-id"`
+	File     string `json:"file"`
+	TrayOpen bool   `json:"tray-open"`
+	Locked   bool   `json:"locked"`
+}
+
+// findCdrom returns the block backend of the cdrom drive of disk diskID
+func (v *VM) findCdrom(diskID string) (QMPBlockInfo, error) {
+	blocks, err := v.QueryBlock()
+	if err != nil {
+		return QMPBlockInfo{}, err
+	}
+	driveID := qmpID("cd", diskID)
+	for _, block := range blocks {
+		if block.Device == driveID {
+			if !block.Removable {
+				return QMPBlockInfo{}, fmt.Errorf("VM:%s cdrom %s does not support removable media, attach it to ide", v.Name(), diskID)
+			}
+			return block, nil
+		}
+	}
+	return QMPBlockInfo{}, fmt.Errorf("VM:%s has no cdrom drive %s", v.Name(), diskID)
+}
+
+// ListMedia returns the cdrom drives of the running VM and their media
+func (v *VM) ListMedia() ([]MediaInfo, error) {
+	media := []MediaInfo{}
+	blocks, err := v.QueryBlock()
+	if err != nil {
+		return media, err
+	}
+	for _, block := range blocks {
+		if !strings.HasPrefix(block.Device, "cd-") {
+			continue
+		}
+		info := MediaInfo{
+			DiskID:   strings.TrimPrefix(block.Device, "cd-"),
+			TrayOpen: block.TrayOpen,
+			Locked:   block.Locked,
+		}
+		if block.Inserted != nil {
+			info.File = block.Inserted.File
+		}
+		media = append(media, info)
+	}
+	return media, nil
+}
+
+// EjectMedia removes the media of cdrom diskID, force ejects media which the
+// guest has locked.
+func (v *VM) EjectMedia(diskID string, force bool) error {
+	block, err := v.findCdrom(diskID)
+	if err != nil {
+		return err
+	}
+	if block.Inserted == nil {
+		return fmt.Errorf("VM:%s cdrom %s has no media", v.Name(), diskID)
+	}
+	log.Infof("VM:%s ejecting %s from cdrom %s", v.Name(), block.Inserted.File, diskID)
+	_, err = v.QMPControl("eject", map[string]interface{}{"device": block.Device, "force": force})
+	return err
+}
+
+// InsertMedia replaces the media of cdrom diskID with file, the tray of a
+// drive the guest has locked is only opened with force.
+func (v *VM) InsertMedia(diskID, file, format string, force bool) error {
+	if !PathExists(file) {
+		return fmt.Errorf("Media file %q does not exist", file)
+	}
+	if format == "" {
+		format = "raw"
+	}
+	block, err := v.findCdrom(diskID)
+	if err != nil {
+		return err
+	}
+	if block.Locked {
+		if !force {
+			return fmt.Errorf("VM:%s guest has locked cdrom %s, eject it in the guest or use force", v.Name(), diskID)
+		}
+		if _, err := v.QMPControl("blockdev-open-tray", map[string]interface{}{"device": block.Device, "force": true}); err != nil {
+			return err
+		}
+	}
+	log.Infof("VM:%s inserting %s into cdrom %s", v.Name(), file, diskID)
+	_, err = v.QMPControl("blockdev-change-medium", map[string]interface{}{
+		"device":         block.Device,
+		"filename":       file,
+		"format":         format,
+		"read-only-mode": "read-only",
+	})
+	return err
+}